@@ -18,8 +18,10 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // KnownBlueprints lists static blueprints
@@ -55,8 +57,52 @@ type Homeserver struct {
 	ApplicationServices []ApplicationService
 	// Optionally override the baseImageURI for blueprint creation
 	BaseImageURI *string
+	// Optionally build the homeserver from an older image, so tests can check that it migrates its data when
+	// Deployment.UpgradeServer upgrades it to the image which would otherwise have been used. Takes precedence
+	// over BaseImageURI.
+	// EXPERIMENTAL
+	UpgradeFromImageURI *string
+	// Containers to run alongside the homeserver e.g databases or workers. Sidecars are started before the
+	// homeserver, and are saved in the blueprint and torn down with it.
+	Sidecars []Sidecar
 }
 
+// Sidecar is a container which runs alongside a homeserver. Sidecars are on the same network as the homeserver
+// and can be reached from it at the hostname `$hsName-$sidecarName` e.g `hs1-postgres`. The homeserver is told
+// this hostname in the environment variable `COMPLEMENT_SIDECAR_$NAME` e.g `COMPLEMENT_SIDECAR_POSTGRES`.
+//
+// Data in volumes is not saved in blueprints, so sidecars must store data elsewhere e.g by setting PGDATA for
+// Postgres, which stores data in a volume by default.
+type Sidecar struct {
+	// The name of the sidecar, which must be unique for the homeserver and only contain lowercase letters,
+	// digits and '-'.
+	Name string
+	// The image to run. If empty, the image of the homeserver is used e.g for workers.
+	Image string
+	// Environment variables in the form KEY=value
+	Env []string
+	// Optionally override the command of the image
+	Cmd []string
+	// Optionally check that the sidecar is ready before starting the homeserver
+	HealthCheck *HealthCheck
+}
+
+// HealthCheck is a command which is run inside a container to check that it is ready, like HEALTHCHECK
+// in a Dockerfile.
+type HealthCheck struct {
+	// The command to run e.g ["CMD", "pg_isready", "-U", "postgres"]. See the Docker documentation for
+	// HEALTHCHECK for the format.
+	Test []string
+	// Time between checks. Defaults to 1s.
+	Interval time.Duration
+	// Time before a check is considered to have failed. Defaults to 5s.
+	Timeout time.Duration
+	// Number of consecutive failures before the container is unhealthy. Defaults to 30.
+	Retries int
+}
+
+var sidecarNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
 type User struct {
 	Localpart   string
 	DisplayName string
@@ -132,6 +178,16 @@ func Validate(bp Blueprint) (Blueprint, error) {
 				return bp, err
 			}
 		}
+		sidecarNames := make(map[string]bool)
+		for _, sc := range hs.Sidecars {
+			if !sidecarNameRegex.MatchString(sc.Name) {
+				return bp, fmt.Errorf("HS %s sidecar name '%s' must only contain lowercase letters, digits and '-'", hs.Name, sc.Name)
+			}
+			if sidecarNames[sc.Name] {
+				return bp, fmt.Errorf("HS %s has more than one sidecar named '%s'", hs.Name, sc.Name)
+			}
+			sidecarNames[sc.Name] = true
+		}
 	}
 
 	return bp, nil
@@ -41,6 +41,24 @@ type Complement struct {
 	// COMPLEMENT_ENABLE_DIRTY_RUNS, server logs are only printed once for reused deployments, at the very
 	// end of the test suite.
 	AlwaysPrintServerLogs bool
+	// Name: COMPLEMENT_SERVER_LOG_DIR
+	// Default: ""
+	// Description: If set, the server logs of a failed test which used a dirty deployment are written to files in
+	// this directory instead of being printed, one file per homeserver named after the test. With
+	// COMPLEMENT_ENABLE_DIRTY_RUNS, only the lines logged while the test was running are included.
+	ServerLogDir string
+	// Name: COMPLEMENT_LOG_RULES
+	// Default: off
+	// Description: What to do when the logs of a homeserver match one of the rules in `runtime.LogRules` during a test,
+	// e.g a panic or a database error. `warn` logs a warning in the test which triggered the match. `fail` also fails
+	// the test if the rule is fatal. `off` disables checking logs. Logs are checked when the test destroys the
+	// deployment. With COMPLEMENT_ENABLE_DIRTY_RUNS, only the lines logged while the test was running are checked.
+	LogRulesMode string
+	// Name: COMPLEMENT_LOG_ALLOWLIST
+	// Default: ""
+	// Description: A regular expression for matches of `runtime.LogRules` which are expected and should not be
+	// reported, in addition to `runtime.LogAllowlist`.
+	LogAllowlist *regexp.Regexp
 	// Name: COMPLEMENT_SHARE_ENV_PREFIX
 	// Description: If set, all environment variables on the host with this prefix will be shared with
 	// every homeserver, with the prefix removed. For example, if the prefix was `FOO_` then setting
@@ -75,8 +93,28 @@ type Complement struct {
 	// `one_to_one_room alice` would not delete the homeserver images for the blueprints `alice` and
 	// `one_to_one_room`. This can speed up homeserver runs if you frequently run the same base image
 	// over and over again. If the base image changes, this should not be set as it means an older version
-	// of the base image will be used for the named blueprints.
+	// of the base image will be used for the named blueprints. See `COMPLEMENT_BLUEPRINT_CACHE` for a way to
+	// keep blueprints which notices when the base image changes.
 	KeepBlueprints []string
+	// Name: COMPLEMENT_BLUEPRINT_CACHE
+	// Default: 0
+	// Description: If 1, blueprint images are kept between runs and reused when nothing which affects them
+	// has changed. Images are labelled with a hash of the blueprint and the IDs of the base images it was built
+	// from, so a new base image causes the blueprint to be rebuilt rather than running a stale image. Unlike
+	// `COMPLEMENT_KEEP_BLUEPRINTS`, this is safe to leave set when the base image changes. A summary of cache
+	// hits and misses is printed at the end of the run.
+	BlueprintCache bool
+	// Name: COMPLEMENT_BLUEPRINT_CACHE_MAX_AGE_HOURS
+	// Default: 168
+	// Description: Cached blueprint images which were built more than this many hours ago are removed at the
+	// start and end of each run. Only used when `COMPLEMENT_BLUEPRINT_CACHE` is set.
+	BlueprintCacheMaxAge time.Duration
+	// Name: COMPLEMENT_BLUEPRINT_CACHE_MAX_ENTRIES
+	// Default: 50
+	// Description: The maximum number of cached blueprint builds to keep. When there are more, the oldest
+	// builds are removed. A build contains one image for each homeserver and sidecar in the blueprint. Only used
+	// when `COMPLEMENT_BLUEPRINT_CACHE` is set.
+	BlueprintCacheMaxEntries int
 	// Name: COMPLEMENT_HOST_MOUNTS
 	// Description: A list of semicolon separated host mounts to mount on every container. The structure
 	// of the mount is `host-path:container-path:[ro]` for example `/path/on/host:/path/on/container` - you
@@ -103,9 +141,78 @@ type Complement struct {
 	// Default: host.docker.internal
 	// Description: The hostname of Complement from the perspective of a Homeserver running inside a container.
 	// This can be useful for container runtimes using another hostname to access the host from a container,
-	// like Podman that uses `host.containers.internal` instead.
+	// like Podman that uses `host.containers.internal` instead. Defaults to `host.containers.internal` when
+	// COMPLEMENT_CONTAINER_RUNTIME is `podman`, and `localhost` when it is `local`.
 	HostnameRunningComplement string
 
+	// Name: COMPLEMENT_CONTAINER_RUNTIME
+	// Default: docker
+	// Description: The runtime used to build and run homeservers. `docker` uses the Docker Engine API configured by
+	// the standard `DOCKER_*` environment variables. `podman` uses Podman's Docker-compatible API at `CONTAINER_HOST`,
+	// or the default rootless or rootful Podman socket. `local` runs COMPLEMENT_LOCAL_HS_COMMAND as a local process for
+	// each homeserver, for iterating on a homeserver without building images. With `local`, features which need extra
+	// containers like `Deployment.FederationProxy` are not supported, and homeservers cannot federate with each other
+	// as `hs1` etc do not resolve.
+	ContainerRuntime string
+
+	// Name: COMPLEMENT_LOCAL_HS_COMMAND
+	// Default: ""
+	// Description: The shell command which starts a homeserver when COMPLEMENT_CONTAINER_RUNTIME is `local`. It is run
+	// in a new data directory for each homeserver, with the environment variables `SERVER_NAME`, `COMPLEMENT_DATA_DIR`,
+	// `COMPLEMENT_CS_PORT` and `COMPLEMENT_FED_PORT` set. The homeserver must listen on those ports of `127.0.0.1`
+	// instead of 8008 and 8448. Files which are placed in containers, like the CA certificate at `/complement/ca/ca.crt`,
+	// are placed under the data directory instead e.g `$COMPLEMENT_DATA_DIR/complement/ca/ca.crt`. Blueprints are
+	// committed by copying the data directory.
+	LocalHomeserverCommand string
+
+	// Name: COMPLEMENT_VIRTUAL_SERVER_HOSTNAMES
+	// Default: 0
+	// Description: The number of extra hostnames (`complement-vs1` to `complement-vsN`) which resolve to the host
+	// running Complement from inside homeserver containers. Each virtual federation server created via
+	// `federation.VirtualHost` uses one of these hostnames, so this is the maximum number of virtual federation
+	// servers which can exist at the same time. Tests which use `federation.VirtualHost` fail if this is 0. Only
+	// supported on Linux, where the hostnames are mapped to the `host-gateway` of each container.
+	VirtualServerHostnames int
+
+	// Name: COMPLEMENT_FEDERATION_PROXY_IMAGE
+	// Default: alpine/socat:latest
+	// Description: The Docker image used to forward federation traffic to Complement when a test routes traffic
+	// between homeservers through `Deployment.FederationProxy`, and for the DNS stand-in created by `WithDNSStandin`.
+	// The image must have `socat` as its entrypoint and contain `/bin/sh`. The image is pulled if it does not exist locally.
+	FederationProxyImage string
+
+	// Name: COMPLEMENT_NETWORK_TOOLS_IMAGE
+	// Default: nicolaka/netshoot:latest
+	// Description: The Docker image used to change the network of a homeserver container when a test calls
+	// `Deployment.Partition` or `Deployment.ImpairNetwork`. Containers using this image share the network namespace
+	// of the homeserver, so homeserver images do not need networking tools installed. The image must contain
+	// `/bin/sh`, `ip`, `tc` and `iptables` with the `conntrack` match. The image is pulled if it does not exist locally.
+	NetworkToolsImage string
+
+	// Name: COMPLEMENT_RESOURCE_REPORT_DIR
+	// Default: ""
+	// Description: If set, the CPU, memory, network and disk usage of each homeserver is sampled while each test
+	// runs, and a report is written to this directory when the test package finishes. The report is a JSON file
+	// named after the package namespace, containing the peak memory, CPU seconds, bytes sent and bytes written to
+	// disk of each homeserver in each test. A summary table is also printed. Usage is measured from when the
+	// deployment is returned to the test until the test calls `Deployment.Destroy`. Not supported when
+	// COMPLEMENT_CONTAINER_RUNTIME is `local`.
+	ResourceReportDir string
+
+	// Name: COMPLEMENT_RESOURCE_SAMPLE_INTERVAL_MS
+	// Default: 1000
+	// Description: How often to sample the resource usage of homeservers when COMPLEMENT_RESOURCE_REPORT_DIR is set.
+	// Peak memory is only as accurate as this interval; the other values are cumulative so are always accurate.
+	ResourceSampleInterval time.Duration
+
+	// Name: COMPLEMENT_FAKETIME_LIB
+	// Default: ""
+	// Description: The path on the host to a libfaketime shared library e.g `/usr/lib/x86_64-linux-gnu/faketime/libfaketime.so.1`,
+	// built for the architecture and libc of the homeserver image. If set, the library is preloaded into every
+	// deployed homeserver so tests can change the clock of a homeserver using `Deployment.SetClockOffset`, or deploy
+	// homeservers with skewed clocks using `WithClockOffset`. Tests which change clocks fail if this is not set.
+	FaketimeLibPath string
+
 	// Name: COMPLEMENT_ENABLE_DIRTY_RUNS
 	// Default: 0
 	// Description: If 1, eligible tests will be provided with reusable deployments rather than a clean deployment.
@@ -124,6 +231,22 @@ type Complement struct {
 	// disable this behaviour being added later, once this has stablised.
 	EnableDirtyRuns bool
 
+	// Name: COMPLEMENT_DIRTY_RUNS_CHECKPOINT
+	// Default: 0
+	// Description: If 1 and COMPLEMENT_ENABLE_DIRTY_RUNS is enabled, each dirty deployment is checkpointed when it
+	// is created, and restored to that checkpoint before it is leased to each test. This stops tests polluting each
+	// other, at the cost of restarting the homeservers for every test. Data in volumes is not restored. Requires
+	// COMPLEMENT_DIRTY_RUNS_POOL_SIZE to be set, as restoring a deployment shared by parallel tests would break them.
+	DirtyRunsCheckpoint bool
+
+	// Name: COMPLEMENT_DIRTY_RUNS_POOL_SIZE
+	// Default: 0
+	// Description: If greater than 0 and COMPLEMENT_ENABLE_DIRTY_RUNS is enabled, each test leases a dirty deployment
+	// exclusively from a pool, and returns it when the deployment is destroyed. The pool lazily grows to at most this
+	// many deployments for each number of homeservers, so parallel tests can run on their own servers. Tests wait
+	// for a deployment when all of them are leased. If 0, all tests share a single dirty deployment.
+	DirtyRunsPoolSize int
+
 	// The IP that is used to connect to the running homeserver from the host.
 	//
 	// For Complement tests, this is always configured as `127.0.0.1` but can be
@@ -154,7 +277,28 @@ func NewConfigFromEnvVars(pkgNamespace, baseImageURI string) *Complement {
 	}
 	cfg.DebugLoggingEnabled = os.Getenv("COMPLEMENT_DEBUG") == "1"
 	cfg.AlwaysPrintServerLogs = os.Getenv("COMPLEMENT_ALWAYS_PRINT_SERVER_LOGS") == "1"
+	cfg.ServerLogDir = os.Getenv("COMPLEMENT_SERVER_LOG_DIR")
+	cfg.LogRulesMode = os.Getenv("COMPLEMENT_LOG_RULES")
+	switch cfg.LogRulesMode {
+	case "":
+		cfg.LogRulesMode = "off"
+	case "off", "warn", "fail":
+	default:
+		panic("COMPLEMENT_LOG_RULES must be one of off, warn or fail, got " + cfg.LogRulesMode)
+	}
+	if allowlist := os.Getenv("COMPLEMENT_LOG_ALLOWLIST"); allowlist != "" {
+		var err error
+		cfg.LogAllowlist, err = regexp.Compile(allowlist)
+		if err != nil {
+			panic("COMPLEMENT_LOG_ALLOWLIST parse error: " + err.Error())
+		}
+	}
 	cfg.EnableDirtyRuns = os.Getenv("COMPLEMENT_ENABLE_DIRTY_RUNS") == "1"
+	cfg.DirtyRunsCheckpoint = os.Getenv("COMPLEMENT_DIRTY_RUNS_CHECKPOINT") == "1"
+	cfg.DirtyRunsPoolSize = parseEnvWithDefault("COMPLEMENT_DIRTY_RUNS_POOL_SIZE", 0)
+	if cfg.EnableDirtyRuns && cfg.DirtyRunsCheckpoint && cfg.DirtyRunsPoolSize <= 0 {
+		panic("COMPLEMENT_DIRTY_RUNS_CHECKPOINT requires COMPLEMENT_DIRTY_RUNS_POOL_SIZE to be greater than 0")
+	}
 	cfg.EnvVarsPropagatePrefix = os.Getenv("COMPLEMENT_SHARE_ENV_PREFIX")
 	cfg.PostTestScript = os.Getenv("COMPLEMENT_POST_TEST_SCRIPT")
 	cfg.SpawnHSTimeout = time.Duration(parseEnvWithDefault("COMPLEMENT_SPAWN_HS_TIMEOUT_SECS", 30)) * time.Second
@@ -170,6 +314,9 @@ func NewConfigFromEnvVars(pkgNamespace, baseImageURI string) *Complement {
 	}
 	cfg.ContainerMemoryBytes = parsedMemoryBytes
 	cfg.KeepBlueprints = strings.Split(os.Getenv("COMPLEMENT_KEEP_BLUEPRINTS"), " ")
+	cfg.BlueprintCache = os.Getenv("COMPLEMENT_BLUEPRINT_CACHE") == "1"
+	cfg.BlueprintCacheMaxAge = time.Duration(parseEnvWithDefault("COMPLEMENT_BLUEPRINT_CACHE_MAX_AGE_HOURS", 168)) * time.Hour
+	cfg.BlueprintCacheMaxEntries = parseEnvWithDefault("COMPLEMENT_BLUEPRINT_CACHE_MAX_ENTRIES", 50)
 	hostMounts := os.Getenv("COMPLEMENT_HOST_MOUNTS")
 	if hostMounts != "" {
 		cfg.HostMounts, err = newHostMounts(strings.Split(hostMounts, ";"))
@@ -200,13 +347,44 @@ func NewConfigFromEnvVars(pkgNamespace, baseImageURI string) *Complement {
 		panic("package namespace must be set")
 	}
 
+	cfg.ContainerRuntime = os.Getenv("COMPLEMENT_CONTAINER_RUNTIME")
+	switch cfg.ContainerRuntime {
+	case "":
+		cfg.ContainerRuntime = "docker"
+	case "docker", "podman":
+	case "local":
+		cfg.LocalHomeserverCommand = os.Getenv("COMPLEMENT_LOCAL_HS_COMMAND")
+		if cfg.LocalHomeserverCommand == "" {
+			panic("COMPLEMENT_LOCAL_HS_COMMAND must be set when COMPLEMENT_CONTAINER_RUNTIME is local")
+		}
+	default:
+		panic("COMPLEMENT_CONTAINER_RUNTIME must be one of docker, podman or local, got " + cfg.ContainerRuntime)
+	}
+
 	HostnameRunningComplement := os.Getenv("COMPLEMENT_HOSTNAME_RUNNING_COMPLEMENT")
 	if HostnameRunningComplement != "" {
 		cfg.HostnameRunningComplement = HostnameRunningComplement
+	} else if cfg.ContainerRuntime == "podman" {
+		cfg.HostnameRunningComplement = "host.containers.internal"
+	} else if cfg.ContainerRuntime == "local" {
+		cfg.HostnameRunningComplement = "localhost"
 	} else {
 		cfg.HostnameRunningComplement = "host.docker.internal"
 	}
 
+	cfg.VirtualServerHostnames = parseEnvWithDefault("COMPLEMENT_VIRTUAL_SERVER_HOSTNAMES", 0)
+	cfg.FederationProxyImage = os.Getenv("COMPLEMENT_FEDERATION_PROXY_IMAGE")
+	if cfg.FederationProxyImage == "" {
+		cfg.FederationProxyImage = "alpine/socat:latest"
+	}
+	cfg.FaketimeLibPath = os.Getenv("COMPLEMENT_FAKETIME_LIB")
+	cfg.NetworkToolsImage = os.Getenv("COMPLEMENT_NETWORK_TOOLS_IMAGE")
+	if cfg.NetworkToolsImage == "" {
+		cfg.NetworkToolsImage = "nicolaka/netshoot:latest"
+	}
+	cfg.ResourceReportDir = os.Getenv("COMPLEMENT_RESOURCE_REPORT_DIR")
+	cfg.ResourceSampleInterval = time.Duration(parseEnvWithDefault("COMPLEMENT_RESOURCE_SAMPLE_INTERVAL_MS", 1000)) * time.Millisecond
+
 	// HSPortBindingIP is fixed here, but used by homerunner to override.
 	cfg.HSPortBindingIP = "127.0.0.1"
 	return cfg
@@ -222,6 +400,21 @@ func (c *Complement) GenerateCA() error {
 	return nil
 }
 
+// VirtualServerHostname returns the i'th (1-based) hostname which resolves to the host running Complement.
+// See VirtualServerHostnames.
+func (c *Complement) VirtualServerHostname(i int) string {
+	return fmt.Sprintf("complement-vs%d", i)
+}
+
+// IsVirtualServerHostname returns true if `host` is one of the hostnames returned by VirtualServerHostname.
+func (c *Complement) IsVirtualServerHostname(host string) bool {
+	n, err := strconv.Atoi(strings.TrimPrefix(host, "complement-vs"))
+	if err != nil || !strings.HasPrefix(host, "complement-vs") {
+		return false
+	}
+	return n >= 1 && n <= c.VirtualServerHostnames
+}
+
 func (c *Complement) CACertificateBytes() ([]byte, error) {
 	cert := bytes.NewBuffer(nil)
 	err := pem.Encode(cert, &pem.Block{Type: "CERTIFICATE", Bytes: c.CACertificate.Raw})
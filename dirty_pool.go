@@ -0,0 +1,159 @@
+package complement
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// dirtyPool is a pool of dirty deployments which are leased exclusively to tests. There is a separate
+// pool for each number of homeservers, each of which grows lazily up to the configured size.
+type dirtyPool struct {
+	cfg  *config.Complement
+	mu   sync.Mutex
+	cond *sync.Cond
+	// number of homeservers -> deployments not leased to a test
+	idle map[int][]*pooledDeployment
+	// number of homeservers -> number of deployments created or being created
+	created map[int]int
+	all     []*pooledDeployment
+	// the number of deployments ever created, so discarded deployments don't share a namespace with new ones
+	namespaces int
+	// creates a deployment, replaced in tests
+	create func(numServers, index int) (*docker.Deployment, error)
+}
+
+type pooledDeployment struct {
+	dep *docker.Deployment
+	// the checkpoint to restore before each lease, if COMPLEMENT_DIRTY_RUNS_CHECKPOINT is enabled
+	checkpoint string
+}
+
+func newDirtyPool(cfg *config.Complement) *dirtyPool {
+	p := &dirtyPool{
+		cfg:     cfg,
+		idle:    make(map[int][]*pooledDeployment),
+		created: make(map[int]int),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	p.create = p.createDeployment
+	return p
+}
+
+// lease returns a deployment with `numServers` homeservers which no other test is using, waiting for one
+// to be returned if the pool is full. The deployment is returned to the pool when the test destroys it.
+func (p *dirtyPool) lease(t ct.TestLike, numServers int) *docker.Deployment {
+	t.Helper()
+	pd, index := p.acquire(numServers)
+	// if the deployment can't be prepared, free its slot so other tests don't wait for it forever
+	leased := false
+	defer func() {
+		if !leased {
+			p.discard(numServers, pd)
+		}
+	}()
+	if pd == nil {
+		dep, err := p.create(numServers, index)
+		if err != nil {
+			ct.Fatalf(t, "dirtyDeploy: %s", err)
+		}
+		pd = &pooledDeployment{dep: dep}
+		p.mu.Lock()
+		p.all = append(p.all, pd)
+		p.mu.Unlock()
+		if p.cfg.DirtyRunsCheckpoint {
+			pd.checkpoint = dep.Checkpoint(t)
+		}
+	} else if pd.checkpoint != "" {
+		pd.dep.Restore(t, pd.checkpoint)
+	}
+	var once sync.Once
+	pd.dep.ReleaseDirty = func(broken bool) {
+		once.Do(func() {
+			if broken {
+				p.discard(numServers, pd)
+				return
+			}
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.idle[numServers] = append(p.idle[numServers], pd)
+			p.cond.Signal()
+		})
+	}
+	leased = true
+	return pd.dep
+}
+
+// acquire waits until a deployment with `numServers` homeservers is idle or the pool can grow. It returns
+// the idle deployment, or nil and the index of the deployment to create if the pool grew.
+func (p *dirtyPool) acquire(numServers int) (*pooledDeployment, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.idle[numServers]) == 0 && p.created[numServers] >= p.cfg.DirtyRunsPoolSize {
+		p.cond.Wait()
+	}
+	if idle := p.idle[numServers]; len(idle) > 0 {
+		p.idle[numServers] = idle[:len(idle)-1]
+		return idle[len(idle)-1], 0
+	}
+	p.created[numServers]++
+	p.namespaces++
+	return nil, p.namespaces
+}
+
+// discard removes a deployment which couldn't be created or reset from the pool, destroying it if it exists,
+// so that a new deployment can be created in its place.
+func (p *dirtyPool) discard(numServers int, pd *pooledDeployment) {
+	if pd != nil {
+		pd.dep.DestroyAtCleanup()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.created[numServers]--
+	if pd != nil {
+		p.all = slices.DeleteFunc(p.all, func(other *pooledDeployment) bool {
+			return other == pd
+		})
+	}
+	p.cond.Signal()
+}
+
+// createDeployment makes a new dirty deployment with `numServers` homeservers. Each deployment has its own namespace
+// so container and network names don't clash.
+func (p *dirtyPool) createDeployment(numServers, index int) (*docker.Deployment, error) {
+	d, err := docker.NewDeployer(fmt.Sprintf("dirty%d_%d", numServers, index), p.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("NewDeployer returned error %s", err)
+	}
+	// this creates a single hs1
+	dep, err := d.CreateDirtyDeployment()
+	if err != nil {
+		return nil, fmt.Errorf("CreateDirtyDeployment failed: %s", err)
+	}
+	for i := 2; i <= numServers; i++ {
+		hsName := fmt.Sprintf("hs%d", i)
+		hsDep, err := d.CreateDirtyServer(hsName)
+		if err != nil {
+			d.Destroy(dep, false, "", false)
+			return nil, fmt.Errorf("failed to add %s: %s", hsName, err)
+		}
+		dep.HS[hsName] = hsDep
+	}
+	return dep, nil
+}
+
+// destroyAll destroys every deployment in the pool. Called when the test package finishes.
+func (p *dirtyPool) destroyAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pd := range p.all {
+		pd.dep.DestroyAtCleanup()
+	}
+	p.all = nil
+	p.idle = make(map[int][]*pooledDeployment)
+	p.created = make(map[int]int)
+}
@@ -0,0 +1,134 @@
+package complement
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// fatalT records Fatalf calls and stops the goroutine, like testing.T does.
+type fatalT struct {
+	ct.TestLike
+	mu     sync.Mutex
+	fatals []string
+}
+
+func (t *fatalT) Helper() {}
+
+func (t *fatalT) Fatalf(msg string, args ...interface{}) {
+	t.mu.Lock()
+	t.fatals = append(t.fatals, msg)
+	t.mu.Unlock()
+	runtime.Goexit()
+}
+
+// testPool returns a pool which makes empty deployments, recording the indexes they were created with.
+func testPool(size int) (*dirtyPool, *[]int) {
+	p := newDirtyPool(&config.Complement{DirtyRunsPoolSize: size})
+	var indexes []int
+	p.create = func(numServers, index int) (*docker.Deployment, error) {
+		indexes = append(indexes, index)
+		return &docker.Deployment{HS: map[string]*docker.HomeserverDeployment{}}, nil
+	}
+	return p, &indexes
+}
+
+func TestDirtyPoolGrowsLazily(t *testing.T) {
+	p, indexes := testPool(2)
+	dep1 := p.lease(t, 1)
+	dep1.ReleaseDirty(false)
+	// the released deployment is reused rather than creating another
+	if dep := p.lease(t, 1); dep != dep1 {
+		t.Fatalf("lease did not reuse the idle deployment")
+	}
+	dep2 := p.lease(t, 1)
+	if dep2 == dep1 {
+		t.Fatalf("lease returned a deployment which is already leased")
+	}
+	// each number of homeservers has its own pool
+	dep3 := p.lease(t, 2)
+	if dep3 == dep1 || dep3 == dep2 {
+		t.Fatalf("lease returned a deployment with the wrong number of homeservers")
+	}
+	if len(*indexes) != 3 {
+		t.Fatalf("created %d deployments, want 3", len(*indexes))
+	}
+	if len(p.all) != 3 {
+		t.Fatalf("pool has %d deployments, want 3", len(p.all))
+	}
+}
+
+func TestDirtyPoolWaitsWhenFull(t *testing.T) {
+	p, _ := testPool(1)
+	dep := p.lease(t, 1)
+	leased := make(chan *docker.Deployment)
+	go func() {
+		leased <- p.lease(t, 1)
+	}()
+	select {
+	case <-leased:
+		t.Fatalf("lease returned while the pool was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release := dep.ReleaseDirty
+	release(false)
+	// releasing twice must not return the deployment to the pool twice
+	release(false)
+	select {
+	case got := <-leased:
+		if got != dep {
+			t.Fatalf("lease did not return the released deployment")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("lease did not return after a deployment was released")
+	}
+	if len(p.idle[1]) != 0 {
+		t.Fatalf("pool has %d idle deployments, want 0", len(p.idle[1]))
+	}
+}
+
+func TestDirtyPoolFreesSlotsOfBrokenDeployments(t *testing.T) {
+	p, indexes := testPool(1)
+	dep := p.lease(t, 1)
+	dep.ReleaseDirty(true)
+	if p.created[1] != 0 || len(p.all) != 0 {
+		t.Fatalf("broken deployment is still in the pool: created=%d all=%d", p.created[1], len(p.all))
+	}
+	if p.lease(t, 1) == dep {
+		t.Fatalf("lease returned a broken deployment")
+	}
+	// the new deployment must not reuse the namespace of the broken one
+	if (*indexes)[0] == (*indexes)[1] {
+		t.Fatalf("deployments were created with the same index %d", (*indexes)[0])
+	}
+}
+
+func TestDirtyPoolFreesSlotsOfFailedCreates(t *testing.T) {
+	p, _ := testPool(1)
+	create := p.create
+	p.create = func(numServers, index int) (*docker.Deployment, error) {
+		return nil, errors.New("no docker")
+	}
+	ft := &fatalT{TestLike: t}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.lease(ft, 1)
+	}()
+	<-done
+	if len(ft.fatals) != 1 {
+		t.Fatalf("lease failed the test %d times, want 1", len(ft.fatals))
+	}
+	if p.created[1] != 0 {
+		t.Fatalf("failed create is still counted: created=%d", p.created[1])
+	}
+	// the slot is free, so this doesn't block
+	p.create = create
+	p.lease(t, 1)
+}
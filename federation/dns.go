@@ -0,0 +1,432 @@
+package federation
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// DNSQuery is a DNS query which was received by a DNSServer.
+type DNSQuery struct {
+	// The name which was queried, without a trailing dot e.g "_matrix-fed._tcp.example.test"
+	Name string
+	// The record type e.g "A", "AAAA" or "SRV"
+	Type string
+	Time time.Time
+}
+
+func (q DNSQuery) String() string {
+	return fmt.Sprintf("%s %s at %s", q.Type, q.Name, q.Time.Format(time.StampMilli))
+}
+
+type dnsRecords struct {
+	ips   []net.IP
+	srv   []net.SRV
+	cname string
+}
+
+// DNSFrontendPorts are the ports on which homeservers can reach the HTTPS frontend of a DNSServer. Traffic
+// to other ports of a routed hostname is not forwarded, so server names and SRV records which point at a
+// routed hostname must use one of these ports.
+var DNSFrontendPorts = []uint16{443, 8448}
+
+// RouteOpt are options that can configure DNSServer.Route
+type RouteOpt func(r *dnsRoute)
+
+type dnsRoute struct {
+	handler      http.Handler
+	certHostname string
+}
+
+// WithCertificateHostname makes the route present a certificate which is valid for `hostname` instead
+// of the requested hostname. Useful to check that homeservers reject invalid certificates.
+func WithCertificateHostname(hostname string) RouteOpt {
+	return func(r *dnsRoute) {
+		r.certHostname = hostname
+	}
+}
+
+// EXPERIMENTAL
+// DNSServer is a programmable DNS server used to test how homeservers discover other servers, via
+// `.well-known/matrix/server` delegation and SRV records. Homeservers in a deployment only query this
+// server for names which are not already known to the deployment network e.g `hs1`.
+//
+// DNSServer also runs an HTTPS frontend which homeservers can reach at FrontendIP on DNSFrontendPorts.
+// Use Route to send requests for a hostname to a federation Server; the frontend presents a certificate
+// derived from the Complement CA which is valid for the hostname requested.
+type DNSServer struct {
+	t ct.TestLike
+	// The IP address of the HTTPS frontend from inside the deployment network. Set by the deployment.
+	FrontendIP net.IP
+
+	tlsConfig *tls.Config
+	conn      net.PacketConn
+	frontend  *http.Server
+
+	mu      sync.Mutex
+	records map[string]*dnsRecords
+	routes  map[string]*dnsRoute
+	queries []DNSQuery
+	certs   map[string]*tls.Certificate
+}
+
+// NewDNSServer creates a DNS server with no records. Call Listen to start serving.
+func NewDNSServer(t ct.TestLike, deployment FederationDeployment) *DNSServer {
+	d := &DNSServer{
+		t:       t,
+		records: make(map[string]*dnsRecords),
+		routes:  make(map[string]*dnsRoute),
+		certs:   make(map[string]*tls.Certificate),
+	}
+	d.tlsConfig = &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return d.certificate(deployment, hello.ServerName)
+		},
+	}
+	return d
+}
+
+// Listen starts serving DNS over UDP and the HTTPS frontend, returning the ports on the host running
+// Complement which they are listening on.
+func (d *DNSServer) Listen() (dnsPort, httpsPort int, err error) {
+	d.conn, err = net.ListenPacket("udp", ":0") //nolint
+	if err != nil {
+		return 0, 0, fmt.Errorf("DNSServer.Listen: failed to listen on UDP: %w", err)
+	}
+	ln, err := net.Listen("tcp", ":0") //nolint
+	if err != nil {
+		d.conn.Close()
+		return 0, 0, fmt.Errorf("DNSServer.Listen: failed to listen on TCP: %w", err)
+	}
+	d.frontend = &http.Server{
+		Handler:   http.HandlerFunc(d.serveHTTP),
+		TLSConfig: d.tlsConfig,
+	}
+	go d.serveDNS()
+	go func() {
+		err := d.frontend.ServeTLS(ln, "", "")
+		if err != nil && err != http.ErrServerClosed {
+			d.t.Logf("DNSServer.Listen: ServeTLS failed: %s", err)
+		}
+	}()
+	return d.conn.LocalAddr().(*net.UDPAddr).Port, ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Close stops serving DNS and the HTTPS frontend.
+func (d *DNSServer) Close() {
+	if d.conn != nil {
+		d.conn.Close()
+	}
+	if d.frontend != nil {
+		d.frontend.Close()
+	}
+}
+
+// Reset removes all records, routes and recorded queries, and logs to `t` from now on. Useful when
+// the server is reused between tests.
+func (d *DNSServer) Reset(t ct.TestLike) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.t = t
+	d.records = make(map[string]*dnsRecords)
+	d.routes = make(map[string]*dnsRoute)
+	d.queries = nil
+}
+
+// SetA sets the A and AAAA records for `name`, replacing any existing ones. IPv4 addresses become
+// A records and IPv6 addresses become AAAA records.
+func (d *DNSServer) SetA(name string, ips ...net.IP) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.recordsFor(name).ips = ips
+}
+
+// SetSRV sets the SRV records for `name` e.g "_matrix-fed._tcp.example.test", replacing any existing ones.
+// Fails the test if a record points at a hostname set with Route on a port not in DNSFrontendPorts.
+func (d *DNSServer) SetSRV(name string, records ...net.SRV) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.recordsFor(name).srv = records
+	if err := d.checkFrontendPorts(); err != nil {
+		ct.Fatalf(d.t, "SetSRV: %s", err)
+	}
+}
+
+// SetCNAME makes `name` an alias of `target`.
+func (d *DNSServer) SetCNAME(name, target string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.recordsFor(name).cname = normaliseDNSName(target)
+}
+
+// Remove removes all records for `name`, so it no longer resolves.
+func (d *DNSServer) Remove(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.records, normaliseDNSName(name))
+	delete(d.routes, normaliseDNSName(name))
+}
+
+// Route makes `hostname` resolve to the HTTPS frontend, which sends requests for that hostname to `h`.
+// `h` is typically a federation Server created with WithServerName, or whose handlers include
+// HandleWellKnownServer. `hostname` can also be an IP literal, in which case it should be FrontendIP.
+// Homeservers can only reach the hostname on DNSFrontendPorts: fails the test if an SRV record points at
+// the hostname on another port.
+func (d *DNSServer) Route(hostname string, h http.Handler, opts ...RouteOpt) {
+	route := &dnsRoute{handler: h}
+	for _, opt := range opts {
+		opt(route)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name := normaliseDNSName(hostname)
+	d.routes[name] = route
+	if net.ParseIP(name) == nil && d.FrontendIP != nil {
+		d.recordsFor(name).ips = []net.IP{d.FrontendIP}
+	}
+	if err := d.checkFrontendPorts(); err != nil {
+		ct.Fatalf(d.t, "Route: %s", err)
+	}
+}
+
+// checkFrontendPorts returns an error if an SRV record points at a routed hostname on a port which the
+// HTTPS frontend can't be reached on. Must be called with mu held.
+func (d *DNSServer) checkFrontendPorts() error {
+	for name, records := range d.records {
+		for _, srv := range records.srv {
+			if _, routed := d.routes[normaliseDNSName(srv.Target)]; routed && !slices.Contains(DNSFrontendPorts, srv.Port) {
+				return fmt.Errorf(
+					"SRV record %s points at %s:%d, but routed hostnames can only be reached on ports %v",
+					name, srv.Target, srv.Port, DNSFrontendPorts,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// Queries returns all queries received so far, in the order they arrived.
+func (d *DNSServer) Queries() []DNSQuery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]DNSQuery{}, d.queries...)
+}
+
+// MustHaveQueried waits until a query of type `qtype` (e.g "SRV") for `name` has been received, failing
+// the test if it is not received within `timeout`.
+func (d *DNSServer) MustHaveQueried(t ct.TestLike, name, qtype string, timeout time.Duration) {
+	t.Helper()
+	name = normaliseDNSName(name)
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, q := range d.Queries() {
+			if q.Name == name && q.Type == qtype {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			var sb strings.Builder
+			for _, q := range d.Queries() {
+				sb.WriteString("  " + q.String() + "\n")
+			}
+			ct.Fatalf(t, "MustHaveQueried: no %s query for %s within %v. Queries:\n%s", qtype, name, timeout, sb.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (d *DNSServer) recordsFor(name string) *dnsRecords {
+	name = normaliseDNSName(name)
+	r, ok := d.records[name]
+	if !ok {
+		r = &dnsRecords{}
+		d.records[name] = r
+	}
+	return r
+}
+
+func (d *DNSServer) serveDNS() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			return // closed
+		}
+		resp, err := d.answer(buf[:n])
+		if err != nil {
+			d.t.Logf("DNSServer: failed to answer query: %s", err)
+			continue
+		}
+		d.conn.WriteTo(resp, addr)
+	}
+}
+
+// answer builds a response to the DNS query in `msg`.
+func (d *DNSServer) answer(msg []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := normaliseDNSName(q.Name.String())
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queries = append(d.queries, DNSQuery{
+		Name: name,
+		Type: strings.TrimPrefix(q.Type.String(), "Type"),
+		Time: time.Now(),
+	})
+
+	respHeader := dnsmessage.Header{
+		ID:               header.ID,
+		Response:         true,
+		Authoritative:    true,
+		RecursionDesired: header.RecursionDesired,
+	}
+	if _, ok := d.records[name]; !ok {
+		respHeader.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, respHeader)
+	if err = b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err = b.Question(q); err != nil {
+		return nil, err
+	}
+	if err = b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	// follow CNAMEs, within reason
+follow:
+	for i := 0; i < 8; i++ {
+		records, ok := d.records[name]
+		if !ok {
+			break
+		}
+		rrName, err := dnsmessage.NewName(name + ".")
+		if err != nil {
+			return nil, err
+		}
+		rr := dnsmessage.ResourceHeader{Name: rrName, Class: dnsmessage.ClassINET, TTL: 1}
+		if records.cname != "" && q.Type != dnsmessage.TypeCNAME {
+			target, err := dnsmessage.NewName(records.cname + ".")
+			if err != nil {
+				return nil, err
+			}
+			if err = b.CNAMEResource(rr, dnsmessage.CNAMEResource{CNAME: target}); err != nil {
+				return nil, err
+			}
+			name = records.cname
+			continue
+		}
+		switch q.Type {
+		case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+			for _, ip := range records.ips {
+				if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+					err = b.AResource(rr, dnsmessage.AResource{A: [4]byte(ip4)})
+				} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+					err = b.AAAAResource(rr, dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())})
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+		case dnsmessage.TypeSRV:
+			for _, srv := range records.srv {
+				target, err := dnsmessage.NewName(normaliseDNSName(srv.Target) + ".")
+				if err != nil {
+					return nil, err
+				}
+				err = b.SRVResource(rr, dnsmessage.SRVResource{
+					Priority: srv.Priority,
+					Weight:   srv.Weight,
+					Port:     srv.Port,
+					Target:   target,
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+		case dnsmessage.TypeCNAME:
+			if records.cname != "" {
+				target, err := dnsmessage.NewName(records.cname + ".")
+				if err != nil {
+					return nil, err
+				}
+				if err = b.CNAMEResource(rr, dnsmessage.CNAMEResource{CNAME: target}); err != nil {
+					return nil, err
+				}
+			}
+		}
+		break follow
+	}
+	return b.Finish()
+}
+
+// serveHTTP sends requests to the handler for the requested hostname.
+func (d *DNSServer) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	d.mu.Lock()
+	route, ok := d.routes[normaliseDNSName(host)]
+	t := d.t
+	d.mu.Unlock()
+	if !ok {
+		t.Logf("DNSServer: no route for %s %s%s", req.Method, req.Host, req.URL.Path)
+		w.WriteHeader(404)
+		w.Write([]byte("complement: DNSServer has no route for " + host))
+		return
+	}
+	route.handler.ServeHTTP(w, req)
+}
+
+// certificate returns a certificate for the hostname, or for the FrontendIP if no hostname was sent.
+func (d *DNSServer) certificate(deployment FederationDeployment, serverName string) (*tls.Certificate, error) {
+	certHostname := normaliseDNSName(serverName)
+	d.mu.Lock()
+	if route, ok := d.routes[certHostname]; ok && route.certHostname != "" {
+		certHostname = route.certHostname
+	}
+	if certHostname == "" && d.FrontendIP != nil {
+		certHostname = d.FrontendIP.String()
+	}
+	cert, ok := d.certs[certHostname]
+	d.mu.Unlock()
+	if ok {
+		return cert, nil
+	}
+	if certHostname == "" {
+		return nil, fmt.Errorf("DNSServer: no hostname in TLS handshake")
+	}
+	derBytes, priv, err := certificateFor(deployment.GetConfig(), []string{certHostname})
+	if err != nil {
+		return nil, err
+	}
+	cert = &tls.Certificate{
+		Certificate: [][]byte{derBytes},
+		PrivateKey:  priv,
+	}
+	d.mu.Lock()
+	d.certs[certHostname] = cert
+	d.mu.Unlock()
+	return cert, nil
+}
+
+func normaliseDNSName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
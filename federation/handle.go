@@ -1,11 +1,15 @@
 package federation
 
 import (
-	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -88,7 +92,7 @@ func MakeRespMakeKnock(s *Server, room *ServerRoom, userID string) (resp fclient
 		Type:     "m.room.member",
 		StateKey: &userID,
 		Content: map[string]interface{}{
-			"membership": spec.Join, // XXX this feels wrong?
+			"membership": spec.Knock,
 		},
 		Sender: userID,
 	})
@@ -104,6 +108,31 @@ func MakeRespMakeKnock(s *Server, room *ServerRoom, userID string) (resp fclient
 	return
 }
 
+// EXPERIMENTAL
+// MakeRespMakeLeave makes the response for a /make_leave request, without verifying any signatures
+// or dealing with HTTP responses itself.
+func MakeRespMakeLeave(s *Server, room *ServerRoom, userID string) (resp fclient.RespMakeLeave, err error) {
+	// Generate a leave event
+	proto, err := room.ProtoEventCreator(room, Event{
+		Type:     "m.room.member",
+		StateKey: &userID,
+		Content: map[string]interface{}{
+			"membership": spec.Leave,
+		},
+		Sender: userID,
+	})
+	if err != nil {
+		err = fmt.Errorf("make_leave cannot set create proto event: %w", err)
+		return
+	}
+
+	resp = fclient.RespMakeLeave{
+		RoomVersion: room.Version,
+		LeaveEvent:  *proto,
+	}
+	return
+}
+
 // EXPERIMENTAL
 // SendJoinRequestsHandler is the http.Handler implementation for the send_join part of
 // HandleMakeSendJoinRequests.
@@ -152,6 +181,7 @@ func SendJoinRequestsHandler(s *Server, w http.ResponseWriter, req *http.Request
 		w.Write([]byte("complement: HandleMakeSendJoinRequests send_join unexpected room version: " + err.Error()))
 		return
 	}
+	s.validateInboundPDU(req.Context(), room, fedReq.Content())
 	event, err := verImpl.NewEventFromUntrustedJSON(fedReq.Content())
 	if err != nil {
 		w.WriteHeader(500)
@@ -199,6 +229,248 @@ func HandlePartialStateMakeSendJoinRequests() func(*Server) {
 	}
 }
 
+// EXPERIMENTAL
+// MakeKnockRequestsHandler is the http.Handler implementation for the make_knock part of
+// HandleMakeSendKnockRequests.
+func MakeKnockRequestsHandler(s *Server, w http.ResponseWriter, req *http.Request) {
+	fedReq, errResp := fclient.VerifyHTTPRequest(
+		req, time.Now(), s.serverName, nil, s.keyRing,
+	)
+	if fedReq == nil {
+		writeJSONResponse(w, errResp)
+		return
+	}
+
+	vars := mux.Vars(req)
+	userID := vars["userID"]
+	roomID := vars["roomID"]
+
+	room, ok := s.rooms[roomID]
+	if !ok {
+		w.WriteHeader(404)
+		w.Write([]byte("complement: HandleMakeSendKnockRequests make_knock unexpected room ID: " + roomID))
+		return
+	}
+
+	// the knocking server must support the room version
+	supported := false
+	for _, ver := range req.URL.Query()["ver"] {
+		if gomatrixserverlib.RoomVersion(ver) == room.Version {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		writeJSONResponse(w, util.JSONResponse{
+			Code: 400,
+			JSON: spec.IncompatibleRoomVersion(string(room.Version)),
+		})
+		return
+	}
+
+	makeKnockResp, err := MakeRespMakeKnock(s, room, userID)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("complement: HandleMakeSendKnockRequests %s", err)))
+		return
+	}
+
+	w.WriteHeader(200)
+	b, _ := json.Marshal(makeKnockResp)
+	w.Write(b)
+}
+
+// EXPERIMENTAL
+// SendKnockRequestsHandler is the http.Handler implementation for the send_knock part of
+// HandleMakeSendKnockRequests. The knock event is checked against the auth rules of the room
+// before being added to the room, so knocks on rooms whose join rules do not allow knocking are rejected.
+func SendKnockRequestsHandler(s *Server, w http.ResponseWriter, req *http.Request) {
+	room, _, ok := handleSendMembership(s, w, req, spec.Knock)
+	if !ok {
+		return
+	}
+	// the knocking server gets some stripped state to help identify the room
+	knockRoomState := []gomatrixserverlib.InviteStrippedState{}
+	for _, evType := range []string{
+		spec.MRoomCreate, spec.MRoomJoinRules, spec.MRoomName, spec.MRoomAvatar,
+		spec.MRoomCanonicalAlias, spec.MRoomEncryption,
+	} {
+		if ev := room.CurrentState(evType, ""); ev != nil {
+			knockRoomState = append(knockRoomState, gomatrixserverlib.NewInviteStrippedState(ev))
+		}
+	}
+	w.WriteHeader(200)
+	b, _ := json.Marshal(fclient.RespSendKnock{
+		KnockRoomState: knockRoomState,
+	})
+	w.Write(b)
+}
+
+// EXPERIMENTAL
+// MakeLeaveRequestsHandler is the http.Handler implementation for the make_leave part of
+// HandleMakeSendLeaveRequests.
+func MakeLeaveRequestsHandler(s *Server, w http.ResponseWriter, req *http.Request) {
+	fedReq, errResp := fclient.VerifyHTTPRequest(
+		req, time.Now(), s.serverName, nil, s.keyRing,
+	)
+	if fedReq == nil {
+		writeJSONResponse(w, errResp)
+		return
+	}
+
+	vars := mux.Vars(req)
+	userID := vars["userID"]
+	roomID := vars["roomID"]
+
+	room, ok := s.rooms[roomID]
+	if !ok {
+		w.WriteHeader(404)
+		w.Write([]byte("complement: HandleMakeSendLeaveRequests make_leave unexpected room ID: " + roomID))
+		return
+	}
+
+	makeLeaveResp, err := MakeRespMakeLeave(s, room, userID)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("complement: HandleMakeSendLeaveRequests %s", err)))
+		return
+	}
+
+	w.WriteHeader(200)
+	b, _ := json.Marshal(makeLeaveResp)
+	w.Write(b)
+}
+
+// EXPERIMENTAL
+// SendLeaveRequestsHandler is the http.Handler implementation for the send_leave part of
+// HandleMakeSendLeaveRequests. The leave event is checked against the auth rules of the room
+// before being added to the room. v1 of the endpoint wraps the response in a [200, {}] array.
+func SendLeaveRequestsHandler(s *Server, w http.ResponseWriter, req *http.Request, v1 bool) {
+	if _, _, ok := handleSendMembership(s, w, req, spec.Leave); !ok {
+		return
+	}
+	w.WriteHeader(200)
+	if v1 {
+		w.Write([]byte(`[200,{}]`))
+	} else {
+		w.Write([]byte(`{}`))
+	}
+}
+
+// handleSendMembership validates a send_knock or send_leave request and adds the membership event to
+// the room. If it returns false, an error response has already been sent.
+func handleSendMembership(s *Server, w http.ResponseWriter, req *http.Request, membership string) (*ServerRoom, gomatrixserverlib.PDU, bool) {
+	fedReq, errResp := fclient.VerifyHTTPRequest(
+		req, time.Now(), s.serverName, nil, s.keyRing,
+	)
+	if fedReq == nil {
+		writeJSONResponse(w, errResp)
+		return nil, nil, false
+	}
+
+	vars := mux.Vars(req)
+	roomID := vars["roomID"]
+	eventID := vars["eventID"]
+
+	room, ok := s.rooms[roomID]
+	if !ok {
+		w.WriteHeader(404)
+		w.Write([]byte(fmt.Sprintf("complement: send_%s unexpected room ID: %s", membership, roomID)))
+		return nil, nil, false
+	}
+	verImpl, err := gomatrixserverlib.GetRoomVersion(room.Version)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("complement: send_%s unexpected room version: %s", membership, err)))
+		return nil, nil, false
+	}
+	badRequest := func(format string, args ...interface{}) (*ServerRoom, gomatrixserverlib.PDU, bool) {
+		msg := fmt.Sprintf("complement: send_%s: %s", membership, fmt.Sprintf(format, args...))
+		log.Print(msg)
+		writeJSONResponse(w, util.JSONResponse{
+			Code: 400,
+			JSON: spec.BadJSON(msg),
+		})
+		return nil, nil, false
+	}
+	s.validateInboundPDU(req.Context(), room, fedReq.Content())
+	event, err := verImpl.NewEventFromUntrustedJSON(fedReq.Content())
+	if err != nil {
+		return badRequest("cannot parse event JSON: %s", err)
+	}
+	if event.EventID() != eventID {
+		return badRequest("event ID %s does not match path %s", event.EventID(), eventID)
+	}
+	if event.RoomID().String() != roomID {
+		return badRequest("event room ID %s does not match path %s", event.RoomID().String(), roomID)
+	}
+	if event.Type() != spec.MRoomMember || event.StateKey() == nil || *event.StateKey() != string(event.SenderID()) {
+		return badRequest("event is not a membership event for the sender")
+	}
+	if gotMembership, err := event.Membership(); err != nil || gotMembership != membership {
+		return badRequest("membership is %q, want %q", gotMembership, membership)
+	}
+	sender, err := userIDForSender(event.RoomID(), event.SenderID())
+	if err != nil {
+		return badRequest("invalid sender: %s", err)
+	}
+	if sender.Domain() != fedReq.Origin() {
+		return badRequest("sender %s does not belong to origin %s", sender, fedReq.Origin())
+	}
+	if err = gomatrixserverlib.VerifyEventSignatures(req.Context(), event, s.keyRing, userIDForSender); err != nil {
+		w.WriteHeader(403)
+		w.Write([]byte(fmt.Sprintf("complement: send_%s: invalid event signatures: %s", membership, err)))
+		return nil, nil, false
+	}
+	if err = room.CheckAuth(event); err != nil {
+		writeJSONResponse(w, util.JSONResponse{
+			Code: 403,
+			JSON: spec.Forbidden(fmt.Sprintf("complement: send_%s: %s", membership, err)),
+		})
+		return nil, nil, false
+	}
+
+	room.AddEvent(event)
+	log.Printf("Received send-%s of event %s", membership, event.EventID())
+	return room, event, true
+}
+
+// EXPERIMENTAL
+// HandleMakeSendKnockRequests is an option which will process make_knock and send_knock requests for rooms which are
+// present in this server. To add a room to this server, see Server.MustMakeRoom. Knocks are checked against the auth
+// rules of the room, so the room must have a join rule which allows knocking.
+func HandleMakeSendKnockRequests() func(*Server) {
+	return func(s *Server) {
+		s.mux.Handle("/_matrix/federation/v1/make_knock/{roomID}/{userID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			MakeKnockRequestsHandler(s, w, req)
+		})).Methods("GET")
+
+		s.mux.Handle("/_matrix/federation/v1/send_knock/{roomID}/{eventID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			SendKnockRequestsHandler(s, w, req)
+		})).Methods("PUT")
+	}
+}
+
+// EXPERIMENTAL
+// HandleMakeSendLeaveRequests is an option which will process make_leave and send_leave (v1 and v2) requests for rooms
+// which are present in this server, including remote users rejecting invites sent from this server. Leaves are checked
+// against the auth rules of the room.
+func HandleMakeSendLeaveRequests() func(*Server) {
+	return func(s *Server) {
+		s.mux.Handle("/_matrix/federation/v1/make_leave/{roomID}/{userID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			MakeLeaveRequestsHandler(s, w, req)
+		})).Methods("GET")
+
+		s.mux.Handle("/_matrix/federation/v1/send_leave/{roomID}/{eventID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			SendLeaveRequestsHandler(s, w, req, true)
+		})).Methods("PUT")
+
+		s.mux.Handle("/_matrix/federation/v2/send_leave/{roomID}/{eventID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			SendLeaveRequestsHandler(s, w, req, false)
+		})).Methods("PUT")
+	}
+}
+
 // EXPERIMENTAL
 // HandleInviteRequests is an option which makes the server process invite requests.
 //
@@ -236,7 +508,8 @@ func HandleInviteRequests(inviteCallback func(gomatrixserverlib.PDU)) func(*Serv
 			}
 
 			// Sign the event before we send it back
-			signedEvent := inviteRequest.Event().Sign(string(s.serverName), s.KeyID, s.Priv)
+			keyID, priv := s.signingKey()
+			signedEvent := inviteRequest.Event().Sign(string(s.serverName), keyID, priv)
 
 			// Send the response
 			res := map[string]interface{}{
@@ -284,6 +557,216 @@ func HandleDirectoryLookups() func(*Server) {
 	}
 }
 
+// EXPERIMENTAL
+// HandleProfileRequests is an option which will process GET /_matrix/federation/v1/query/profile requests
+// using the profiles set via Server.SetProfile.
+func HandleProfileRequests() func(*Server) {
+	return func(s *Server) {
+		s.mux.Handle("/_matrix/federation/v1/query/profile", s.ValidFederationRequest(s.t, func(fr *fclient.FederationRequest, pathParams map[string]string) util.JSONResponse {
+			query := requestQuery(fr)
+			s.directoryMu.Lock()
+			profile, ok := s.profiles[query.Get("user_id")]
+			s.directoryMu.Unlock()
+			if !ok {
+				return util.JSONResponse{
+					Code: 404,
+					JSON: spec.NotFound("complement: HandleProfileRequests unknown user: " + query.Get("user_id")),
+				}
+			}
+			switch query.Get("field") {
+			case "displayname":
+				profile.AvatarURL = ""
+			case "avatar_url":
+				profile.DisplayName = ""
+			}
+			return util.JSONResponse{
+				Code: 200,
+				JSON: profile,
+			}
+		})).Methods("GET")
+	}
+}
+
+// EXPERIMENTAL
+// HandlePublicRoomsRequests is an option which will process GET and POST /_matrix/federation/v1/publicRooms
+// requests, returning the rooms published via Server.PublishRoom. Room summaries are generated from the current
+// state of each room. POST requests may filter by `generic_search_term` (matched against the room name, topic
+// and canonical alias) and `room_types`. Pagination tokens are offsets into the list of matching rooms.
+func HandlePublicRoomsRequests() func(*Server) {
+	return func(s *Server) {
+		publicRooms := func(limit int, since string, searchTerm string, roomTypes []*string) util.JSONResponse {
+			s.directoryMu.Lock()
+			roomIDs := append([]string{}, s.publishedRooms...)
+			s.directoryMu.Unlock()
+			var rooms []fclient.PublicRoom
+			for _, roomID := range roomIDs {
+				room, ok := s.rooms[roomID]
+				if !ok {
+					continue
+				}
+				pr := room.PublicRoom()
+				if searchTerm != "" && !publicRoomMatchesSearchTerm(pr, searchTerm) {
+					continue
+				}
+				if roomTypes != nil && !publicRoomMatchesRoomTypes(pr, roomTypes) {
+					continue
+				}
+				rooms = append(rooms, pr)
+			}
+			offset := 0
+			if since != "" {
+				var err error
+				offset, err = strconv.Atoi(since)
+				if err != nil || offset < 0 || offset > len(rooms) {
+					return util.JSONResponse{
+						Code: 400,
+						JSON: spec.InvalidParam("complement: HandlePublicRoomsRequests invalid since token: " + since),
+					}
+				}
+			}
+			end := len(rooms)
+			if limit > 0 && offset+limit < end {
+				end = offset + limit
+			}
+			resp := fclient.RespPublicRooms{
+				Chunk:                  append([]fclient.PublicRoom{}, rooms[offset:end]...),
+				TotalRoomCountEstimate: len(rooms),
+			}
+			if offset > 0 {
+				prev := offset - limit
+				if limit <= 0 || prev < 0 {
+					prev = 0
+				}
+				resp.PrevBatch = strconv.Itoa(prev)
+			}
+			if end < len(rooms) {
+				resp.NextBatch = strconv.Itoa(end)
+			}
+			return util.JSONResponse{
+				Code: 200,
+				JSON: resp,
+			}
+		}
+
+		s.mux.Handle("/_matrix/federation/v1/publicRooms", s.ValidFederationRequest(s.t, func(fr *fclient.FederationRequest, pathParams map[string]string) util.JSONResponse {
+			query := requestQuery(fr)
+			limit, _ := strconv.Atoi(query.Get("limit"))
+			return publicRooms(limit, query.Get("since"), "", nil)
+		})).Methods("GET")
+
+		s.mux.Handle("/_matrix/federation/v1/publicRooms", s.ValidFederationRequest(s.t, func(fr *fclient.FederationRequest, pathParams map[string]string) util.JSONResponse {
+			var body struct {
+				Limit  int    `json:"limit"`
+				Since  string `json:"since"`
+				Filter struct {
+					GenericSearchTerm string    `json:"generic_search_term"`
+					RoomTypes         []*string `json:"room_types"`
+				} `json:"filter"`
+			}
+			if err := json.Unmarshal(fr.Content(), &body); err != nil {
+				return util.JSONResponse{
+					Code: 400,
+					JSON: spec.BadJSON("complement: HandlePublicRoomsRequests cannot parse body: " + err.Error()),
+				}
+			}
+			return publicRooms(body.Limit, body.Since, body.Filter.GenericSearchTerm, body.Filter.RoomTypes)
+		})).Methods("POST")
+	}
+}
+
+func publicRoomMatchesSearchTerm(pr fclient.PublicRoom, searchTerm string) bool {
+	searchTerm = strings.ToLower(searchTerm)
+	for _, field := range []string{pr.Name, pr.Topic, pr.CanonicalAlias} {
+		if strings.Contains(strings.ToLower(field), searchTerm) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicRoomMatchesRoomTypes checks the room type against the filter, where a nil entry matches rooms without a type.
+func publicRoomMatchesRoomTypes(pr fclient.PublicRoom, roomTypes []*string) bool {
+	for _, roomType := range roomTypes {
+		if (roomType == nil && pr.RoomType == "") || (roomType != nil && *roomType == pr.RoomType) {
+			return true
+		}
+	}
+	return false
+}
+
+// EXPERIMENTAL
+// HandleHierarchyRequests is an option which will process GET /_matrix/federation/v1/hierarchy/{roomID} requests
+// for rooms which are present in this server, using the m.space.child state of the room. The requested room and
+// its children are only returned if the requesting server could view or join them: i.e they are public, knockable,
+// world readable, the requesting server is in the room, or the room is restricted and the requesting server is in
+// one of the allowed rooms. Children which are known to this server but not accessible are returned in
+// `inaccessible_children`. Children which are not known to this server are omitted.
+func HandleHierarchyRequests() func(*Server) {
+	return func(s *Server) {
+		hierarchyHandler := s.ValidFederationRequest(s.t, func(fr *fclient.FederationRequest, pathParams map[string]string) util.JSONResponse {
+			roomID := pathParams["roomID"]
+			suggestedOnly := requestQuery(fr).Get("suggested_only") == "true"
+			room, ok := s.rooms[roomID]
+			if !ok || !s.roomAccessibleTo(room, fr.Origin()) {
+				return util.JSONResponse{
+					Code: 404,
+					JSON: spec.NotFound("complement: HandleHierarchyRequests unknown or inaccessible room: " + roomID),
+				}
+			}
+			resp := fclient.RoomHierarchyResponse{
+				Room:                 room.hierarchyRoom(suggestedOnly),
+				Children:             []fclient.RoomHierarchyRoom{},
+				InaccessibleChildren: []string{},
+			}
+			for _, child := range room.spaceChildren(suggestedOnly) {
+				childRoom, ok := s.rooms[*child.StateKey()]
+				if !ok {
+					continue
+				}
+				if !s.roomAccessibleTo(childRoom, fr.Origin()) {
+					resp.InaccessibleChildren = append(resp.InaccessibleChildren, childRoom.RoomID)
+					continue
+				}
+				resp.Children = append(resp.Children, childRoom.hierarchyRoom(suggestedOnly))
+			}
+			return util.JSONResponse{
+				Code: 200,
+				JSON: resp,
+			}
+		})
+		s.mux.Handle("/_matrix/federation/v1/hierarchy/{roomID}", hierarchyHandler).Methods("GET")
+		// some servers fall back to the unstable endpoint when the stable endpoint returns an error
+		s.mux.Handle("/_matrix/federation/unstable/org.matrix.msc2946/hierarchy/{roomID}", hierarchyHandler).Methods("GET")
+	}
+}
+
+// EXPERIMENTAL
+// HandleOpenIDRequests is an option which will process GET /_matrix/federation/v1/openid/userinfo requests,
+// exchanging tokens created via Server.CreateOpenIDToken for the user ID they were created for.
+func HandleOpenIDRequests() func(*Server) {
+	return func(s *Server) {
+		s.mux.Handle("/_matrix/federation/v1/openid/userinfo", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			token := req.URL.Query().Get("access_token")
+			s.directoryMu.Lock()
+			userID, ok := s.openIDTokens[token]
+			s.directoryMu.Unlock()
+			if !ok {
+				writeJSONResponse(w, util.JSONResponse{
+					Code: 401,
+					JSON: spec.UnknownToken("complement: HandleOpenIDRequests unknown access token"),
+				})
+				return
+			}
+			writeJSONResponse(w, util.JSONResponse{
+				Code: 200,
+				JSON: map[string]string{
+					"sub": userID,
+				},
+			})
+		})).Methods("GET")
+	}
+}
+
 // EXPERIMENTAL
 // HandleEventRequests is an option which will process GET /_matrix/federation/v1/event/{eventId} requests universally when requested.
 func HandleEventRequests() func(*Server) {
@@ -380,33 +863,15 @@ func HandleEventAuthRequests() func(*Server) {
 
 // EXPERIMENTAL
 // HandleKeyRequests is an option which will process GET /_matrix/key/v2/server requests universally when requested.
+// The response includes any keys rotated out via Server.RotateSigningKey as `old_verify_keys`.
 func HandleKeyRequests() func(*Server) {
 	return func(srv *Server) {
 		keymux := srv.mux.PathPrefix("/_matrix/key/v2").Subrouter()
 		keyFn := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			k := gomatrixserverlib.ServerKeys{}
-			k.ServerName = spec.ServerName(srv.serverName)
-			publicKey := srv.Priv.Public().(ed25519.PublicKey)
-			k.VerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
-				srv.KeyID: {
-					Key: spec.Base64Bytes(publicKey),
-				},
-			}
-			k.OldVerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey{}
-			k.ValidUntilTS = spec.AsTimestamp(time.Now().Add(24 * time.Hour))
-			toSign, err := json.Marshal(k.ServerKeyFields)
+			k, err := srv.ServerKeys()
 			if err != nil {
 				w.WriteHeader(500)
-				w.Write([]byte("complement: HandleKeyRequests cannot marshal serverkeyfields: " + err.Error()))
-				return
-			}
-
-			k.Raw, err = gomatrixserverlib.SignJSON(
-				string(srv.serverName), srv.KeyID, srv.Priv, toSign,
-			)
-			if err != nil {
-				w.WriteHeader(500)
-				w.Write([]byte("complement: HandleKeyRequests cannot sign json: " + err.Error()))
+				w.Write([]byte("complement: HandleKeyRequests " + err.Error()))
 				return
 			}
 			w.WriteHeader(200)
@@ -420,13 +885,156 @@ func HandleKeyRequests() func(*Server) {
 }
 
 // EXPERIMENTAL
+// HandleNotaryRequests is an option which makes this server act as a notary (perspective server) by
+// processing GET /_matrix/key/v2/query/{serverName} and POST /_matrix/key/v2/query requests.
+// Keys for other servers are fetched directly from them, unless they were added via Server.AddNotaryServerKeys.
+// All returned keys are additionally signed by this server.
+func HandleNotaryRequests() func(*Server) {
+	return func(srv *Server) {
+		keymux := srv.mux.PathPrefix("/_matrix/key/v2").Subrouter()
+		respond := func(w http.ResponseWriter, req *http.Request, criteria map[spec.ServerName]spec.Timestamp) {
+			resp := struct {
+				ServerKeys []json.RawMessage `json:"server_keys"`
+			}{
+				ServerKeys: []json.RawMessage{},
+			}
+			for serverName, minimumValidUntil := range criteria {
+				keys, err := srv.notaryServerKeys(req.Context(), serverName, minimumValidUntil)
+				if err != nil {
+					// the spec says to omit servers we cannot get keys for
+					srv.t.Logf("HandleNotaryRequests: %s", err)
+					continue
+				}
+				resp.ServerKeys = append(resp.ServerKeys, keys)
+			}
+			b, err := json.Marshal(resp)
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleNotaryRequests failed to marshal JSON: " + err.Error()))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(b)
+		}
+
+		keymux.Handle("/query/{serverName}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var minimumValidUntil spec.Timestamp
+			if ts := req.URL.Query().Get("minimum_valid_until_ts"); ts != "" {
+				n, err := strconv.ParseUint(ts, 10, 64)
+				if err != nil {
+					w.WriteHeader(400)
+					w.Write([]byte("complement: HandleNotaryRequests invalid minimum_valid_until_ts: " + err.Error()))
+					return
+				}
+				minimumValidUntil = spec.Timestamp(n)
+			}
+			respond(w, req, map[spec.ServerName]spec.Timestamp{
+				spec.ServerName(mux.Vars(req)["serverName"]): minimumValidUntil,
+			})
+		})).Methods("GET")
+
+		keymux.Handle("/query", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var body struct {
+				ServerKeys map[spec.ServerName]map[gomatrixserverlib.KeyID]struct {
+					MinimumValidUntilTS spec.Timestamp `json:"minimum_valid_until_ts"`
+				} `json:"server_keys"`
+			}
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				errResp := util.MessageResponse(400, err.Error())
+				w.WriteHeader(errResp.Code)
+				b, _ := json.Marshal(errResp.JSON)
+				w.Write(b)
+				return
+			}
+			criteria := make(map[spec.ServerName]spec.Timestamp, len(body.ServerKeys))
+			for serverName, keyIDs := range body.ServerKeys {
+				criteria[serverName] = 0
+				for _, c := range keyIDs {
+					if c.MinimumValidUntilTS > criteria[serverName] {
+						criteria[serverName] = c.MinimumValidUntilTS
+					}
+				}
+			}
+			respond(w, req, criteria)
+		})).Methods("POST")
+	}
+}
+
+// EXPERIMENTAL
+// HandleWellKnownServer is an option which serves /.well-known/matrix/server, delegating federation for
+// this server to `delegatedServerName`. Homeservers only look for delegation on port 443 of server names
+// without a port, so this is typically used with WithServerName and DNSServer.Route. If `delegatedServerName`
+// is also routed with DNSServer.Route, its port must be one of DNSFrontendPorts, as the frontend can't be
+// reached on other ports.
+func HandleWellKnownServer(delegatedServerName string) func(*Server) {
+	return func(s *Server) {
+		s.mux.Handle("/.well-known/matrix/server", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			writeJSONResponse(w, util.JSONResponse{
+				Code: 200,
+				JSON: map[string]string{
+					"m.server": delegatedServerName,
+				},
+			})
+		})).Methods("GET")
+	}
+}
+
 // HandleMediaRequests is an option which will process /_matrix/media/v1/download/* using the provided map
 // as a way to do so. The key of the map is the media ID to be handled.
-func HandleMediaRequests(mediaIds map[string]func(w http.ResponseWriter)) func(*Server) {
+//
+// Authenticated media requests to /_matrix/federation/v1/media/download/* and /_matrix/federation/v1/media/thumbnail/*
+// are also handled, wrapping the output of the callback in a multipart/mixed response. Thumbnails are generated by
+// scaling PNG, JPEG and GIF media to the requested size. Use WithMediaRedirects to respond with a `Location` instead.
+func HandleMediaRequests(mediaIds map[string]func(w http.ResponseWriter), opts ...MediaOpt) func(*Server) {
+	var cfg mediaConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 	return func(srv *Server) {
 		mediamux := srv.mux.PathPrefix("/_matrix/media").Subrouter()
 		mediamuxAuthenticated := srv.mux.PathPrefix("/_matrix/federation/v1/media").Subrouter()
 
+		// fetchMedia runs the callback for the media ID, returning false and writing an error if it doesn't exist.
+		fetchMedia := func(w http.ResponseWriter, mediaId string) (*httptest.ResponseRecorder, bool) {
+			f, ok := mediaIds[mediaId]
+			if !ok {
+				w.WriteHeader(404)
+				w.Write([]byte("complement: Unknown predefined media ID: " + mediaId))
+				return nil, false
+			}
+			rec := httptest.NewRecorder()
+			f(rec)
+			if rec.Code != 200 {
+				// pass through errors as-is
+				for k, v := range rec.Header() {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(rec.Code)
+				w.Write(rec.Body.Bytes())
+				return nil, false
+			}
+			return rec, true
+		}
+		// thumbnailMedia scales the media according to the query parameters of the request.
+		thumbnailMedia := func(w http.ResponseWriter, req *http.Request, rec *httptest.ResponseRecorder) ([]byte, string, bool) {
+			query := req.URL.Query()
+			width, _ := strconv.Atoi(query.Get("width"))
+			height, _ := strconv.Atoi(query.Get("height"))
+			method := query.Get("method")
+			if method == "" {
+				method = "scale"
+			}
+			body, contentType, err := thumbnail(rec.Body.Bytes(), rec.Header().Get("Content-Type"), width, height, method)
+			if err != nil {
+				writeJSONResponse(w, util.JSONResponse{
+					Code: 400,
+					JSON: spec.Unknown("complement: " + err.Error()),
+				})
+				return nil, "", false
+			}
+			return body, contentType, true
+		}
+
 		downloadFn := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			vars := mux.Vars(req)
 			origin := vars["origin"]
@@ -447,6 +1055,45 @@ func HandleMediaRequests(mediaIds map[string]func(w http.ResponseWriter)) func(*
 			}
 		})
 
+		authenticatedDownloadFn := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mediaId := mux.Vars(req)["mediaId"]
+			if cfg.redirects {
+				if _, ok := mediaIds[mediaId]; !ok {
+					w.WriteHeader(404)
+					w.Write([]byte("complement: Unknown predefined media ID: " + mediaId))
+					return
+				}
+				writeMultipartRedirect(w, fmt.Sprintf("https://%s/_complement/media/download/%s", srv.serverName, url.PathEscape(mediaId)))
+				return
+			}
+			rec, ok := fetchMedia(w, mediaId)
+			if !ok {
+				return
+			}
+			writeMultipartMedia(w, rec.Header(), rec.Body.Bytes())
+		})
+
+		authenticatedThumbnailFn := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mediaId := mux.Vars(req)["mediaId"]
+			rec, ok := fetchMedia(w, mediaId)
+			if !ok {
+				return
+			}
+			body, contentType, ok := thumbnailMedia(w, req, rec)
+			if !ok {
+				return
+			}
+			if cfg.redirects {
+				writeMultipartRedirect(w, fmt.Sprintf(
+					"https://%s/_complement/media/thumbnail/%s?%s", srv.serverName, url.PathEscape(mediaId), req.URL.RawQuery,
+				))
+				return
+			}
+			header := http.Header{}
+			header.Set("Content-Type", contentType)
+			writeMultipartMedia(w, header, body)
+		})
+
 		// Note: The spec says to use /v3, but implementations rely on /v1 and /r0 working for federation requests as a legacy
 		// route.
 		mediamux.Handle("/r0/download/{origin}/{mediaId}", downloadFn).Methods("GET")
@@ -454,7 +1101,36 @@ func HandleMediaRequests(mediaIds map[string]func(w http.ResponseWriter)) func(*
 		mediamux.Handle("/v3/download/{origin}/{mediaId}", downloadFn).Methods("GET")
 
 		// Also handle authenticated media requests
-		mediamuxAuthenticated.Handle("/download/{mediaId}", downloadFn).Methods("GET")
+		mediamuxAuthenticated.Handle("/download/{mediaId}", authenticatedDownloadFn).Methods("GET")
+		mediamuxAuthenticated.Handle("/thumbnail/{mediaId}", authenticatedThumbnailFn).Methods("GET")
+
+		if cfg.redirects {
+			// The targets of the redirects, which are fetched without authentication.
+			srv.mux.Handle("/_complement/media/download/{mediaId}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				rec, ok := fetchMedia(w, mux.Vars(req)["mediaId"])
+				if !ok {
+					return
+				}
+				for k, v := range rec.Header() {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(200)
+				w.Write(rec.Body.Bytes())
+			})).Methods("GET")
+			srv.mux.Handle("/_complement/media/thumbnail/{mediaId}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				rec, ok := fetchMedia(w, mux.Vars(req)["mediaId"])
+				if !ok {
+					return
+				}
+				body, contentType, ok := thumbnailMedia(w, req, rec)
+				if !ok {
+					return
+				}
+				w.Header().Set("Content-Type", contentType)
+				w.WriteHeader(200)
+				w.Write(body)
+			})).Methods("GET")
+		}
 	}
 }
 
@@ -464,132 +1140,244 @@ func HandleMediaRequests(mediaIds map[string]func(w http.ResponseWriter)) func(*
 // Callbacks will be fired AFTER the event has been stored onto the respective ServerRoom.
 func HandleTransactionRequests(pduCallback func(gomatrixserverlib.PDU), eduCallback func(gomatrixserverlib.EDU)) func(*Server) {
 	return func(srv *Server) {
-		srv.mux.Handle("/_matrix/federation/v1/send/{transactionID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			// Extract the transaction ID from the request vars
-			vars := mux.Vars(req)
-			transactionID := vars["transactionID"]
+		var pduFn func(gomatrixserverlib.PDU) error
+		if pduCallback != nil {
+			pduFn = func(pdu gomatrixserverlib.PDU) error {
+				pduCallback(pdu)
+				return nil
+			}
+		}
+		var eduFn func(gomatrixserverlib.EDU) error
+		if eduCallback != nil {
+			eduFn = func(edu gomatrixserverlib.EDU) error {
+				eduCallback(edu)
+				return nil
+			}
+		}
+		handleTransactions(srv, pduFn, eduFn, false)
+	}
+}
 
-			// Check federation signature
-			fedReq, errResp := fclient.VerifyHTTPRequest(
-				req, time.Now(), srv.serverName, nil, srv.keyRing,
+// EXPERIMENTAL
+// HandleTransactionRequestsWithErrors is like HandleTransactionRequests, but the callbacks decide the response
+// to the /send request. Callbacks are fired BEFORE the event is stored onto the respective ServerRoom.
+//   - If pduCallback returns nil, the PDU is stored and reported as successful.
+//   - If pduCallback returns an error, the PDU is not stored and the error is reported for that PDU.
+//   - If either callback returns a *TransactionError, processing stops and the whole transaction fails with
+//     the status code in the error. No events from the transaction are stored, so a retransmission of the
+//     transaction doesn't store them twice.
+//
+// Other errors returned from eduCallback are logged, as EDUs have no results in the response.
+//
+// Transaction IDs which have been seen before from the same origin are reported via Server.Retransmissions.
+// If the previous attempt succeeded, the previous response is sent again without processing the transaction.
+func HandleTransactionRequestsWithErrors(pduCallback func(gomatrixserverlib.PDU) error, eduCallback func(gomatrixserverlib.EDU) error) func(*Server) {
+	return func(srv *Server) {
+		handleTransactions(srv, pduCallback, eduCallback, true)
+	}
+}
+
+// acceptedPDU is a PDU from a transaction which is stored once the transaction succeeds.
+type acceptedPDU struct {
+	room  *ServerRoom
+	event gomatrixserverlib.PDU
+}
+
+// handleTransactions handles /send. If callbackBeforeStore is set, PDUs are only stored if pduCallback
+// returns nil and the transaction succeeds, otherwise they are always stored before pduCallback is called.
+func handleTransactions(srv *Server, pduCallback func(gomatrixserverlib.PDU) error, eduCallback func(gomatrixserverlib.EDU) error, callbackBeforeStore bool) {
+	srv.mux.Handle("/_matrix/federation/v1/send/{transactionID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Extract the transaction ID from the request vars
+		vars := mux.Vars(req)
+		transactionID := vars["transactionID"]
+
+		// Check federation signature
+		fedReq, errResp := fclient.VerifyHTTPRequest(
+			req, time.Now(), srv.serverName, nil, srv.keyRing,
+		)
+		if fedReq == nil {
+			log.Printf(
+				"complement: Transaction '%s': HTTP Code %d. Invalid http request: %s",
+				transactionID, errResp.Code, errResp.JSON,
 			)
-			if fedReq == nil {
-				log.Printf(
-					"complement: Transaction '%s': HTTP Code %d. Invalid http request: %s",
-					transactionID, errResp.Code, errResp.JSON,
-				)
 
-				w.WriteHeader(errResp.Code)
-				b, _ := json.Marshal(errResp.JSON)
-				w.Write(b)
-				return
+			w.WriteHeader(errResp.Code)
+			b, _ := json.Marshal(errResp.JSON)
+			w.Write(b)
+			return
+		}
+
+		// Transactions which succeeded are not processed again, as the origin must not have received our response.
+		if previousResponse := srv.trackTransaction(fedReq.Origin(), gomatrixserverlib.TransactionID(transactionID), fedReq.Content()); previousResponse != nil {
+			w.WriteHeader(200)
+			w.Write(previousResponse)
+			return
+		}
+
+		// Unmarshal the request body into a transaction object
+		var transaction gomatrixserverlib.Transaction
+		err := json.Unmarshal(fedReq.Content(), &transaction)
+		if err != nil {
+			log.Printf(
+				"complement: Transaction '%s': Unable to unmarshal transaction body bytes into Transaction object: %s",
+				transaction.TransactionID, err.Error(),
+			)
+
+			errResp := util.MessageResponse(400, err.Error())
+			w.WriteHeader(errResp.Code)
+			b, _ := json.Marshal(errResp.JSON)
+			w.Write(b)
+			return
+		}
+		transaction.TransactionID = gomatrixserverlib.TransactionID(transactionID)
+
+		// Transactions are limited in size; they can have at most 50 PDUs and 100 EDUs.
+		// https://matrix.org/docs/spec/server_server/latest#transactions
+		if len(transaction.PDUs) > 50 || len(transaction.EDUs) > 100 {
+			log.Printf(
+				"complement: Transaction '%s': Transaction too large. PDUs: %d/50, EDUs: %d/100",
+				transaction.TransactionID, len(transaction.PDUs), len(transaction.EDUs),
+			)
+
+			errResp := util.MessageResponse(400, "Transactions are limited to 50 PDUs and 100 EDUs")
+			w.WriteHeader(errResp.Code)
+			b, _ := json.Marshal(errResp.JSON)
+			w.Write(b)
+			return
+		}
+
+		// Construct a response and fill as we process each PDU
+		response := fclient.RespSend{}
+		response.PDUs = make(map[string]fclient.PDUResult)
+		// the PDUs to store once the whole transaction has been processed, if callbackBeforeStore is set
+		var accepted []acceptedPDU
+		for _, pdu := range transaction.PDUs {
+			var header struct {
+				RoomID string `json:"room_id"`
+			}
+			if err = json.Unmarshal(pdu, &header); err != nil {
+				log.Printf("complement: Transaction '%s': Failed to extract room ID from event: %s", transaction.TransactionID, err.Error())
+
+				// We don't know the event ID at this point so we can't return the
+				// failure in the PDU results
+				continue
 			}
 
-			// Unmarshal the request body into a transaction object
-			var transaction gomatrixserverlib.Transaction
-			err := json.Unmarshal(fedReq.Content(), &transaction)
+			// Retrieve the room version from the server
+			room := srv.rooms[header.RoomID]
+			if room == nil {
+				// An invalid room ID may have been provided
+				log.Printf("complement: Transaction '%s': Failed to find local room: %s", transaction.TransactionID, header.RoomID)
+				continue
+			}
+
+			var event gomatrixserverlib.PDU
+			verImpl, err := gomatrixserverlib.GetRoomVersion(room.Version)
 			if err != nil {
 				log.Printf(
-					"complement: Transaction '%s': Unable to unmarshal transaction body bytes into Transaction object: %s",
+					"complement: Transaction '%s': Failed to get room version: %s",
 					transaction.TransactionID, err.Error(),
 				)
-
-				errResp := util.MessageResponse(400, err.Error())
-				w.WriteHeader(errResp.Code)
-				b, _ := json.Marshal(errResp.JSON)
-				w.Write(b)
-				return
+				continue
 			}
-			transaction.TransactionID = gomatrixserverlib.TransactionID(transactionID)
 
-			// Transactions are limited in size; they can have at most 50 PDUs and 100 EDUs.
-			// https://matrix.org/docs/spec/server_server/latest#transactions
-			if len(transaction.PDUs) > 50 || len(transaction.EDUs) > 100 {
+			srv.validateInboundPDU(req.Context(), room, pdu)
+			event, err = verImpl.NewEventFromUntrustedJSON(pdu)
+			if err != nil {
+				// We were unable to verify or process this event.
 				log.Printf(
-					"complement: Transaction '%s': Transaction too large. PDUs: %d/50, EDUs: %d/100",
-					transaction.TransactionID, len(transaction.PDUs), len(transaction.EDUs),
+					"complement: Transaction '%s': Unable to process event: %s",
+					transaction.TransactionID, err.Error(),
 				)
 
-				errResp := util.MessageResponse(400, "Transactions are limited to 50 PDUs and 100 EDUs")
-				w.WriteHeader(errResp.Code)
-				b, _ := json.Marshal(errResp.JSON)
-				w.Write(b)
-				return
+				// We still don't know the event ID, and cannot add the failure to the PDU results
+				continue
 			}
 
-			// Construct a response and fill as we process each PDU
-			response := fclient.RespSend{}
-			response.PDUs = make(map[string]fclient.PDUResult)
-			for _, pdu := range transaction.PDUs {
-				var header struct {
-					RoomID string `json:"room_id"`
-				}
-				if err = json.Unmarshal(pdu, &header); err != nil {
-					log.Printf("complement: Transaction '%s': Failed to extract room ID from event: %s", transaction.TransactionID, err.Error())
-
-					// We don't know the event ID at this point so we can't return the
-					// failure in the PDU results
-					continue
-				}
+			if !callbackBeforeStore {
+				// Store this PDU in the room's timeline
+				room.AddEvent(event)
+			}
 
-				// Retrieve the room version from the server
-				room := srv.rooms[header.RoomID]
-				if room == nil {
-					// An invalid room ID may have been provided
-					log.Printf("complement: Transaction '%s': Failed to find local room: %s", transaction.TransactionID, header.RoomID)
+			// Run the PDU callback function with this event
+			if pduCallback != nil {
+				if err = pduCallback(event); err != nil {
+					var txnErr *TransactionError
+					if errors.As(err, &txnErr) {
+						failTransaction(w, transaction.TransactionID, txnErr)
+						return
+					}
+					// Add this PDU as a failure to the response
+					response.PDUs[event.EventID()] = fclient.PDUResult{Error: err.Error()}
 					continue
 				}
+			}
 
-				var event gomatrixserverlib.PDU
-				verImpl, err := gomatrixserverlib.GetRoomVersion(room.Version)
-				if err != nil {
-					log.Printf(
-						"complement: Transaction '%s': Failed to get room version: %s",
-						transaction.TransactionID, err.Error(),
-					)
-					continue
-				}
+			if callbackBeforeStore {
+				accepted = append(accepted, acceptedPDU{room: room, event: event})
+			}
 
-				event, err = verImpl.NewEventFromUntrustedJSON(pdu)
-				if err != nil {
-					// We were unable to verify or process this event.
-					log.Printf(
-						"complement: Transaction '%s': Unable to process event '%s': %s",
-						transaction.TransactionID, event.EventID(), err.Error(),
-					)
+			// Add this PDU as a success to the response
+			response.PDUs[event.EventID()] = fclient.PDUResult{}
+		}
 
-					// We still don't know the event ID, and cannot add the failure to the PDU results
-					continue
+		for _, edu := range transaction.EDUs {
+			srv.validateInboundEDU(fedReq.Origin(), edu)
+			// Run the EDU callback function with this EDU
+			if eduCallback != nil {
+				if err = eduCallback(edu); err != nil {
+					var txnErr *TransactionError
+					if errors.As(err, &txnErr) {
+						failTransaction(w, transaction.TransactionID, txnErr)
+						return
+					}
+					log.Printf("complement: Transaction '%s': EDU callback failed for %s: %s", transaction.TransactionID, edu.Type, err)
 				}
+			}
+		}
 
-				// Store this PDU in the room's timeline
-				room.AddEvent(event)
+		for _, a := range accepted {
+			a.room.AddEvent(a.event)
+		}
 
-				// Add this PDU as a success to the response
-				response.PDUs[event.EventID()] = fclient.PDUResult{}
+		resp, err := json.Marshal(response)
+		if err != nil {
+			log.Printf("complement: Transaction '%s': Failed to marshal JSON response: %s", transaction.TransactionID, err.Error())
+			w.WriteHeader(500)
+			w.Write([]byte(fmt.Sprintf(`complement: failed to marshal JSON response: %s`, err)))
+			return
+		}
+		srv.transactionSucceeded(fedReq.Origin(), transaction.TransactionID, resp)
+		w.WriteHeader(200)
+		w.Write(resp)
+	})).Methods("PUT")
+}
 
-				// Run the PDU callback function with this event
-				if pduCallback != nil {
-					pduCallback(event)
-				}
-			}
+// failTransaction responds to a /send request with the status code and error in txnErr.
+func failTransaction(w http.ResponseWriter, txnID gomatrixserverlib.TransactionID, txnErr *TransactionError) {
+	log.Printf("complement: Transaction '%s': %s", txnID, txnErr)
+	writeJSONResponse(w, util.JSONResponse{
+		Code: txnErr.StatusCode,
+		JSON: spec.MatrixError{
+			ErrCode: spec.MatrixErrorCode(txnErr.errCode()),
+			Err:     txnErr.Message,
+		},
+	})
+}
 
-			for _, edu := range transaction.EDUs {
-				// Run the EDU callback function with this EDU
-				if eduCallback != nil {
-					eduCallback(edu)
-				}
-			}
+// writeJSONResponse sends the given response as JSON.
+func writeJSONResponse(w http.ResponseWriter, res util.JSONResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.Code)
+	b, _ := json.Marshal(res.JSON)
+	w.Write(b)
+}
 
-			resp, err := json.Marshal(response)
-			if err != nil {
-				log.Printf("complement: Transaction '%s': Failed to marshal JSON response: %s", transaction.TransactionID, err.Error())
-				w.WriteHeader(500)
-				w.Write([]byte(fmt.Sprintf(`complement: failed to marshal JSON response: %s`, err)))
-				return
-			}
-			w.WriteHeader(200)
-			w.Write(resp)
-		})).Methods("PUT")
+// requestQuery returns the query parameters of a verified federation request.
+func requestQuery(fr *fclient.FederationRequest) url.Values {
+	u, err := url.Parse(fr.RequestURI())
+	if err != nil {
+		return url.Values{}
 	}
+	return u.Query()
 }
@@ -0,0 +1,375 @@
+package federation
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal"
+)
+
+// ProxyRule controls when a Fault is injected into federation traffic passing through a Proxy.
+type ProxyRule struct {
+	// Only requests from this server are affected, based on the X-Matrix Authorization header.
+	// If empty, requests from all servers are affected.
+	From spec.ServerName
+	// Only requests to this server are affected. If empty, requests to all servers are affected.
+	To spec.ServerName
+	// Only requests with this HTTP method are affected. If empty, all methods are affected.
+	Method string
+	// Only requests whose path matches this regular expression are affected e.g `^/_matrix/federation/v1/send/`.
+	// If empty, all paths are affected.
+	PathRegexp string
+	// The fault to inject. The `next` handler forwards the request to the destination server.
+	Fault Fault
+	// If non-zero, the fault is only injected into the first `Times` matching requests, after which
+	// requests are forwarded normally.
+	Times int
+
+	pathRegexp *regexp.Regexp
+	matched    int
+}
+
+// ProxyRuleID identifies a rule added via Proxy.AddRule.
+type ProxyRuleID int
+
+// ProxiedRequest is a federation request which passed through a Proxy.
+type ProxiedRequest struct {
+	ReceivedRequest
+	// The server the request was sent to.
+	Destination spec.ServerName
+	// The HTTP status code of the response, or 0 if the request has not completed or no response was sent.
+	StatusCode int
+	// The response body which was sent to the requesting server.
+	ResponseBody []byte
+}
+
+func (r ProxiedRequest) String() string {
+	return fmt.Sprintf("%s %s from '%s' to '%s' at %s => %d", r.Method, r.Path, r.Origin, r.Destination, r.Time.Format(time.StampMilli), r.StatusCode)
+}
+
+// EXPERIMENTAL
+// Proxy intercepts federation traffic between homeservers in a deployment. Requests to each
+// homeserver are re-terminated using a certificate derived from the Complement CA, recorded, and then
+// forwarded to the real homeserver unless a ProxyRule says otherwise. Use Deployment.FederationProxy
+// to route traffic through a proxy.
+type Proxy struct {
+	t          ct.TestLike
+	deployment FederationDeployment
+
+	mu          sync.Mutex
+	rules       []proxyRuleWithID
+	ruleCounter int
+	requests    []*ProxiedRequest
+	servers     map[spec.ServerName]*http.Server
+}
+
+type proxyRuleWithID struct {
+	id   ProxyRuleID
+	rule *ProxyRule
+}
+
+// NewProxy creates a proxy which forwards requests using the round tripper of the deployment.
+// Call Listen to start intercepting traffic for a server.
+func NewProxy(t ct.TestLike, deployment FederationDeployment) *Proxy {
+	return &Proxy{
+		t:          t,
+		deployment: deployment,
+		servers:    make(map[spec.ServerName]*http.Server),
+	}
+}
+
+// Listen starts accepting traffic destined for `serverName`, which will be forwarded to the real server.
+// Returns the port on the host running Complement to which the traffic should be sent.
+func (p *Proxy) Listen(serverName spec.ServerName) (int, error) {
+	host := string(serverName)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	derBytes, priv, err := certificateFor(p.deployment.GetConfig(), []string{host})
+	if err != nil {
+		return 0, fmt.Errorf("Proxy.Listen: failed to create certificate for %s: %w", serverName, err)
+	}
+	ln, err := net.Listen("tcp", ":0") //nolint
+	if err != nil {
+		return 0, fmt.Errorf("Proxy.Listen: net.Listen failed: %w", err)
+	}
+	srv := &http.Server{
+		Handler: p.handler(serverName),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{derBytes},
+				PrivateKey:  priv,
+			}},
+		},
+	}
+	p.mu.Lock()
+	p.servers[serverName] = srv
+	p.mu.Unlock()
+	go func() {
+		err := srv.ServeTLS(ln, "", "")
+		if err != nil && err != http.ErrServerClosed {
+			p.t.Logf("Proxy.Listen: ServeTLS for %s failed: %s", serverName, err)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Close stops accepting traffic for all servers.
+func (p *Proxy) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for serverName, srv := range p.servers {
+		if err := srv.Close(); err != nil {
+			p.t.Logf("Proxy.Close: failed to close listener for %s: %s", serverName, err)
+		}
+	}
+	p.servers = make(map[spec.ServerName]*http.Server)
+}
+
+// Reset removes all rules and recorded requests, and logs to `t` from now on. Useful when the proxy is
+// reused between tests.
+func (p *Proxy) Reset(t ct.TestLike) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.t = t
+	p.rules = nil
+	p.requests = nil
+}
+
+// AddRule starts injecting a fault into matching requests. Rules are checked in the order they were
+// added, and only the first matching rule is applied. Returns an ID which can be used to remove the
+// rule via RemoveRule.
+func (p *Proxy) AddRule(rule ProxyRule) ProxyRuleID {
+	if rule.PathRegexp != "" {
+		var err error
+		rule.pathRegexp, err = regexp.Compile(rule.PathRegexp)
+		if err != nil {
+			ct.Fatalf(p.t, "Proxy.AddRule: invalid PathRegexp %q: %s", rule.PathRegexp, err)
+		}
+	}
+	if rule.Fault.Apply == nil {
+		ct.Fatalf(p.t, "Proxy.AddRule: rule has no Fault")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ruleCounter++
+	id := ProxyRuleID(p.ruleCounter)
+	p.rules = append(p.rules, proxyRuleWithID{id: id, rule: &rule})
+	return id
+}
+
+// RemoveRule stops injecting the fault added via AddRule.
+func (p *Proxy) RemoveRule(id ProxyRuleID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, r := range p.rules {
+		if r.id == id {
+			p.rules = append(p.rules[:i], p.rules[i+1:]...)
+			return
+		}
+	}
+}
+
+// ClearRules removes all rules, so all requests are forwarded normally.
+func (p *Proxy) ClearRules() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = nil
+}
+
+// Requests returns all requests which have passed through the proxy so far, in the order they arrived.
+func (p *Proxy) Requests() []ProxiedRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	reqs := make([]ProxiedRequest, len(p.requests))
+	for i, r := range p.requests {
+		reqs[i] = *r
+	}
+	return reqs
+}
+
+// ClearRequests forgets all requests recorded so far.
+func (p *Proxy) ClearRequests() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests = nil
+}
+
+// MustHaveProxied waits until a request to `to` matching `m` has passed through the proxy, and returns it.
+// If `to` is empty, requests to all servers are considered. Fails the test if no matching request is seen
+// within `timeout`.
+func (p *Proxy) MustHaveProxied(t ct.TestLike, to spec.ServerName, m RequestMatcher, timeout time.Duration) ProxiedRequest {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		matches := p.matchingRequests(t, to, m)
+		if len(matches) > 0 {
+			return matches[0]
+		}
+		if time.Now().After(deadline) {
+			ct.Fatalf(t, "MustHaveProxied: no request to '%s' matching %s within %v. Proxied:\n%s", to, m, timeout, p.requestSummary())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// MustNotHaveProxied waits for `duration` and fails the test if a request to `to` matching `m` passed
+// through the proxy, including any requests before this function was called.
+func (p *Proxy) MustNotHaveProxied(t ct.TestLike, to spec.ServerName, m RequestMatcher, duration time.Duration) {
+	t.Helper()
+	time.Sleep(duration)
+	matches := p.matchingRequests(t, to, m)
+	if len(matches) > 0 {
+		ct.Fatalf(t, "MustNotHaveProxied: %d requests to '%s' matching %s, first: %s", len(matches), to, m, matches[0])
+	}
+}
+
+func (p *Proxy) matchingRequests(t ct.TestLike, to spec.ServerName, m RequestMatcher) []ProxiedRequest {
+	t.Helper()
+	matches := m.matcher(t)
+	var matching []ProxiedRequest
+	for _, r := range p.Requests() {
+		if (to == "" || to == r.Destination) && matches(r.ReceivedRequest) {
+			matching = append(matching, r)
+		}
+	}
+	return matching
+}
+
+func (p *Proxy) requestSummary() string {
+	var sb strings.Builder
+	for _, r := range p.Requests() {
+		sb.WriteString("  " + r.String() + "\n")
+	}
+	return sb.String()
+}
+
+// matchRule returns the fault to apply to this request, if any.
+func (p *Proxy) matchRule(r *ProxiedRequest) (*Fault, ProxyRuleID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pr := range p.rules {
+		rule := pr.rule
+		if rule.From != "" && rule.From != r.Origin {
+			continue
+		}
+		if rule.To != "" && rule.To != r.Destination {
+			continue
+		}
+		if rule.Method != "" && rule.Method != r.Method {
+			continue
+		}
+		if rule.pathRegexp != nil && !rule.pathRegexp.MatchString(r.Path) {
+			continue
+		}
+		if rule.Times > 0 && rule.matched >= rule.Times {
+			continue
+		}
+		rule.matched++
+		return &rule.Fault, pr.id
+	}
+	return nil, 0
+}
+
+// handler records requests to `destination`, applies any matching rule and forwards the request.
+func (p *Proxy) handler(destination spec.ServerName) http.Handler {
+	forward := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		outReq, err := http.NewRequestWithContext(req.Context(), req.Method, "https://"+string(destination)+req.URL.RequestURI(), req.Body)
+		if err != nil {
+			w.WriteHeader(502)
+			w.Write([]byte("complement: proxy failed to create request: " + err.Error()))
+			return
+		}
+		outReq.Header = req.Header.Clone()
+		outReq.ContentLength = req.ContentLength
+		res, err := p.deployment.RoundTripper().RoundTrip(outReq)
+		if err != nil {
+			w.WriteHeader(502)
+			w.Write([]byte("complement: proxy failed to forward request: " + err.Error()))
+			return
+		}
+		defer internal.CloseIO(res.Body, "Proxy: response body")
+		for k, v := range res.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rr, err := newReceivedRequest(req)
+		if err != nil {
+			p.t.Logf("[proxy %s] %s", destination, err)
+		}
+		proxied := &ProxiedRequest{
+			ReceivedRequest: rr,
+			Destination:     destination,
+		}
+		p.mu.Lock()
+		p.requests = append(p.requests, proxied)
+		t := p.t
+		p.mu.Unlock()
+
+		capture := &capturingResponseWriter{ResponseWriter: w, mu: &p.mu, req: proxied}
+		fault, id := p.matchRule(proxied)
+		if fault == nil {
+			forward.ServeHTTP(capture, req)
+			return
+		}
+		t.Logf("[proxy] injecting fault '%s' into %s (rule %d)", fault.Description, proxied, id)
+		fault.Apply(capture, req, forward)
+	})
+}
+
+// capturingResponseWriter records the status code and body written into the ProxiedRequest, as they
+// are written. It supports hijacking so that faults like FaultConnectionReset work.
+type capturingResponseWriter struct {
+	http.ResponseWriter
+	mu          *sync.Mutex
+	req         *ProxiedRequest
+	wroteHeader bool
+}
+
+func (w *capturingResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.mu.Lock()
+		w.req.StatusCode = code
+		w.mu.Unlock()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *capturingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	w.mu.Lock()
+	w.req.ResponseBody = append(w.req.ResponseBody, b...)
+	w.mu.Unlock()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *capturingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *capturingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("capturingResponseWriter: underlying ResponseWriter cannot be hijacked")
+	}
+	return hj.Hijack()
+}
@@ -51,6 +51,8 @@ type Server struct {
 	// Default: true
 	UnexpectedRequestsAreErrors bool
 
+	// The key this server signs with. These are replaced by RotateSigningKey, so must not be read while
+	// another goroutine may be rotating the key.
 	Priv  ed25519.PrivateKey
 	KeyID gomatrixserverlib.KeyID
 	// The homeserver name. This should be a resolvable address in the deployment network
@@ -66,11 +68,85 @@ type Server struct {
 	aliases               map[string]string
 	rooms                 map[string]*ServerRoom
 	keyRing               *gomatrixserverlib.KeyRing
+	keyFetcher            *basicKeyFetcher
+	keyClient             *fclient.Client
+
+	// protects key rotation state. Priv and KeyID are also only modified with this held.
+	keysMu        sync.RWMutex
+	oldKeys       map[gomatrixserverlib.KeyID]oldSigningKey
+	keyValidUntil time.Time
+	notaryKeys    map[spec.ServerName]gomatrixserverlib.ServerKeys
+
+	queues   []*TransactionQueue
+	queuesMu sync.Mutex
+
+	// set if this server shares a listener with other servers. See VirtualHost.
+	virtualHost *VirtualHost
+
+	faultsMu         sync.Mutex
+	faultRules       []faultRuleWithID
+	faultRuleCounter int
+
+	receivedMu sync.Mutex
+	received   []ReceivedRequest
+
+	// used to lazily create queues e.g for device list updates
+	deployment FederationDeployment
+
+	directoryMu    sync.Mutex
+	profiles       map[string]fclient.RespProfile
+	publishedRooms []string
+	openIDTokens   map[string]string // token -> user ID
+
+	devicesMu         sync.Mutex
+	deviceLists       map[string]*userDeviceList // user ID -> devices and keys
+	deviceListQueue   *TransactionQueue
+	oneTimeKeyCounter int
+
+	// protects transactions received via /send. See Retransmissions.
+	transactionsMu  sync.Mutex
+	transactions    map[string]*receivedTransaction // origin|txn ID -> transaction
+	retransmissions []Retransmission
+
+	// set via WithStrictValidation
+	strictValidation bool
+	// set via WithServerName, in which case Listen does not add the port to the server name
+	fixedServerName bool
 }
 
 // EXPERIMENTAL
 // NewServer creates a new federation server with configured options.
 func NewServer(t ct.TestLike, deployment FederationDeployment, opts ...func(*Server)) *Server {
+	srv := newServer(t, deployment, deployment.GetConfig().HostnameRunningComplement)
+
+	// generate certs and an http.Server
+	httpServer, certPath, keyPath, err := federationServer(deployment.GetConfig(), srv)
+	if err != nil {
+		ct.Fatalf(t, "complement: unable to create federation server and certificates: %s", err.Error())
+	}
+	srv.certPath = certPath
+	srv.keyPath = keyPath
+	srv.srv = httpServer
+
+	for _, opt := range opts {
+		opt(srv)
+	}
+	return srv
+}
+
+// WithServerName is an option which sets the server name, instead of using the hostname and port
+// of the listener. The server is only reachable at this name if something routes requests for it to
+// the server, such as DNSServer.Route. Useful for testing server discovery.
+func WithServerName(serverName spec.ServerName) func(*Server) {
+	return func(s *Server) {
+		s.serverName = serverName
+		s.fixedServerName = true
+	}
+}
+
+// newServer creates a federation server which will be reachable at `hostname`, without any
+// way of listening for requests.
+func newServer(t ct.TestLike, deployment FederationDeployment, hostname string) *Server {
 	// generate signing key
 	pub, priv, err := ed25519.GenerateKey(nil)
 	if err != nil {
@@ -84,16 +160,24 @@ func NewServer(t ct.TestLike, deployment FederationDeployment, opts ...func(*Ser
 		mux:   mux.NewRouter(),
 		// The server name will be updated when the caller calls Listen() to include the port number
 		// of the HTTP server e.g "host.docker.internal:56353"
-		serverName:                  spec.ServerName(deployment.GetConfig().HostnameRunningComplement),
+		serverName:                  spec.ServerName(hostname),
 		rooms:                       make(map[string]*ServerRoom),
 		aliases:                     make(map[string]string),
+		oldKeys:                     make(map[gomatrixserverlib.KeyID]oldSigningKey),
+		notaryKeys:                  make(map[spec.ServerName]gomatrixserverlib.ServerKeys),
+		deviceLists:                 make(map[string]*userDeviceList),
+		profiles:                    make(map[string]fclient.RespProfile),
+		openIDTokens:                make(map[string]string),
+		transactions:                make(map[string]*receivedTransaction),
+		deployment:                  deployment,
 		UnexpectedRequestsAreErrors: true,
+		keyClient: fclient.NewClient(
+			fclient.WithTransport(deployment.RoundTripper()),
+		),
 	}
 	fetcher := &basicKeyFetcher{
 		KeyFetcher: &gomatrixserverlib.DirectKeyFetcher{
-			Client: fclient.NewClient(
-				fclient.WithTransport(deployment.RoundTripper()),
-			),
+			Client: srv.keyClient,
 			IsLocalServerName: func(s spec.ServerName) bool {
 				return s == spec.ServerName(deployment.GetConfig().HostnameRunningComplement)
 			},
@@ -101,6 +185,7 @@ func NewServer(t ct.TestLike, deployment FederationDeployment, opts ...func(*Ser
 		},
 		srv: srv,
 	}
+	srv.keyFetcher = fetcher
 	srv.keyRing = &gomatrixserverlib.KeyRing{
 		KeyDatabase: &nopKeyDatabase{},
 		KeyFetchers: []gomatrixserverlib.KeyFetcher{
@@ -124,19 +209,6 @@ func NewServer(t ct.TestLike, deployment FederationDeployment, opts ...func(*Ser
 		w.WriteHeader(404)
 		w.Write([]byte("complement: federation server is not listening for this path"))
 	})
-
-	// generate certs and an http.Server
-	httpServer, certPath, keyPath, err := federationServer(deployment.GetConfig(), srv.mux)
-	if err != nil {
-		ct.Fatalf(t, "complement: unable to create federation server and certificates: %s", err.Error())
-	}
-	srv.certPath = certPath
-	srv.keyPath = keyPath
-	srv.srv = httpServer
-
-	for _, opt := range opts {
-		opt(srv)
-	}
 	return srv
 }
 
@@ -225,10 +297,11 @@ func (s *Server) FederationClient(deployment FederationDeployment) fclient.Feder
 	if !s.listening {
 		ct.Fatalf(s.t, "FederationClient() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the server name and thus changes the way federation requests are signed. Ensure you Listen() first!")
 	}
+	keyID, priv := s.signingKey()
 	identity := fclient.SigningIdentity{
 		ServerName: s.ServerName(),
-		KeyID:      s.KeyID,
-		PrivateKey: s.Priv,
+		KeyID:      keyID,
+		PrivateKey: priv,
 	}
 	fedClient := fclient.NewFederationClient(
 		[]*fclient.SigningIdentity{&identity},
@@ -274,7 +347,8 @@ func (s *Server) SendFederationRequest(
 	req fclient.FederationRequest,
 	resBody interface{},
 ) error {
-	if err := req.Sign(spec.ServerName(s.serverName), s.KeyID, s.Priv); err != nil {
+	keyID, priv := s.signingKey()
+	if err := req.Sign(spec.ServerName(s.serverName), keyID, priv); err != nil {
 		return err
 	}
 
@@ -306,7 +380,8 @@ func (s *Server) DoFederationRequest(
 	t ct.TestLike,
 	deployment FederationDeployment,
 	req fclient.FederationRequest) (*http.Response, error) {
-	if err := req.Sign(spec.ServerName(s.serverName), s.KeyID, s.Priv); err != nil {
+	keyID, priv := s.signingKey()
+	if err := req.Sign(spec.ServerName(s.serverName), keyID, priv); err != nil {
 		return nil, err
 	}
 
@@ -381,8 +456,7 @@ func (s *Server) MustJoinRoom(t ct.TestLike, deployment FederationDeployment, re
 	}
 
 	var senderID spec.SenderID
-	signingKey := s.Priv
-	keyID := s.KeyID
+	keyID, signingKey := s.signingKey()
 	origOrigin := origin
 	switch roomVer {
 	case gomatrixserverlib.RoomVersionPseudoIDs:
@@ -397,7 +471,8 @@ func (s *Server) MustJoinRoom(t ct.TestLike, deployment FederationDeployment, re
 			UserRoomKey: senderID,
 			UserID:      userID,
 		}
-		if err = mapping.Sign(origOrigin, s.KeyID, s.Priv); err != nil {
+		serverKeyID, serverKey := s.signingKey()
+		if err = mapping.Sign(origOrigin, serverKeyID, serverKey); err != nil {
 			ct.Fatalf(t, "MustJoinRoom: failed signing mxid_mapping: %v", err)
 		}
 
@@ -443,7 +518,8 @@ func (s *Server) MustJoinRoom(t ct.TestLike, deployment FederationDeployment, re
 	return room
 }
 
-// Leaves a room. If this is rejecting an invite then a make_leave request is made first, before send_leave.
+// Leaves a room. If this server is not in the room, e.g when rejecting an invite or rescinding a knock, then a
+// make_leave request is made first, before send_leave.
 //
 // Args:
 //   - `remoteServer`: This should be a resolvable addresses within the deployment network.
@@ -454,7 +530,8 @@ func (s *Server) MustLeaveRoom(t ct.TestLike, deployment FederationDeployment, r
 	var leaveEvent gomatrixserverlib.PDU
 	room := s.rooms[roomID]
 	if room == nil {
-		// e.g rejecting an invite
+		// e.g rejecting an invite or rescinding a knock. This server doesn't know the state of the room, so
+		// ask the remote server to make the leave event.
 		makeLeaveResp, err := fedClient.MakeLeave(context.Background(), origin, remoteServer, roomID, userID)
 		if err != nil {
 			ct.Fatalf(t, "MustLeaveRoom: (rejecting invite) make_leave failed: %v", err)
@@ -464,7 +541,8 @@ func (s *Server) MustLeaveRoom(t ct.TestLike, deployment FederationDeployment, r
 			ct.Fatalf(t, "MustLeaveRoom: invalid room version: %v", err)
 		}
 		eb := verImpl.NewEventBuilderFromProtoEvent(&makeLeaveResp.LeaveEvent)
-		leaveEvent, err = eb.Build(time.Now(), origin, s.KeyID, s.Priv)
+		keyID, priv := s.signingKey()
+		leaveEvent, err = eb.Build(time.Now(), origin, keyID, priv)
 		if err != nil {
 			ct.Fatalf(t, "MustLeaveRoom: (rejecting invite) failed to sign event: %v", err)
 		}
@@ -483,12 +561,54 @@ func (s *Server) MustLeaveRoom(t ct.TestLike, deployment FederationDeployment, r
 	if err != nil {
 		ct.Fatalf(t, "MustLeaveRoom: send_leave failed: %v", err)
 	}
-	room.AddEvent(leaveEvent)
-	s.rooms[roomID] = room
+	if room != nil {
+		room.AddEvent(leaveEvent)
+	}
 
 	t.Logf("Server.MustLeaveRoom left room ID %s", roomID)
 }
 
+// MustKnockRoom will make the server send a make_knock and a send_knock to knock on a room.
+// It returns the resultant room, which only contains the knock event unless this server was already
+// in the room, along with the stripped state returned by the remote server. The room is not added to
+// this server unless it was already in the room, as the server doesn't know its state. Use MustLeaveRoom
+// to rescind the knock.
+//
+// Args:
+//   - `remoteServer`: This should be a resolvable addresses within the deployment network.
+func (s *Server) MustKnockRoom(t ct.TestLike, deployment FederationDeployment, remoteServer spec.ServerName, roomID string, userID string) (*ServerRoom, []gomatrixserverlib.InviteStrippedState) {
+	t.Helper()
+	origin := spec.ServerName(s.serverName)
+	fedClient := s.FederationClient(deployment)
+	makeKnockResp, err := fedClient.MakeKnock(context.Background(), origin, remoteServer, roomID, userID, SupportedRoomVersions())
+	if err != nil {
+		ct.Fatalf(t, "MustKnockRoom: make_knock failed: %v", err)
+	}
+	verImpl, err := gomatrixserverlib.GetRoomVersion(makeKnockResp.RoomVersion)
+	if err != nil {
+		ct.Fatalf(t, "MustKnockRoom: invalid room version: %v", err)
+	}
+	eb := verImpl.NewEventBuilderFromProtoEvent(&makeKnockResp.KnockEvent)
+	keyID, priv := s.signingKey()
+	knockEvent, err := eb.Build(time.Now(), origin, keyID, priv)
+	if err != nil {
+		ct.Fatalf(t, "MustKnockRoom: failed to sign event: %v", err)
+	}
+	sendKnockResp, err := fedClient.SendKnock(context.Background(), origin, remoteServer, knockEvent)
+	if err != nil {
+		ct.Fatalf(t, "MustKnockRoom: send_knock failed: %v", err)
+	}
+	room := s.rooms[roomID]
+	if room == nil {
+		room = NewServerRoom(makeKnockResp.RoomVersion, roomID)
+	}
+	room.AddEvent(knockEvent)
+
+	t.Logf("Server.MustKnockRoom knocked on room ID %s", roomID)
+
+	return room, sendKnockResp.KnockRoomState
+}
+
 // ValidFederationRequest is a wrapper around http.HandlerFunc which automatically validates the incoming
 // federation request and supports sending back JSON. Fails the test if the request is not valid.
 func (s *Server) ValidFederationRequest(t ct.TestLike, handler func(fr *fclient.FederationRequest, pathParams map[string]string) util.JSONResponse) http.HandlerFunc {
@@ -523,6 +643,12 @@ func (s *Server) ValidFederationRequest(t ct.TestLike, handler func(fr *fclient.
 	}
 }
 
+// ServeHTTP processes an incoming request to this server, recording it in the request log and
+// injecting any faults added via AddFaultRule.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.recordRequests(s.injectFaults(s.mux)).ServeHTTP(w, req)
+}
+
 // Mux returns this server's router so you can attach additional paths.
 func (s *Server) Mux() *mux.Router {
 	return s.mux
@@ -533,6 +659,9 @@ func (s *Server) Listen() (cancel func()) {
 	if s.listening {
 		return
 	}
+	if s.virtualHost != nil {
+		return s.virtualHost.listen(s)
+	}
 	var wg sync.WaitGroup
 	wg.Add(1)
 
@@ -541,7 +670,9 @@ func (s *Server) Listen() (cancel func()) {
 		ct.Fatalf(s.t, "ListenFederationServer: net.Listen failed: %s", err)
 	}
 	port := ln.Addr().(*net.TCPAddr).Port
-	s.serverName = spec.ServerName(fmt.Sprintf("%s:%d", s.serverName, port))
+	if !s.fixedServerName {
+		s.serverName = spec.ServerName(fmt.Sprintf("%s:%d", s.serverName, port))
+	}
 	s.listening = true
 
 	go func() {
@@ -556,6 +687,7 @@ func (s *Server) Listen() (cancel func()) {
 	}()
 
 	return func() {
+		s.closeQueues()
 		err := s.srv.Close()
 		if err != nil {
 			ct.Fatalf(s.t, "ListenFederationServer: failed to shutdown server: %s", err)
@@ -564,6 +696,15 @@ func (s *Server) Listen() (cancel func()) {
 	}
 }
 
+// closeQueues stops sending transactions. This should be done before we stop listening.
+func (s *Server) closeQueues() {
+	s.queuesMu.Lock()
+	defer s.queuesMu.Unlock()
+	for _, q := range s.queues {
+		q.Close()
+	}
+}
+
 type joinRoom struct {
 	partialState bool
 	roomOpts     []ServerRoomOpt
@@ -586,26 +727,64 @@ func WithRoomOpts(opts ...ServerRoomOpt) JoinRoomOpt {
 	}
 }
 
-// federationServer creates a federation server with the given handler
-func federationServer(cfg *config.Complement, h http.Handler) (*http.Server, string, string, error) {
-	var derBytes []byte
+// federationServer creates a federation server with the given handler. The certificate is valid for
+// HostnameRunningComplement and any `extraHostnames`.
+func federationServer(cfg *config.Complement, h http.Handler, extraHostnames ...string) (*http.Server, string, string, error) {
 	srv := &http.Server{
 		Addr:    ":8448",
 		Handler: h,
 	}
 	tlsCertPath := path.Join(os.TempDir(), "complement.crt")
 	tlsKeyPath := path.Join(os.TempDir(), "complement.key")
+	if len(extraHostnames) > 0 {
+		// don't clobber the certificate used by regular servers
+		tlsCertPath = path.Join(os.TempDir(), "complement-virtual.crt")
+		tlsKeyPath = path.Join(os.TempDir(), "complement-virtual.key")
+	}
+	derBytes, priv, err := certificateFor(cfg, append([]string{cfg.HostnameRunningComplement}, extraHostnames...))
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	certOut, err := os.Create(tlsCertPath)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer certOut.Close() // nolint: errcheck
+	if err = pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
+		return nil, "", "", err
+	}
+
+	keyOut, err := os.OpenFile(tlsKeyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer keyOut.Close() // nolint: errcheck
+	err = pem.Encode(keyOut, &pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return srv, tlsCertPath, tlsKeyPath, nil
+}
+
+// certificateFor creates a certificate derived from the Complement CA which is valid for the given
+// hostnames. The first hostname is used as the common name.
+func certificateFor(cfg *config.Complement, hostnames []string) ([]byte, *rsa.PrivateKey, error) {
 	certificateDuration := time.Hour
 	priv, err := rsa.GenerateKey(rand.Reader, 4096)
 	if err != nil {
-		return nil, "", "", err
+		return nil, nil, err
 	}
 	notBefore := time.Now()
 	notAfter := notBefore.Add(certificateDuration)
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		return nil, "", "", err
+		return nil, nil, err
 	}
 
 	template := x509.Certificate{
@@ -622,45 +801,23 @@ func federationServer(cfg *config.Complement, h http.Handler) (*http.Server, str
 			Locality:      []string{"London"},
 			StreetAddress: []string{"123 Street"},
 			PostalCode:    []string{"12345"},
-			CommonName:    cfg.HostnameRunningComplement,
+			CommonName:    hostnames[0],
 		},
 	}
-	host := cfg.HostnameRunningComplement
-	if ip := net.ParseIP(host); ip != nil {
-		template.IPAddresses = append(template.IPAddresses, ip)
-	} else {
-		template.DNSNames = append(template.DNSNames, host)
+	for _, host := range hostnames {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
 	}
 
 	// derive a new certificate from the base complement one
-	derBytes, err = x509.CreateCertificate(rand.Reader, &template, cfg.CACertificate, &priv.PublicKey, cfg.CAPrivateKey)
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, cfg.CACertificate, &priv.PublicKey, cfg.CAPrivateKey)
 	if err != nil {
-		return nil, "", "", err
-	}
-
-	certOut, err := os.Create(tlsCertPath)
-	if err != nil {
-		return nil, "", "", err
-	}
-	defer certOut.Close() // nolint: errcheck
-	if err = pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
-		return nil, "", "", err
-	}
-
-	keyOut, err := os.OpenFile(tlsKeyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return nil, "", "", err
+		return nil, nil, err
 	}
-	defer keyOut.Close() // nolint: errcheck
-	err = pem.Encode(keyOut, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(priv),
-	})
-	if err != nil {
-		return nil, "", "", err
-	}
-
-	return srv, tlsCertPath, tlsKeyPath, nil
+	return derBytes, priv, nil
 }
 
 type nopKeyDatabase struct {
@@ -692,19 +849,25 @@ func (f *basicKeyFetcher) FetchKeys(
 	map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error,
 ) {
 	result := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(requests))
-	for req := range requests {
-		if req.ServerName == f.srv.serverName && req.KeyID == f.srv.KeyID {
-			publicKey := f.srv.Priv.Public().(ed25519.PublicKey)
-			result[req] = gomatrixserverlib.PublicKeyLookupResult{
-				ValidUntilTS: spec.AsTimestamp(time.Now().Add(24 * time.Hour)),
-				ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
-				VerifyKey: gomatrixserverlib.VerifyKey{
-					Key: spec.Base64Bytes(publicKey),
-				},
+	remoteRequests := make(map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp)
+	for req, ts := range requests {
+		if req.ServerName == f.srv.serverName {
+			if res, ok := f.srv.lookupOwnKey(req.KeyID); ok {
+				result[req] = res
+				continue
 			}
-		} else {
-			return f.KeyFetcher.FetchKeys(ctx, requests)
 		}
+		remoteRequests[req] = ts
+	}
+	if len(remoteRequests) == 0 {
+		return result, nil
+	}
+	remoteResult, err := f.KeyFetcher.FetchKeys(ctx, remoteRequests)
+	if err != nil {
+		return nil, err
+	}
+	for req, res := range remoteResult {
+		result[req] = res
 	}
 	return result, nil
 }
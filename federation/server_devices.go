@@ -0,0 +1,576 @@
+package federation
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// Device is a device belonging to a user on this server. Create devices with Server.MustAddDevice.
+type Device struct {
+	UserID      string
+	DeviceID    string
+	DisplayName string
+	// The signed device keys, as returned in /user/keys/query and /user/devices.
+	Keys fclient.RespUserDeviceKeys
+	// The ed25519 private key of this device, which signs the device keys and one-time keys.
+	Priv ed25519.PrivateKey
+}
+
+// userDeviceList is the device/key store for a single user.
+type userDeviceList struct {
+	// incremented every time the device list changes
+	streamID        int64
+	devices         map[string]*Device
+	masterKey       *fclient.CrossSigningKey
+	selfSigningKey  *fclient.CrossSigningKey
+	selfSigningPriv ed25519.PrivateKey
+	// device ID -> algorithm:key ID -> key
+	oneTimeKeys  map[string]map[string]json.RawMessage
+	fallbackKeys map[string]map[string]json.RawMessage
+}
+
+func (s *Server) deviceList(userID string) *userDeviceList {
+	dl, ok := s.deviceLists[userID]
+	if !ok {
+		dl = &userDeviceList{
+			devices:      make(map[string]*Device),
+			oneTimeKeys:  make(map[string]map[string]json.RawMessage),
+			fallbackKeys: make(map[string]map[string]json.RawMessage),
+		}
+		s.deviceLists[userID] = dl
+	}
+	return dl
+}
+
+// MustAddDevice adds a device with freshly generated ed25519 and curve25519 keys for the given user.
+// If the device already exists, its keys are replaced. A m.device_list_update EDU is sent to all servers
+// which share a room with the user.
+func (s *Server) MustAddDevice(t ct.TestLike, userID, deviceID, displayName string) *Device {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		ct.Fatalf(t, "MustAddDevice: failed to generate ed25519 key: %s", err)
+	}
+	curveKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		ct.Fatalf(t, "MustAddDevice: failed to generate curve25519 key: %s", err)
+	}
+	dev := &Device{
+		UserID:      userID,
+		DeviceID:    deviceID,
+		DisplayName: displayName,
+		Priv:        priv,
+		Keys: fclient.RespUserDeviceKeys{
+			UserID:   userID,
+			DeviceID: deviceID,
+			Algorithms: []string{
+				"m.olm.v1.curve25519-aes-sha2",
+				"m.megolm.v1.aes-sha2",
+			},
+			Keys: map[gomatrixserverlib.KeyID]spec.Base64Bytes{
+				gomatrixserverlib.KeyID("ed25519:" + deviceID):    spec.Base64Bytes(pub),
+				gomatrixserverlib.KeyID("curve25519:" + deviceID): spec.Base64Bytes(curveKey.PublicKey().Bytes()),
+			},
+		},
+	}
+	s.devicesMu.Lock()
+	dl := s.deviceList(userID)
+	if err = signDeviceKeys(dev, dl); err != nil {
+		s.devicesMu.Unlock()
+		ct.Fatalf(t, "MustAddDevice: %s", err)
+	}
+	dl.devices[deviceID] = dev
+	edu := s.deviceListUpdateEDU(dl, dev, false)
+	s.devicesMu.Unlock()
+
+	s.emitDeviceKeyEDUs(userID, edu)
+	return dev
+}
+
+// MustSetDeviceDisplayName changes the display name of a device added via MustAddDevice, and sends
+// a m.device_list_update EDU to all servers which share a room with the user.
+func (s *Server) MustSetDeviceDisplayName(t ct.TestLike, userID, deviceID, displayName string) {
+	t.Helper()
+	s.devicesMu.Lock()
+	dl := s.deviceList(userID)
+	dev, ok := dl.devices[deviceID]
+	if !ok {
+		s.devicesMu.Unlock()
+		ct.Fatalf(t, "MustSetDeviceDisplayName: unknown device %s for %s", deviceID, userID)
+	}
+	dev.DisplayName = displayName
+	edu := s.deviceListUpdateEDU(dl, dev, false)
+	s.devicesMu.Unlock()
+
+	s.emitDeviceKeyEDUs(userID, edu)
+}
+
+// MustDeleteDevice removes a device added via MustAddDevice along with its one-time and fallback keys,
+// and sends a m.device_list_update EDU with `deleted: true` to all servers which share a room with the user.
+func (s *Server) MustDeleteDevice(t ct.TestLike, userID, deviceID string) {
+	t.Helper()
+	s.devicesMu.Lock()
+	dl := s.deviceList(userID)
+	dev, ok := dl.devices[deviceID]
+	if !ok {
+		s.devicesMu.Unlock()
+		ct.Fatalf(t, "MustDeleteDevice: unknown device %s for %s", deviceID, userID)
+	}
+	delete(dl.devices, deviceID)
+	delete(dl.oneTimeKeys, deviceID)
+	delete(dl.fallbackKeys, deviceID)
+	edu := s.deviceListUpdateEDU(dl, dev, true)
+	s.devicesMu.Unlock()
+
+	s.emitDeviceKeyEDUs(userID, edu)
+}
+
+// MustAddCrossSigningKeys generates master and self-signing keys for the given user, replacing any
+// existing keys. The self-signing key is signed by the master key, and all existing devices are
+// re-signed by the self-signing key. A m.signing_key_update EDU and m.device_list_update EDUs for each
+// device are sent to all servers which share a room with the user.
+func (s *Server) MustAddCrossSigningKeys(t ct.TestLike, userID string) (masterKey, selfSigningKey fclient.CrossSigningKey) {
+	t.Helper()
+	masterPub, masterPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		ct.Fatalf(t, "MustAddCrossSigningKeys: failed to generate master key: %s", err)
+	}
+	sskPub, sskPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		ct.Fatalf(t, "MustAddCrossSigningKeys: failed to generate self-signing key: %s", err)
+	}
+	masterKey = fclient.CrossSigningKey{
+		UserID: userID,
+		Usage:  []fclient.CrossSigningKeyPurpose{fclient.CrossSigningKeyPurposeMaster},
+		Keys: map[gomatrixserverlib.KeyID]spec.Base64Bytes{
+			crossSigningKeyID(masterPub): spec.Base64Bytes(masterPub),
+		},
+	}
+	selfSigningKey = fclient.CrossSigningKey{
+		UserID: userID,
+		Usage:  []fclient.CrossSigningKeyPurpose{fclient.CrossSigningKeyPurposeSelfSigning},
+		Keys: map[gomatrixserverlib.KeyID]spec.Base64Bytes{
+			crossSigningKeyID(sskPub): spec.Base64Bytes(sskPub),
+		},
+	}
+	if err = signObject(&selfSigningKey, userID, crossSigningKeyID(masterPub), masterPriv); err != nil {
+		ct.Fatalf(t, "MustAddCrossSigningKeys: failed to sign self-signing key: %s", err)
+	}
+
+	s.devicesMu.Lock()
+	dl := s.deviceList(userID)
+	dl.masterKey = &masterKey
+	dl.selfSigningKey = &selfSigningKey
+	dl.selfSigningPriv = sskPriv
+	edus := []gomatrixserverlib.EDU{s.signingKeyUpdateEDU(userID, dl)}
+	for _, deviceID := range sortedDeviceIDs(dl) {
+		dev := dl.devices[deviceID]
+		if err = signDeviceKeys(dev, dl); err != nil {
+			s.devicesMu.Unlock()
+			ct.Fatalf(t, "MustAddCrossSigningKeys: %s", err)
+		}
+		edus = append(edus, s.deviceListUpdateEDU(dl, dev, false))
+	}
+	s.devicesMu.Unlock()
+
+	s.emitDeviceKeyEDUs(userID, edus...)
+	return masterKey, selfSigningKey
+}
+
+// MustAddOneTimeKeys generates `count` signed_curve25519 one-time keys for the given device, which can
+// be claimed via /user/keys/claim. Each key can only be claimed once. Returns the generated keys, keyed
+// by "signed_curve25519:<key ID>".
+func (s *Server) MustAddOneTimeKeys(t ct.TestLike, userID, deviceID string, count int) map[string]json.RawMessage {
+	t.Helper()
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	dl := s.deviceList(userID)
+	dev, ok := dl.devices[deviceID]
+	if !ok {
+		ct.Fatalf(t, "MustAddOneTimeKeys: unknown device %s for %s", deviceID, userID)
+	}
+	if dl.oneTimeKeys[deviceID] == nil {
+		dl.oneTimeKeys[deviceID] = make(map[string]json.RawMessage)
+	}
+	keys := make(map[string]json.RawMessage, count)
+	for i := 0; i < count; i++ {
+		algKeyID, key, err := s.generateCurve25519Key(dev, false)
+		if err != nil {
+			ct.Fatalf(t, "MustAddOneTimeKeys: %s", err)
+		}
+		dl.oneTimeKeys[deviceID][algKeyID] = key
+		keys[algKeyID] = key
+	}
+	return keys
+}
+
+// MustSetFallbackKey generates a signed_curve25519 fallback key for the given device, replacing any
+// existing fallback key. The fallback key is returned from /user/keys/claim when the device has no
+// one-time keys left, and is not removed when claimed.
+func (s *Server) MustSetFallbackKey(t ct.TestLike, userID, deviceID string) (algKeyID string, key json.RawMessage) {
+	t.Helper()
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	dl := s.deviceList(userID)
+	dev, ok := dl.devices[deviceID]
+	if !ok {
+		ct.Fatalf(t, "MustSetFallbackKey: unknown device %s for %s", deviceID, userID)
+	}
+	algKeyID, key, err := s.generateCurve25519Key(dev, true)
+	if err != nil {
+		ct.Fatalf(t, "MustSetFallbackKey: %s", err)
+	}
+	dl.fallbackKeys[deviceID] = map[string]json.RawMessage{
+		algKeyID: key,
+	}
+	return algKeyID, key
+}
+
+// OneTimeKeyCount returns the number of unclaimed one-time keys for the given device.
+func (s *Server) OneTimeKeyCount(userID, deviceID string) int {
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	return len(s.deviceList(userID).oneTimeKeys[deviceID])
+}
+
+// DeviceListStreamID returns the current device list stream ID for the given user, as returned in
+// /user/devices and m.device_list_update EDUs. Returns 0 if the user's device list has never changed.
+func (s *Server) DeviceListStreamID(userID string) int64 {
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	return s.deviceList(userID).streamID
+}
+
+// DeviceListQueue returns the queue used to send device list EDUs to other servers, so tests can wait
+// for them to be delivered. The server must be listening.
+func (s *Server) DeviceListQueue() *TransactionQueue {
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	if s.deviceListQueue == nil {
+		s.deviceListQueue = s.NewTransactionQueue(s.deployment)
+	}
+	return s.deviceListQueue
+}
+
+// deviceListUpdateEDU bumps the stream ID for the user and returns the EDU describing the change.
+// The caller must hold devicesMu.
+func (s *Server) deviceListUpdateEDU(dl *userDeviceList, dev *Device, deleted bool) gomatrixserverlib.EDU {
+	update := gomatrixserverlib.DeviceListUpdateEvent{
+		UserID:   dev.UserID,
+		DeviceID: dev.DeviceID,
+		Deleted:  deleted,
+	}
+	if dl.streamID > 0 {
+		update.PrevID = []int64{dl.streamID}
+	}
+	dl.streamID++
+	update.StreamID = dl.streamID
+	if !deleted {
+		update.DeviceDisplayName = dev.DisplayName
+		update.Keys, _ = json.Marshal(dev.Keys)
+	}
+	content, _ := json.Marshal(update)
+	return gomatrixserverlib.EDU{
+		Type:    "m.device_list_update",
+		Origin:  string(s.serverName),
+		Content: content,
+	}
+}
+
+// signingKeyUpdateEDU returns a m.signing_key_update EDU for the user's cross-signing keys.
+// The caller must hold devicesMu.
+func (s *Server) signingKeyUpdateEDU(userID string, dl *userDeviceList) gomatrixserverlib.EDU {
+	content, _ := json.Marshal(struct {
+		UserID         string                   `json:"user_id"`
+		MasterKey      *fclient.CrossSigningKey `json:"master_key,omitempty"`
+		SelfSigningKey *fclient.CrossSigningKey `json:"self_signing_key,omitempty"`
+	}{
+		UserID:         userID,
+		MasterKey:      dl.masterKey,
+		SelfSigningKey: dl.selfSigningKey,
+	})
+	return gomatrixserverlib.EDU{
+		Type:    "m.signing_key_update",
+		Origin:  string(s.serverName),
+		Content: content,
+	}
+}
+
+// emitDeviceKeyEDUs sends the EDUs to every other server which shares a room with the user.
+func (s *Server) emitDeviceKeyEDUs(userID string, edus ...gomatrixserverlib.EDU) {
+	if !s.listening {
+		// no rooms can exist yet, so there is nobody to tell
+		return
+	}
+	destinations := s.serversSharingRoomsWith(userID)
+	if len(destinations) == 0 {
+		return
+	}
+	q := s.DeviceListQueue()
+	for _, dest := range destinations {
+		destEDUs := make([]gomatrixserverlib.EDU, len(edus))
+		for i, edu := range edus {
+			edu.Destination = string(dest)
+			destEDUs[i] = edu
+		}
+		q.QueueEDUs(dest, destEDUs...)
+	}
+}
+
+// serversSharingRoomsWith returns all other servers in rooms which the user has joined.
+func (s *Server) serversSharingRoomsWith(userID string) []spec.ServerName {
+	seen := make(map[spec.ServerName]bool)
+	var servers []spec.ServerName
+	for _, room := range s.rooms {
+		member := room.CurrentState(spec.MRoomMember, userID)
+		if member == nil {
+			continue
+		}
+		if membership, _ := member.Membership(); membership != spec.Join {
+			continue
+		}
+		for _, server := range room.ServersInRoom() {
+			if server == s.serverName || seen[server] {
+				continue
+			}
+			seen[server] = true
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// generateCurve25519Key generates a signed_curve25519 key for the device. The caller must hold devicesMu.
+func (s *Server) generateCurve25519Key(dev *Device, fallback bool) (string, json.RawMessage, error) {
+	curveKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate curve25519 key: %w", err)
+	}
+	s.oneTimeKeyCounter++
+	key := struct {
+		Key        spec.Base64Bytes                                        `json:"key"`
+		Fallback   bool                                                    `json:"fallback,omitempty"`
+		Signatures map[string]map[gomatrixserverlib.KeyID]spec.Base64Bytes `json:"signatures,omitempty"`
+	}{
+		Key:      spec.Base64Bytes(curveKey.PublicKey().Bytes()),
+		Fallback: fallback,
+	}
+	unsigned, err := json.Marshal(key)
+	if err != nil {
+		return "", nil, err
+	}
+	signed, err := gomatrixserverlib.SignJSON(dev.UserID, gomatrixserverlib.KeyID("ed25519:"+dev.DeviceID), dev.Priv, unsigned)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to sign curve25519 key: %w", err)
+	}
+	return fmt.Sprintf("signed_curve25519:AAAA%04d", s.oneTimeKeyCounter), signed, nil
+}
+
+// signDeviceKeys signs the device keys with the device key, and the user's self-signing key if there is one.
+func signDeviceKeys(dev *Device, dl *userDeviceList) error {
+	dev.Keys.Signatures = nil
+	if err := signObject(&dev.Keys, dev.UserID, gomatrixserverlib.KeyID("ed25519:"+dev.DeviceID), dev.Priv); err != nil {
+		return fmt.Errorf("failed to sign device keys: %w", err)
+	}
+	if dl.selfSigningKey == nil {
+		return nil
+	}
+	sskPub := dl.selfSigningPriv.Public().(ed25519.PublicKey)
+	if err := signObject(&dev.Keys, dev.UserID, crossSigningKeyID(sskPub), dl.selfSigningPriv); err != nil {
+		return fmt.Errorf("failed to sign device keys with self-signing key: %w", err)
+	}
+	return nil
+}
+
+// signObject signs the JSON form of `obj`, which must have a `Signatures` field, and adds the signature to it.
+func signObject(obj interface{}, signingName string, keyID gomatrixserverlib.KeyID, priv ed25519.PrivateKey) error {
+	unsigned, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	// SignJSON can't add to `"signatures": null`, which is how a nil map is marshalled.
+	if gjson.GetBytes(unsigned, "signatures").Type == gjson.Null {
+		if unsigned, err = sjson.DeleteBytes(unsigned, "signatures"); err != nil {
+			return err
+		}
+	}
+	signed, err := gomatrixserverlib.SignJSON(signingName, keyID, priv, unsigned)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(signed, obj)
+}
+
+func crossSigningKeyID(pub ed25519.PublicKey) gomatrixserverlib.KeyID {
+	return gomatrixserverlib.KeyID("ed25519:" + base64.RawStdEncoding.EncodeToString(pub))
+}
+
+func sortedDeviceIDs(dl *userDeviceList) []string {
+	deviceIDs := make([]string, 0, len(dl.devices))
+	for deviceID := range dl.devices {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	sort.Strings(deviceIDs)
+	return deviceIDs
+}
+
+// EXPERIMENTAL
+// HandleDeviceKeyRequests is an option which will process POST /_matrix/federation/v1/user/keys/query,
+// POST /_matrix/federation/v1/user/keys/claim and GET /_matrix/federation/v1/user/devices/{userID} requests
+// using the devices and keys added via Server.MustAddDevice, Server.MustAddCrossSigningKeys,
+// Server.MustAddOneTimeKeys and Server.MustSetFallbackKey.
+func HandleDeviceKeyRequests() func(*Server) {
+	return func(s *Server) {
+		s.mux.Handle("/_matrix/federation/v1/user/keys/query", s.ValidFederationRequest(s.t, func(fr *fclient.FederationRequest, pathParams map[string]string) util.JSONResponse {
+			var body struct {
+				DeviceKeys map[string][]string `json:"device_keys"`
+			}
+			if err := json.Unmarshal(fr.Content(), &body); err != nil {
+				return util.JSONResponse{
+					Code: 400,
+					JSON: spec.BadJSON("complement: HandleDeviceKeyRequests cannot parse /user/keys/query body: " + err.Error()),
+				}
+			}
+			resp := fclient.RespQueryKeys{
+				DeviceKeys:      make(map[string]map[string]fclient.DeviceKeys),
+				MasterKeys:      make(map[string]fclient.CrossSigningKey),
+				SelfSigningKeys: make(map[string]fclient.CrossSigningKey),
+			}
+			s.devicesMu.Lock()
+			defer s.devicesMu.Unlock()
+			for userID, deviceIDs := range body.DeviceKeys {
+				dl, ok := s.deviceLists[userID]
+				if !ok {
+					continue
+				}
+				resp.DeviceKeys[userID] = make(map[string]fclient.DeviceKeys)
+				for deviceID, dev := range dl.devices {
+					if len(deviceIDs) > 0 && !slices.Contains(deviceIDs, deviceID) {
+						continue
+					}
+					resp.DeviceKeys[userID][deviceID] = fclient.DeviceKeys{
+						RespUserDeviceKeys: dev.Keys,
+						Unsigned: map[string]interface{}{
+							"device_display_name": dev.DisplayName,
+						},
+					}
+				}
+				if dl.masterKey != nil {
+					resp.MasterKeys[userID] = *dl.masterKey
+				}
+				if dl.selfSigningKey != nil {
+					resp.SelfSigningKeys[userID] = *dl.selfSigningKey
+				}
+			}
+			return util.JSONResponse{
+				Code: 200,
+				JSON: resp,
+			}
+		})).Methods("POST")
+
+		s.mux.Handle("/_matrix/federation/v1/user/keys/claim", s.ValidFederationRequest(s.t, func(fr *fclient.FederationRequest, pathParams map[string]string) util.JSONResponse {
+			var body struct {
+				OneTimeKeys map[string]map[string]string `json:"one_time_keys"`
+			}
+			if err := json.Unmarshal(fr.Content(), &body); err != nil {
+				return util.JSONResponse{
+					Code: 400,
+					JSON: spec.BadJSON("complement: HandleDeviceKeyRequests cannot parse /user/keys/claim body: " + err.Error()),
+				}
+			}
+			resp := fclient.RespClaimKeys{
+				OneTimeKeys: make(map[string]map[string]map[string]json.RawMessage),
+			}
+			s.devicesMu.Lock()
+			defer s.devicesMu.Unlock()
+			for userID, devices := range body.OneTimeKeys {
+				dl, ok := s.deviceLists[userID]
+				if !ok {
+					continue
+				}
+				for deviceID, algorithm := range devices {
+					algKeyID, key := claimKey(dl, deviceID, algorithm)
+					if key == nil {
+						continue
+					}
+					if resp.OneTimeKeys[userID] == nil {
+						resp.OneTimeKeys[userID] = make(map[string]map[string]json.RawMessage)
+					}
+					resp.OneTimeKeys[userID][deviceID] = map[string]json.RawMessage{
+						algKeyID: key,
+					}
+				}
+			}
+			return util.JSONResponse{
+				Code: 200,
+				JSON: resp,
+			}
+		})).Methods("POST")
+
+		s.mux.Handle("/_matrix/federation/v1/user/devices/{userID}", s.ValidFederationRequest(s.t, func(fr *fclient.FederationRequest, pathParams map[string]string) util.JSONResponse {
+			userID := pathParams["userID"]
+			s.devicesMu.Lock()
+			defer s.devicesMu.Unlock()
+			dl := s.deviceList(userID)
+			resp := fclient.RespUserDevices{
+				UserID:         userID,
+				StreamID:       dl.streamID,
+				Devices:        []fclient.RespUserDevice{},
+				MasterKey:      dl.masterKey,
+				SelfSigningKey: dl.selfSigningKey,
+			}
+			for _, deviceID := range sortedDeviceIDs(dl) {
+				dev := dl.devices[deviceID]
+				resp.Devices = append(resp.Devices, fclient.RespUserDevice{
+					DeviceID:    dev.DeviceID,
+					DisplayName: dev.DisplayName,
+					Keys:        dev.Keys,
+				})
+			}
+			return util.JSONResponse{
+				Code: 200,
+				JSON: resp,
+			}
+		})).Methods("GET")
+	}
+}
+
+// claimKey removes and returns a one-time key for the device with the given algorithm, falling back
+// to the fallback key if there are no one-time keys left. The caller must hold devicesMu.
+func claimKey(dl *userDeviceList, deviceID, algorithm string) (string, json.RawMessage) {
+	prefix := algorithm + ":"
+	var candidates []string
+	for algKeyID := range dl.oneTimeKeys[deviceID] {
+		if strings.HasPrefix(algKeyID, prefix) {
+			candidates = append(candidates, algKeyID)
+		}
+	}
+	if len(candidates) > 0 {
+		sort.Strings(candidates)
+		key := dl.oneTimeKeys[deviceID][candidates[0]]
+		delete(dl.oneTimeKeys[deviceID], candidates[0])
+		return candidates[0], key
+	}
+	for algKeyID, key := range dl.fallbackKeys[deviceID] {
+		if strings.HasPrefix(algKeyID, prefix) {
+			return algKeyID, key
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,177 @@
+package federation
+
+import (
+	"encoding/json"
+	"slices"
+	"sort"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+// SetProfile sets the profile for a user on this server, which is returned from /query/profile
+// when using HandleProfileRequests. Empty fields are omitted from responses.
+func (s *Server) SetProfile(userID, displayName, avatarURL string) {
+	s.directoryMu.Lock()
+	defer s.directoryMu.Unlock()
+	s.profiles[userID] = fclient.RespProfile{
+		DisplayName: displayName,
+		AvatarURL:   avatarURL,
+	}
+}
+
+// PublishRoom adds a room on this server to the public room directory, which is returned from
+// /publicRooms when using HandlePublicRoomsRequests. Rooms are listed in the order they were published.
+func (s *Server) PublishRoom(roomID string) {
+	s.directoryMu.Lock()
+	defer s.directoryMu.Unlock()
+	if !slices.Contains(s.publishedRooms, roomID) {
+		s.publishedRooms = append(s.publishedRooms, roomID)
+	}
+}
+
+// UnpublishRoom removes a room from the public room directory.
+func (s *Server) UnpublishRoom(roomID string) {
+	s.directoryMu.Lock()
+	defer s.directoryMu.Unlock()
+	s.publishedRooms = slices.DeleteFunc(s.publishedRooms, func(id string) bool {
+		return id == roomID
+	})
+}
+
+// CreateOpenIDToken creates an OpenID access token for the given user, which can be exchanged for the
+// user ID via /openid/userinfo when using HandleOpenIDRequests.
+func (s *Server) CreateOpenIDToken(userID string) string {
+	s.directoryMu.Lock()
+	defer s.directoryMu.Unlock()
+	token := util.RandomString(24)
+	s.openIDTokens[token] = userID
+	return token
+}
+
+// PublicRoom returns a summary of the room based on its current state, as returned by /publicRooms.
+func (r *ServerRoom) PublicRoom() fclient.PublicRoom {
+	pr := fclient.PublicRoom{
+		RoomID:         r.RoomID,
+		Name:           r.stateContentString(spec.MRoomName, "name"),
+		Topic:          r.stateContentString(spec.MRoomTopic, "topic"),
+		CanonicalAlias: r.stateContentString(spec.MRoomCanonicalAlias, "alias"),
+		AvatarURL:      r.stateContentString(spec.MRoomAvatar, "url"),
+		JoinRule:       r.stateContentString(spec.MRoomJoinRules, "join_rule"),
+		RoomType:       r.stateContentString(spec.MRoomCreate, "type"),
+		WorldReadable:  r.stateContentString(spec.MRoomHistoryVisibility, "history_visibility") == "world_readable",
+		GuestCanJoin:   r.stateContentString(spec.MRoomGuestAccess, "guest_access") == "can_join",
+	}
+	r.StateMutex.RLock()
+	for _, ev := range r.State {
+		if ev.Type() != spec.MRoomMember {
+			continue
+		}
+		if membership, err := ev.Membership(); err == nil && membership == spec.Join {
+			pr.JoinedMembersCount++
+		}
+	}
+	r.StateMutex.RUnlock()
+	return pr
+}
+
+// stateContentString returns a string field from the content of a state event with an empty state key.
+func (r *ServerRoom) stateContentString(evType, field string) string {
+	ev := r.CurrentState(evType, "")
+	if ev == nil {
+		return ""
+	}
+	return gjson.GetBytes(ev.Content(), field).Str
+}
+
+// hierarchyRoom returns the room as it appears in a /hierarchy response.
+func (r *ServerRoom) hierarchyRoom(suggestedOnly bool) fclient.RoomHierarchyRoom {
+	pr := r.PublicRoom()
+	hr := fclient.RoomHierarchyRoom{
+		PublicRoom:    pr,
+		RoomType:      pr.RoomType,
+		ChildrenState: []fclient.RoomHierarchyStrippedEvent{},
+	}
+	for _, child := range r.spaceChildren(suggestedOnly) {
+		hr.ChildrenState = append(hr.ChildrenState, fclient.RoomHierarchyStrippedEvent{
+			Type:           child.Type(),
+			StateKey:       *child.StateKey(),
+			Content:        child.Content(),
+			Sender:         string(child.SenderID()),
+			OriginServerTS: child.OriginServerTS(),
+		})
+	}
+	if pr.JoinRule == spec.Restricted || pr.JoinRule == spec.KnockRestricted {
+		hr.AllowedRoomIDs = r.restrictedAllowedRoomIDs()
+	}
+	return hr
+}
+
+// spaceChildren returns the valid m.space.child events in this room, sorted by state key.
+// Children without a `via` are not valid, as they have been removed from the space.
+func (r *ServerRoom) spaceChildren(suggestedOnly bool) (children []gomatrixserverlib.PDU) {
+	r.StateMutex.RLock()
+	for _, ev := range r.State {
+		if ev.Type() != spec.MSpaceChild {
+			continue
+		}
+		content := gjson.ParseBytes(ev.Content())
+		if len(content.Get("via").Array()) == 0 {
+			continue
+		}
+		if suggestedOnly && !content.Get("suggested").Bool() {
+			continue
+		}
+		children = append(children, ev)
+	}
+	r.StateMutex.RUnlock()
+	sort.Slice(children, func(i, j int) bool {
+		return *children[i].StateKey() < *children[j].StateKey()
+	})
+	return
+}
+
+// restrictedAllowedRoomIDs returns the rooms in the `allow` list of the join rules.
+func (r *ServerRoom) restrictedAllowedRoomIDs() (roomIDs []string) {
+	ev := r.CurrentState(spec.MRoomJoinRules, "")
+	if ev == nil {
+		return nil
+	}
+	var content gomatrixserverlib.JoinRuleContent
+	if err := json.Unmarshal(ev.Content(), &content); err != nil {
+		return nil
+	}
+	for _, allow := range content.Allow {
+		if allow.Type == spec.MRoomMembership && allow.RoomID != "" {
+			roomIDs = append(roomIDs, allow.RoomID)
+		}
+	}
+	return
+}
+
+// roomAccessibleTo returns true if users on `server` could view or join the room, which determines
+// whether it is returned from /hierarchy.
+func (s *Server) roomAccessibleTo(room *ServerRoom, server spec.ServerName) bool {
+	if slices.Contains(room.ServersInRoom(), server) {
+		return true
+	}
+	pr := room.PublicRoom()
+	if pr.WorldReadable {
+		return true
+	}
+	switch pr.JoinRule {
+	case spec.Public, spec.Knock, spec.KnockRestricted:
+		return true
+	case spec.Restricted:
+		for _, roomID := range room.restrictedAllowedRoomIDs() {
+			allowRoom, ok := s.rooms[roomID]
+			if ok && slices.Contains(allowRoom.ServersInRoom(), server) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,278 @@
+package federation
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// Fault is something which goes wrong when processing a request. See FaultRule.
+type Fault struct {
+	// A human readable description of the fault, used when logging.
+	Description string
+	// Apply the fault to the request. `next` is the handler which would normally process the request,
+	// which the fault may or may not call.
+	Apply func(w http.ResponseWriter, req *http.Request, next http.Handler)
+}
+
+// FaultRule controls when a Fault is injected into requests to a Server.
+type FaultRule struct {
+	// Only requests with this HTTP method are affected. If empty, all methods are affected.
+	Method string
+	// Only requests whose path matches this regular expression are affected e.g `^/_matrix/federation/v1/send/`.
+	// If empty, all paths are affected.
+	PathRegexp string
+	// The fault to inject.
+	Fault Fault
+	// If non-zero, the fault is only injected into the first `Times` matching requests, after which
+	// requests are processed normally. To make a request succeed only on the Nth attempt, set this to N-1.
+	Times int
+
+	pathRegexp *regexp.Regexp
+	matched    int
+}
+
+// FaultRuleID identifies a rule added via Server.AddFaultRule.
+type FaultRuleID int
+
+// FaultLatency delays processing of the request by `d`, then processes the request normally.
+func FaultLatency(d time.Duration) Fault {
+	return Fault{
+		Description: fmt.Sprintf("latency %v", d),
+		Apply: func(w http.ResponseWriter, req *http.Request, next http.Handler) {
+			select {
+			case <-time.After(d):
+			case <-req.Context().Done():
+				return
+			}
+			next.ServeHTTP(w, req)
+		},
+	}
+}
+
+// FaultStatus responds with the given HTTP status code and a standard Matrix error body.
+func FaultStatus(code int) Fault {
+	return Fault{
+		Description: fmt.Sprintf("HTTP %d", code),
+		Apply: func(w http.ResponseWriter, req *http.Request, next http.Handler) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			w.Write([]byte(fmt.Sprintf(`{"errcode":"M_UNKNOWN","error":"complement: injected HTTP %d"}`, code)))
+		},
+	}
+}
+
+// FaultRateLimited responds with HTTP 429 M_LIMIT_EXCEEDED, asking the caller to retry after `retryAfter`.
+func FaultRateLimited(retryAfter time.Duration) Fault {
+	return Fault{
+		Description: fmt.Sprintf("HTTP 429 retry after %v", retryAfter),
+		Apply: func(w http.ResponseWriter, req *http.Request, next http.Handler) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+			w.WriteHeader(429)
+			w.Write([]byte(fmt.Sprintf(`{"errcode":"M_LIMIT_EXCEEDED","error":"complement: injected rate limit","retry_after_ms":%d}`, retryAfter.Milliseconds())))
+		},
+	}
+}
+
+// FaultConnectionReset closes the connection without sending a response.
+func FaultConnectionReset() Fault {
+	return Fault{
+		Description: "connection reset",
+		Apply: func(w http.ResponseWriter, req *http.Request, next http.Handler) {
+			if hj, ok := w.(http.Hijacker); ok {
+				conn, _, err := hj.Hijack()
+				if err == nil {
+					// Send a RST rather than a FIN if we can get at the TCP connection.
+					if tcpConn, ok := conn.(*net.TCPConn); ok {
+						tcpConn.SetLinger(0)
+					}
+					conn.Close()
+					return
+				}
+			}
+			// e.g HTTP/2, where the best we can do is abort the stream.
+			panic(http.ErrAbortHandler)
+		},
+	}
+}
+
+// FaultTruncatedBody processes the request normally, but only sends the first half of the response
+// body before closing the connection. The Content-Length header reflects the complete body.
+func FaultTruncatedBody() Fault {
+	return Fault{
+		Description: "truncated body",
+		Apply: func(w http.ResponseWriter, req *http.Request, next http.Handler) {
+			rec := httptest.NewRecorder()
+			next.ServeHTTP(rec, req)
+			body := rec.Body.Bytes()
+			for k, v := range rec.Header() {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.WriteHeader(rec.Code)
+			w.Write(body[:len(body)/2])
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			panic(http.ErrAbortHandler)
+		},
+	}
+}
+
+// FaultInvalidJSON responds with HTTP 200 and a body which is not valid JSON.
+func FaultInvalidJSON() Fault {
+	return Fault{
+		Description: "invalid JSON",
+		Apply: func(w http.ResponseWriter, req *http.Request, next http.Handler) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			w.Write([]byte(`{"complement": "this is not valid JSON`))
+		},
+	}
+}
+
+// FaultBlackhole never responds to the request, as if it was lost. The request is held open until the
+// caller gives up.
+func FaultBlackhole() Fault {
+	return Fault{
+		Description: "blackhole",
+		Apply: func(w http.ResponseWriter, req *http.Request, next http.Handler) {
+			<-req.Context().Done()
+		},
+	}
+}
+
+// FaultModifyRequest replaces the request body with the result of `modify` and then processes the
+// request normally. Modifying the body of a signed federation request invalidates the signature.
+func FaultModifyRequest(modify func(req *http.Request, body []byte) []byte) Fault {
+	return Fault{
+		Description: "modified request",
+		Apply: func(w http.ResponseWriter, req *http.Request, next http.Handler) {
+			var body []byte
+			if req.Body != nil {
+				body, _ = io.ReadAll(req.Body)
+			}
+			body = modify(req, body)
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+			next.ServeHTTP(w, req)
+		},
+	}
+}
+
+// FaultModifyResponse processes the request normally, then replaces the response status code and body
+// with the result of `modify`.
+func FaultModifyResponse(modify func(req *http.Request, code int, body []byte) (int, []byte)) Fault {
+	return Fault{
+		Description: "modified response",
+		Apply: func(w http.ResponseWriter, req *http.Request, next http.Handler) {
+			rec := httptest.NewRecorder()
+			next.ServeHTTP(rec, req)
+			code, body := modify(req, rec.Code, rec.Body.Bytes())
+			for k, v := range rec.Header() {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.WriteHeader(code)
+			w.Write(body)
+		},
+	}
+}
+
+// WithFaultRules is an option which adds the given fault rules to the server. See Server.AddFaultRule.
+func WithFaultRules(rules ...FaultRule) func(*Server) {
+	return func(s *Server) {
+		for _, rule := range rules {
+			s.AddFaultRule(rule)
+		}
+	}
+}
+
+// AddFaultRule starts injecting a fault into matching requests to this server. Rules are checked in
+// the order they were added, and only the first matching rule is applied. Can be called at any time.
+// Returns an ID which can be used to remove the rule via RemoveFaultRule.
+func (s *Server) AddFaultRule(rule FaultRule) FaultRuleID {
+	if rule.PathRegexp != "" {
+		var err error
+		rule.pathRegexp, err = regexp.Compile(rule.PathRegexp)
+		if err != nil {
+			ct.Fatalf(s.t, "AddFaultRule: invalid PathRegexp %q: %s", rule.PathRegexp, err)
+		}
+	}
+	if rule.Fault.Apply == nil {
+		ct.Fatalf(s.t, "AddFaultRule: rule has no Fault")
+	}
+	s.faultsMu.Lock()
+	defer s.faultsMu.Unlock()
+	s.faultRuleCounter++
+	id := FaultRuleID(s.faultRuleCounter)
+	s.faultRules = append(s.faultRules, faultRuleWithID{id: id, rule: &rule})
+	return id
+}
+
+// RemoveFaultRule stops injecting the fault added via AddFaultRule.
+func (s *Server) RemoveFaultRule(id FaultRuleID) {
+	s.faultsMu.Lock()
+	defer s.faultsMu.Unlock()
+	for i, r := range s.faultRules {
+		if r.id == id {
+			s.faultRules = append(s.faultRules[:i], s.faultRules[i+1:]...)
+			return
+		}
+	}
+}
+
+// ClearFaultRules removes all fault rules from this server, so all requests are processed normally.
+func (s *Server) ClearFaultRules() {
+	s.faultsMu.Lock()
+	defer s.faultsMu.Unlock()
+	s.faultRules = nil
+}
+
+type faultRuleWithID struct {
+	id   FaultRuleID
+	rule *FaultRule
+}
+
+// matchFaultRule returns the fault to apply to this request, if any.
+func (s *Server) matchFaultRule(req *http.Request) (*Fault, FaultRuleID, int) {
+	s.faultsMu.Lock()
+	defer s.faultsMu.Unlock()
+	for _, r := range s.faultRules {
+		rule := r.rule
+		if rule.Method != "" && rule.Method != req.Method {
+			continue
+		}
+		if rule.pathRegexp != nil && !rule.pathRegexp.MatchString(req.URL.Path) {
+			continue
+		}
+		if rule.Times > 0 && rule.matched >= rule.Times {
+			continue
+		}
+		rule.matched++
+		return &rule.Fault, r.id, rule.matched
+	}
+	return nil, 0, 0
+}
+
+// injectFaults is middleware which applies any matching fault rule to the request.
+func (s *Server) injectFaults(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fault, id, n := s.matchFaultRule(req)
+		if fault == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		s.t.Logf("[%s] injecting fault '%s' into %s %s (rule %d, match %d)", s.serverName, fault.Description, req.Method, req.URL.Path, id, n)
+		fault.Apply(w, req, next)
+	})
+}
@@ -0,0 +1,184 @@
+package federation
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// oldSigningKey is a key which this server used to sign with, but no longer does.
+type oldSigningKey struct {
+	public    ed25519.PublicKey
+	expiredTS spec.Timestamp
+}
+
+// WithPerspectiveKeyFetcher configures the server to fetch the keys of remote servers via the notary
+// `notaryServerName` rather than directly from the remote server. Responses from the notary must be
+// signed by one of `notaryKeys`. The keys of this server are always known locally and are never fetched.
+func WithPerspectiveKeyFetcher(notaryServerName spec.ServerName, notaryKeys map[gomatrixserverlib.KeyID]ed25519.PublicKey) func(*Server) {
+	return func(s *Server) {
+		s.keyFetcher.KeyFetcher = &gomatrixserverlib.PerspectiveKeyFetcher{
+			PerspectiveServerName: notaryServerName,
+			PerspectiveServerKeys: notaryKeys,
+			Client:                s.keyClient,
+		}
+	}
+}
+
+// RotateSigningKey generates a new signing key for this server and starts using it to sign events
+// and requests. The previous key is moved to `old_verify_keys` with an `expired_ts` of now.
+// Returns the key ID of the previous key.
+func (s *Server) RotateSigningKey(t ct.TestLike) gomatrixserverlib.KeyID {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		ct.Fatalf(t, "RotateSigningKey: failed to generate ed25519 key: %s", err)
+	}
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	oldKeyID := s.KeyID
+	s.oldKeys[oldKeyID] = oldSigningKey{
+		public:    s.Priv.Public().(ed25519.PublicKey),
+		expiredTS: spec.AsTimestamp(time.Now()),
+	}
+	s.Priv = priv
+	s.KeyID = gomatrixserverlib.KeyID(fmt.Sprintf("ed25519:complement_%x", pub))
+	t.Logf("Server.RotateSigningKey rotated %s to %s", oldKeyID, s.KeyID)
+	return oldKeyID
+}
+
+// signingKey returns the key this server currently signs with. Use this rather than reading KeyID and Priv
+// directly, as they are replaced by RotateSigningKey.
+func (s *Server) signingKey() (gomatrixserverlib.KeyID, ed25519.PrivateKey) {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+	return s.KeyID, s.Priv
+}
+
+// SetOldVerifyKeyExpiry changes the `expired_ts` of a key previously rotated out via RotateSigningKey.
+// Fails the test if the key ID is not an old key of this server.
+func (s *Server) SetOldVerifyKeyExpiry(t ct.TestLike, keyID gomatrixserverlib.KeyID, expiredTS time.Time) {
+	t.Helper()
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	oldKey, ok := s.oldKeys[keyID]
+	if !ok {
+		ct.Fatalf(t, "SetOldVerifyKeyExpiry: %s is not an old key of this server", keyID)
+	}
+	oldKey.expiredTS = spec.AsTimestamp(expiredTS)
+	s.oldKeys[keyID] = oldKey
+}
+
+// SetKeyValidUntil controls the `valid_until_ts` returned for this server's keys. By default, keys are
+// valid for 24 hours from the time they are requested. Pass the zero time to restore the default.
+func (s *Server) SetKeyValidUntil(validUntil time.Time) {
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	s.keyValidUntil = validUntil
+}
+
+// AddNotaryServerKeys makes this server return `keys` when it is asked for the keys of `keys.ServerName`
+// as a notary, instead of fetching them from that server. `keys.Raw` must be set and signed by the
+// server in question, unless the test wants the notary to return invalid keys. See HandleNotaryRequests.
+func (s *Server) AddNotaryServerKeys(keys gomatrixserverlib.ServerKeys) {
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	s.notaryKeys[keys.ServerName] = keys
+}
+
+// ServerKeys returns this server's current and old keys, signed by the current key.
+// This is the response to /_matrix/key/v2/server.
+func (s *Server) ServerKeys() (gomatrixserverlib.ServerKeys, error) {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+	k := gomatrixserverlib.ServerKeys{}
+	k.ServerName = s.serverName
+	k.VerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
+		s.KeyID: {
+			Key: spec.Base64Bytes(s.Priv.Public().(ed25519.PublicKey)),
+		},
+	}
+	k.OldVerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey{}
+	for keyID, oldKey := range s.oldKeys {
+		k.OldVerifyKeys[keyID] = gomatrixserverlib.OldVerifyKey{
+			VerifyKey: gomatrixserverlib.VerifyKey{
+				Key: spec.Base64Bytes(oldKey.public),
+			},
+			ExpiredTS: oldKey.expiredTS,
+		}
+	}
+	k.ValidUntilTS = s.validUntilTS()
+	toSign, err := json.Marshal(k.ServerKeyFields)
+	if err != nil {
+		return k, fmt.Errorf("cannot marshal serverkeyfields: %w", err)
+	}
+	k.Raw, err = gomatrixserverlib.SignJSON(string(s.serverName), s.KeyID, s.Priv, toSign)
+	if err != nil {
+		return k, fmt.Errorf("cannot sign json: %w", err)
+	}
+	return k, nil
+}
+
+// notaryServerKeys returns the keys for `serverName`, signed by this server acting as a notary.
+// Keys added via AddNotaryServerKeys are preferred, unless they expire before `minimumValidUntil`.
+func (s *Server) notaryServerKeys(ctx context.Context, serverName spec.ServerName, minimumValidUntil spec.Timestamp) (json.RawMessage, error) {
+	var keys gomatrixserverlib.ServerKeys
+	var err error
+	s.keysMu.RLock()
+	cached, ok := s.notaryKeys[serverName]
+	s.keysMu.RUnlock()
+	if serverName == s.serverName {
+		keys, err = s.ServerKeys()
+	} else if ok && cached.ValidUntilTS >= minimumValidUntil {
+		keys = cached
+	} else {
+		keys, err = s.keyClient.GetServerKeys(ctx, serverName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get keys for %s: %w", serverName, err)
+	}
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+	return gomatrixserverlib.SignJSON(string(s.serverName), s.KeyID, s.Priv, keys.Raw)
+}
+
+// lookupOwnKey returns the public key for one of this server's current or old keys.
+func (s *Server) lookupOwnKey(keyID gomatrixserverlib.KeyID) (gomatrixserverlib.PublicKeyLookupResult, bool) {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+	if keyID == s.KeyID {
+		return gomatrixserverlib.PublicKeyLookupResult{
+			ValidUntilTS: s.validUntilTS(),
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			VerifyKey: gomatrixserverlib.VerifyKey{
+				Key: spec.Base64Bytes(s.Priv.Public().(ed25519.PublicKey)),
+			},
+		}, true
+	}
+	oldKey, ok := s.oldKeys[keyID]
+	if !ok {
+		return gomatrixserverlib.PublicKeyLookupResult{}, false
+	}
+	return gomatrixserverlib.PublicKeyLookupResult{
+		ValidUntilTS: gomatrixserverlib.PublicKeyNotValid,
+		ExpiredTS:    oldKey.expiredTS,
+		VerifyKey: gomatrixserverlib.VerifyKey{
+			Key: spec.Base64Bytes(oldKey.public),
+		},
+	}, true
+}
+
+// validUntilTS must be called with keysMu held.
+func (s *Server) validUntilTS() spec.Timestamp {
+	if s.keyValidUntil.IsZero() {
+		return spec.AsTimestamp(time.Now().Add(24 * time.Hour))
+	}
+	return spec.AsTimestamp(s.keyValidUntil)
+}
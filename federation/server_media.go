@@ -0,0 +1,194 @@
+package federation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/image/draw"
+
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal"
+)
+
+// MediaOpt are options that can configure HandleMediaRequests
+type MediaOpt func(c *mediaConfig)
+
+type mediaConfig struct {
+	redirects bool
+}
+
+// WithMediaRedirects makes authenticated federation media requests respond with a `Location` part instead
+// of the media itself, which tells the requesting server to fetch the media from that URL. The URL is
+// served by this server without authentication.
+func WithMediaRedirects() MediaOpt {
+	return func(c *mediaConfig) {
+		c.redirects = true
+	}
+}
+
+// MultipartMedia is a parsed multipart/mixed response from /_matrix/federation/v1/media/download or
+// /_matrix/federation/v1/media/thumbnail.
+type MultipartMedia struct {
+	// The JSON metadata in the first part.
+	Metadata json.RawMessage
+	// The headers of the second part.
+	ContentType        string
+	ContentDisposition string
+	// If set, the media is not included in the response and must be fetched from this URL instead.
+	Location string
+	// The media itself, if Location is not set.
+	Body []byte
+}
+
+// ParseMultipartMedia parses an authenticated federation media response. The response body is consumed.
+func ParseMultipartMedia(resp *http.Response) (*MultipartMedia, error) {
+	defer internal.CloseIO(resp.Body, "ParseMultipartMedia: response body")
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("ParseMultipartMedia: invalid Content-Type: %w", err)
+	}
+	if mediaType != "multipart/mixed" {
+		return nil, fmt.Errorf("ParseMultipartMedia: Content-Type is %s, want multipart/mixed", mediaType)
+	}
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+	metadataPart, err := reader.NextPart()
+	if err != nil {
+		return nil, fmt.Errorf("ParseMultipartMedia: failed to read metadata part: %w", err)
+	}
+	if ct := metadataPart.Header.Get("Content-Type"); ct != "application/json" {
+		return nil, fmt.Errorf("ParseMultipartMedia: metadata part has Content-Type %s, want application/json", ct)
+	}
+	var media MultipartMedia
+	if media.Metadata, err = io.ReadAll(metadataPart); err != nil {
+		return nil, fmt.Errorf("ParseMultipartMedia: failed to read metadata part: %w", err)
+	}
+	if !json.Valid(media.Metadata) {
+		return nil, fmt.Errorf("ParseMultipartMedia: metadata part is not valid JSON: %s", string(media.Metadata))
+	}
+	mediaPart, err := reader.NextPart()
+	if err != nil {
+		return nil, fmt.Errorf("ParseMultipartMedia: failed to read media part: %w", err)
+	}
+	media.ContentType = mediaPart.Header.Get("Content-Type")
+	media.ContentDisposition = mediaPart.Header.Get("Content-Disposition")
+	media.Location = mediaPart.Header.Get("Location")
+	if media.Body, err = io.ReadAll(mediaPart); err != nil {
+		return nil, fmt.Errorf("ParseMultipartMedia: failed to read media part: %w", err)
+	}
+	if _, err = reader.NextPart(); err != io.EOF {
+		return nil, fmt.Errorf("ParseMultipartMedia: expected exactly 2 parts")
+	}
+	return &media, nil
+}
+
+// MustParseMultipartMedia is ParseMultipartMedia, but fails the test on error.
+func MustParseMultipartMedia(t ct.TestLike, resp *http.Response) *MultipartMedia {
+	t.Helper()
+	media, err := ParseMultipartMedia(resp)
+	if err != nil {
+		ct.Fatalf(t, "%s", err)
+	}
+	return media
+}
+
+// writeMultipartMedia writes an authenticated media response containing the media.
+func writeMultipartMedia(w http.ResponseWriter, header http.Header, body []byte) {
+	partHeader := textproto.MIMEHeader{}
+	partHeader.Set("Content-Type", header.Get("Content-Type"))
+	if cd := header.Get("Content-Disposition"); cd != "" {
+		partHeader.Set("Content-Disposition", cd)
+	}
+	writeMultipart(w, partHeader, body)
+}
+
+// writeMultipartRedirect writes an authenticated media response which redirects to `location`.
+func writeMultipartRedirect(w http.ResponseWriter, location string) {
+	partHeader := textproto.MIMEHeader{}
+	partHeader.Set("Location", location)
+	writeMultipart(w, partHeader, nil)
+}
+
+func writeMultipart(w http.ResponseWriter, partHeader textproto.MIMEHeader, body []byte) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	metadata, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": []string{"application/json"},
+	})
+	metadata.Write([]byte(`{}`))
+	part, _ := mw.CreatePart(partHeader)
+	part.Write(body)
+	mw.Close()
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.WriteHeader(200)
+	w.Write(buf.Bytes())
+}
+
+// thumbnail scales the image to the requested size. With method "crop" the image is scaled to cover
+// width x height and then cropped to exactly that size, otherwise it is scaled to fit within width x height.
+// Images are never scaled up. Returns the encoded thumbnail and its content type.
+func thumbnail(body []byte, contentType string, width, height int, method string) ([]byte, string, error) {
+	if width <= 0 || height <= 0 {
+		return nil, "", fmt.Errorf("invalid thumbnail size %dx%d", width, height)
+	}
+	var src image.Image
+	var err error
+	switch strings.Split(contentType, ";")[0] {
+	case "image/png":
+		src, err = png.Decode(bytes.NewReader(body))
+	case "image/jpeg":
+		src, err = jpeg.Decode(bytes.NewReader(body))
+	case "image/gif":
+		src, err = gif.Decode(bytes.NewReader(body))
+	default:
+		return nil, "", fmt.Errorf("cannot thumbnail media with Content-Type %s", contentType)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode %s: %w", contentType, err)
+	}
+
+	srcBounds := src.Bounds()
+	srcW, srcH := srcBounds.Dx(), srcBounds.Dy()
+	scaleW := float64(width) / float64(srcW)
+	scaleH := float64(height) / float64(srcH)
+	scale := min(scaleW, scaleH)
+	if method == "crop" {
+		scale = max(scaleW, scaleH)
+	}
+	scale = min(scale, 1)
+	scaledW := max(int(float64(srcW)*scale), 1)
+	scaledH := max(int(float64(srcH)*scale), 1)
+	dst := image.NewRGBA(image.Rect(0, 0, scaledW, scaledH))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, srcBounds, draw.Over, nil)
+
+	var out image.Image = dst
+	if method == "crop" && (scaledW > width || scaledH > height) {
+		cropW, cropH := min(scaledW, width), min(scaledH, height)
+		x0, y0 := (scaledW-cropW)/2, (scaledH-cropH)/2
+		out = dst.SubImage(image.Rect(x0, y0, x0+cropW, y0+cropH))
+	}
+
+	var buf bytes.Buffer
+	if strings.HasPrefix(contentType, "image/jpeg") {
+		err = jpeg.Encode(&buf, out, nil)
+		contentType = "image/jpeg"
+	} else {
+		err = png.Encode(&buf, out)
+		contentType = "image/png"
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	return buf.Bytes(), contentType, nil
+}
@@ -0,0 +1,323 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+const (
+	// Transactions are limited in size; they can have at most 50 PDUs and 100 EDUs.
+	// https://spec.matrix.org/v1.11/server-server-api/#transactions
+	maxPDUsPerTransaction = 50
+	maxEDUsPerTransaction = 100
+)
+
+// TransactionQueueOpt are options that can configure a TransactionQueue
+type TransactionQueueOpt func(q *TransactionQueue)
+
+// WithQueueBackoff configures the minimum and maximum delay between retries of a failed transaction.
+// The delay doubles after every failed attempt, starting at `min` and capped at `max`.
+// Defaults to 100ms and 5s respectively.
+func WithQueueBackoff(min, max time.Duration) TransactionQueueOpt {
+	return func(q *TransactionQueue) {
+		q.minBackoff = min
+		q.maxBackoff = max
+	}
+}
+
+// WithQueueRequestTimeout configures how long each /send attempt may take before it is considered
+// failed and retried. Defaults to 10s.
+func WithQueueRequestTimeout(timeout time.Duration) TransactionQueueOpt {
+	return func(q *TransactionQueue) {
+		q.requestTimeout = timeout
+	}
+}
+
+// DeliveryStatus is a snapshot of the state of the outbound queue for a single destination.
+type DeliveryStatus struct {
+	Destination spec.ServerName
+	// The number of PDUs/EDUs which have been queued but not yet successfully sent, including
+	// any which are part of the transaction currently being attempted.
+	PendingPDUs int
+	PendingEDUs int
+	// The number of PDUs/EDUs/transactions which have been successfully sent.
+	SentPDUs         int
+	SentEDUs         int
+	SentTransactions int
+	// The number of consecutive failed attempts for the transaction currently being sent.
+	// Reset to 0 when a transaction is sent successfully.
+	FailedAttempts int
+	// The total number of failed /send attempts to this destination.
+	TotalFailedAttempts int
+	// The error from the most recent failed attempt, if any.
+	LastError error
+	// When the next attempt will be made, if the queue is currently backing off.
+	NextRetry time.Time
+	// Errors returned in the /send response for individual PDUs, keyed by event ID.
+	// These are not retried as the transaction itself was accepted.
+	PDUErrors map[string]string
+}
+
+// EXPERIMENTAL
+// TransactionQueue sends PDUs and EDUs to remote servers in the background, batching them into
+// transactions and retrying with backoff until the destination accepts them. Ordering is preserved
+// per destination: a transaction is only sent once all earlier transactions to that destination
+// have been accepted. This mirrors how a real homeserver behaves when a remote is unreachable,
+// which allows tests to check that the homeserver under test catches up after e.g PauseServer/UnpauseServer.
+//
+// Create a queue with Server.NewTransactionQueue.
+type TransactionQueue struct {
+	srv            *Server
+	deployment     FederationDeployment
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+	requestTimeout time.Duration
+	txnCounter     atomic.Int64
+
+	mu           sync.Mutex
+	destinations map[spec.ServerName]*destinationQueue
+	closed       bool
+	stopCh       chan struct{}
+	wg           sync.WaitGroup
+}
+
+type destinationQueue struct {
+	q           *TransactionQueue
+	destination spec.ServerName
+	notifyCh    chan struct{}
+
+	mu          sync.Mutex
+	pendingPDUs []json.RawMessage
+	pendingEDUs []gomatrixserverlib.EDU
+	status      DeliveryStatus
+}
+
+// NewTransactionQueue creates a new outbound transaction queue for this server. The server must be
+// listening. The queue is stopped when the server stops listening, or by calling TransactionQueue.Close.
+//
+// The requests will be routed according to the deployment map in `deployment`.
+func (s *Server) NewTransactionQueue(deployment FederationDeployment, opts ...TransactionQueueOpt) *TransactionQueue {
+	if !s.listening {
+		ct.Fatalf(s.t, "NewTransactionQueue() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the server name and thus changes the origin of transactions. Ensure you Listen() first!")
+	}
+	q := &TransactionQueue{
+		srv:            s,
+		deployment:     deployment,
+		minBackoff:     100 * time.Millisecond,
+		maxBackoff:     5 * time.Second,
+		requestTimeout: 10 * time.Second,
+		destinations:   make(map[spec.ServerName]*destinationQueue),
+		stopCh:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	s.queuesMu.Lock()
+	s.queues = append(s.queues, q)
+	s.queuesMu.Unlock()
+	return q
+}
+
+// QueuePDUs adds the given PDUs to the end of the queue for `destination`. Returns immediately.
+func (q *TransactionQueue) QueuePDUs(destination spec.ServerName, pdus ...json.RawMessage) {
+	dq := q.destinationQueue(destination)
+	if dq == nil {
+		return
+	}
+	dq.mu.Lock()
+	dq.pendingPDUs = append(dq.pendingPDUs, pdus...)
+	dq.status.PendingPDUs = len(dq.pendingPDUs)
+	dq.mu.Unlock()
+	dq.notify()
+}
+
+// QueueEDUs adds the given EDUs to the end of the queue for `destination`. Returns immediately.
+func (q *TransactionQueue) QueueEDUs(destination spec.ServerName, edus ...gomatrixserverlib.EDU) {
+	dq := q.destinationQueue(destination)
+	if dq == nil {
+		return
+	}
+	dq.mu.Lock()
+	dq.pendingEDUs = append(dq.pendingEDUs, edus...)
+	dq.status.PendingEDUs = len(dq.pendingEDUs)
+	dq.mu.Unlock()
+	dq.notify()
+}
+
+// Status returns a snapshot of the delivery status for `destination`.
+func (q *TransactionQueue) Status(destination spec.ServerName) DeliveryStatus {
+	q.mu.Lock()
+	dq := q.destinations[destination]
+	q.mu.Unlock()
+	if dq == nil {
+		return DeliveryStatus{Destination: destination}
+	}
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	status := dq.status
+	status.PDUErrors = make(map[string]string, len(dq.status.PDUErrors))
+	for k, v := range dq.status.PDUErrors {
+		status.PDUErrors[k] = v
+	}
+	return status
+}
+
+// MustWaitUntilEmpty blocks until everything queued for `destination` has been sent successfully.
+// Fails the test if this does not happen within `timeout`.
+func (q *TransactionQueue) MustWaitUntilEmpty(t ct.TestLike, destination spec.ServerName, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		status := q.Status(destination)
+		if status.PendingPDUs == 0 && status.PendingEDUs == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			ct.Fatalf(t, "TransactionQueue.MustWaitUntilEmpty: timed out after %v waiting for %s: %d PDUs and %d EDUs still pending after %d failed attempts, last error: %v",
+				timeout, destination, status.PendingPDUs, status.PendingEDUs, status.FailedAttempts, status.LastError)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Close stops the queue. Anything which has not been sent yet is discarded.
+func (q *TransactionQueue) Close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.stopCh)
+	q.mu.Unlock()
+	q.wg.Wait()
+}
+
+func (q *TransactionQueue) destinationQueue(destination spec.ServerName) *destinationQueue {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		q.srv.t.Logf("TransactionQueue: dropping events for %s as the queue is closed", destination)
+		return nil
+	}
+	dq, ok := q.destinations[destination]
+	if ok {
+		return dq
+	}
+	dq = &destinationQueue{
+		q:           q,
+		destination: destination,
+		notifyCh:    make(chan struct{}, 1),
+		status: DeliveryStatus{
+			Destination: destination,
+			PDUErrors:   make(map[string]string),
+		},
+	}
+	q.destinations[destination] = dq
+	q.wg.Add(1)
+	go dq.run()
+	return dq
+}
+
+func (dq *destinationQueue) notify() {
+	select {
+	case dq.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// run sends transactions to the destination until the queue is closed.
+func (dq *destinationQueue) run() {
+	defer dq.q.wg.Done()
+	for {
+		select {
+		case <-dq.q.stopCh:
+			return
+		case <-dq.notifyCh:
+		}
+		for {
+			dq.mu.Lock()
+			numPDUs := min(len(dq.pendingPDUs), maxPDUsPerTransaction)
+			numEDUs := min(len(dq.pendingEDUs), maxEDUsPerTransaction)
+			pdus := dq.pendingPDUs[:numPDUs]
+			edus := dq.pendingEDUs[:numEDUs]
+			dq.mu.Unlock()
+			if numPDUs == 0 && numEDUs == 0 {
+				break
+			}
+			if !dq.sendUntilSuccess(pdus, edus) {
+				return // the queue was closed
+			}
+			dq.mu.Lock()
+			dq.pendingPDUs = dq.pendingPDUs[numPDUs:]
+			dq.pendingEDUs = dq.pendingEDUs[numEDUs:]
+			dq.status.PendingPDUs = len(dq.pendingPDUs)
+			dq.status.PendingEDUs = len(dq.pendingEDUs)
+			dq.status.SentPDUs += numPDUs
+			dq.status.SentEDUs += numEDUs
+			dq.status.SentTransactions++
+			dq.mu.Unlock()
+		}
+	}
+}
+
+// sendUntilSuccess sends a single transaction, retrying with the same transaction ID until it is accepted.
+// Returns false if the queue was closed before the transaction was accepted.
+func (dq *destinationQueue) sendUntilSuccess(pdus []json.RawMessage, edus []gomatrixserverlib.EDU) bool {
+	q := dq.q
+	txn := gomatrixserverlib.Transaction{
+		TransactionID:  gomatrixserverlib.TransactionID(fmt.Sprintf("complement-q-%d-%d", time.Now().UnixNano(), q.txnCounter.Add(1))),
+		Origin:         q.srv.serverName,
+		Destination:    dq.destination,
+		OriginServerTS: spec.AsTimestamp(time.Now()),
+		PDUs:           pdus,
+		EDUs:           edus,
+	}
+	backoff := q.minBackoff
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), q.requestTimeout)
+		// make a new client for each attempt so transactions are signed with the current key, which may
+		// have been rotated since the transaction was first sent
+		resp, err := q.srv.FederationClient(q.deployment).SendTransaction(ctx, txn)
+		cancel()
+		if err == nil {
+			dq.mu.Lock()
+			dq.status.FailedAttempts = 0
+			dq.status.NextRetry = time.Time{}
+			for eventID, res := range resp.PDUs {
+				if res.Error != "" {
+					dq.status.PDUErrors[eventID] = res.Error
+				}
+			}
+			dq.mu.Unlock()
+			return true
+		}
+		dq.mu.Lock()
+		dq.status.FailedAttempts++
+		dq.status.TotalFailedAttempts++
+		dq.status.LastError = err
+		dq.status.NextRetry = time.Now().Add(backoff)
+		attempts := dq.status.FailedAttempts
+		dq.mu.Unlock()
+		q.srv.t.Logf("TransactionQueue: transaction %s to %s failed (attempt %d), retrying in %v: %s", txn.TransactionID, dq.destination, attempts, backoff, err)
+
+		select {
+		case <-q.stopCh:
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > q.maxBackoff {
+			backoff = q.maxBackoff
+		}
+	}
+}
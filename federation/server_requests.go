@@ -0,0 +1,219 @@
+package federation
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/match"
+)
+
+// ReceivedRequest is an inbound request which was received by a Server.
+type ReceivedRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	// The origin in the X-Matrix Authorization header, if any. The signature is not checked.
+	Origin spec.ServerName
+	// The raw request body.
+	Body []byte
+	// When the request was received.
+	Time time.Time
+}
+
+// JSON returns the parsed request body.
+func (r ReceivedRequest) JSON() gjson.Result {
+	return gjson.ParseBytes(r.Body)
+}
+
+func (r ReceivedRequest) String() string {
+	return fmt.Sprintf("%s %s from '%s' at %s", r.Method, r.Path, r.Origin, r.Time.Format(time.StampMilli))
+}
+
+// RequestMatcher selects received requests. All non-empty fields must match.
+type RequestMatcher struct {
+	// The HTTP method e.g "PUT".
+	Method string
+	// A regular expression which must match the request path e.g `^/_matrix/federation/v1/send/`.
+	PathRegexp string
+	// The origin in the X-Matrix Authorization header.
+	Origin spec.ServerName
+	// Matchers which are applied to the JSON request body.
+	JSON []match.JSON
+}
+
+func (m RequestMatcher) String() string {
+	return fmt.Sprintf("{Method: '%s' PathRegexp: '%s' Origin: '%s' %d JSON matchers}", m.Method, m.PathRegexp, m.Origin, len(m.JSON))
+}
+
+// ReceivedRequests returns all requests received by this server so far, in the order they arrived.
+func (s *Server) ReceivedRequests() []ReceivedRequest {
+	s.receivedMu.Lock()
+	defer s.receivedMu.Unlock()
+	reqs := make([]ReceivedRequest, len(s.received))
+	copy(reqs, s.received)
+	return reqs
+}
+
+// ClearReceivedRequests forgets all requests received so far. Subsequent assertions only consider
+// requests received after this call.
+func (s *Server) ClearReceivedRequests() {
+	s.receivedMu.Lock()
+	defer s.receivedMu.Unlock()
+	s.received = nil
+}
+
+// CountReceived returns the number of requests received so far which match `m`.
+func (s *Server) CountReceived(t ct.TestLike, m RequestMatcher) int {
+	t.Helper()
+	return len(s.matchingRequests(t, m))
+}
+
+// MustHaveReceived waits until this server has received a request matching `m`, and returns it.
+// Requests received before this function was called are considered. Fails the test if no matching
+// request is received within `timeout`.
+func (s *Server) MustHaveReceived(t ct.TestLike, m RequestMatcher, timeout time.Duration) ReceivedRequest {
+	t.Helper()
+	matches := s.waitForMatchingRequests(t, m, 1, timeout)
+	if len(matches) == 0 {
+		ct.Fatalf(t, "MustHaveReceived: no request matching %s received within %v. Received:\n%s", m, timeout, s.receivedSummary())
+	}
+	return matches[0]
+}
+
+// MustNotHaveReceived waits for `duration` and fails the test if this server received a request matching
+// `m`, including any requests received before this function was called.
+func (s *Server) MustNotHaveReceived(t ct.TestLike, m RequestMatcher, duration time.Duration) {
+	t.Helper()
+	time.Sleep(duration)
+	matches := s.matchingRequests(t, m)
+	if len(matches) > 0 {
+		ct.Fatalf(t, "MustNotHaveReceived: received %d requests matching %s, first: %s", len(matches), m, matches[0])
+	}
+}
+
+// MustHaveReceivedCount waits until this server has received `count` requests matching `m`, and returns
+// them. Fails the test if fewer are received within `timeout`, or if more than `count` have been received.
+func (s *Server) MustHaveReceivedCount(t ct.TestLike, m RequestMatcher, count int, timeout time.Duration) []ReceivedRequest {
+	t.Helper()
+	matches := s.waitForMatchingRequests(t, m, count, timeout)
+	if len(matches) != count {
+		ct.Fatalf(t, "MustHaveReceivedCount: got %d requests matching %s within %v, want %d. Received:\n%s", len(matches), m, timeout, count, s.receivedSummary())
+	}
+	return matches
+}
+
+// waitForMatchingRequests polls until at least `count` requests match, or the timeout expires.
+func (s *Server) waitForMatchingRequests(t ct.TestLike, m RequestMatcher, count int, timeout time.Duration) []ReceivedRequest {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		matches := s.matchingRequests(t, m)
+		if len(matches) >= count || time.Now().After(deadline) {
+			return matches
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (s *Server) matchingRequests(t ct.TestLike, m RequestMatcher) []ReceivedRequest {
+	t.Helper()
+	matches := m.matcher(t)
+	var matching []ReceivedRequest
+	for _, r := range s.ReceivedRequests() {
+		if matches(r) {
+			matching = append(matching, r)
+		}
+	}
+	return matching
+}
+
+// matcher returns a function which returns true if the request matches. Fails the test if the
+// matcher is invalid.
+func (m RequestMatcher) matcher(t ct.TestLike) func(r ReceivedRequest) bool {
+	t.Helper()
+	var pathRegexp *regexp.Regexp
+	if m.PathRegexp != "" {
+		var err error
+		pathRegexp, err = regexp.Compile(m.PathRegexp)
+		if err != nil {
+			ct.Fatalf(t, "RequestMatcher: invalid PathRegexp %q: %s", m.PathRegexp, err)
+		}
+	}
+	return func(r ReceivedRequest) bool {
+		if m.Method != "" && m.Method != r.Method {
+			return false
+		}
+		if pathRegexp != nil && !pathRegexp.MatchString(r.Path) {
+			return false
+		}
+		if m.Origin != "" && m.Origin != r.Origin {
+			return false
+		}
+		if len(m.JSON) > 0 {
+			if !gjson.ValidBytes(r.Body) {
+				return false
+			}
+			body := r.JSON()
+			for _, jm := range m.JSON {
+				if err := jm(body); err != nil {
+					return false
+				}
+			}
+		}
+		return true
+	}
+}
+
+func (s *Server) receivedSummary() string {
+	var sb strings.Builder
+	for _, r := range s.ReceivedRequests() {
+		sb.WriteString("  " + r.String() + "\n")
+	}
+	return sb.String()
+}
+
+// recordRequests is middleware which stores every request in the request log.
+func (s *Server) recordRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rr, err := newReceivedRequest(req)
+		if err != nil {
+			s.t.Logf("[%s] %s", s.serverName, err)
+		}
+		s.receivedMu.Lock()
+		s.received = append(s.received, rr)
+		s.receivedMu.Unlock()
+		next.ServeHTTP(w, req)
+	})
+}
+
+// newReceivedRequest captures the request. The request body is read and replaced so it can be read again.
+func newReceivedRequest(req *http.Request) (ReceivedRequest, error) {
+	rr := ReceivedRequest{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Query:  req.URL.Query(),
+		Time:   time.Now(),
+	}
+	_, rr.Origin, _, _, _ = fclient.ParseAuthorization(req.Header.Get("Authorization"))
+	if req.Body == nil {
+		return rr, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	rr.Body = body
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return rr, fmt.Errorf("failed to read body of %s %s: %s", req.Method, req.URL.Path, err)
+	}
+	return rr, nil
+}
@@ -168,6 +168,16 @@ func (r *ServerRoom) AuthEvents(sn gomatrixserverlib.StateNeeded) (eventIDs []st
 	return
 }
 
+// CheckAuth checks that the event is allowed by the auth rules of the room version, using the current
+// state of the room as the auth events.
+func (r *ServerRoom) CheckAuth(ev gomatrixserverlib.PDU) error {
+	authEvents, err := gomatrixserverlib.NewAuthEvents(r.AllCurrentState())
+	if err != nil {
+		return fmt.Errorf("CheckAuth: failed to load auth events: %w", err)
+	}
+	return gomatrixserverlib.Allowed(ev, authEvents, userIDForSender)
+}
+
 // ReplaceCurrentState inserts a new state event for this room or replaces current state depending
 // on the (type, state_key) provided. The event provided must be a state event.
 func (r *ServerRoom) ReplaceCurrentState(ev gomatrixserverlib.PDU) {
@@ -481,7 +491,8 @@ func (i *ServerRoomImplDefault) EventCreator(room *ServerRoom, s *Server, proto
 		return nil, fmt.Errorf("EventCreator: invalid room version: %s", err)
 	}
 	eb := verImpl.NewEventBuilderFromProtoEvent(proto)
-	signedEvent, err := eb.Build(time.Now(), spec.ServerName(s.serverName), s.KeyID, s.Priv)
+	keyID, priv := s.signingKey()
+	signedEvent, err := eb.Build(time.Now(), spec.ServerName(s.serverName), keyID, priv)
 	if err != nil {
 		return nil, fmt.Errorf("EventCreator: failed to sign event: %s", err)
 	}
@@ -538,3 +549,9 @@ func (i *ServerRoomImplDefault) GenerateSendJoinResponse(room *ServerRoom, s *Se
 		ServersInRoom: serversInRoomStrings,
 	}
 }
+
+// userIDForSender maps sender IDs to user IDs. Complement does not track pseudo IDs, so sender IDs
+// are assumed to be user IDs.
+func userIDForSender(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+	return spec.NewUserID(string(senderID), true)
+}
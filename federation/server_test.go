@@ -1,13 +1,36 @@
 package federation
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net"
 	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/sjson"
+
+	"github.com/matrix-org/complement/b"
 	"github.com/matrix-org/complement/config"
 	"github.com/matrix-org/complement/internal"
+	"github.com/matrix-org/complement/match"
 )
 
 type fedDeploy struct {
@@ -22,6 +45,24 @@ func (d *fedDeploy) RoundTripper() http.RoundTripper {
 	return d.tripper
 }
 
+// localFedDeploy returns a deployment which routes federation requests between Complement servers
+// running on localhost.
+func localFedDeploy() *fedDeploy {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	return &fedDeploy{
+		cfg: cfg,
+		// federation clients use matrix:// URLs, which the deployment usually resolves
+		tripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req.URL.Scheme = "https"
+			return transport.RoundTrip(req)
+		}),
+	}
+}
+
 func TestComplementServerIsSigned(t *testing.T) {
 	cfg := config.NewConfigFromEnvVars("test", "unimportant")
 	cfg.HostnameRunningComplement = "localhost"
@@ -74,3 +115,1070 @@ func TestComplementServerIsSigned(t *testing.T) {
 		}
 	}
 }
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+func TestTransactionQueueRetriesInOrder(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	var mu sync.Mutex
+	var gotTxnIDs []string
+	var gotPDUs []string
+	failuresRemaining := 2
+	tripper := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		gotTxnIDs = append(gotTxnIDs, path.Base(req.URL.Path))
+		if failuresRemaining > 0 {
+			failuresRemaining--
+			return nil, fmt.Errorf("connection refused")
+		}
+		body, _ := io.ReadAll(req.Body)
+		var txn gomatrixserverlib.Transaction
+		if err := json.Unmarshal(body, &txn); err != nil {
+			t.Errorf("failed to unmarshal transaction: %s", err)
+		}
+		for _, pdu := range txn.PDUs {
+			gotPDUs = append(gotPDUs, string(pdu))
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"pdus":{}}`)),
+		}, nil
+	})
+	deployment := &fedDeploy{
+		cfg:     cfg,
+		tripper: tripper,
+	}
+	srv := NewServer(t, deployment)
+	srv.UnexpectedRequestsAreErrors = false
+	cancel := srv.Listen()
+	defer cancel()
+
+	queue := srv.NewTransactionQueue(deployment, WithQueueBackoff(10*time.Millisecond, 50*time.Millisecond))
+	queue.QueuePDUs("hs1", json.RawMessage(`{"n":1}`), json.RawMessage(`{"n":2}`))
+	queue.QueuePDUs("hs1", json.RawMessage(`{"n":3}`))
+	queue.MustWaitUntilEmpty(t, "hs1", 5*time.Second)
+
+	status := queue.Status("hs1")
+	if status.TotalFailedAttempts != 2 {
+		t.Errorf("TotalFailedAttempts: got %d want 2", status.TotalFailedAttempts)
+	}
+	if status.SentPDUs != 3 {
+		t.Errorf("SentPDUs: got %d want 3", status.SentPDUs)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// the failed attempts must be retried with the same transaction ID
+	if gotTxnIDs[0] != gotTxnIDs[1] || gotTxnIDs[1] != gotTxnIDs[2] {
+		t.Errorf("retries used different transaction IDs: %v", gotTxnIDs)
+	}
+	wantPDUs := []string{`{"n":1}`, `{"n":2}`, `{"n":3}`}
+	if strings.Join(gotPDUs, ",") != strings.Join(wantPDUs, ",") {
+		t.Errorf("PDUs sent out of order: got %v want %v", gotPDUs, wantPDUs)
+	}
+}
+
+func TestRotateSigningKey(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	srv := NewServer(t, &fedDeploy{
+		cfg:     cfg,
+		tripper: http.DefaultClient.Transport,
+	})
+	oldPublicKey := srv.Priv.Public().(ed25519.PublicKey)
+	oldKeyID := srv.RotateSigningKey(t)
+	if oldKeyID == srv.KeyID {
+		t.Fatalf("RotateSigningKey did not change the key ID")
+	}
+	expiredTS := time.Now().Add(-time.Hour)
+	srv.SetOldVerifyKeyExpiry(t, oldKeyID, expiredTS)
+
+	keys, err := srv.ServerKeys()
+	if err != nil {
+		t.Fatalf("ServerKeys: %s", err)
+	}
+	if err = gomatrixserverlib.VerifyJSON(string(srv.serverName), srv.KeyID, srv.Priv.Public().(ed25519.PublicKey), keys.Raw); err != nil {
+		t.Errorf("key response is not signed with the new key: %s", err)
+	}
+	if _, ok := keys.VerifyKeys[oldKeyID]; ok {
+		t.Errorf("old key %s is still in verify_keys", oldKeyID)
+	}
+	oldKey, ok := keys.OldVerifyKeys[oldKeyID]
+	if !ok {
+		t.Fatalf("old key %s missing from old_verify_keys", oldKeyID)
+	}
+	if !bytes.Equal(oldKey.Key, oldPublicKey) {
+		t.Errorf("old_verify_keys has the wrong public key for %s", oldKeyID)
+	}
+	if oldKey.ExpiredTS != spec.AsTimestamp(expiredTS) {
+		t.Errorf("old_verify_keys expired_ts: got %d want %d", oldKey.ExpiredTS, spec.AsTimestamp(expiredTS))
+	}
+
+	// the server must still be able to verify things signed with the old key
+	res, err := srv.keyFetcher.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp{
+		{ServerName: srv.serverName, KeyID: oldKeyID}: spec.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys: %s", err)
+	}
+	if len(res) != 1 {
+		t.Fatalf("FetchKeys: got %d results, want 1", len(res))
+	}
+}
+
+func TestTransactionQueueSignsWithRotatedKey(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	var mu sync.Mutex
+	var gotAuth []string
+	tripper := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		gotAuth = append(gotAuth, req.Header.Get("Authorization"))
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"pdus":{}}`)),
+		}, nil
+	})
+	deployment := &fedDeploy{
+		cfg:     cfg,
+		tripper: tripper,
+	}
+	srv := NewServer(t, deployment)
+	cancel := srv.Listen()
+	defer cancel()
+
+	queue := srv.NewTransactionQueue(deployment)
+	srv.RotateSigningKey(t)
+	queue.QueuePDUs("hs1", json.RawMessage(`{"n":1}`))
+	queue.MustWaitUntilEmpty(t, "hs1", 5*time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(gotAuth) != 1 {
+		t.Fatalf("got %d requests, want 1", len(gotAuth))
+	}
+	if !strings.Contains(gotAuth[0], `key="`+string(srv.KeyID)+`"`) {
+		t.Errorf("transaction was not signed with the rotated key %s: %s", srv.KeyID, gotAuth[0])
+	}
+}
+
+func TestVirtualHostRoutesByServerName(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	cfg.VirtualServerHostnames = 10
+	deployment := &fedDeploy{
+		cfg:     cfg,
+		tripper: http.DefaultClient.Transport,
+	}
+	vh := NewVirtualHost(t, deployment)
+	cancel := vh.Listen()
+	defer cancel()
+
+	var servers []*Server
+	for i := 0; i < 3; i++ {
+		srv := vh.NewServer(t, deployment, HandleKeyRequests())
+		srvCancel := srv.Listen()
+		defer srvCancel()
+		servers = append(servers, srv)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	for _, srv := range servers {
+		req, err := http.NewRequest("GET", fmt.Sprintf("https://localhost:%d/_matrix/key/v2/server", vh.port), nil)
+		if err != nil {
+			t.Fatalf("failed to make request: %s", err)
+		}
+		req.Host = string(srv.ServerName())
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to GET: %s", err)
+		}
+		var keys gomatrixserverlib.ServerKeys
+		if err = json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+			t.Fatalf("failed to decode key response: %s", err)
+		}
+		resp.Body.Close()
+		if keys.ServerName != srv.ServerName() {
+			t.Errorf("request for %s was routed to %s", srv.ServerName(), keys.ServerName)
+		}
+		if _, ok := keys.VerifyKeys[srv.KeyID]; !ok {
+			t.Errorf("key response for %s did not contain its key %s", srv.ServerName(), srv.KeyID)
+		}
+	}
+}
+
+func TestFaultRules(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	srv := NewServer(t, &fedDeploy{
+		cfg:     cfg,
+		tripper: http.DefaultClient.Transport,
+	}, HandleKeyRequests(), WithFaultRules(FaultRule{
+		Method:     "GET",
+		PathRegexp: "^/_matrix/key/v2/server",
+		Fault:      FaultStatus(502),
+		Times:      2,
+	}))
+	cancel := srv.Listen()
+	defer cancel()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	get := func() (int, error) {
+		resp, err := client.Get("https://" + string(srv.ServerName()) + "/_matrix/key/v2/server")
+		if err != nil {
+			return 0, err
+		}
+		defer internal.CloseIO(resp.Body, "server response body")
+		_, err = io.ReadAll(resp.Body)
+		return resp.StatusCode, err
+	}
+	// the first two requests fail, then it succeeds
+	for i, wantCode := range []int{502, 502, 200} {
+		gotCode, err := get()
+		if err != nil {
+			t.Fatalf("request %d failed: %s", i, err)
+		}
+		if gotCode != wantCode {
+			t.Errorf("request %d: got HTTP %d want %d", i, gotCode, wantCode)
+		}
+	}
+
+	id := srv.AddFaultRule(FaultRule{
+		Fault: FaultTruncatedBody(),
+	})
+	if _, err := get(); err == nil {
+		t.Errorf("expected truncated body to cause an error, got none")
+	}
+	srv.RemoveFaultRule(id)
+	srv.AddFaultRule(FaultRule{
+		Fault: FaultConnectionReset(),
+	})
+	if _, err := get(); err == nil {
+		t.Errorf("expected connection reset to cause an error, got none")
+	}
+	srv.ClearFaultRules()
+	if code, err := get(); err != nil || code != 200 {
+		t.Errorf("expected request to succeed after clearing faults, got HTTP %d err %v", code, err)
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	srv := NewServer(t, &fedDeploy{
+		cfg:     cfg,
+		tripper: http.DefaultClient.Transport,
+	}, HandleKeyRequests())
+	srv.UnexpectedRequestsAreErrors = false
+	cancel := srv.Listen()
+	defer cancel()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Post(
+			"https://"+string(srv.ServerName())+"/_matrix/federation/v1/user/keys/query", "application/json",
+			strings.NewReader(fmt.Sprintf(`{"device_keys":{"@alice:hs1":[]},"attempt":%d}`, i)),
+		)
+		if err != nil {
+			t.Fatalf("request %d failed: %s", i, err)
+		}
+		internal.CloseIO(resp.Body, "server response body")
+	}
+
+	keysQuery := RequestMatcher{
+		Method:     "POST",
+		PathRegexp: "^/_matrix/federation/v1/user/keys/query$",
+	}
+	srv.MustHaveReceivedCount(t, keysQuery, 2, time.Second)
+	keysQuery.JSON = []match.JSON{match.JSONKeyEqual("attempt", 1)}
+	got := srv.MustHaveReceived(t, keysQuery, time.Second)
+	if !got.JSON().Get("device_keys").Get("@alice:hs1").Exists() {
+		t.Errorf("recorded body is missing device_keys: %s", string(got.Body))
+	}
+	srv.MustNotHaveReceived(t, RequestMatcher{PathRegexp: "^/_matrix/federation/v1/send/"}, 100*time.Millisecond)
+
+	srv.ClearReceivedRequests()
+	if n := srv.CountReceived(t, keysQuery); n != 0 {
+		t.Errorf("CountReceived after clearing: got %d want 0", n)
+	}
+}
+
+func TestKnockAndLeaveBetweenServers(t *testing.T) {
+	deployment := localFedDeploy()
+	resident := NewServer(t, deployment,
+		HandleKeyRequests(), HandleMakeSendKnockRequests(), HandleMakeSendLeaveRequests(),
+	)
+	residentCancel := resident.Listen()
+	defer residentCancel()
+	knocker := NewServer(t, deployment, HandleKeyRequests())
+	knockerCancel := knocker.Listen()
+	defer knockerCancel()
+
+	creator := resident.UserID("alice")
+	events := append(InitialRoomEvents(gomatrixserverlib.RoomVersionV7, creator), Event{
+		Type:     spec.MRoomJoinRules,
+		StateKey: b.Ptr(""),
+		Sender:   creator,
+		Content: map[string]interface{}{
+			"join_rule": spec.Knock,
+		},
+	})
+	room := resident.MustMakeRoom(t, gomatrixserverlib.RoomVersionV7, events)
+
+	bob := knocker.UserID("bob")
+	_, knockRoomState := knocker.MustKnockRoom(t, deployment, resident.ServerName(), room.RoomID, bob)
+	room.MustHaveMembershipForUser(t, bob, spec.Knock)
+	if len(knockRoomState) == 0 {
+		t.Errorf("send_knock returned no knock_room_state")
+	}
+	// the knocker doesn't know the state of the room, so must not serve it
+	if knocker.rooms[room.RoomID] != nil {
+		t.Errorf("MustKnockRoom added the room to the knocking server")
+	}
+
+	knocker.MustLeaveRoom(t, deployment, resident.ServerName(), room.RoomID, bob)
+	room.MustHaveMembershipForUser(t, bob, spec.Leave)
+
+	// knocks on rooms which do not allow knocking are rejected by the auth rules
+	publicRoom := resident.MustMakeRoom(t, gomatrixserverlib.RoomVersionV7, InitialRoomEvents(gomatrixserverlib.RoomVersionV7, creator))
+	makeKnockResp, err := MakeRespMakeKnock(resident, publicRoom, bob)
+	if err != nil {
+		t.Fatalf("MakeRespMakeKnock: %s", err)
+	}
+	knockEvent, err := gomatrixserverlib.MustGetRoomVersion(publicRoom.Version).NewEventBuilderFromProtoEvent(&makeKnockResp.KnockEvent).Build(
+		time.Now(), knocker.ServerName(), knocker.KeyID, knocker.Priv,
+	)
+	if err != nil {
+		t.Fatalf("failed to build knock event: %s", err)
+	}
+	_, err = knocker.FederationClient(deployment).SendKnock(context.Background(), knocker.ServerName(), resident.ServerName(), knockEvent)
+	if err == nil {
+		t.Errorf("send_knock on a public room succeeded, want error")
+	}
+	if publicRoom.CurrentState(spec.MRoomMember, bob) != nil {
+		t.Errorf("rejected knock was added to the room")
+	}
+}
+
+func TestDeviceKeyStore(t *testing.T) {
+	deployment := localFedDeploy()
+	var edusMu sync.Mutex
+	var edus []gomatrixserverlib.EDU
+	resident := NewServer(t, deployment,
+		HandleKeyRequests(), HandleMakeSendJoinRequests(),
+		HandleTransactionRequests(nil, func(e gomatrixserverlib.EDU) {
+			edusMu.Lock()
+			defer edusMu.Unlock()
+			edus = append(edus, e)
+		}),
+	)
+	residentCancel := resident.Listen()
+	defer residentCancel()
+	remote := NewServer(t, deployment, HandleKeyRequests(), HandleDeviceKeyRequests())
+	remoteCancel := remote.Listen()
+	defer remoteCancel()
+
+	room := resident.MustMakeRoom(t, gomatrixserverlib.RoomVersionV10, InitialRoomEvents(gomatrixserverlib.RoomVersionV10, resident.UserID("alice")))
+	bob := remote.UserID("bob")
+	remote.MustJoinRoom(t, deployment, resident.ServerName(), room.RoomID, bob)
+
+	remote.MustAddDevice(t, bob, "PHONE", "Bob's phone")
+	remote.MustAddDevice(t, bob, "LAPTOP", "Bob's laptop")
+	remote.MustAddCrossSigningKeys(t, bob)
+	remote.MustAddOneTimeKeys(t, bob, "PHONE", 1)
+	fallbackKeyID, _ := remote.MustSetFallbackKey(t, bob, "PHONE")
+	remote.DeviceListQueue().MustWaitUntilEmpty(t, resident.ServerName(), 5*time.Second)
+
+	// 2 device additions + 1 signing key update + 2 device re-signings
+	edusMu.Lock()
+	var streamIDs []int64
+	for _, e := range edus {
+		if e.Type == "m.device_list_update" {
+			var update gomatrixserverlib.DeviceListUpdateEvent
+			if err := json.Unmarshal(e.Content, &update); err != nil {
+				t.Fatalf("failed to unmarshal m.device_list_update: %s", err)
+			}
+			streamIDs = append(streamIDs, update.StreamID)
+		}
+	}
+	edusMu.Unlock()
+	if fmt.Sprint(streamIDs) != "[1 2 3 4]" {
+		t.Errorf("m.device_list_update stream IDs: got %v want [1 2 3 4]", streamIDs)
+	}
+
+	fedClient := resident.FederationClient(deployment)
+	ctx := context.Background()
+	devices, err := fedClient.GetUserDevices(ctx, resident.ServerName(), remote.ServerName(), bob)
+	if err != nil {
+		t.Fatalf("GetUserDevices: %s", err)
+	}
+	if devices.StreamID != 4 || len(devices.Devices) != 2 || devices.MasterKey == nil || devices.SelfSigningKey == nil {
+		t.Errorf("GetUserDevices: unexpected response %+v", devices)
+	}
+	queryResp, err := fedClient.QueryKeys(ctx, resident.ServerName(), remote.ServerName(), map[string][]string{bob: {"PHONE"}})
+	if err != nil {
+		t.Fatalf("QueryKeys: %s", err)
+	}
+	phoneKeys, ok := queryResp.DeviceKeys[bob]["PHONE"]
+	if !ok || len(queryResp.DeviceKeys[bob]) != 1 {
+		t.Fatalf("QueryKeys: unexpected device keys %+v", queryResp.DeviceKeys)
+	}
+	keysJSON, _ := json.Marshal(phoneKeys.RespUserDeviceKeys)
+	err = gomatrixserverlib.VerifyJSON(bob, "ed25519:PHONE", ed25519.PublicKey(phoneKeys.Keys["ed25519:PHONE"]), keysJSON)
+	if err != nil {
+		t.Errorf("device keys are not signed by the device: %s", err)
+	}
+	if _, ok := queryResp.MasterKeys[bob]; !ok {
+		t.Errorf("QueryKeys: missing master key")
+	}
+
+	// the one-time key is claimed first, then the fallback key is returned repeatedly
+	for i, wantFallback := range []bool{false, true, true} {
+		claimResp, err := fedClient.ClaimKeys(ctx, resident.ServerName(), remote.ServerName(), map[string]map[string]string{
+			bob: {"PHONE": "signed_curve25519"},
+		})
+		if err != nil {
+			t.Fatalf("ClaimKeys: %s", err)
+		}
+		claimed := claimResp.OneTimeKeys[bob]["PHONE"]
+		if len(claimed) != 1 {
+			t.Fatalf("ClaimKeys %d: got %d keys want 1", i, len(claimed))
+		}
+		_, isFallback := claimed[fallbackKeyID]
+		if isFallback != wantFallback {
+			t.Errorf("ClaimKeys %d: got fallback=%v want %v", i, isFallback, wantFallback)
+		}
+	}
+	if n := remote.OneTimeKeyCount(bob, "PHONE"); n != 0 {
+		t.Errorf("OneTimeKeyCount: got %d want 0", n)
+	}
+}
+
+func TestDirectoryEndpoints(t *testing.T) {
+	deployment := localFedDeploy()
+	dir := NewServer(t, deployment,
+		HandleKeyRequests(), HandleMakeSendJoinRequests(), HandleProfileRequests(),
+		HandlePublicRoomsRequests(), HandleHierarchyRequests(), HandleOpenIDRequests(),
+	)
+	dirCancel := dir.Listen()
+	defer dirCancel()
+	peer := NewServer(t, deployment, HandleKeyRequests())
+	peerCancel := peer.Listen()
+	defer peerCancel()
+	fedClient := peer.FederationClient(deployment)
+	ctx := context.Background()
+
+	alice := dir.UserID("alice")
+	ver := gomatrixserverlib.RoomVersionV10
+	makeRoom := func(joinRule string, extra ...Event) *ServerRoom {
+		events := append(InitialRoomEvents(ver, alice), Event{
+			Type:     spec.MRoomJoinRules,
+			StateKey: b.Ptr(""),
+			Sender:   alice,
+			Content: map[string]interface{}{
+				"join_rule": joinRule,
+			},
+		})
+		return dir.MustMakeRoom(t, ver, append(events, extra...))
+	}
+	nameEvent := func(name string) Event {
+		return Event{Type: spec.MRoomName, StateKey: b.Ptr(""), Sender: alice, Content: map[string]interface{}{"name": name}}
+	}
+
+	// profiles
+	dir.SetProfile(alice, "Alice", "mxc://example.com/alice")
+	profile, err := fedClient.LookupProfile(ctx, peer.ServerName(), dir.ServerName(), alice, "displayname")
+	if err != nil {
+		t.Fatalf("LookupProfile: %s", err)
+	}
+	if profile.DisplayName != "Alice" || profile.AvatarURL != "" {
+		t.Errorf("LookupProfile: got %+v", profile)
+	}
+
+	// public rooms
+	for _, name := range []string{"Cats", "Dogs", "Cat videos"} {
+		dir.PublishRoom(makeRoom(spec.Public, nameEvent(name)).RoomID)
+	}
+	page1, err := fedClient.GetPublicRooms(ctx, peer.ServerName(), dir.ServerName(), 2, "", false, "")
+	if err != nil {
+		t.Fatalf("GetPublicRooms: %s", err)
+	}
+	if len(page1.Chunk) != 2 || page1.NextBatch == "" || page1.TotalRoomCountEstimate != 3 {
+		t.Fatalf("GetPublicRooms: unexpected first page %+v", page1)
+	}
+	page2, err := fedClient.GetPublicRooms(ctx, peer.ServerName(), dir.ServerName(), 2, page1.NextBatch, false, "")
+	if err != nil {
+		t.Fatalf("GetPublicRooms: %s", err)
+	}
+	if len(page2.Chunk) != 1 || page2.NextBatch != "" || page2.Chunk[0].Name != "Cat videos" {
+		t.Errorf("GetPublicRooms: unexpected second page %+v", page2)
+	}
+	filtered, err := fedClient.GetPublicRoomsFiltered(ctx, peer.ServerName(), dir.ServerName(), 10, "", "cat", false, "")
+	if err != nil {
+		t.Fatalf("GetPublicRoomsFiltered: %s", err)
+	}
+	if len(filtered.Chunk) != 2 {
+		t.Errorf("GetPublicRoomsFiltered: got %d rooms want 2", len(filtered.Chunk))
+	}
+
+	// hierarchy
+	allowRoom := makeRoom(spec.Public)
+	publicChild := makeRoom(spec.Public)
+	restrictedChild := makeRoom(spec.Restricted)
+	restrictedChild.AddEvent(dir.MustCreateEvent(t, restrictedChild, Event{
+		Type:     spec.MRoomJoinRules,
+		StateKey: b.Ptr(""),
+		Sender:   alice,
+		Content: map[string]interface{}{
+			"join_rule": spec.Restricted,
+			"allow":     []map[string]interface{}{{"type": spec.MRoomMembership, "room_id": allowRoom.RoomID}},
+		},
+	}))
+	inviteChild := makeRoom(spec.Invite)
+	var children []Event
+	for _, child := range []*ServerRoom{publicChild, restrictedChild, inviteChild} {
+		children = append(children, Event{
+			Type:     spec.MSpaceChild,
+			StateKey: b.Ptr(child.RoomID),
+			Sender:   alice,
+			Content: map[string]interface{}{
+				"via":       []string{string(dir.ServerName())},
+				"suggested": child == publicChild,
+			},
+		})
+	}
+	space := makeRoom(spec.Public, children...)
+
+	hierarchy, err := fedClient.RoomHierarchy(ctx, peer.ServerName(), dir.ServerName(), space.RoomID, false)
+	if err != nil {
+		t.Fatalf("RoomHierarchy: %s", err)
+	}
+	if len(hierarchy.Room.ChildrenState) != 3 || len(hierarchy.Children) != 1 || len(hierarchy.InaccessibleChildren) != 2 {
+		t.Errorf("RoomHierarchy before joining allowed room: unexpected response %+v", hierarchy)
+	}
+	peer.MustJoinRoom(t, deployment, dir.ServerName(), allowRoom.RoomID, peer.UserID("bob"))
+	hierarchy, err = fedClient.RoomHierarchy(ctx, peer.ServerName(), dir.ServerName(), space.RoomID, false)
+	if err != nil {
+		t.Fatalf("RoomHierarchy: %s", err)
+	}
+	if len(hierarchy.Children) != 2 || len(hierarchy.InaccessibleChildren) != 1 || hierarchy.InaccessibleChildren[0] != inviteChild.RoomID {
+		t.Errorf("RoomHierarchy after joining allowed room: unexpected response %+v", hierarchy)
+	}
+	suggested, err := fedClient.RoomHierarchy(ctx, peer.ServerName(), dir.ServerName(), space.RoomID, true)
+	if err != nil {
+		t.Fatalf("RoomHierarchy: %s", err)
+	}
+	if len(suggested.Children) != 1 || suggested.Children[0].RoomID != publicChild.RoomID {
+		t.Errorf("RoomHierarchy suggested_only: unexpected response %+v", suggested)
+	}
+	if _, err = fedClient.RoomHierarchy(ctx, peer.ServerName(), dir.ServerName(), inviteChild.RoomID, false); err == nil {
+		t.Errorf("RoomHierarchy on an inaccessible room succeeded, want error")
+	}
+
+	// openid
+	token := dir.CreateOpenIDToken(alice)
+	keyClient := fclient.NewClient(fclient.WithTransport(deployment.RoundTripper()))
+	userInfo, err := keyClient.LookupUserInfo(ctx, dir.ServerName(), token)
+	if err != nil {
+		t.Fatalf("LookupUserInfo: %s", err)
+	}
+	if userInfo.Sub != alice {
+		t.Errorf("LookupUserInfo: got %s want %s", userInfo.Sub, alice)
+	}
+	if _, err = keyClient.LookupUserInfo(ctx, dir.ServerName(), "unknown"); err == nil {
+		t.Errorf("LookupUserInfo with an unknown token succeeded, want error")
+	}
+}
+
+func TestAuthenticatedMedia(t *testing.T) {
+	deployment := localFedDeploy()
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	var pngBytes bytes.Buffer
+	if err := png.Encode(&pngBytes, img); err != nil {
+		t.Fatalf("failed to encode png: %s", err)
+	}
+	media := map[string]func(w http.ResponseWriter){
+		"image": func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Content-Disposition", `inline; filename="image.png"`)
+			w.WriteHeader(200)
+			w.Write(pngBytes.Bytes())
+		},
+	}
+	peer := NewServer(t, deployment, HandleKeyRequests())
+	peerCancel := peer.Listen()
+	defer peerCancel()
+	ctx := context.Background()
+
+	thumbnailRequest := func(srv *Server, mediaID, method string) *http.Response {
+		t.Helper()
+		req := fclient.NewFederationRequest("GET", peer.ServerName(), srv.ServerName(),
+			"/_matrix/federation/v1/media/thumbnail/"+mediaID+"?width=16&height=16&method="+method)
+		resp, err := peer.DoFederationRequest(ctx, t, deployment, req)
+		if err != nil {
+			t.Fatalf("thumbnail request failed: %s", err)
+		}
+		return resp
+	}
+	decodeThumbnail := func(m *MultipartMedia) image.Rectangle {
+		t.Helper()
+		thumb, err := png.Decode(bytes.NewReader(m.Body))
+		if err != nil {
+			t.Fatalf("failed to decode thumbnail: %s", err)
+		}
+		return thumb.Bounds()
+	}
+
+	srv := NewServer(t, deployment, HandleKeyRequests(), HandleMediaRequests(media))
+	cancel := srv.Listen()
+	defer cancel()
+
+	resp, err := peer.FederationClient(deployment).DownloadMedia(ctx, peer.ServerName(), srv.ServerName(), "image")
+	if err != nil {
+		t.Fatalf("DownloadMedia: %s", err)
+	}
+	download := MustParseMultipartMedia(t, resp)
+	if !bytes.Equal(download.Body, pngBytes.Bytes()) || download.ContentType != "image/png" || download.ContentDisposition != `inline; filename="image.png"` {
+		t.Errorf("DownloadMedia: got %s %s with %d bytes", download.ContentType, download.ContentDisposition, len(download.Body))
+	}
+	if string(download.Metadata) != "{}" {
+		t.Errorf("DownloadMedia: got metadata %s", download.Metadata)
+	}
+	if bounds := decodeThumbnail(MustParseMultipartMedia(t, thumbnailRequest(srv, "image", "scale"))); bounds.Dx() != 16 || bounds.Dy() != 8 {
+		t.Errorf("scaled thumbnail: got size %v, want 16x8", bounds.Size())
+	}
+	if bounds := decodeThumbnail(MustParseMultipartMedia(t, thumbnailRequest(srv, "image", "crop"))); bounds.Dx() != 16 || bounds.Dy() != 16 {
+		t.Errorf("cropped thumbnail: got size %v, want 16x16", bounds.Size())
+	}
+	if resp := thumbnailRequest(srv, "missing", "scale"); resp.StatusCode != 404 {
+		t.Errorf("unknown media: got status %d, want 404", resp.StatusCode)
+	}
+
+	redirectSrv := NewServer(t, deployment, HandleKeyRequests(), HandleMediaRequests(media, WithMediaRedirects()))
+	redirectCancel := redirectSrv.Listen()
+	defer redirectCancel()
+	redirect := MustParseMultipartMedia(t, thumbnailRequest(redirectSrv, "image", "scale"))
+	if redirect.Location == "" || len(redirect.Body) != 0 {
+		t.Fatalf("redirect: got Location %q with %d bytes", redirect.Location, len(redirect.Body))
+	}
+	httpClient := &http.Client{Transport: deployment.RoundTripper()}
+	resp, err = httpClient.Get(redirect.Location)
+	if err != nil {
+		t.Fatalf("failed to follow redirect: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	thumb, err := png.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to decode redirected thumbnail: %s", err)
+	}
+	if thumb.Bounds().Dx() != 16 || thumb.Bounds().Dy() != 8 {
+		t.Errorf("redirected thumbnail: got size %v, want 16x8", thumb.Bounds().Size())
+	}
+}
+
+// recordingT records errors instead of failing the test.
+type recordingT struct {
+	*testing.T
+	mu     sync.Mutex
+	errors []string
+}
+
+func (t *recordingT) Errorf(msg string, args ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.errors = append(t.errors, fmt.Sprintf(msg, args...))
+}
+
+func (t *recordingT) Errors() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string{}, t.errors...)
+}
+
+func TestStrictValidation(t *testing.T) {
+	deployment := localFedDeploy()
+	rt := &recordingT{T: t}
+	resident := NewServer(rt, deployment,
+		HandleKeyRequests(), HandleMakeSendJoinRequests(), HandleTransactionRequests(nil, nil), WithStrictValidation(),
+	)
+	residentCancel := resident.Listen()
+	defer residentCancel()
+	joiner := NewServer(t, deployment, HandleKeyRequests())
+	joinerCancel := joiner.Listen()
+	defer joinerCancel()
+
+	ver := gomatrixserverlib.RoomVersionV10
+	room := resident.MustMakeRoom(t, ver, InitialRoomEvents(ver, resident.UserID("alice")))
+	bob := joiner.UserID("bob")
+	joinerRoom := joiner.MustJoinRoom(t, deployment, resident.ServerName(), room.RoomID, bob)
+	if errs := rt.Errors(); len(errs) > 0 {
+		t.Fatalf("valid join was reported as invalid: %v", errs)
+	}
+
+	message := func(body string) gomatrixserverlib.PDU {
+		ev := joiner.MustCreateEvent(t, joinerRoom, Event{
+			Type:    "m.room.message",
+			Sender:  bob,
+			Content: map[string]interface{}{"msgtype": "m.text", "body": body},
+		})
+		joinerRoom.AddEvent(ev)
+		return ev
+	}
+	valid := message("valid")
+	tampered, err := sjson.SetBytes(message("tampered").JSON(), "content.body", "changed")
+	if err != nil {
+		t.Fatalf("failed to tamper with event: %s", err)
+	}
+	_, err = joiner.FederationClient(deployment).SendTransaction(context.Background(), gomatrixserverlib.Transaction{
+		TransactionID:  "txn1",
+		Origin:         joiner.ServerName(),
+		Destination:    resident.ServerName(),
+		OriginServerTS: spec.AsTimestamp(time.Now()),
+		PDUs:           []json.RawMessage{valid.JSON(), tampered},
+		EDUs: []gomatrixserverlib.EDU{
+			{Type: spec.MTyping, Content: []byte(fmt.Sprintf(`{"room_id":%q,"user_id":%q,"typing":true}`, room.RoomID, bob))},
+			{Type: spec.MTyping, Content: []byte(fmt.Sprintf(`{"room_id":%q,"user_id":"@mallory:evil","typing":"yes"}`, room.RoomID))},
+		},
+	})
+	if err != nil {
+		t.Fatalf("SendTransaction: %s", err)
+	}
+	errs := rt.Errors()
+	if len(errs) != 2 {
+		t.Fatalf("got %d validation errors, want 2: %v", len(errs), errs)
+	}
+	for i, want := range []string{"content hash mismatch", "typing is not a boolean"} {
+		if !strings.Contains(errs[i], want) {
+			t.Errorf("validation error %d: got %q, want it to contain %q", i, errs[i], want)
+		}
+	}
+	if !strings.Contains(errs[1], "does not belong to origin") {
+		t.Errorf("EDU validation error did not report the user from another server: %s", errs[1])
+	}
+}
+
+func TestProxy(t *testing.T) {
+	deployment := localFedDeploy()
+	origin := NewServer(t, deployment, HandleKeyRequests())
+	originCancel := origin.Listen()
+	defer originCancel()
+	var pdus []gomatrixserverlib.PDU
+	var mu sync.Mutex
+	dest := NewServer(t, deployment, HandleKeyRequests(), HandleMakeSendJoinRequests(), HandleTransactionRequests(func(ev gomatrixserverlib.PDU) {
+		mu.Lock()
+		defer mu.Unlock()
+		pdus = append(pdus, ev)
+	}, nil))
+	destCancel := dest.Listen()
+	defer destCancel()
+
+	proxy := NewProxy(t, deployment)
+	defer proxy.Close()
+	port, err := proxy.Listen(dest.ServerName())
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	// send traffic for dest to the proxy, checking the proxy uses a certificate from the Complement CA
+	roots := x509.NewCertPool()
+	roots.AddCert(deployment.cfg.CACertificate)
+	proxyTransport := &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost"},
+	}
+	viaProxy := &fedDeploy{
+		cfg: deployment.cfg,
+		tripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req.URL.Scheme = "https"
+			if req.URL.Host == string(dest.ServerName()) {
+				req.URL.Host = fmt.Sprintf("localhost:%d", port)
+			}
+			return proxyTransport.RoundTrip(req)
+		}),
+	}
+
+	ver := gomatrixserverlib.RoomVersionV10
+	room := dest.MustMakeRoom(t, ver, InitialRoomEvents(ver, dest.UserID("alice")))
+	bob := origin.UserID("bob")
+	originRoom := origin.MustJoinRoom(t, viaProxy, dest.ServerName(), room.RoomID, bob)
+	proxy.MustHaveProxied(t, dest.ServerName(), RequestMatcher{
+		Method:     "PUT",
+		PathRegexp: "^/_matrix/federation/v2/send_join/",
+		Origin:     origin.ServerName(),
+	}, time.Second)
+
+	sendMessage := func(txnID string) error {
+		ev := origin.MustCreateEvent(t, originRoom, Event{
+			Type:    "m.room.message",
+			Sender:  bob,
+			Content: map[string]interface{}{"msgtype": "m.text", "body": txnID},
+		})
+		originRoom.AddEvent(ev)
+		_, err := origin.FederationClient(viaProxy).SendTransaction(context.Background(), gomatrixserverlib.Transaction{
+			TransactionID:  gomatrixserverlib.TransactionID(txnID),
+			Origin:         origin.ServerName(),
+			Destination:    dest.ServerName(),
+			OriginServerTS: spec.AsTimestamp(time.Now()),
+			PDUs:           []json.RawMessage{ev.JSON()},
+		})
+		return err
+	}
+
+	// drop the first transaction, then deliver the second
+	proxy.AddRule(ProxyRule{
+		From:       origin.ServerName(),
+		To:         dest.ServerName(),
+		PathRegexp: "^/_matrix/federation/v1/send/",
+		Fault:      FaultConnectionReset(),
+		Times:      1,
+	})
+	if err = sendMessage("lost"); err == nil {
+		t.Errorf("dropped transaction succeeded")
+	}
+	if err = sendMessage("delivered"); err != nil {
+		t.Fatalf("SendTransaction: %s", err)
+	}
+	mu.Lock()
+	if len(pdus) != 1 || messageBody(pdus[0]) != "delivered" {
+		t.Errorf("destination received %d PDUs, want only the delivered one", len(pdus))
+	}
+	mu.Unlock()
+	sends := proxy.Requests()
+	var statuses []int
+	for _, r := range sends {
+		if strings.HasPrefix(r.Path, "/_matrix/federation/v1/send/") {
+			statuses = append(statuses, r.StatusCode)
+		}
+	}
+	if len(statuses) != 2 || statuses[0] != 0 || statuses[1] != 200 {
+		t.Errorf("proxied transactions: got statuses %v, want [0 200]", statuses)
+	}
+
+	// responses can be modified
+	proxy.ClearRequests()
+	proxy.AddRule(ProxyRule{
+		PathRegexp: "^/_matrix/federation/v1/send/",
+		Fault: FaultModifyResponse(func(req *http.Request, code int, body []byte) (int, []byte) {
+			return 500, []byte(`{"errcode":"M_UNKNOWN"}`)
+		}),
+	})
+	if err = sendMessage("modified"); err == nil {
+		t.Errorf("transaction with modified response succeeded")
+	}
+	proxied := proxy.MustHaveProxied(t, "", RequestMatcher{PathRegexp: "^/_matrix/federation/v1/send/"}, time.Second)
+	if proxied.StatusCode != 500 {
+		t.Errorf("modified response: got status %d, want 500", proxied.StatusCode)
+	}
+}
+
+func messageBody(ev gomatrixserverlib.PDU) string {
+	var content struct {
+		Body string `json:"body"`
+	}
+	json.Unmarshal(ev.Content(), &content)
+	return content.Body
+}
+
+func TestDNSServer(t *testing.T) {
+	deployment := localFedDeploy()
+	dns := NewDNSServer(t, deployment)
+	dnsPort, httpsPort, err := dns.Listen()
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer dns.Close()
+	dns.FrontendIP = net.ParseIP("127.0.0.1")
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", fmt.Sprintf("127.0.0.1:%d", dnsPort))
+		},
+	}
+	ctx := context.Background()
+
+	dns.SetA("target.test", net.ParseIP("10.1.2.3"))
+	dns.SetCNAME("alias.test", "target.test")
+	dns.SetSRV("_matrix-fed._tcp.delegator.test", net.SRV{Target: "target.test", Port: 8448, Priority: 10, Weight: 5})
+	addrs, err := resolver.LookupHost(ctx, "alias.test")
+	if err != nil {
+		t.Fatalf("LookupHost: %s", err)
+	}
+	if len(addrs) != 1 || addrs[0] != "10.1.2.3" {
+		t.Errorf("LookupHost: got %v, want [10.1.2.3]", addrs)
+	}
+	_, srvs, err := resolver.LookupSRV(ctx, "matrix-fed", "tcp", "delegator.test")
+	if err != nil {
+		t.Fatalf("LookupSRV: %s", err)
+	}
+	if len(srvs) != 1 || srvs[0].Target != "target.test." || srvs[0].Port != 8448 {
+		t.Errorf("LookupSRV: got %+v", srvs)
+	}
+	dns.MustHaveQueried(t, "_matrix-fed._tcp.delegator.test", "SRV", time.Second)
+	_, err = resolver.LookupHost(ctx, "unknown.test")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("LookupHost: got %v, want not found", err)
+	}
+
+	// route the delegating name to a server which serves .well-known, via the HTTPS frontend
+	delegator := NewServer(t, deployment, WithServerName("delegator.test"), HandleWellKnownServer("target.test:8448"))
+	dns.Route("delegator.test", delegator)
+	addrs, err = resolver.LookupHost(ctx, "delegator.test")
+	if err != nil || len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+		t.Errorf("LookupHost: got %v %v, want the frontend IP", addrs, err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(deployment.cfg.CACertificate)
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, fmt.Sprintf("127.0.0.1:%d", httpsPort))
+			},
+		},
+	}
+	res, err := httpClient.Get("https://delegator.test/.well-known/matrix/server")
+	if err != nil {
+		t.Fatalf("GET .well-known: %s", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 || !strings.Contains(string(body), `"m.server":"target.test:8448"`) {
+		t.Errorf("GET .well-known: got %d %s", res.StatusCode, string(body))
+	}
+
+	// SRV records can't point at routed hostnames on ports the frontend isn't reachable on
+	dns.mu.Lock()
+	dns.recordsFor("_matrix-fed._tcp.srv.test").srv = []net.SRV{{Target: "delegator.test", Port: 8448}}
+	if err = dns.checkFrontendPorts(); err != nil {
+		t.Errorf("checkFrontendPorts: got %s for a frontend port", err)
+	}
+	dns.recordsFor("_matrix-fed._tcp.srv.test").srv = []net.SRV{{Target: "delegator.test", Port: 1234}}
+	if err = dns.checkFrontendPorts(); err == nil {
+		t.Errorf("checkFrontendPorts: got no error for a port the frontend isn't reachable on")
+	}
+	delete(dns.records, "_matrix-fed._tcp.srv.test")
+	dns.mu.Unlock()
+
+	// the certificate can be made invalid for the hostname
+	dns.Route("delegator.test", delegator, WithCertificateHostname("wrong.test"))
+	httpClient.CloseIdleConnections()
+	if _, err = httpClient.Get("https://delegator.test/.well-known/matrix/server"); err == nil {
+		t.Errorf("GET .well-known: expected certificate error, got none")
+	}
+}
+
+func TestTransactionErrors(t *testing.T) {
+	deployment := localFedDeploy()
+	origin := NewServer(t, deployment, HandleKeyRequests())
+	originCancel := origin.Listen()
+	defer originCancel()
+	var failTransaction atomic.Bool
+	dest := NewServer(t, deployment, HandleKeyRequests(), HandleMakeSendJoinRequests(), HandleTransactionRequestsWithErrors(func(ev gomatrixserverlib.PDU) error {
+		if failTransaction.Load() || messageBody(ev) == "fail" {
+			return &TransactionError{StatusCode: 503, Message: "try again later"}
+		}
+		if messageBody(ev) == "reject" {
+			return fmt.Errorf("rejected by test")
+		}
+		return nil
+	}, nil))
+	destCancel := dest.Listen()
+	defer destCancel()
+
+	ver := gomatrixserverlib.RoomVersionV10
+	room := dest.MustMakeRoom(t, ver, InitialRoomEvents(ver, dest.UserID("alice")))
+	bob := origin.UserID("bob")
+	originRoom := origin.MustJoinRoom(t, deployment, dest.ServerName(), room.RoomID, bob)
+	send := func(txnID string, bodies ...string) (fclient.RespSend, []gomatrixserverlib.PDU, error) {
+		var pdus []json.RawMessage
+		var events []gomatrixserverlib.PDU
+		for _, body := range bodies {
+			ev := origin.MustCreateEvent(t, originRoom, Event{
+				Type:    "m.room.message",
+				Sender:  bob,
+				Content: map[string]interface{}{"msgtype": "m.text", "body": body},
+			})
+			originRoom.AddEvent(ev)
+			pdus = append(pdus, ev.JSON())
+			events = append(events, ev)
+		}
+		res, err := origin.FederationClient(deployment).SendTransaction(context.Background(), gomatrixserverlib.Transaction{
+			TransactionID:  gomatrixserverlib.TransactionID(txnID),
+			Origin:         origin.ServerName(),
+			Destination:    dest.ServerName(),
+			OriginServerTS: spec.AsTimestamp(time.Now()),
+			PDUs:           pdus,
+		})
+		return res, events, err
+	}
+
+	// rejected PDUs are reported in the response and not stored
+	res, events, err := send("partial", "accept", "reject")
+	if err != nil {
+		t.Fatalf("SendTransaction: %s", err)
+	}
+	if got := res.PDUs[events[0].EventID()]; got.Error != "" {
+		t.Errorf("accepted PDU: got error %q", got.Error)
+	}
+	if got := res.PDUs[events[1].EventID()]; got.Error != "rejected by test" {
+		t.Errorf("rejected PDU: got error %q, want 'rejected by test'", got.Error)
+	}
+	if _, ok := room.GetEventInTimeline(events[1].EventID()); ok {
+		t.Errorf("rejected PDU was stored in the room")
+	}
+
+	// the whole transaction can fail, in which case it is processed again when retransmitted
+	failTransaction.Store(true)
+	_, _, err = send("failed", "accept")
+	var httpErr gomatrix.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Code != 503 {
+		t.Errorf("failed transaction: got %v, want HTTP 503", err)
+	}
+	failTransaction.Store(false)
+	// PDUs before the one which failed the transaction are not stored, so retransmissions don't duplicate them
+	_, midwayEvents, err := send("midway", "accept", "fail")
+	if !errors.As(err, &httpErr) || httpErr.Code != 503 {
+		t.Errorf("failed transaction: got %v, want HTTP 503", err)
+	}
+	if _, ok := room.GetEventInTimeline(midwayEvents[0].EventID()); ok {
+		t.Errorf("PDU from a failed transaction was stored in the room")
+	}
+	if _, _, err = send("failed", "accept"); err != nil {
+		t.Errorf("retransmitted transaction: %s", err)
+	}
+
+	// successful transactions are not processed again, and the previous response is sent
+	res2, _, err := send("partial", "reject")
+	if err != nil {
+		t.Fatalf("SendTransaction: %s", err)
+	}
+	if len(res2.PDUs) != 2 || res2.PDUs[events[1].EventID()].Error != "rejected by test" {
+		t.Errorf("retransmitted transaction: got %+v, want the original response", res2.PDUs)
+	}
+	retransmissions := dest.Retransmissions()
+	if len(retransmissions) != 2 {
+		t.Fatalf("got %d retransmissions, want 2: %v", len(retransmissions), retransmissions)
+	}
+	if r := retransmissions[0]; r.TransactionID != "failed" || r.PreviouslySucceeded || r.Count != 2 {
+		t.Errorf("retransmission of failed transaction: got %s", r)
+	}
+	if r := retransmissions[1]; r.TransactionID != "partial" || r.Identical || !r.PreviouslySucceeded {
+		t.Errorf("retransmission of successful transaction: got %s", r)
+	}
+}
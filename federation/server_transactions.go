@@ -0,0 +1,104 @@
+package federation
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// TransactionError can be returned from the callbacks passed to HandleTransactionRequestsWithErrors to fail
+// the whole transaction. The /send request is responded to with StatusCode and a standard Matrix error body.
+type TransactionError struct {
+	StatusCode int
+	ErrCode    string // e.g M_FORBIDDEN. Defaults to M_UNKNOWN.
+	Message    string
+}
+
+func (e *TransactionError) Error() string {
+	return fmt.Sprintf("transaction failed with HTTP %d %s: %s", e.StatusCode, e.errCode(), e.Message)
+}
+
+func (e *TransactionError) errCode() string {
+	if e.ErrCode == "" {
+		return "M_UNKNOWN"
+	}
+	return e.ErrCode
+}
+
+// Retransmission is a transaction which was received again with a transaction ID already seen from the
+// same origin.
+type Retransmission struct {
+	Origin        spec.ServerName
+	TransactionID gomatrixserverlib.TransactionID
+	// How many times the transaction has been received, including the original.
+	Count int
+	// True if the body is identical to the first time the transaction was received. Homeservers must not
+	// reuse transaction IDs for different transactions.
+	Identical bool
+	// True if the previous attempt was successful, in which case the previous response was sent again
+	// without processing the transaction.
+	PreviouslySucceeded bool
+	Time                time.Time
+}
+
+func (r Retransmission) String() string {
+	return fmt.Sprintf(
+		"%s txn %s received %d times (identical=%v previously_succeeded=%v) at %s",
+		r.Origin, r.TransactionID, r.Count, r.Identical, r.PreviouslySucceeded, r.Time.Format(time.StampMilli),
+	)
+}
+
+// receivedTransaction is the first copy of a transaction received from an origin.
+type receivedTransaction struct {
+	hash  [sha256.Size]byte
+	count int
+	// the body of the successful response, if the transaction was successful
+	response []byte
+}
+
+// Retransmissions returns every retransmitted transaction received by the /send handler, in the order they
+// arrived. Useful for testing that homeservers retry failed transactions with the same transaction ID, and
+// don't reuse transaction IDs.
+func (s *Server) Retransmissions() []Retransmission {
+	s.transactionsMu.Lock()
+	defer s.transactionsMu.Unlock()
+	return append([]Retransmission{}, s.retransmissions...)
+}
+
+// trackTransaction records that the transaction was received. If it has been received before, the
+// retransmission is recorded and the previous response is returned if it succeeded.
+func (s *Server) trackTransaction(origin spec.ServerName, txnID gomatrixserverlib.TransactionID, body []byte) (previousResponse []byte) {
+	s.transactionsMu.Lock()
+	defer s.transactionsMu.Unlock()
+	key := string(origin) + "|" + string(txnID)
+	hash := sha256.Sum256(body)
+	txn, ok := s.transactions[key]
+	if !ok {
+		s.transactions[key] = &receivedTransaction{hash: hash, count: 1}
+		return nil
+	}
+	txn.count++
+	r := Retransmission{
+		Origin:              origin,
+		TransactionID:       txnID,
+		Count:               txn.count,
+		Identical:           txn.hash == hash,
+		PreviouslySucceeded: txn.response != nil,
+		Time:                time.Now(),
+	}
+	s.retransmissions = append(s.retransmissions, r)
+	s.t.Logf("[%s] Retransmission: %s", s.serverName, r)
+	return txn.response
+}
+
+// transactionSucceeded records the response to a transaction, which is sent again if it is retransmitted.
+func (s *Server) transactionSucceeded(origin spec.ServerName, txnID gomatrixserverlib.TransactionID, response []byte) {
+	s.transactionsMu.Lock()
+	defer s.transactionsMu.Unlock()
+	if txn, ok := s.transactions[string(origin)+"|"+string(txnID)]; ok {
+		txn.response = response
+	}
+}
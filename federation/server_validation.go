@@ -0,0 +1,244 @@
+package federation
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// maxPDUSize is the maximum size of a PDU in bytes, as per the spec.
+const maxPDUSize = 65536
+
+// WithStrictValidation enables strict validation of inbound PDUs and EDUs. Every PDU received via /send,
+// send_join, send_knock or send_leave is checked for its size, room version format, content hash, signatures
+// and whether it passes the auth rules of the room. Every EDU received via /send is checked for the required
+// fields of its type.
+// Violations are reported as test errors along with the offending JSON, but otherwise the events are
+// processed as normal.
+func WithStrictValidation() func(*Server) {
+	return func(s *Server) {
+		s.strictValidation = true
+	}
+}
+
+// validateInboundPDU reports a test error if the PDU fails validation, when strict validation is enabled.
+func (s *Server) validateInboundPDU(ctx context.Context, room *ServerRoom, pduJSON []byte) {
+	if !s.strictValidation {
+		return
+	}
+	if err := s.validatePDU(ctx, room, pduJSON); err != nil {
+		ct.Errorf(s.t, "[%s] WithStrictValidation: invalid PDU in room %s: %s\n%s", s.serverName, room.RoomID, err, string(pduJSON))
+	}
+}
+
+// validateInboundEDU reports a test error if the EDU fails validation, when strict validation is enabled.
+func (s *Server) validateInboundEDU(origin spec.ServerName, edu gomatrixserverlib.EDU) {
+	if !s.strictValidation {
+		return
+	}
+	if err := validateEDU(origin, edu); err != nil {
+		eduJSON, _ := json.Marshal(edu)
+		ct.Errorf(s.t, "[%s] WithStrictValidation: invalid %s EDU from %s: %s\n%s", s.serverName, edu.Type, origin, err, string(eduJSON))
+	}
+}
+
+// validatePDU returns all the reasons why the PDU is invalid, or nil if it is valid.
+func (s *Server) validatePDU(ctx context.Context, room *ServerRoom, pduJSON []byte) error {
+	var errs []error
+	if len(pduJSON) > maxPDUSize {
+		errs = append(errs, fmt.Errorf("PDU is %d bytes, maximum is %d", len(pduJSON), maxPDUSize))
+	}
+	verImpl, err := gomatrixserverlib.GetRoomVersion(room.Version)
+	if err != nil {
+		return fmt.Errorf("unknown room version %s: %w", room.Version, err)
+	}
+	hasEventID := gjson.GetBytes(pduJSON, "event_id").Exists()
+	if verImpl.EventFormat() == gomatrixserverlib.EventFormatV1 && !hasEventID {
+		errs = append(errs, fmt.Errorf("missing event_id, which is required in room version %s", room.Version))
+	} else if verImpl.EventFormat() != gomatrixserverlib.EventFormatV1 && hasEventID {
+		errs = append(errs, fmt.Errorf("has an event_id, which is not allowed in room version %s", room.Version))
+	}
+	if err = checkContentHash(pduJSON); err != nil {
+		errs = append(errs, err)
+	}
+	event, err := verImpl.NewEventFromUntrustedJSON(pduJSON)
+	if err != nil {
+		// we can't check anything else without a parsed event
+		errs = append(errs, fmt.Errorf("failed to parse event: %w", err))
+		return errors.Join(errs...)
+	}
+	if err = gomatrixserverlib.VerifyEventSignatures(ctx, event, s.keyRing, userIDForSender); err != nil {
+		errs = append(errs, fmt.Errorf("invalid signatures: %w", err))
+	}
+	if err = checkAuthAgainstAuthEvents(room, event); err != nil {
+		errs = append(errs, fmt.Errorf("not allowed by auth rules: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// checkContentHash checks that the sha256 content hash of the event matches the event. Unlike
+// NewEventFromUntrustedJSON, which redacts events with mismatched hashes, this returns an error.
+func checkContentHash(pduJSON []byte) error {
+	hash := gjson.GetBytes(pduJSON, "hashes.sha256")
+	if hash.Type != gjson.String {
+		return fmt.Errorf("missing hashes.sha256")
+	}
+	var want spec.Base64Bytes
+	if err := want.Decode(hash.Str); err != nil {
+		return fmt.Errorf("invalid hashes.sha256: %w", err)
+	}
+	hashable, err := gomatrixserverlib.CanonicalJSON(pduJSON)
+	if err != nil {
+		return fmt.Errorf("PDU is not valid canonical JSON: %w", err)
+	}
+	for _, key := range []string{"signatures", "unsigned", "hashes"} {
+		if hashable, err = sjson.DeleteBytes(hashable, key); err != nil {
+			return fmt.Errorf("failed to strip %s: %w", key, err)
+		}
+	}
+	got := sha256.Sum256(hashable)
+	if !bytes.Equal(got[:], want) {
+		return fmt.Errorf("content hash mismatch: got %s, event has %s", spec.Base64Bytes(got[:]).Encode(), hash.Str)
+	}
+	return nil
+}
+
+// checkAuthAgainstAuthEvents checks the event against the auth events it references. If any of
+// them are unknown, the current state of the room is used instead.
+func checkAuthAgainstAuthEvents(room *ServerRoom, event gomatrixserverlib.PDU) error {
+	var authEvents []gomatrixserverlib.PDU
+	for _, eventID := range event.AuthEventIDs() {
+		ev, ok := room.GetEventInTimeline(eventID)
+		if !ok {
+			return room.CheckAuth(event)
+		}
+		authEvents = append(authEvents, ev)
+	}
+	provider, err := gomatrixserverlib.NewAuthEvents(authEvents)
+	if err != nil {
+		return fmt.Errorf("failed to load auth events: %w", err)
+	}
+	return gomatrixserverlib.Allowed(event, provider, userIDForSender)
+}
+
+// validateEDU checks that an EDU has the fields required for its type. EDUs with unknown types are
+// not checked.
+func validateEDU(origin spec.ServerName, edu gomatrixserverlib.EDU) error {
+	if edu.Type == "" {
+		return fmt.Errorf("missing edu_type")
+	}
+	content := gjson.ParseBytes(edu.Content)
+	if !content.IsObject() {
+		return fmt.Errorf("content is not an object")
+	}
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch edu.Type {
+	case spec.MTyping:
+		check(requireString(content, "room_id"))
+		check(requireLocalUser(origin, content, "user_id"))
+		if !content.Get("typing").IsBool() {
+			check(fmt.Errorf("typing is not a boolean"))
+		}
+	case spec.MReceipt:
+		content.ForEach(func(roomID, receipts gjson.Result) bool {
+			receipts.ForEach(func(receiptType, users gjson.Result) bool {
+				users.ForEach(func(userID, receipt gjson.Result) bool {
+					if err := requireUserOnServer(origin, userID.Str); err != nil {
+						check(fmt.Errorf("%s %s: %w", roomID.Str, receiptType.Str, err))
+					}
+					eventIDs := receipt.Get("event_ids")
+					if !eventIDs.IsArray() || len(eventIDs.Array()) == 0 {
+						check(fmt.Errorf("%s %s %s: event_ids is not a non-empty array", roomID.Str, receiptType.Str, userID.Str))
+					}
+					if !receipt.Get("data").IsObject() {
+						check(fmt.Errorf("%s %s %s: data is not an object", roomID.Str, receiptType.Str, userID.Str))
+					}
+					return true
+				})
+				return true
+			})
+			return true
+		})
+	case spec.MPresence:
+		push := content.Get("push")
+		if !push.IsArray() {
+			return fmt.Errorf("push is not an array")
+		}
+		for i, p := range push.Array() {
+			if err := requireLocalUser(origin, p, "user_id"); err != nil {
+				check(fmt.Errorf("push[%d]: %w", i, err))
+			}
+			switch p.Get("presence").Str {
+			case "online", "offline", "unavailable":
+			default:
+				check(fmt.Errorf("push[%d]: invalid presence %q", i, p.Get("presence").Str))
+			}
+			if p.Get("last_active_ago").Type != gjson.Number {
+				check(fmt.Errorf("push[%d]: last_active_ago is not a number", i))
+			}
+		}
+	case "m.device_list_update":
+		check(requireLocalUser(origin, content, "user_id"))
+		check(requireString(content, "device_id"))
+		if content.Get("stream_id").Type != gjson.Number {
+			check(fmt.Errorf("stream_id is not a number"))
+		}
+		if prevID := content.Get("prev_id"); prevID.Exists() && !prevID.IsArray() {
+			check(fmt.Errorf("prev_id is not an array"))
+		}
+	case "m.signing_key_update":
+		check(requireLocalUser(origin, content, "user_id"))
+	case "m.direct_to_device":
+		check(requireLocalUser(origin, content, "sender"))
+		check(requireString(content, "type"))
+		check(requireString(content, "message_id"))
+		if !content.Get("messages").IsObject() {
+			check(fmt.Errorf("messages is not an object"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func requireString(content gjson.Result, field string) error {
+	if content.Get(field).Type != gjson.String {
+		return fmt.Errorf("%s is not a string", field)
+	}
+	return nil
+}
+
+// requireLocalUser checks that the field is a user ID on the origin server, as EDUs must originate there.
+func requireLocalUser(origin spec.ServerName, content gjson.Result, field string) error {
+	if err := requireString(content, field); err != nil {
+		return err
+	}
+	if err := requireUserOnServer(origin, content.Get(field).Str); err != nil {
+		return fmt.Errorf("%s: %w", field, err)
+	}
+	return nil
+}
+
+func requireUserOnServer(origin spec.ServerName, userID string) error {
+	user, err := spec.NewUserID(userID, true)
+	if err != nil {
+		return fmt.Errorf("invalid user ID %q: %w", userID, err)
+	}
+	if user.Domain() != origin {
+		return fmt.Errorf("user %s does not belong to origin %s", userID, origin)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package federation
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+)
+
+// EXPERIMENTAL
+// VirtualHost is a single listener which serves many federation servers. Each server created via
+// VirtualHost.NewServer has its own server name, signing keys, rooms and handlers, but they all share
+// one port and one TLS certificate. This makes it cheap to simulate rooms with dozens of remote servers.
+//
+// Each virtual server is given one of the hostnames from config.Complement.VirtualServerHostname, which
+// resolve to the host running Complement from inside homeserver containers. These hostnames are only
+// added to containers if COMPLEMENT_VIRTUAL_SERVER_HOSTNAMES is set, and only on Linux. Incoming requests are routed
+// to a virtual server by the `destination` in the X-Matrix Authorization header, falling back to the Host
+// header for unauthenticated requests such as key fetches.
+//
+// Usage:
+//
+//	vh := federation.NewVirtualHost(t, deployment)
+//	cancel := vh.Listen()
+//	defer cancel()
+//	srv := vh.NewServer(t, deployment, federation.HandleKeyRequests())
+//	srvCancel := srv.Listen()
+//	defer srvCancel()
+type VirtualHost struct {
+	t   ct.TestLike
+	cfg *config.Complement
+
+	certPath  string
+	keyPath   string
+	srv       *http.Server
+	port      int
+	listening bool
+
+	mu            sync.RWMutex
+	servers       map[spec.ServerName]*Server
+	usedHostnames map[string]bool
+}
+
+// EXPERIMENTAL
+// NewVirtualHost creates a listener which can serve many federation servers. Call Listen() before
+// creating servers with NewServer.
+func NewVirtualHost(t ct.TestLike, deployment FederationDeployment) *VirtualHost {
+	cfg := deployment.GetConfig()
+	if cfg.VirtualServerHostnames == 0 {
+		ct.Fatalf(t, "NewVirtualHost: COMPLEMENT_VIRTUAL_SERVER_HOSTNAMES is 0, so there are no hostnames available for virtual servers. Set it to the number of virtual servers the tests need.")
+	}
+	vh := &VirtualHost{
+		t:             t,
+		cfg:           cfg,
+		servers:       make(map[spec.ServerName]*Server),
+		usedHostnames: make(map[string]bool),
+	}
+	hostnames := make([]string, 0, cfg.VirtualServerHostnames)
+	for i := 1; i <= cfg.VirtualServerHostnames; i++ {
+		hostnames = append(hostnames, cfg.VirtualServerHostname(i))
+	}
+	httpServer, certPath, keyPath, err := federationServer(cfg, vh, hostnames...)
+	if err != nil {
+		ct.Fatalf(t, "NewVirtualHost: unable to create federation server and certificates: %s", err.Error())
+	}
+	vh.srv = httpServer
+	vh.certPath = certPath
+	vh.keyPath = keyPath
+	return vh
+}
+
+// NewServer creates a new virtual federation server with configured options. As with normal servers,
+// call Listen() on the returned server before using it, which will start routing requests to it.
+// Fails the test if all of the virtual server hostnames are in use.
+func (vh *VirtualHost) NewServer(t ct.TestLike, deployment FederationDeployment, opts ...func(*Server)) *Server {
+	t.Helper()
+	vh.mu.Lock()
+	var hostname string
+	for i := 1; i <= vh.cfg.VirtualServerHostnames; i++ {
+		h := vh.cfg.VirtualServerHostname(i)
+		if !vh.usedHostnames[h] {
+			hostname = h
+			vh.usedHostnames[h] = true
+			break
+		}
+	}
+	vh.mu.Unlock()
+	if hostname == "" {
+		ct.Fatalf(t, "VirtualHost.NewServer: all %d virtual server hostnames are in use, increase COMPLEMENT_VIRTUAL_SERVER_HOSTNAMES", vh.cfg.VirtualServerHostnames)
+	}
+	srv := newServer(t, deployment, hostname)
+	srv.virtualHost = vh
+	for _, opt := range opts {
+		opt(srv)
+	}
+	return srv
+}
+
+// Servers returns all virtual servers which are currently listening.
+func (vh *VirtualHost) Servers() []*Server {
+	vh.mu.RLock()
+	defer vh.mu.RUnlock()
+	servers := make([]*Server, 0, len(vh.servers))
+	for _, s := range vh.servers {
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+// Listen for federation server requests - call the returned function to gracefully close the listener.
+func (vh *VirtualHost) Listen() (cancel func()) {
+	if vh.listening {
+		return func() {}
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	ln, err := net.Listen("tcp", ":0") //nolint
+	if err != nil {
+		ct.Fatalf(vh.t, "VirtualHost.Listen: net.Listen failed: %s", err)
+	}
+	vh.port = ln.Addr().(*net.TCPAddr).Port
+	vh.listening = true
+
+	go func() {
+		defer ln.Close()
+		defer wg.Done()
+		err := vh.srv.ServeTLS(ln, vh.certPath, vh.keyPath)
+		if err != nil && err != http.ErrServerClosed {
+			vh.t.Logf("VirtualHost.Listen: ServeTLS failed: %s", err)
+		}
+	}()
+
+	return func() {
+		for _, s := range vh.Servers() {
+			s.closeQueues()
+		}
+		err := vh.srv.Close()
+		if err != nil {
+			ct.Fatalf(vh.t, "VirtualHost.Listen: failed to shutdown server: %s", err)
+		}
+		wg.Wait()
+	}
+}
+
+// listen starts routing requests to `s`, which must have been created via NewServer.
+func (vh *VirtualHost) listen(s *Server) (cancel func()) {
+	if !vh.listening {
+		ct.Fatalf(s.t, "Server.Listen() called on a virtual server before VirtualHost.Listen() - ensure you call VirtualHost.Listen() first!")
+	}
+	hostname := string(s.serverName)
+	s.serverName = spec.ServerName(fmt.Sprintf("%s:%d", hostname, vh.port))
+	s.listening = true
+	vh.mu.Lock()
+	vh.servers[s.serverName] = s
+	vh.mu.Unlock()
+
+	return func() {
+		s.closeQueues()
+		vh.mu.Lock()
+		defer vh.mu.Unlock()
+		delete(vh.servers, s.serverName)
+		delete(vh.usedHostnames, hostname)
+	}
+}
+
+// ServeHTTP routes the request to the virtual server it is destined for.
+func (vh *VirtualHost) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	destination := spec.ServerName(req.Host)
+	if _, _, authDestination, _, _ := fclient.ParseAuthorization(req.Header.Get("Authorization")); authDestination != "" {
+		destination = authDestination
+	}
+	vh.mu.RLock()
+	s := vh.servers[destination]
+	vh.mu.RUnlock()
+	if s == nil {
+		vh.t.Logf("VirtualHost: received request for unknown server %s: %s %s - sending 404", destination, req.Method, req.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(404)
+		w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"complement: no virtual server with this name"}`))
+		return
+	}
+	s.ServeHTTP(w, req)
+}
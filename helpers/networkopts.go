@@ -0,0 +1,11 @@
+package helpers
+
+import "time"
+
+// NetworkImpairmentOpts describes how traffic sent by a homeserver is impaired. Zero values are not applied.
+type NetworkImpairmentOpts struct {
+	Latency       time.Duration // default 0 (no added latency)
+	Jitter        time.Duration // default 0 (constant latency). Only applied with Latency.
+	LossPercent   float64       // default 0 (no loss) e.g 12.5 to drop 12.5% of packets
+	BandwidthKbit int           // default 0 (unlimited) in kilobits per second
+}
@@ -0,0 +1,248 @@
+package docker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+
+	"github.com/matrix-org/complement/b"
+)
+
+// the label on blueprint images with the hash of everything which was used to build them. See blueprintHash.
+const blueprintHashLabel = "complement_blueprint_hash"
+
+// blueprintCacheVersion is included in the hash of every blueprint. Bump it when a change to Complement changes
+// the images built from blueprints, so cached images from older versions are not used.
+const blueprintCacheVersion = 1
+
+// blueprintCacheStats records whether each blueprint was found in the cache, so a report can be printed at
+// the end of the run.
+type blueprintCacheStats struct {
+	mu     sync.Mutex
+	hits   []string
+	misses []string // "$name ($reason)"
+}
+
+func (s *blueprintCacheStats) hit(bprintName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hits = append(s.hits, bprintName)
+}
+
+func (s *blueprintCacheStats) miss(bprintName, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.misses = append(s.misses, fmt.Sprintf("%s (%s)", bprintName, reason))
+}
+
+// report prints the cache hits and misses since the last report.
+func (s *blueprintCacheStats) report() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.hits) == 0 && len(s.misses) == 0 {
+		return
+	}
+	log.Printf(
+		"Blueprint cache: %d hit(s), %d miss(es)\n  hits: %s\n  misses: %s\n",
+		len(s.hits), len(s.misses), strings.Join(s.hits, ", "), strings.Join(s.misses, ", "),
+	)
+	s.hits = nil
+	s.misses = nil
+}
+
+// hashBlueprint returns a hash of the blueprint and the other inputs which affect the images built from it.
+func hashBlueprint(bprint b.Blueprint, inputs []string) (string, error) {
+	// application service tokens are random, and are read from image labels when the blueprint is deployed
+	// so they don't need to match
+	homeservers := make([]b.Homeserver, len(bprint.Homeservers))
+	for i, hs := range bprint.Homeservers {
+		hs.ApplicationServices = slices.Clone(hs.ApplicationServices)
+		for j := range hs.ApplicationServices {
+			hs.ApplicationServices[j].HSToken = ""
+			hs.ApplicationServices[j].ASToken = ""
+		}
+		homeservers[i] = hs
+	}
+	bprint.Homeservers = homeservers
+	data, err := json.Marshal(struct {
+		Version   int
+		Blueprint b.Blueprint
+		Inputs    []string
+	}{
+		Version:   blueprintCacheVersion,
+		Blueprint: bprint,
+		Inputs:    inputs,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// blueprintHash returns the hash to label images built from the blueprint with, or "" if the cache is
+// disabled. The hash covers the blueprint, the IDs of the images it is built from and the environment
+// variables shared with homeservers.
+func (d *Builder) blueprintHash(bprint b.Blueprint) (string, error) {
+	if !d.Config.BlueprintCache {
+		return "", nil
+	}
+	var inputs []string
+	for _, hs := range bprint.Homeservers {
+		refs := []string{d.baseImageURI(hs)}
+		for _, sc := range hs.Sidecars {
+			if sc.Image != "" {
+				refs = append(refs, sc.Image)
+			}
+		}
+		for _, ref := range refs {
+			inspect, err := d.Docker.ImageInspect(context.Background(), ref)
+			if err != nil {
+				return "", fmt.Errorf("failed to inspect image %s: %w", ref, err)
+			}
+			inputs = append(inputs, hs.Name+":"+ref+"="+inspect.ID)
+		}
+		if hs.UpgradeFromImageURI != nil {
+			// the image to upgrade to is stored in a label
+			inputs = append(inputs, hs.Name+":upgrade_to="+d.upgradeToImageURI(hs))
+		}
+	}
+	if d.Config.EnvVarsPropagatePrefix != "" {
+		var env []string
+		for _, ev := range os.Environ() {
+			if strings.HasPrefix(ev, d.Config.EnvVarsPropagatePrefix) {
+				env = append(env, ev)
+			}
+		}
+		sort.Strings(env)
+		inputs = append(inputs, env...)
+	}
+	return hashBlueprint(bprint, inputs)
+}
+
+// lookupBlueprintCache checks if images built from the blueprint with this hash exist. Images of the
+// blueprint with any other hash are stale, so they are removed.
+func (d *Builder) lookupBlueprintCache(bprint b.Blueprint, hash string, images []image.Summary) (bool, error) {
+	stale, missReason := classifyBlueprintImages(bprint, hash, images)
+	for _, img := range stale {
+		_, err := d.Docker.ImageRemove(context.Background(), img.ID, image.RemoveOptions{
+			Force: true,
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to remove stale image %s: %w", img.ID, err)
+		}
+	}
+	if missReason != "" {
+		d.cacheStats.miss(bprint.Name, missReason)
+		return false, nil
+	}
+	d.cacheStats.hit(bprint.Name)
+	return true, nil
+}
+
+// classifyBlueprintImages returns the images of the blueprint which should be removed, and why the blueprint
+// must be built, or "" if every image was built with this hash.
+func classifyBlueprintImages(bprint b.Blueprint, hash string, images []image.Summary) (stale []image.Summary, missReason string) {
+	wantImages := 0
+	for _, hs := range bprint.Homeservers {
+		wantImages += 1 + len(hs.Sidecars)
+	}
+	found := 0
+	for _, img := range images {
+		if img.Labels[blueprintHashLabel] == hash {
+			found++
+		} else {
+			stale = append(stale, img)
+		}
+	}
+	switch {
+	case found == wantImages:
+		return stale, ""
+	case len(images) == 0:
+		return nil, "not cached"
+	case found == 0:
+		return images, "blueprint or base image changed"
+	default:
+		// a previous build didn't finish, so start again
+		return images, "incomplete build"
+	}
+}
+
+// cachedBuild is the images of one build of a blueprint.
+type cachedBuild struct {
+	pkg      string
+	imageIDs []string
+	created  time.Time
+}
+
+// gcBlueprintCache removes cached blueprint images which are older than COMPLEMENT_BLUEPRINT_CACHE_MAX_AGE_HOURS,
+// then the oldest builds if there are more than COMPLEMENT_BLUEPRINT_CACHE_MAX_ENTRIES. Images from every
+// package are considered, so the cache doesn't grow when packages are renamed. Images of other packages
+// are not forced, as those packages may be deploying them right now: images which are in use are kept.
+func (d *Builder) gcBlueprintCache() error {
+	images, err := d.Docker.ImageList(context.Background(), image.ListOptions{
+		Filters: label(blueprintHashLabel),
+	})
+	if err != nil {
+		return err
+	}
+	builds := make(map[string]*cachedBuild) // pkg/blueprint/hash -> build
+	for _, img := range images {
+		if img.Labels[blueprintHashLabel] == "" || !isLocalhostImage(img) {
+			continue
+		}
+		key := img.Labels["complement_pkg"] + "/" + img.Labels["complement_blueprint"] + "/" + img.Labels[blueprintHashLabel]
+		build := builds[key]
+		if build == nil {
+			build = &cachedBuild{pkg: img.Labels["complement_pkg"]}
+			builds[key] = build
+		}
+		build.imageIDs = append(build.imageIDs, img.ID)
+		if created := time.Unix(img.Created, 0); created.After(build.created) {
+			build.created = created
+		}
+	}
+	sorted := make([]*cachedBuild, 0, len(builds))
+	for _, build := range builds {
+		sorted = append(sorted, build)
+	}
+	// newest first
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].created.After(sorted[j].created)
+	})
+	for i, build := range sorted {
+		if i < d.Config.BlueprintCacheMaxEntries && time.Since(build.created) < d.Config.BlueprintCacheMaxAge {
+			continue
+		}
+		ownPackage := build.pkg == d.Config.PackageNamespace
+		var removed []string
+		for _, imageID := range build.imageIDs {
+			_, err = d.Docker.ImageRemove(context.Background(), imageID, image.RemoveOptions{
+				Force: ownPackage,
+			})
+			if err != nil && ownPackage {
+				return err
+			}
+			if err != nil {
+				d.log("Not removing cached blueprint image %s of package %s: %s", imageID, build.pkg, err)
+				continue
+			}
+			removed = append(removed, imageID)
+		}
+		if len(removed) > 0 {
+			d.log("Removed cached blueprint images %v built at %s", removed, build.created)
+		}
+	}
+	return nil
+}
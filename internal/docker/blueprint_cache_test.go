@@ -0,0 +1,205 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/config"
+)
+
+func TestHashBlueprint(t *testing.T) {
+	blueprint := func(hsToken, asToken string) b.Blueprint {
+		return b.Blueprint{
+			Name: "bridge",
+			Homeservers: []b.Homeserver{
+				{
+					Name:  "hs1",
+					Users: []b.User{{Localpart: "alice"}},
+					ApplicationServices: []b.ApplicationService{
+						{ID: "bridge", HSToken: hsToken, ASToken: asToken, URL: "http://bridge", SenderLocalpart: "bot"},
+					},
+				},
+			},
+		}
+	}
+	mustHash := func(bprint b.Blueprint, inputs ...string) string {
+		t.Helper()
+		hash, err := hashBlueprint(bprint, inputs)
+		if err != nil {
+			t.Fatalf("hashBlueprint: %s", err)
+		}
+		return hash
+	}
+	base := blueprint("hs_token_1", "as_token_1")
+	hash := mustHash(base, "hs1:base=sha256:aaa")
+
+	// the hash is stable, and ignores the random application service tokens
+	if got := mustHash(blueprint("hs_token_1", "as_token_1"), "hs1:base=sha256:aaa"); got != hash {
+		t.Errorf("hash of the same blueprint changed: got %s, want %s", got, hash)
+	}
+	if got := mustHash(blueprint("hs_token_2", "as_token_2"), "hs1:base=sha256:aaa"); got != hash {
+		t.Errorf("hash changed when only application service tokens changed: got %s, want %s", got, hash)
+	}
+	// the tokens are still needed to deploy the blueprint, so must not be stripped from it
+	if as := base.Homeservers[0].ApplicationServices[0]; as.HSToken != "hs_token_1" || as.ASToken != "as_token_1" {
+		t.Errorf("hashBlueprint modified the blueprint: got %+v", as)
+	}
+
+	// anything else which affects the images changes the hash
+	changedUsers := blueprint("hs_token_1", "as_token_1")
+	changedUsers.Homeservers[0].Users = append(changedUsers.Homeservers[0].Users, b.User{Localpart: "bob"})
+	changedAS := blueprint("hs_token_1", "as_token_1")
+	changedAS.Homeservers[0].ApplicationServices[0].URL = "http://other"
+	testCases := []struct {
+		name   string
+		bprint b.Blueprint
+		inputs []string
+	}{
+		{"users", changedUsers, []string{"hs1:base=sha256:aaa"}},
+		{"application service", changedAS, []string{"hs1:base=sha256:aaa"}},
+		{"base image", base, []string{"hs1:base=sha256:bbb"}},
+		{"no inputs", base, nil},
+	}
+	for _, tc := range testCases {
+		if got := mustHash(tc.bprint, tc.inputs...); got == hash {
+			t.Errorf("%s: hash did not change", tc.name)
+		}
+	}
+}
+
+func TestClassifyBlueprintImages(t *testing.T) {
+	bprint := b.Blueprint{
+		Name: "two_servers",
+		Homeservers: []b.Homeserver{
+			{Name: "hs1", Sidecars: []b.Sidecar{{Name: "db"}}},
+			{Name: "hs2"},
+		},
+	}
+	img := func(id, hash string) image.Summary {
+		return image.Summary{ID: id, Labels: map[string]string{blueprintHashLabel: hash}}
+	}
+	ids := func(images []image.Summary) []string {
+		var ids []string
+		for _, img := range images {
+			ids = append(ids, img.ID)
+		}
+		return ids
+	}
+	testCases := []struct {
+		name       string
+		images     []image.Summary
+		wantStale  []string
+		wantReason string
+	}{
+		{
+			name:       "not cached",
+			wantReason: "not cached",
+		},
+		{
+			name:   "cached",
+			images: []image.Summary{img("hs1", "new"), img("db", "new"), img("hs2", "new")},
+		},
+		{
+			name:      "cached with images from an old build",
+			images:    []image.Summary{img("hs1", "new"), img("db", "new"), img("hs2", "new"), img("old_hs1", "old")},
+			wantStale: []string{"old_hs1"},
+		},
+		{
+			name:       "changed",
+			images:     []image.Summary{img("hs1", "old"), img("db", "old"), img("hs2", "old")},
+			wantStale:  []string{"hs1", "db", "hs2"},
+			wantReason: "blueprint or base image changed",
+		},
+		{
+			name:       "incomplete build",
+			images:     []image.Summary{img("hs1", "new"), img("db", "new"), img("old_hs2", "old")},
+			wantStale:  []string{"hs1", "db", "old_hs2"},
+			wantReason: "incomplete build",
+		},
+		{
+			name:       "unlabelled images",
+			images:     []image.Summary{img("hs1", ""), img("db", ""), img("hs2", "")},
+			wantStale:  []string{"hs1", "db", "hs2"},
+			wantReason: "blueprint or base image changed",
+		},
+	}
+	for _, tc := range testCases {
+		stale, reason := classifyBlueprintImages(bprint, "new", tc.images)
+		if reason != tc.wantReason {
+			t.Errorf("%s: got reason %q, want %q", tc.name, reason, tc.wantReason)
+		}
+		if got := ids(stale); !slices.Equal(got, tc.wantStale) {
+			t.Errorf("%s: got stale images %v, want %v", tc.name, got, tc.wantStale)
+		}
+	}
+}
+
+// imageRemoveRecorder is a ContainerRuntime which lists canned images and records which are removed.
+type imageRemoveRecorder struct {
+	ContainerRuntime
+	images  []image.Summary
+	inUse   map[string]bool
+	removed map[string]bool // image ID -> forced
+}
+
+func (r *imageRemoveRecorder) ImageList(ctx context.Context, options image.ListOptions) ([]image.Summary, error) {
+	return r.images, nil
+}
+
+func (r *imageRemoveRecorder) ImageRemove(ctx context.Context, imageID string, options image.RemoveOptions) ([]image.DeleteResponse, error) {
+	if r.inUse[imageID] && !options.Force {
+		return nil, fmt.Errorf("conflict: image %s is being used by a running container", imageID)
+	}
+	r.removed[imageID] = options.Force
+	return nil, nil
+}
+
+func TestGCBlueprintCacheOnlyForcesOwnPackage(t *testing.T) {
+	cachedImage := func(id, pkg string) image.Summary {
+		return image.Summary{
+			ID:       id,
+			RepoTags: []string{"localhost/complement-" + pkg + "-bprint:hs1"},
+			Created:  time.Now().Add(-time.Minute).Unix(),
+			Labels: map[string]string{
+				blueprintHashLabel:     "hash",
+				"complement_pkg":       pkg,
+				"complement_blueprint": "bprint",
+			},
+		}
+	}
+	r := &imageRemoveRecorder{
+		images: []image.Summary{
+			cachedImage("own", "pkg1"),
+			cachedImage("other", "pkg2"),
+			cachedImage("other-in-use", "pkg3"),
+		},
+		inUse:   map[string]bool{"other-in-use": true},
+		removed: make(map[string]bool),
+	}
+	d := &Builder{
+		Docker: r,
+		Config: &config.Complement{
+			PackageNamespace:         "pkg1",
+			BlueprintCacheMaxEntries: 0,
+			BlueprintCacheMaxAge:     time.Hour,
+		},
+	}
+	if err := d.gcBlueprintCache(); err != nil {
+		t.Fatalf("gcBlueprintCache: %s", err)
+	}
+	if forced, ok := r.removed["own"]; !ok || !forced {
+		t.Errorf("image of this package: got removed=%v forced=%v, want forced removal", ok, forced)
+	}
+	if forced, ok := r.removed["other"]; !ok || forced {
+		t.Errorf("image of another package: got removed=%v forced=%v, want removal without force", ok, forced)
+	}
+	if _, ok := r.removed["other-in-use"]; ok {
+		t.Errorf("in-use image of another package was removed")
+	}
+}
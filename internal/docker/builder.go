@@ -14,16 +14,17 @@
 package docker
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"log"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/network"
-	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
 
@@ -35,15 +36,13 @@ import (
 const complementLabel = "complement_context"
 
 type Builder struct {
-	Config *config.Complement
-	Docker *client.Client
+	Config     *config.Complement
+	Docker     ContainerRuntime
+	cacheStats blueprintCacheStats
 }
 
 func NewBuilder(cfg *config.Complement) (*Builder, error) {
-	cli, err := client.NewClientWithOpts(
-		client.FromEnv,
-		client.WithAPIVersionNegotiation(),
-	)
+	cli, err := NewContainerRuntime(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -73,6 +72,13 @@ func (d *Builder) Cleanup() {
 	if err != nil {
 		d.log("Cleanup: Failed to remove networks: %s", err)
 	}
+	if d.Config.BlueprintCache {
+		err = d.gcBlueprintCache()
+		if err != nil {
+			d.log("Cleanup: Failed to remove old cached blueprints: %s", err)
+		}
+		d.cacheStats.report()
+	}
 }
 
 // removeImages removes all images with `complementLabel`.
@@ -107,20 +113,14 @@ func (d *Builder) removeImages() error {
 		return err
 	}
 	for _, img := range images {
-		// we only clean up localhost/complement images else if someone docker pulls
-		// an anonymous snapshot we might incorrectly nuke it :( any non-localhost
-		// tag marks this image as safe (as images can have multiple tags)
-		isLocalhost := true
-		for _, rt := range img.RepoTags {
-			if !strings.HasPrefix(rt, "localhost/complement") {
-				isLocalhost = false
-				break
-			}
-		}
-		if !isLocalhost {
+		if !isLocalhostImage(img) {
 			d.log("Not cleaning up image with tags: %v", img.RepoTags)
 			continue
 		}
+		if d.Config.BlueprintCache && img.Labels[blueprintHashLabel] != "" {
+			// cached images are removed by gcBlueprintCache
+			continue
+		}
 		bprintName := img.Labels["complement_blueprint"]
 		keep := false
 		for _, keepBprint := range d.Config.KeepBlueprints {
@@ -144,6 +144,19 @@ func (d *Builder) removeImages() error {
 	return nil
 }
 
+// isLocalhostImage returns true if the image was made by Complement.
+func isLocalhostImage(img image.Summary) bool {
+	// we only clean up localhost/complement images else if someone docker pulls
+	// an anonymous snapshot we might incorrectly nuke it :( any non-localhost
+	// tag marks this image as safe (as images can have multiple tags)
+	for _, rt := range img.RepoTags {
+		if !strings.HasPrefix(rt, "localhost/complement") {
+			return false
+		}
+	}
+	return true
+}
+
 // removeContainers removes all containers with `complementLabel`.
 func (d *Builder) removeContainers() error {
 	containers, err := d.Docker.ContainerList(context.Background(), container.ListOptions{
@@ -177,6 +190,21 @@ func (d *Builder) ConstructBlueprintIfNotExist(bprint b.Blueprint) error {
 	if err != nil {
 		return fmt.Errorf("ConstructBlueprintIfNotExist(%s): failed to ImageList: %w", bprint.Name, err)
 	}
+	if d.Config.BlueprintCache && !slices.Contains(d.Config.KeepBlueprints, bprint.Name) {
+		hash, err := d.blueprintHash(bprint)
+		if err != nil {
+			return fmt.Errorf("ConstructBlueprintIfNotExist(%s): failed to hash blueprint: %w", bprint.Name, err)
+		}
+		found, err := d.lookupBlueprintCache(bprint, hash, images)
+		if err != nil {
+			return fmt.Errorf("ConstructBlueprintIfNotExist(%s): %w", bprint.Name, err)
+		}
+		if found {
+			d.log("Using cached images for blueprint %s", bprint.Name)
+			return nil
+		}
+		images = nil
+	}
 	if len(images) == 0 {
 		err = d.ConstructBlueprint(bprint)
 		if err != nil {
@@ -241,6 +269,10 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 	if err != nil {
 		return []error{err}
 	}
+	hash, err := d.blueprintHash(bprint)
+	if err != nil {
+		return []error{err}
+	}
 
 	runner := instruction.NewRunner(bprint.Name, d.Config.BestEffort, d.Config.DebugLoggingEnabled)
 	results := make([]result, len(bprint.Homeservers))
@@ -252,6 +284,15 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 				// something went wrong, but we have a container which may have interesting logs
 				printLogs(d.Docker, res.containerID, res.contextStr)
 			}
+			for _, name := range sortedSidecarNames(res.sidecars) {
+				sidecarContext := res.contextStr + "." + name
+				printLogs(d.Docker, res.sidecars[name], sidecarContext)
+				if delErr := d.Docker.ContainerRemove(context.Background(), res.sidecars[name], container.RemoveOptions{
+					Force: true,
+				}); delErr != nil {
+					d.log("%s: failed to remove sidecar which failed to deploy: %s", sidecarContext, delErr)
+				}
+			}
 			if delErr := d.Docker.ContainerRemove(context.Background(), res.containerID, container.RemoveOptions{
 				Force: true,
 			}); delErr != nil {
@@ -260,25 +301,12 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 			// there is little point continuing to set up the remaining homeservers at this point
 			return
 		}
-		// kill the container
+		// kill the containers
 		defer func(r result) {
-			containerInfo, err := d.Docker.ContainerInspect(context.Background(), r.containerID)
-
-			if err != nil {
-				d.log("%s : Can't get status of %s", r.contextStr, r.containerID)
-				return
-			}
-
-			if !containerInfo.State.Running {
-				// The container isn't running anyway, so no need to kill it.
-				return
+			d.killContainer(r.contextStr, r.containerID)
+			for _, name := range sortedSidecarNames(r.sidecars) {
+				d.killContainer(r.contextStr+"."+name, r.sidecars[name])
 			}
-
-			killErr := d.Docker.ContainerKill(context.Background(), r.containerID, "KILL")
-			if killErr != nil {
-				d.log("%s : Failed to kill container %s: %s\n", r.contextStr, r.containerID, killErr)
-			}
-
 		}(res)
 		results[i] = res
 	}
@@ -316,6 +344,12 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 		for k, v := range asLabels {
 			labels[k] = v
 		}
+		if hash != "" {
+			labels[blueprintHashLabel] = hash
+		}
+		if res.homeserver.UpgradeFromImageURI != nil {
+			labels[upgradeToLabel] = d.upgradeToImageURI(res.homeserver)
+		}
 
 		// Stop the container before we commit it.
 		// This gives it chance to shut down gracefully.
@@ -348,10 +382,57 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 		}
 		imageID := strings.Replace(commit.ID, "sha256:", "", 1)
 		d.log("%s: Created docker image %s\n", res.contextStr, imageID)
+
+		// commit the sidecars after the homeserver has stopped, so it isn't still writing to them. The images
+		// inherit the labels of the sidecar containers, so they are found alongside the homeserver image.
+		for _, name := range sortedSidecarNames(res.sidecars) {
+			sidecarContext := res.contextStr + "." + name
+			containerID := res.sidecars[name]
+			d.Docker.ContainerStop(context.Background(), containerID, container.StopOptions{
+				Timeout: &tenSeconds,
+			})
+			var changes []string
+			if hash != "" {
+				changes = toChanges(map[string]string{blueprintHashLabel: hash})
+			}
+			commit, err := d.Docker.ContainerCommit(context.Background(), containerID, container.CommitOptions{
+				Author:    "Complement",
+				Pause:     true,
+				Reference: "localhost/complement:" + res.contextStr + "_" + name,
+				Changes:   changes,
+				Config:    &container.Config{},
+			})
+			if err != nil {
+				d.log("%s : failed to ContainerCommit: %s\n", sidecarContext, err)
+				errs = append(errs, fmt.Errorf("%s : failed to ContainerCommit: %w", sidecarContext, err))
+				continue
+			}
+			d.log("%s: Created docker image %s\n", sidecarContext, strings.Replace(commit.ID, "sha256:", "", 1))
+		}
 	}
 	return errs
 }
 
+// killContainer kills the container if it is still running.
+func (d *Builder) killContainer(contextStr, containerID string) {
+	containerInfo, err := d.Docker.ContainerInspect(context.Background(), containerID)
+
+	if err != nil {
+		d.log("%s : Can't get status of %s", contextStr, containerID)
+		return
+	}
+
+	if !containerInfo.State.Running {
+		// The container isn't running anyway, so no need to kill it.
+		return
+	}
+
+	killErr := d.Docker.ContainerKill(context.Background(), containerID, "KILL")
+	if killErr != nil {
+		d.log("%s : Failed to kill container %s: %s\n", contextStr, containerID, killErr)
+	}
+}
+
 // Convert a map of labels to a list of changes directive in Dockerfile format.
 // Labels keys and values can't be multiline (eg. can't contain `\n` character)
 // neither can they contain unescaped `"` character.
@@ -371,14 +452,17 @@ func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.
 	if err != nil {
 		log.Printf("%s : failed to deployBaseImage: %s\n", contextStr, err)
 		containerID := ""
+		var sidecars map[string]string
 		if dep != nil {
 			containerID = dep.ContainerID
+			sidecars = dep.Sidecars
 		}
 		return result{
 			err:         err,
 			containerID: containerID,
 			contextStr:  contextStr,
 			homeserver:  hs,
+			sidecars:    sidecars,
 		}
 	}
 	d.log("%s : deployed base image to %s (%s)\n", contextStr, dep.BaseURL, dep.ContainerID)
@@ -391,28 +475,67 @@ func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.
 		containerID: dep.ContainerID,
 		contextStr:  contextStr,
 		homeserver:  hs,
+		sidecars:    dep.Sidecars,
+	}
+}
+
+// baseImageURI returns the image which the homeserver is built from.
+func (d *Builder) baseImageURI(hs b.Homeserver) string {
+	if hs.UpgradeFromImageURI != nil {
+		return *hs.UpgradeFromImageURI
+	}
+	return d.upgradeToImageURI(hs)
+}
+
+// upgradeToImageURI returns the image which the homeserver would be built from if it didn't have an
+// UpgradeFromImageURI.
+func (d *Builder) upgradeToImageURI(hs b.Homeserver) string {
+	if hs.BaseImageURI != nil {
+		return *hs.BaseImageURI
 	}
+	// Use HS specific base image if defined
+	if uri, ok := d.Config.BaseImageURIs[hs.Name]; ok {
+		return uri
+	}
+	return d.Config.BaseImageURI
 }
 
 // deployBaseImage runs the base image and returns the baseURL, containerID or an error.
 func (d *Builder) deployBaseImage(blueprintName string, hs b.Homeserver, contextStr, networkName string) (*HomeserverDeployment, error) {
 	asIDToRegistrationMap := asIDToRegistrationFromLabels(labelsForApplicationServices(hs))
-	var baseImageURI string
-	if hs.BaseImageURI == nil {
-		baseImageURI = d.Config.BaseImageURI
-		// Use HS specific base image if defined
-		if uri, ok := d.Config.BaseImageURIs[hs.Name]; ok {
-			baseImageURI = uri
+	baseImageURI := d.baseImageURI(hs)
+
+	// start the sidecars first, as the homeserver may need them to start e.g a database
+	var sidecars map[string]string
+	for _, sc := range hs.Sidecars {
+		if sidecars == nil {
+			sidecars = make(map[string]string)
+		}
+		spec := sidecarSpecFromBlueprint(sc, baseImageURI)
+		spec.hsName = hs.Name
+		spec.containerName = fmt.Sprintf("complement_%s_%s", contextStr, sc.Name)
+		spec.networkName = networkName
+		spec.blueprintName = blueprintName
+		spec.contextStr = contextStr
+		containerID, err := deploySidecar(d.Docker, d.Config, spec)
+		if containerID != "" {
+			sidecars[sc.Name] = containerID
+		}
+		if err != nil {
+			return &HomeserverDeployment{Sidecars: sidecars}, err
 		}
-	} else {
-		baseImageURI = *hs.BaseImageURI
+		d.log("%s : deployed sidecar %s (%s)\n", contextStr, sc.Name, containerID)
 	}
 
-	return deployImage(
+	dep, err := deployImage(
 		d.Docker, baseImageURI, fmt.Sprintf("complement_%s", contextStr),
 		d.Config.PackageNamespace, blueprintName, hs.Name, asIDToRegistrationMap, contextStr,
-		networkName, d.Config,
+		networkName, d.Config, deployImageOpts{sidecars: sidecars},
 	)
+	if dep == nil && len(sidecars) > 0 {
+		dep = &HomeserverDeployment{Sidecars: sidecars}
+	}
+	return dep, err
 }
 
 // Multilines label using Dockerfile syntax is unsupported, let's inline \n instead
@@ -436,7 +559,7 @@ func generateASRegistrationYaml(as b.ApplicationService) string {
 
 // createNetworkIfNotExists creates a docker network and returns its name.
 // Name is guaranteed not to be empty when err == nil
-func createNetworkIfNotExists(docker *client.Client, pkgNamespace, blueprintName string) (networkName string, err error) {
+func createNetworkIfNotExists(docker ContainerRuntime, pkgNamespace, blueprintName string) (networkName string, err error) {
 	// check if a network already exists for this blueprint
 	nws, err := docker.NetworkList(context.Background(), network.ListOptions{
 		Filters: label(
@@ -478,7 +601,7 @@ func createNetworkIfNotExists(docker *client.Client, pkgNamespace, blueprintName
 	return networkName, nil
 }
 
-func printLogs(docker *client.Client, containerID, contextStr string) {
+func printLogs(docker ContainerRuntime, containerID, contextStr string) {
 	reader, err := docker.ContainerLogs(context.Background(), containerID, container.LogsOptions{
 		ShowStderr: true,
 		ShowStdout: true,
@@ -494,7 +617,25 @@ func printLogs(docker *client.Client, containerID, contextStr string) {
 	log.Printf("============== %s : END LOGS ==============\n\n\n", contextStr)
 }
 
-func printPortBindingsOfAllComplementContainers(docker *client.Client, contextStr string) {
+// readLogs returns the stdout and stderr of the container, split into lines.
+func readLogs(docker ContainerRuntime, containerID string) ([]string, error) {
+	reader, err := docker.ContainerLogs(context.Background(), containerID, container.LogsOptions{
+		ShowStderr: true,
+		ShowStdout: true,
+		Follow:     false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	var buf bytes.Buffer
+	if _, err = stdcopy.StdCopy(&buf, &buf, reader); err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n"), nil
+}
+
+func printPortBindingsOfAllComplementContainers(docker ContainerRuntime, contextStr string) {
 	ctx := context.Background()
 
 	containers, err := docker.ContainerList(ctx, container.ListOptions{
@@ -596,4 +737,6 @@ type result struct {
 	containerID string
 	contextStr  string
 	homeserver  b.Homeserver
+	// sidecar name -> container ID
+	sidecars map[string]string
 }
@@ -0,0 +1,187 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+)
+
+// checkpoint is the state of every homeserver in a deployment at the time Checkpoint was called.
+type checkpoint struct {
+	servers map[string]checkpointServer // HS name -> state
+}
+
+type checkpointServer struct {
+	imageID string
+	// sidecar name -> image ID
+	sidecarImageIDs map[string]string
+	accessTokens    map[string]string
+	deviceIDs       map[string]string
+	clockOffset     time.Duration
+}
+
+// checkpointServer commits the filesystem of the homeserver container and its sidecars to images, returning
+// the image ID of the homeserver and of each sidecar. The containers are paused while the images are made.
+func (d *Deployer) checkpointServer(dep *Deployment, hsName, checkpointID string) (string, map[string]string, error) {
+	hsDep := dep.HS[hsName]
+	var sidecarImageIDs map[string]string
+	if len(hsDep.Sidecars) > 0 {
+		// keep the homeserver paused while its sidecars are saved, so they are consistent with each other
+		if err := d.Docker.ContainerPause(context.Background(), hsDep.ContainerID); err != nil {
+			return "", nil, fmt.Errorf("failed to pause container %s: %w", hsDep.ContainerID, err)
+		}
+		sidecarImageIDs = make(map[string]string)
+		err := forEachSidecar(hsDep, func(name, containerID string) error {
+			imageID, err := d.commitCheckpoint(containerID, checkpointID, hsName+"_"+name)
+			sidecarImageIDs[name] = imageID
+			return err
+		})
+		if unpauseErr := d.Docker.ContainerUnpause(context.Background(), hsDep.ContainerID); unpauseErr != nil && err == nil {
+			err = fmt.Errorf("failed to unpause container %s: %w", hsDep.ContainerID, unpauseErr)
+		}
+		if err != nil {
+			return "", sidecarImageIDs, err
+		}
+	}
+	imageID, err := d.commitCheckpoint(hsDep.ContainerID, checkpointID, hsName)
+	if err != nil {
+		return "", sidecarImageIDs, err
+	}
+	return imageID, sidecarImageIDs, nil
+}
+
+// commitCheckpoint commits the filesystem of the container to an image, pausing it while the image is made.
+func (d *Deployer) commitCheckpoint(containerID, checkpointID, name string) (string, error) {
+	reference := fmt.Sprintf("localhost/complement:checkpoint_%s_%s_%s_%s", d.config.PackageNamespace, d.DeployNamespace, checkpointID, name)
+	commit, err := d.Docker.ContainerCommit(context.Background(), containerID, container.CommitOptions{
+		Author:    "Complement",
+		Pause:     true,
+		Reference: reference,
+		Changes: toChanges(map[string]string{
+			complementLabel: "checkpoint_" + checkpointID + "_" + name,
+			// so the image isn't deployed as part of the blueprint, or kept in the blueprint cache
+			"complement_blueprint": "",
+			blueprintHashLabel:     "",
+			"complement_pkg":       d.config.PackageNamespace,
+		}),
+		Config: &container.Config{},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to commit container %s: %w", containerID, err)
+	}
+	imageID := strings.Replace(commit.ID, "sha256:", "", 1)
+	d.log("%s: checkpoint %s -> %s\n", name, checkpointID, imageID)
+	return imageID, nil
+}
+
+// restoreServer replaces the homeserver container with a container of the checkpoint image, keeping the
+// same name and network alias. The HomeserverDeployment is updated in place so existing clients talk to
+// the new container.
+func (d *Deployer) restoreServer(dep *Deployment, hsName string, state checkpointServer) error {
+	ctx := context.Background()
+	hsDep := dep.HS[hsName]
+	inspect, err := d.Docker.ContainerInspect(ctx, hsDep.ContainerID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect container %s: %w", hsDep.ContainerID, err)
+	}
+	containerName := strings.TrimPrefix(inspect.Name, "/")
+	contextStr := inspect.Config.Labels[complementLabel]
+	err = d.Docker.ContainerRemove(ctx, hsDep.ContainerID, container.RemoveOptions{
+		Force: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove container %s: %w", hsDep.ContainerID, err)
+	}
+	sidecars, err := d.restoreSidecars(hsDep, hsName, contextStr, state.sidecarImageIDs)
+	if err != nil {
+		return err
+	}
+	hsDep.Sidecars = sidecars
+	restored, err := deployImage(
+		d.Docker, state.imageID, containerName,
+		d.config.PackageNamespace, dep.BlueprintName, hsName, nil, contextStr,
+		hsDep.Network, d.config, deployImageOpts{
+			dnsServers:  dep.dnsServers,
+			clockOffset: clockOffset(d.config, state.clockOffset),
+			sidecars:    sidecars,
+		},
+	)
+	if err != nil {
+		if restored != nil && restored.ContainerID != "" {
+			printLogs(d.Docker, restored.ContainerID, contextStr)
+			hsDep.setContainerID(restored.ContainerID)
+		}
+		return fmt.Errorf("failed to deploy checkpoint image %s: %w", state.imageID, err)
+	}
+	hsDep.setContainerID(restored.ContainerID)
+	hsDep.SetEndpoints(restored.BaseURL, restored.FedBaseURL)
+	hsDep.accessTokensMutex.Lock()
+	hsDep.AccessTokens = maps.Clone(state.accessTokens)
+	hsDep.accessTokensMutex.Unlock()
+	hsDep.DeviceIDs = maps.Clone(state.deviceIDs)
+	d.log("%s: restored %s (%s)\n", hsName, hsDep.BaseURL, hsDep.ContainerID)
+	return nil
+}
+
+// restoreSidecars replaces the sidecars of the homeserver with containers of the checkpoint images, keeping
+// the same names. Returns the new container ID of each sidecar.
+func (d *Deployer) restoreSidecars(hsDep *HomeserverDeployment, hsName, contextStr string, imageIDs map[string]string) (map[string]string, error) {
+	if len(hsDep.Sidecars) == 0 {
+		return nil, nil
+	}
+	ctx := context.Background()
+	sidecars := make(map[string]string)
+	err := forEachSidecar(hsDep, func(name, containerID string) error {
+		inspect, err := d.Docker.ContainerInspect(ctx, containerID)
+		if err != nil {
+			return fmt.Errorf("failed to inspect container %s: %w", containerID, err)
+		}
+		err = d.Docker.ContainerRemove(ctx, containerID, container.RemoveOptions{
+			Force: true,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to remove container %s: %w", containerID, err)
+		}
+		restoredID, err := deploySidecar(d.Docker, d.config, sidecarSpec{
+			name:          name,
+			hsName:        hsName,
+			imageID:       imageIDs[name],
+			containerName: strings.TrimPrefix(inspect.Name, "/"),
+			networkName:   hsDep.Network,
+			blueprintName: inspect.Config.Labels["complement_blueprint"],
+			contextStr:    contextStr,
+		})
+		if restoredID != "" {
+			sidecars[name] = restoredID
+		}
+		return err
+	})
+	return sidecars, err
+}
+
+// removeCheckpoints removes the images made by checkpointServer.
+func (d *Deployer) removeCheckpoints(dep *Deployment) {
+	for _, cp := range dep.checkpoints {
+		for hsName, state := range cp.servers {
+			imageIDs := []string{state.imageID}
+			for _, imageID := range state.sidecarImageIDs {
+				imageIDs = append(imageIDs, imageID)
+			}
+			for _, imageID := range imageIDs {
+				_, err := d.Docker.ImageRemove(context.Background(), imageID, image.RemoveOptions{
+					Force: true,
+				})
+				if err != nil {
+					log.Printf("removeCheckpoints: failed to remove checkpoint image %s for %s: %s", imageID, hsName, err)
+				}
+			}
+		}
+	}
+	dep.checkpoints = nil
+}
@@ -0,0 +1,122 @@
+//go:build !windows
+
+package docker
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+
+	"github.com/matrix-org/complement/config"
+)
+
+func TestCheckpointImages(t *testing.T) {
+	r := testProcessRuntime(t, `exec sleep 30`)
+	ctx := context.Background()
+	hs1 := mustCreate(t, r, "complement-base", "hs1")
+	db := mustCreate(t, r, "complement-base", "hs1_db")
+	for _, containerID := range []string{hs1, db} {
+		if err := r.ContainerStart(ctx, containerID, container.StartOptions{}); err != nil {
+			t.Fatalf("ContainerStart: %s", err)
+		}
+		t.Cleanup(func() {
+			r.ContainerRemove(ctx, containerID, container.RemoveOptions{Force: true})
+		})
+	}
+	err := r.CopyToContainer(ctx, hs1, "/", makeArchive(t, "data/", "", "data/signing.key", "secret"), container.CopyToContainerOptions{})
+	if err != nil {
+		t.Fatalf("CopyToContainer: %s", err)
+	}
+	dep := &Deployment{
+		Deployer: &Deployer{
+			DeployNamespace: "1",
+			Docker:          r,
+			config:          &config.Complement{PackageNamespace: "pkg"},
+		},
+		HS: map[string]*HomeserverDeployment{
+			"hs1": {
+				ContainerID:  hs1,
+				Sidecars:     map[string]string{"db": db},
+				AccessTokens: map[string]string{"@alice:hs1": "token"},
+			},
+		},
+	}
+
+	checkpointID := dep.Checkpoint(t)
+	state := dep.checkpoints[checkpointID].servers["hs1"]
+	if state.accessTokens["@alice:hs1"] != "token" {
+		t.Errorf("checkpoint access tokens: got %v", state.accessTokens)
+	}
+	imageIDs := map[string]string{
+		"hs1":    state.imageID,
+		"hs1_db": state.sidecarImageIDs["db"],
+	}
+	for name, imageID := range imageIDs {
+		inspect, err := r.ImageInspect(ctx, imageID)
+		if err != nil {
+			t.Fatalf("%s: ImageInspect: %s", name, err)
+		}
+		labels := inspect.Config.Labels
+		if labels[complementLabel] != "checkpoint_"+checkpointID+"_"+name {
+			t.Errorf("%s: got %s label %q", name, complementLabel, labels[complementLabel])
+		}
+		// checkpoints must not be deployed as part of the blueprint or kept in the blueprint cache
+		if labels["complement_blueprint"] != "" || labels[blueprintHashLabel] != "" {
+			t.Errorf("%s: checkpoint image has blueprint labels: %v", name, labels)
+		}
+	}
+	key, err := os.ReadFile(filepath.Join(r.lookupImage(state.imageID).dir, "data", "signing.key"))
+	if err != nil || string(key) != "secret" {
+		t.Errorf("checkpoint image data: got %q %v", key, err)
+	}
+	// the containers are unpaused once they have been saved
+	for _, containerID := range []string{hs1, db} {
+		if r.containers[containerID].paused {
+			t.Errorf("container %s is still paused", containerID)
+		}
+	}
+
+	dep.Deployer.removeCheckpoints(dep)
+	for name, imageID := range imageIDs {
+		if _, err := r.ImageInspect(ctx, imageID); !errdefs.IsNotFound(err) {
+			t.Errorf("%s: ImageInspect after removeCheckpoints: got %v, want not found", name, err)
+		}
+	}
+	if dep.checkpoints != nil {
+		t.Errorf("checkpoints were not forgotten: %v", dep.checkpoints)
+	}
+}
+
+func TestRestoreForgetsNetworkStateOfRestoredServers(t *testing.T) {
+	r := testProcessRuntime(t, `exec sleep 30`)
+	dep := &Deployment{
+		Deployer: &Deployer{Docker: r, config: &config.Complement{}},
+		HS: map[string]*HomeserverDeployment{
+			// the container is missing, so restoring hs1 fails the test without needing a homeserver
+			"hs1": {ContainerID: "missing"},
+			// added after the checkpoint
+			"hs2": {ContainerID: "hs2"},
+		},
+		checkpoints: map[string]*checkpoint{
+			"checkpoint1": {servers: map[string]checkpointServer{"hs1": {imageID: "image"}}},
+		},
+		partitioned: []string{"hs1", "hs2"},
+		impaired:    map[string]bool{"hs1": true, "hs2": true},
+	}
+	rt := runRecording(func(rt *recordingT) {
+		dep.Restore(rt, "checkpoint1")
+	})
+	if len(rt.fatals) != 1 {
+		t.Errorf("Restore: got fatals %v, want 1", rt.fatals)
+	}
+	if len(dep.partitioned) != 1 || dep.partitioned[0] != "hs2" {
+		t.Errorf("partitioned: got %v, want [hs2]", dep.partitioned)
+	}
+	if len(dep.impaired) != 1 || !dep.impaired["hs2"] {
+		t.Errorf("impaired: got %v, want only hs2", dep.impaired)
+	}
+}
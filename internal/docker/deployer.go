@@ -25,12 +25,12 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/docker/docker/client"
 	"github.com/matrix-org/complement/internal"
 	complementRuntime "github.com/matrix-org/complement/runtime"
 
@@ -40,6 +40,8 @@ import (
 	"github.com/docker/docker/api/types/network"
 
 	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/federation"
 )
 
 const (
@@ -50,17 +52,14 @@ const (
 
 type Deployer struct {
 	DeployNamespace string
-	Docker          *client.Client
+	Docker          ContainerRuntime
 	Counter         int
 	debugLogging    bool
 	config          *config.Complement
 }
 
 func NewDeployer(deployNamespace string, cfg *config.Complement) (*Deployer, error) {
-	cli, err := client.NewClientWithOpts(
-		client.FromEnv,
-		client.WithAPIVersionNegotiation(),
-	)
+	cli, err := NewContainerRuntime(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -83,7 +82,8 @@ func (d *Deployer) log(str string, args ...interface{}) {
 // This homeserver should be added to the dirty deployment. The hsName should start as 'hs1', then
 // 'hs2' ... 'hsN'.
 func (d *Deployer) CreateDirtyServer(hsName string) (*HomeserverDeployment, error) {
-	networkName, err := createNetworkIfNotExists(d.Docker, d.config.PackageNamespace, "dirty")
+	// each dirty deployment has its own network so the HS names don't clash
+	networkName, err := createNetworkIfNotExists(d.Docker, d.config.PackageNamespace, d.DeployNamespace)
 	if err != nil {
 		return nil, fmt.Errorf("CreateDirtyDeployment: %w", err)
 	}
@@ -93,11 +93,11 @@ func (d *Deployer) CreateDirtyServer(hsName string) (*HomeserverDeployment, erro
 		baseImageURI = uri
 	}
 
-	containerName := fmt.Sprintf("complement_%s_dirty_%s", d.config.PackageNamespace, hsName)
+	containerName := fmt.Sprintf("complement_%s_%s_%s", d.config.PackageNamespace, d.DeployNamespace, hsName)
 	hsDeployment, err := deployImage(
 		d.Docker, baseImageURI, containerName,
 		d.config.PackageNamespace, "", hsName, nil, "dirty",
-		networkName, d.config,
+		networkName, d.config, deployImageOpts{clockOffset: clockOffset(d.config, 0)},
 	)
 	if err != nil {
 		if hsDeployment != nil && hsDeployment.ContainerID != "" {
@@ -134,6 +134,22 @@ func (d *Deployer) CreateDirtyDeployment() (*Deployment, error) {
 }
 
 func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deployment, error) {
+	return d.DeployWithOptions(ctx, blueprintName, DeployOptions{})
+}
+
+// DeployOptions configure how DeployWithOptions deploys a blueprint.
+type DeployOptions struct {
+	// If set, a DNS stand-in container is created on the deployment network which forwards DNS queries and
+	// HTTPS traffic to a federation.DNSServer running in Complement, which logs to this test. Homeservers
+	// resolve names which are not known to the deployment network using the stand-in. See Deployment.DNS.
+	DNSStandin ct.TestLike
+	// The clock offset of each homeserver when it starts, keyed by HS name. Requires COMPLEMENT_FAKETIME_LIB.
+	// See Deployment.SetClockOffset.
+	ClockOffsets map[string]time.Duration
+}
+
+// DeployWithOptions deploys the blueprint like Deploy, configured by `opts`.
+func (d *Deployer) DeployWithOptions(ctx context.Context, blueprintName string, opts DeployOptions) (*Deployment, error) {
 	dep := &Deployment{
 		Deployer:      d,
 		BlueprintName: blueprintName,
@@ -156,11 +172,45 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 	if err != nil {
 		return nil, fmt.Errorf("Deploy: %w", err)
 	}
+	if len(opts.ClockOffsets) > 0 && d.config.FaketimeLibPath == "" {
+		return nil, fmt.Errorf("Deploy: clock offsets require COMPLEMENT_FAKETIME_LIB to be set")
+	}
+	for hsName, offset := range opts.ClockOffsets {
+		if err = checkClockOffset(offset); err != nil {
+			return nil, fmt.Errorf("Deploy: %s: %w", hsName, err)
+		}
+	}
+	var dnsServers []string
+	if opts.DNSStandin != nil {
+		standinIP, err := d.createDNSStandin(ctx, dep, networkName, federation.NewDNSServer(opts.DNSStandin, dep))
+		if err != nil {
+			dep.stopDNSStandin()
+			return dep, fmt.Errorf("Deploy: %w", err)
+		}
+		dnsServers = []string{standinIP.String()}
+	}
+	dep.dnsServers = dnsServers
+
+	// sidecar images are deployed with their homeserver rather than on their own
+	var hsImages []image.Summary
+	sidecarImages := make(map[string]map[string]image.Summary) // HS name -> sidecar name -> image
+	for _, img := range images {
+		sidecarName := img.Labels[sidecarLabel]
+		if sidecarName == "" {
+			hsImages = append(hsImages, img)
+			continue
+		}
+		hsName := img.Labels["complement_hs_name"]
+		if sidecarImages[hsName] == nil {
+			sidecarImages[hsName] = make(map[string]image.Summary)
+		}
+		sidecarImages[hsName][sidecarName] = img
+	}
 
 	// deploy images in parallel
 	var mu sync.Mutex // protects mutable values like the counter and errors
 	var wg sync.WaitGroup
-	wg.Add(len(images)) // ensure we wait until all images have deployed
+	wg.Add(len(hsImages)) // ensure we wait until all images have deployed
 	deployImg := func(img image.Summary) error {
 		defer wg.Done()
 		mu.Lock()
@@ -173,9 +223,18 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 
 		// TODO: Make CSAPI port configurable
 		containerName := fmt.Sprintf("complement_%s_%s_%s_%d", d.config.PackageNamespace, d.DeployNamespace, contextStr, counter)
+		sidecars, err := d.deploySidecarImages(sidecarImages[hsName], hsName, containerName, blueprintName, contextStr, networkName)
+		if err != nil {
+			return fmt.Errorf("Deploy: Failed to deploy sidecars of %s : %w", hsName, err)
+		}
 		deployment, err := deployImage(
 			d.Docker, img.ID, containerName,
 			d.config.PackageNamespace, blueprintName, hsName, asIDToRegistrationMap, contextStr, networkName, d.config,
+			deployImageOpts{
+				dnsServers:  dnsServers,
+				clockOffset: clockOffset(d.config, opts.ClockOffsets[hsName]),
+				sidecars:    sidecars,
+			},
 		)
 		if err != nil {
 			if deployment != nil && deployment.ContainerID != "" {
@@ -187,6 +246,10 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 			// This gives better context for when `bind: address already in use` errors happen.
 			printPortBindingsOfAllComplementContainers(d.Docker, "While deploying "+containerName)
 
+			// the sidecars aren't part of the deployment yet, so Destroy won't remove them
+			for _, id := range sidecars {
+				d.Docker.ContainerRemove(context.Background(), id, container.RemoveOptions{Force: true})
+			}
 			return fmt.Errorf("Deploy: Failed to deploy image %+v : %w", img, err)
 		}
 		mu.Lock()
@@ -197,7 +260,7 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 	}
 
 	var lastErr error
-	for _, img := range images {
+	for _, img := range hsImages {
 		go func(i image.Summary) {
 			err := deployImg(i)
 			if err != nil {
@@ -208,59 +271,122 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 		}(img)
 	}
 	wg.Wait()
+	if lastErr != nil {
+		// the deployment can't be used, so stop forwarding traffic to the DNS server
+		dep.stopDNSStandin()
+	}
 	return dep, lastErr
 }
 
+// deploySidecarImages deploys the sidecar images built for the homeserver, keyed by sidecar name, returning
+// the container ID of each sidecar. If any sidecar fails to start, all of them are removed.
+func (d *Deployer) deploySidecarImages(
+	images map[string]image.Summary, hsName, hsContainerName, blueprintName, contextStr, networkName string,
+) (map[string]string, error) {
+	if len(images) == 0 {
+		return nil, nil
+	}
+	sidecars := make(map[string]string)
+	names := make([]string, 0, len(images))
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		containerID, err := deploySidecar(d.Docker, d.config, sidecarSpec{
+			name:          name,
+			hsName:        hsName,
+			imageID:       images[name].ID,
+			containerName: hsContainerName + "_" + name,
+			networkName:   networkName,
+			blueprintName: blueprintName,
+			contextStr:    contextStr,
+		})
+		if containerID != "" {
+			sidecars[name] = containerID
+		}
+		if err != nil {
+			for sidecarName, id := range sidecars {
+				if sidecarName == name {
+					printLogs(d.Docker, id, contextStr+"."+name)
+				}
+				d.Docker.ContainerRemove(context.Background(), id, container.RemoveOptions{Force: true})
+			}
+			return nil, err
+		}
+		d.log("%s.%s -> %s\n", contextStr, name, containerID)
+	}
+	return sidecars, nil
+}
+
 func (d *Deployer) PrintLogs(dep *Deployment) {
 	for _, hsDep := range dep.HS {
 		printLogs(d.Docker, hsDep.ContainerID, hsDep.ContainerID)
+		forEachSidecar(hsDep, func(name, containerID string) error {
+			printLogs(d.Docker, containerID, hsDep.ContainerID+"."+name)
+			return nil
+		})
 	}
 }
 
 // Destroy a deployment. This will kill all running containers.
 func (d *Deployer) Destroy(dep *Deployment, printServerLogs bool, testName string, failed bool) {
+	dep.stopFederationProxy()
+	dep.stopDNSStandin()
+	dep.stopLogStream()
+	defer d.removeCheckpoints(dep)
 	for _, hsDep := range dep.HS {
-		if printServerLogs {
-			// If we want the logs we gracefully stop the containers to allow
-			// the logs to be flushed.
-			oneSecond := 1
-			err := d.Docker.ContainerStop(context.Background(), hsDep.ContainerID, container.StopOptions{
-				Timeout: &oneSecond,
-			})
-			if err != nil {
-				log.Printf("Destroy: Failed to destroy container %s : %s\n", hsDep.ContainerID, err)
-			}
-
-			printLogs(d.Docker, hsDep.ContainerID, hsDep.ContainerID)
-		} else {
-			err := complementRuntime.ContainerKillFunc(d.Docker, hsDep.ContainerID)
-			if err != nil {
-				log.Printf("Destroy: Failed to destroy container %s : %s\n", hsDep.ContainerID, err)
-			}
-		}
+		// the homeserver is destroyed before its sidecars, as it may still be using them
+		d.destroyContainer(hsDep.ContainerID, hsDep.ContainerID, printServerLogs, testName, failed)
+		forEachSidecar(hsDep, func(name, containerID string) error {
+			d.destroyContainer(containerID, hsDep.ContainerID+"."+name, printServerLogs, testName, failed)
+			return nil
+		})
+	}
+}
 
-		result, err := d.executePostScript(hsDep, testName, failed)
+// destroyContainer stops and removes a container of the deployment, running the post test script on it.
+func (d *Deployer) destroyContainer(containerID, contextStr string, printServerLogs bool, testName string, failed bool) {
+	if printServerLogs {
+		// If we want the logs we gracefully stop the containers to allow
+		// the logs to be flushed.
+		oneSecond := 1
+		err := d.Docker.ContainerStop(context.Background(), containerID, container.StopOptions{
+			Timeout: &oneSecond,
+		})
 		if err != nil {
-			log.Printf("Failed to execute post test script: %s - %s", err, string(result))
-		}
-		if printServerLogs && err == nil && result != nil {
-			log.Printf("Post test script result: %s", string(result))
+			log.Printf("Destroy: Failed to destroy container %s : %s\n", containerID, err)
 		}
 
-		err = d.Docker.ContainerRemove(context.Background(), hsDep.ContainerID, container.RemoveOptions{
-			Force: true,
-		})
+		printLogs(d.Docker, containerID, contextStr)
+	} else {
+		err := complementRuntime.ContainerKillFunc(d.Docker, containerID)
 		if err != nil {
-			log.Printf("Destroy: Failed to remove container %s : %s\n", hsDep.ContainerID, err)
+			log.Printf("Destroy: Failed to destroy container %s : %s\n", containerID, err)
 		}
 	}
+
+	result, err := d.executePostScript(containerID, testName, failed)
+	if err != nil {
+		log.Printf("Failed to execute post test script: %s - %s", err, string(result))
+	}
+	if printServerLogs && err == nil && result != nil {
+		log.Printf("Post test script result: %s", string(result))
+	}
+
+	err = d.Docker.ContainerRemove(context.Background(), containerID, container.RemoveOptions{
+		Force: true,
+	})
+	if err != nil {
+		log.Printf("Destroy: Failed to remove container %s : %s\n", containerID, err)
+	}
 }
 
-func (d *Deployer) executePostScript(hsDep *HomeserverDeployment, testName string, failed bool) ([]byte, error) {
+func (d *Deployer) executePostScript(containerID string, testName string, failed bool) ([]byte, error) {
 	if d.config.PostTestScript == "" {
 		return nil, nil
 	}
-	cmd := exec.Command(d.config.PostTestScript, hsDep.ContainerID, testName, strconv.FormatBool(failed))
+	cmd := exec.Command(d.config.PostTestScript, containerID, testName, strconv.FormatBool(failed))
 
 	return cmd.CombinedOutput()
 }
@@ -271,12 +397,20 @@ func (d *Deployer) PauseServer(hsDep *HomeserverDeployment) error {
 	if err != nil {
 		return fmt.Errorf("failed to pause container %s: %s", hsDep.ContainerID, err)
 	}
-	return nil
+	return forEachSidecar(hsDep, func(name, containerID string) error {
+		return d.Docker.ContainerPause(ctx, containerID)
+	})
 }
 
 func (d *Deployer) UnpauseServer(hsDep *HomeserverDeployment) error {
 	ctx := context.Background()
-	err := d.Docker.ContainerUnpause(ctx, hsDep.ContainerID)
+	err := forEachSidecar(hsDep, func(name, containerID string) error {
+		return d.Docker.ContainerUnpause(ctx, containerID)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to unpause: %s", err)
+	}
+	err = d.Docker.ContainerUnpause(ctx, hsDep.ContainerID)
 	if err != nil {
 		return fmt.Errorf("failed to unpause container %s: %s", hsDep.ContainerID, err)
 	}
@@ -292,7 +426,11 @@ func (d *Deployer) StopServer(hsDep *HomeserverDeployment) error {
 	if err != nil {
 		return fmt.Errorf("failed to stop container %s: %s", hsDep.ContainerID, err)
 	}
-	return nil
+	return forEachSidecar(hsDep, func(name, containerID string) error {
+		return d.Docker.ContainerStop(ctx, containerID, container.StopOptions{
+			Timeout: &secs,
+		})
+	})
 }
 
 // Restart a homeserver deployment.
@@ -308,6 +446,9 @@ func (d *Deployer) Restart(hsDep *HomeserverDeployment) error {
 
 func (d *Deployer) StartServer(hsDep *HomeserverDeployment) error {
 	ctx := context.Background()
+	if err := d.startSidecars(hsDep); err != nil {
+		return err
+	}
 	err := d.Docker.ContainerStart(ctx, hsDep.ContainerID, container.StartOptions{})
 	if err != nil {
 		return fmt.Errorf("failed to start container %s: %s", hsDep.ContainerID, err)
@@ -333,10 +474,22 @@ func (d *Deployer) StartServer(hsDep *HomeserverDeployment) error {
 	return nil
 }
 
+// deployImageOpts are the optional settings for deployImage.
+type deployImageOpts struct {
+	// the DNS servers the homeserver uses, or nil to use the default
+	dnsServers []string
+	// the offset of the homeserver clock from the real time, or nil to not fake the time
+	clockOffset *time.Duration
+	// sidecar name -> container ID of the sidecars which the homeserver uses
+	sidecars map[string]string
+	// called after the container is created but before it is started
+	beforeStart func(containerID string) error
+}
+
 // nolint
 func deployImage(
-	docker *client.Client, imageID string, containerName, pkgNamespace, blueprintName, hsName string,
-	asIDToRegistrationMap map[string]string, contextStr, networkName string, cfg *config.Complement,
+	docker ContainerRuntime, imageID string, containerName, pkgNamespace, blueprintName, hsName string,
+	asIDToRegistrationMap map[string]string, contextStr, networkName string, cfg *config.Complement, opts deployImageOpts,
 ) (*HomeserverDeployment, error) {
 	ctx := context.Background()
 	var extraHosts []string
@@ -349,6 +502,10 @@ func deployImage(
 		// Note: this feature of docker landed in Docker 20.10,
 		// see https://github.com/moby/moby/pull/40007
 		extraHosts = []string{fmt.Sprintf("%s:host-gateway", cfg.HostnameRunningComplement)}
+		// Virtual federation servers need their own hostnames which all point at the host.
+		for i := 1; i <= cfg.VirtualServerHostnames; i++ {
+			extraHosts = append(extraHosts, fmt.Sprintf("%s:host-gateway", cfg.VirtualServerHostname(i)))
+		}
 	}
 
 	for _, m := range cfg.HostMounts {
@@ -366,6 +523,7 @@ func deployImage(
 	env := []string{
 		"SERVER_NAME=" + hsName,
 	}
+	env = append(env, sidecarEnv(hsName, sortedSidecarNames(opts.sidecars))...)
 	if cfg.EnvVarsPropagatePrefix != "" {
 		for _, ev := range os.Environ() {
 			if strings.HasPrefix(ev, cfg.EnvVarsPropagatePrefix) {
@@ -374,6 +532,13 @@ func deployImage(
 		}
 		log.Printf("Sharing %v host environment variables with container", env)
 	}
+	if opts.clockOffset != nil {
+		faketimeEnv, err := faketimeEnv(ctx, docker, imageID)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, faketimeEnv...)
+	}
 
 	body, err := docker.ContainerCreate(ctx, &container.Config{
 		Image: imageID,
@@ -398,7 +563,9 @@ func deployImage(
 		// means we're also listening on `cfg.HSPortBindingIP` so it's good enough.
 		PublishAllPorts: true,
 		ExtraHosts:      extraHosts,
-		Mounts:          mounts,
+		// Names which aren't aliases on the network are resolved using these servers, if set.
+		DNS:    opts.dnsServers,
+		Mounts: mounts,
 		// https://docs.docker.com/engine/containers/resource_constraints/
 		Resources: container.Resources{
 			// Constrain the the number of CPU cores this container can use
@@ -444,6 +611,7 @@ func deployImage(
 	}
 	stubDeployment := &HomeserverDeployment{
 		ContainerID: containerID,
+		Sidecars:    opts.sidecars,
 	}
 
 	// Create the application service files
@@ -472,6 +640,18 @@ func deployImage(
 		return stubDeployment, fmt.Errorf("failed to copy CA key to container: %s", err)
 	}
 
+	if opts.clockOffset != nil {
+		if err = copyFaketime(docker, containerID, cfg, *opts.clockOffset); err != nil {
+			return stubDeployment, err
+		}
+	}
+
+	if opts.beforeStart != nil {
+		if err = opts.beforeStart(containerID); err != nil {
+			return stubDeployment, err
+		}
+	}
+
 	err = docker.ContainerStart(ctx, containerID, container.StartOptions{})
 	if err != nil {
 		return stubDeployment, fmt.Errorf("ContainerStart: %s", err)
@@ -512,6 +692,7 @@ func deployImage(
 		ApplicationServices: asIDToRegistrationFromLabels(inspect.Config.Labels),
 		DeviceIDs:           deviceIDsFromLabels(inspect.Config.Labels),
 		Network:             networkName,
+		Sidecars:            opts.sidecars,
 	}
 
 	stopTime := time.Now().Add(cfg.SpawnHSTimeout)
@@ -526,7 +707,7 @@ func deployImage(
 	return d, nil
 }
 
-func copyToContainer(docker *client.Client, containerID, path string, data []byte) error {
+func copyToContainer(docker ContainerRuntime, containerID, path string, data []byte) error {
 	// Create a fake/virtual file in memory that we can copy to the container
 	// via https://stackoverflow.com/a/52131297/796832
 	var buf bytes.Buffer
@@ -566,7 +747,7 @@ func assertHostnameEqual(inputUrl string, expectedHostname string) error {
 
 // getHostAccessibleHomeserverURLs returns URLs that are accessible from the host
 // machine (outside the container) for the homeserver's client API and federation API.
-func getHostAccessibleHomeserverURLs(ctx context.Context, docker *client.Client, containerID string, hsPortBindingIP string) (baseURL string, fedBaseURL string, err error) {
+func getHostAccessibleHomeserverURLs(ctx context.Context, docker ContainerRuntime, containerID string, hsPortBindingIP string) (baseURL string, fedBaseURL string, err error) {
 	inspectResponse, err := inspectContainer(ctx, docker, containerID)
 	if err != nil {
 		return "", "", fmt.Errorf("failed to inspect ports: %w", err)
@@ -591,7 +772,7 @@ func getHostAccessibleHomeserverURLs(ctx context.Context, docker *client.Client,
 }
 
 // waitForPorts waits until a homeserver container has NAT ports assigned (8008, 8448).
-func waitForPorts(ctx context.Context, docker *client.Client, containerID string, hsPortBindingIP string) (err error) {
+func waitForPorts(ctx context.Context, docker ContainerRuntime, containerID string, hsPortBindingIP string) (err error) {
 	// We need to hammer the inspect endpoint until the ports show up, they don't appear immediately.
 	inspectStartTime := time.Now()
 	for time.Since(inspectStartTime) < time.Second {
@@ -628,7 +809,7 @@ func (e *containerInspectionError) Error() string { return e.msg }
 // `err.Fatal: true` if the container is no longer running.
 func inspectContainer(
 	ctx context.Context,
-	docker *client.Client,
+	docker ContainerRuntime,
 	containerID string,
 ) (inspectResponse container.InspectResponse, err error) {
 	inspectResponse, err = docker.ContainerInspect(ctx, containerID)
@@ -650,7 +831,7 @@ func inspectContainer(
 }
 
 // waitForContainer waits until a homeserver deployment is ready to serve requests.
-func waitForContainer(ctx context.Context, docker *client.Client, hsDep *HomeserverDeployment, stopTime time.Time) (iterCount int, lastErr error) {
+func waitForContainer(ctx context.Context, docker ContainerRuntime, hsDep *HomeserverDeployment, stopTime time.Time) (iterCount int, lastErr error) {
 	iterCount = 0
 
 	// If the container has a healthcheck, wait for it first
@@ -715,7 +896,7 @@ type RoundTripper struct {
 func (t *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	// map HS names to localhost:port combos
 	hsName := req.URL.Hostname()
-	if hsName == t.Deployment.Config.HostnameRunningComplement {
+	if hsName == t.Deployment.Config.HostnameRunningComplement || t.Deployment.Config.IsVirtualServerHostname(hsName) {
 		if req.URL.Port() == "" {
 			req.URL.Host = "localhost"
 		} else {
@@ -1,8 +1,11 @@
 package docker
 
 import (
+	"errors"
 	"fmt"
+	"maps"
 	"net/http"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -10,6 +13,7 @@ import (
 	"github.com/matrix-org/complement/client"
 	"github.com/matrix-org/complement/config"
 	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/federation"
 	"github.com/matrix-org/complement/helpers"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/spec"
@@ -24,10 +28,44 @@ type Deployment struct {
 	BlueprintName string
 	// Set to true if this deployment is a dirty deployment and so should not be destroyed.
 	Dirty bool
-	// A map of HS name to a HomeserverDeployment
+	// Called when a test destroys this dirty deployment, if set. Used to return the deployment to a pool.
+	// `broken` is true if the deployment couldn't be reset for the next test, so should not be reused.
+	ReleaseDirty func(broken bool)
+	// A map of HS name to a HomeserverDeployment. Use AddServer to add to a deployment which is in use.
 	HS               map[string]*HomeserverDeployment
 	Config           *config.Complement
 	localpartCounter atomic.Int64
+
+	// guards HS, which is read by goroutines streaming logs and sampling resource usage while tests add
+	// homeservers
+	hsMu sync.RWMutex
+
+	// set when federation traffic is routed through a proxy. See FederationProxy.
+	federationProxyMu           sync.Mutex
+	federationProxy             *federation.Proxy
+	federationProxyContainerIDs []string
+
+	// set when the deployment was created with a DNS stand-in. See DNS.
+	dnsServer             *federation.DNSServer
+	dnsStandinContainerID string
+
+	// the homeservers which have partition rules. See Partition.
+	partitioned []string
+	// the homeservers which have impaired networks. See ImpairNetwork.
+	impaired map[string]bool
+	// the homeservers whose clocks were changed by SetClockOffset.
+	clockOffsets map[string]time.Duration
+	// the DNS servers homeservers were deployed with, so restored homeservers use them too.
+	dnsServers []string
+	// checkpoint ID -> checkpoint. See Checkpoint.
+	checkpoints       map[string]*checkpoint
+	checkpointCounter int
+	// test name -> the monitor sampling resource usage during the test. See MonitorResources.
+	resourceMonitorsMu sync.Mutex
+	resourceMonitors   map[string]*resourceMonitor
+	// set when the logs of homeservers are being followed. See StreamLogs.
+	logsMu sync.Mutex
+	logs   *logStream
 }
 
 // HomeserverDeployment represents a running homeserver in a container.
@@ -46,12 +84,20 @@ type HomeserverDeployment struct {
 	// The docker network this HS is connected to.
 	// Useful if you want to connect other containers to the same network.
 	Network string
+	// The containers of the sidecars of this HS, keyed by the name of the sidecar in the blueprint.
+	// EXPERIMENTAL
+	Sidecars map[string]string // e.g { "postgres": "8c12ab7f3d" }
+	// guards ContainerID and the base URLs, which change when the container is replaced or restarted while
+	// goroutines are streaming its logs or sampling its resource usage
+	containerMu sync.RWMutex
 }
 
 // Updates the client and federation base URLs of the homeserver deployment.
 func (hsDep *HomeserverDeployment) SetEndpoints(baseURL string, fedBaseURL string) {
+	hsDep.containerMu.Lock()
 	hsDep.BaseURL = baseURL
 	hsDep.FedBaseURL = fedBaseURL
+	hsDep.containerMu.Unlock()
 
 	for _, client := range hsDep.CSAPIClients {
 		client.BaseURL = baseURL
@@ -68,6 +114,35 @@ func (d *Deployment) GetFullyQualifiedHomeserverName(t ct.TestLike, hsName strin
 	return spec.ServerName(hsName)
 }
 
+// AddServer adds a homeserver to the deployment. Use this rather than writing to HS if the deployment may
+// be in use, e.g when scaling up a dirty deployment.
+func (d *Deployment) AddServer(hsName string, hsDep *HomeserverDeployment) {
+	d.hsMu.Lock()
+	defer d.hsMu.Unlock()
+	d.HS[hsName] = hsDep
+}
+
+// servers returns a copy of HS, which can be used while homeservers are being added.
+func (d *Deployment) servers() map[string]*HomeserverDeployment {
+	d.hsMu.RLock()
+	defer d.hsMu.RUnlock()
+	return maps.Clone(d.HS)
+}
+
+// setContainerID updates the container of the homeserver after it was replaced.
+func (hsDep *HomeserverDeployment) setContainerID(containerID string) {
+	hsDep.containerMu.Lock()
+	defer hsDep.containerMu.Unlock()
+	hsDep.ContainerID = containerID
+}
+
+// container returns the current container ID and base URL of the homeserver.
+func (hsDep *HomeserverDeployment) container() (containerID, baseURL string) {
+	hsDep.containerMu.RLock()
+	defer hsDep.containerMu.RUnlock()
+	return hsDep.ContainerID, hsDep.BaseURL
+}
+
 // DestroyAtCleanup destroys the entire deployment. It should be called at cleanup time for dirty
 // deployments only. Handles configuration options for things which should run at container destroy
 // time, like post-run scripts and printing logs.
@@ -75,6 +150,7 @@ func (d *Deployment) DestroyAtCleanup() {
 	if !d.Dirty {
 		return
 	}
+	d.stopResourceMonitors()
 	d.Deployer.Destroy(d, d.Deployer.config.AlwaysPrintServerLogs, "COMPLEMENT_ENABLE_DIRTY_RUNS", false)
 }
 
@@ -82,15 +158,102 @@ func (d *Deployment) DestroyAtCleanup() {
 // will print container logs before killing the container.
 func (d *Deployment) Destroy(t ct.TestLike) {
 	t.Helper()
+	d.stopResourceMonitor(t.Name())
 	if d.Dirty {
-		if t.Failed() {
-			d.Deployer.PrintLogs(d)
+		// release the deployment even if resetting it fails the test, so other tests don't wait for it forever
+		reset := false
+		defer func() {
+			if d.ReleaseDirty != nil {
+				d.ReleaseDirty(!reset)
+			}
+		}()
+		d.endTest(t)
+		// the deployment is reused by the next test, which shouldn't have its traffic proxied unless it asks
+		d.stopFederationProxy()
+		d.Heal(t)
+		for hsName := range d.impaired {
+			d.ClearNetworkImpairment(t, hsName)
+		}
+		for hsName, offset := range d.clockOffsets {
+			if offset != 0 {
+				d.SetClockOffset(t, hsName, 0)
+			}
 		}
+		reset = true
 		return
 	}
+	d.checkLogs(t)
 	d.Deployer.Destroy(d, d.Deployer.config.AlwaysPrintServerLogs || t.Failed(), t.Name(), t.Failed())
 }
 
+// FederationProxy routes all federation traffic between homeservers in this deployment through a proxy
+// running in Complement, creating it on first use. Subsequent calls return the same proxy, with its rules
+// and recorded requests cleared. Fails the test if the homeservers are partitioned: use Partition or the
+// proxy, but not both.
+func (d *Deployment) FederationProxy(t ct.TestLike) *federation.Proxy {
+	t.Helper()
+	if len(d.partitioned) > 0 {
+		ct.Fatalf(t, "FederationProxy: cannot proxy federation traffic while homeservers are partitioned, call Heal first")
+	}
+	d.federationProxyMu.Lock()
+	defer d.federationProxyMu.Unlock()
+	if d.federationProxy != nil {
+		d.federationProxy.Reset(t)
+		return d.federationProxy
+	}
+	proxy := federation.NewProxy(t, d)
+	ports := make(map[string]int)
+	for hsName := range d.HS {
+		port, err := proxy.Listen(spec.ServerName(hsName))
+		if err != nil {
+			proxy.Close()
+			ct.Fatalf(t, "FederationProxy: %s", err)
+		}
+		ports[hsName] = port
+	}
+	containerIDs, err := d.Deployer.routeFederationViaProxy(d, ports)
+	if err != nil {
+		d.Deployer.removeFederationProxy(d, containerIDs)
+		proxy.Close()
+		ct.Fatalf(t, "FederationProxy: %s", err)
+	}
+	d.federationProxy = proxy
+	d.federationProxyContainerIDs = containerIDs
+	return proxy
+}
+
+// DNS returns the DNS server which homeservers in this deployment use to resolve names not known to the
+// deployment network. The deployment must have been created with a DNS stand-in. The DNS server is
+// reset before it is returned, so records and routes from previous tests are removed.
+func (d *Deployment) DNS(t ct.TestLike) *federation.DNSServer {
+	t.Helper()
+	if d.dnsServer == nil {
+		ct.Fatalf(t, "DNS: deployment was not created with a DNS stand-in, use complement.WithDNSStandin()")
+	}
+	d.dnsServer.Reset(t)
+	return d.dnsServer
+}
+
+// proxyingFederation returns true if FederationProxy has been called and not undone.
+func (d *Deployment) proxyingFederation() bool {
+	d.federationProxyMu.Lock()
+	defer d.federationProxyMu.Unlock()
+	return d.federationProxy != nil
+}
+
+// stopFederationProxy undoes FederationProxy, if it was called.
+func (d *Deployment) stopFederationProxy() {
+	d.federationProxyMu.Lock()
+	defer d.federationProxyMu.Unlock()
+	if d.federationProxy == nil {
+		return
+	}
+	d.Deployer.removeFederationProxy(d, d.federationProxyContainerIDs)
+	d.federationProxy.Close()
+	d.federationProxy = nil
+	d.federationProxyContainerIDs = nil
+}
+
 func (d *Deployment) GetConfig() *config.Complement {
 	return d.Config
 }
@@ -309,6 +472,249 @@ func (d *Deployment) UnpauseServer(t ct.TestLike, hsName string) {
 	}
 }
 
+// UpgradeServer stops the homeserver and starts `imageURI` with its data, server name and signing key, so tests
+// can check that data is migrated between versions. If `imageURI` is empty, the homeserver must have been built
+// from Homeserver.UpgradeFromImageURI and is upgraded to the image it would otherwise have been built from.
+// Existing clients keep working. Partitions and network impairments of the homeserver, and the federation proxy,
+// are removed. Fails the test if the signing key of the homeserver changes.
+func (d *Deployment) UpgradeServer(t ct.TestLike, hsName, imageURI string) {
+	t.Helper()
+	t.Logf("UpgradeServer %s %s", hsName, imageURI)
+	if d.HS[hsName] == nil {
+		ct.Fatalf(t, "UpgradeServer: %s does not exist in this deployment", hsName)
+	}
+	if d.Dirty {
+		ct.Fatalf(t, "UpgradeServer: cannot upgrade homeservers in dirty deployments, as they are shared between tests")
+	}
+	keyIDsBefore, err := d.signingKeyIDs(hsName)
+	if err != nil {
+		ct.Fatalf(t, "UpgradeServer: failed to get signing keys of %s: %s", hsName, err)
+	}
+	d.stopFederationProxy()
+	if err = d.Deployer.UpgradeServer(d, hsName, imageURI); err != nil {
+		ct.Fatalf(t, "UpgradeServer: %s", err)
+	}
+	// the new container has a new network namespace
+	d.partitioned = slices.DeleteFunc(d.partitioned, func(name string) bool {
+		return name == hsName
+	})
+	delete(d.impaired, hsName)
+	keyIDsAfter, err := d.signingKeyIDs(hsName)
+	if err != nil {
+		ct.Fatalf(t, "UpgradeServer: failed to get signing keys of %s: %s", hsName, err)
+	}
+	if !slices.Equal(keyIDsBefore, keyIDsAfter) {
+		ct.Errorf(t, "UpgradeServer: signing keys of %s changed from %v to %v: is the key in runtime.DataPaths?", hsName, keyIDsBefore, keyIDsAfter)
+	}
+}
+
+// Partition splits the homeservers into groups which cannot talk to each other. Any homeservers not in a group
+// are placed in a group together. Homeservers also cannot make or receive federation connections to or from
+// anything else, such as servers hosted by Complement, but clients can still connect to them, and they can
+// still talk to their own sidecars. Replaces any existing partition. Call Heal to remove the partition.
+// Fails the test if federation traffic is routed through FederationProxy, as the proxy would be cut off from
+// every homeserver.
+func (d *Deployment) Partition(t ct.TestLike, groups ...[]string) {
+	t.Helper()
+	t.Logf("Partition %v", groups)
+	if d.proxyingFederation() {
+		ct.Fatalf(t, "Partition: cannot partition homeservers while federation traffic goes through FederationProxy")
+	}
+	groupOf := make(map[string]int)
+	for i, group := range groups {
+		for _, hsName := range group {
+			if d.HS[hsName] == nil {
+				ct.Fatalf(t, "Partition: %s does not exist in this deployment", hsName)
+			}
+			if _, exists := groupOf[hsName]; exists {
+				ct.Fatalf(t, "Partition: %s is in more than one group", hsName)
+			}
+			groupOf[hsName] = i
+		}
+	}
+	for hsName := range d.HS {
+		if _, exists := groupOf[hsName]; !exists {
+			groupOf[hsName] = len(groups)
+		}
+	}
+	ips := make(map[string]string)
+	for hsName, hsDep := range d.HS {
+		ip, err := d.Deployer.containerIP(hsDep)
+		if err != nil {
+			ct.Fatalf(t, "Partition: %s", err)
+		}
+		ips[hsName] = ip
+	}
+	d.partitioned = nil
+	for hsName, hsDep := range d.HS {
+		var peerIPs, blockedIPs []string
+		for otherName, ip := range ips {
+			if otherName == hsName {
+				continue
+			}
+			if groupOf[otherName] == groupOf[hsName] {
+				peerIPs = append(peerIPs, ip)
+			} else {
+				blockedIPs = append(blockedIPs, ip)
+			}
+		}
+		d.partitioned = append(d.partitioned, hsName)
+		if err := d.Deployer.partitionServer(hsDep, peerIPs, blockedIPs); err != nil {
+			ct.Fatalf(t, "Partition: %s", err)
+		}
+	}
+}
+
+// Heal removes the partition created by Partition, if there is one.
+func (d *Deployment) Heal(t ct.TestLike) {
+	t.Helper()
+	if len(d.partitioned) == 0 {
+		return
+	}
+	t.Logf("Heal %v", d.partitioned)
+	for _, hsName := range d.partitioned {
+		if err := d.Deployer.healServer(d.HS[hsName]); err != nil {
+			ct.Fatalf(t, "Heal: %s", err)
+		}
+	}
+	d.partitioned = nil
+}
+
+// ImpairNetwork applies latency, jitter, packet loss and a bandwidth cap to traffic sent by the homeserver,
+// except responses to clients. Replaces any existing impairment. Call ClearNetworkImpairment to remove it.
+func (d *Deployment) ImpairNetwork(t ct.TestLike, hsName string, opts helpers.NetworkImpairmentOpts) {
+	t.Helper()
+	t.Logf("ImpairNetwork %s %+v", hsName, opts)
+	hsDep := d.HS[hsName]
+	if hsDep == nil {
+		ct.Fatalf(t, "ImpairNetwork: %s does not exist in this deployment", hsName)
+	}
+	if err := d.Deployer.impairServer(hsDep, opts); err != nil {
+		ct.Fatalf(t, "ImpairNetwork: %s", err)
+	}
+	if d.impaired == nil {
+		d.impaired = make(map[string]bool)
+	}
+	d.impaired[hsName] = true
+}
+
+// ClearNetworkImpairment removes the impairment applied by ImpairNetwork, if there is one.
+func (d *Deployment) ClearNetworkImpairment(t ct.TestLike, hsName string) {
+	t.Helper()
+	hsDep := d.HS[hsName]
+	if hsDep == nil {
+		ct.Fatalf(t, "ClearNetworkImpairment: %s does not exist in this deployment", hsName)
+	}
+	if !d.impaired[hsName] {
+		return
+	}
+	t.Logf("ClearNetworkImpairment %s", hsName)
+	if err := d.Deployer.clearServerImpairment(hsDep); err != nil {
+		ct.Fatalf(t, "ClearNetworkImpairment: %s", err)
+	}
+	delete(d.impaired, hsName)
+}
+
+// SetClockOffset changes the clock of the homeserver to be `offset` from the real time e.g 24 hours in the
+// future. Offsets are not cumulative: use 0 to reset the clock. Offsets must be whole seconds, as that is
+// the granularity libfaketime supports. Requires COMPLEMENT_FAKETIME_LIB.
+func (d *Deployment) SetClockOffset(t ct.TestLike, hsName string, offset time.Duration) {
+	t.Helper()
+	t.Logf("SetClockOffset %s %v", hsName, offset)
+	hsDep := d.HS[hsName]
+	if hsDep == nil {
+		ct.Fatalf(t, "SetClockOffset: %s does not exist in this deployment", hsName)
+	}
+	if err := d.Deployer.SetClockOffset(hsDep, offset); err != nil {
+		ct.Fatalf(t, "SetClockOffset: %s", err)
+	}
+	if d.clockOffsets == nil {
+		d.clockOffsets = make(map[string]time.Duration)
+	}
+	d.clockOffsets[hsName] = offset
+}
+
+// Checkpoint saves the filesystem of every homeserver in the deployment, returning an ID which can be passed
+// to Restore. Data in volumes is not saved. Each homeserver is paused while it is saved.
+func (d *Deployment) Checkpoint(t ct.TestLike) string {
+	t.Helper()
+	d.checkpointCounter++
+	checkpointID := fmt.Sprintf("checkpoint%d", d.checkpointCounter)
+	cp := &checkpoint{
+		servers: make(map[string]checkpointServer),
+	}
+	for hsName, hsDep := range d.HS {
+		imageID, sidecarImageIDs, err := d.Deployer.checkpointServer(d, hsName, checkpointID)
+		if err != nil {
+			ct.Fatalf(t, "Checkpoint: %s", err)
+		}
+		hsDep.accessTokensMutex.RLock()
+		accessTokens := maps.Clone(hsDep.AccessTokens)
+		hsDep.accessTokensMutex.RUnlock()
+		cp.servers[hsName] = checkpointServer{
+			imageID:         imageID,
+			sidecarImageIDs: sidecarImageIDs,
+			accessTokens:    accessTokens,
+			deviceIDs:       maps.Clone(hsDep.DeviceIDs),
+			clockOffset:     d.clockOffsets[hsName],
+		}
+	}
+	if d.checkpoints == nil {
+		d.checkpoints = make(map[string]*checkpoint)
+	}
+	d.checkpoints[checkpointID] = cp
+	t.Logf("Checkpoint %s", checkpointID)
+	return checkpointID
+}
+
+// Restore replaces every homeserver saved by Checkpoint with a new container started from the checkpoint.
+// Homeservers added after the checkpoint are left as they are. Existing clients keep working, but access
+// tokens created after the checkpoint are no longer valid. The restored homeservers are no longer partitioned
+// or impaired, as their network is not saved in the checkpoint; homeservers added after the checkpoint keep
+// theirs. The federation proxy is removed; call FederationProxy again to route traffic through the proxy.
+func (d *Deployment) Restore(t ct.TestLike, checkpointID string) {
+	t.Helper()
+	cp, ok := d.checkpoints[checkpointID]
+	if !ok {
+		ct.Fatalf(t, "Restore: unknown checkpoint %s", checkpointID)
+	}
+	t.Logf("Restore %s", checkpointID)
+	d.stopFederationProxy()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for hsName, state := range cp.servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := d.Deployer.restoreServer(d, hsName, state); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", hsName, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	for hsName, state := range cp.servers {
+		// the restored containers have new network namespaces, but homeservers added after the checkpoint don't
+		d.partitioned = slices.DeleteFunc(d.partitioned, func(name string) bool {
+			return name == hsName
+		})
+		delete(d.impaired, hsName)
+		if state.clockOffset == 0 {
+			delete(d.clockOffsets, hsName)
+		} else {
+			if d.clockOffsets == nil {
+				d.clockOffsets = make(map[string]time.Duration)
+			}
+			d.clockOffsets[hsName] = state.clockOffset
+		}
+	}
+	if len(errs) > 0 {
+		ct.Fatalf(t, "Restore: %s", errors.Join(errs...))
+	}
+}
+
 func (d *Deployment) ContainerID(t ct.TestLike, hsName string) string {
 	t.Helper()
 	hsDep := d.HS[hsName]
@@ -0,0 +1,60 @@
+package docker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/federation"
+)
+
+func TestDestroyDirtyStopsFederationProxy(t *testing.T) {
+	cfg := &config.Complement{}
+	dep := &Deployment{
+		Deployer: &Deployer{config: cfg},
+		HS:       map[string]*HomeserverDeployment{},
+		Config:   cfg,
+		Dirty:    true,
+	}
+	released := false
+	dep.ReleaseDirty = func(broken bool) {
+		released = true
+		if broken {
+			t.Errorf("ReleaseDirty: deployment was released as broken")
+		}
+	}
+	dep.federationProxy = federation.NewProxy(t, dep)
+
+	dep.Destroy(t)
+	if dep.federationProxy != nil {
+		t.Errorf("dirty deployment still has a federation proxy after Destroy")
+	}
+	if !released {
+		t.Errorf("dirty deployment was not released")
+	}
+}
+
+func TestPartitionAndFederationProxyAreExclusive(t *testing.T) {
+	cfg := &config.Complement{}
+	dep := &Deployment{
+		Deployer: &Deployer{config: cfg},
+		HS:       map[string]*HomeserverDeployment{},
+		Config:   cfg,
+	}
+	dep.federationProxy = federation.NewProxy(t, dep)
+	rt := runRecording(func(rt *recordingT) {
+		dep.Partition(rt, []string{"hs1"})
+	})
+	if len(rt.fatals) != 1 || !strings.Contains(rt.fatals[0], "FederationProxy") {
+		t.Errorf("Partition while proxying: got fatals %v, want one about FederationProxy", rt.fatals)
+	}
+
+	dep.federationProxy = nil
+	dep.partitioned = []string{"hs1"}
+	rt = runRecording(func(rt *recordingT) {
+		dep.FederationProxy(rt)
+	})
+	if len(rt.fatals) != 1 || !strings.Contains(rt.fatals[0], "partitioned") {
+		t.Errorf("FederationProxy while partitioned: got fatals %v, want one about the partition", rt.fatals)
+	}
+}
@@ -0,0 +1,92 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+
+	"github.com/matrix-org/complement/federation"
+)
+
+// createDNSStandin starts `dns` listening on the host running Complement, then creates a container on the
+// network which forwards DNS queries on port 53 and HTTPS traffic on federation.DNSFrontendPorts to it.
+// Returns the IP address of the container on the network, which homeservers should use as their DNS server.
+func (d *Deployer) createDNSStandin(ctx context.Context, dep *Deployment, networkName string, dns *federation.DNSServer) (net.IP, error) {
+	if err := d.pullImageIfNotExists(ctx, d.config.FederationProxyImage); err != nil {
+		return nil, err
+	}
+	dnsPort, httpsPort, err := dns.Listen()
+	if err != nil {
+		return nil, fmt.Errorf("createDNSStandin: %w", err)
+	}
+	dep.dnsServer = dns
+	host := d.config.HostnameRunningComplement
+	var extraHosts []string
+	if runtime.GOOS == "linux" {
+		extraHosts = []string{fmt.Sprintf("%s:host-gateway", host)}
+	}
+	script := fmt.Sprintf("socat UDP4-RECVFROM:53,fork UDP4-SENDTO:%s:%d & ", host, dnsPort)
+	for _, port := range federation.DNSFrontendPorts {
+		script += fmt.Sprintf("socat TCP-LISTEN:%d,fork,reuseaddr TCP:%s:%d & ", port, host, httpsPort)
+	}
+	script += "wait"
+	body, err := d.Docker.ContainerCreate(ctx, &container.Config{
+		Image:      d.config.FederationProxyImage,
+		Entrypoint: []string{"/bin/sh", "-c"},
+		Cmd:        []string{script},
+		Labels: map[string]string{
+			complementLabel:  "dns_standin",
+			"complement_pkg": d.config.PackageNamespace,
+		},
+	}, &container.HostConfig{
+		ExtraHosts: extraHosts,
+	}, &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			networkName: {},
+		},
+	}, nil, fmt.Sprintf("complement_%s_%s_dns_standin", d.config.PackageNamespace, d.DeployNamespace))
+	if err != nil {
+		return nil, fmt.Errorf("createDNSStandin: failed to create container: %w", err)
+	}
+	dep.dnsStandinContainerID = body.ID
+	if err = d.Docker.ContainerStart(ctx, body.ID, container.StartOptions{}); err != nil {
+		return nil, fmt.Errorf("createDNSStandin: failed to start container: %w", err)
+	}
+	inspect, err := d.Docker.ContainerInspect(ctx, body.ID)
+	if err != nil {
+		return nil, fmt.Errorf("createDNSStandin: failed to inspect container: %w", err)
+	}
+	endpoint, ok := inspect.NetworkSettings.Networks[networkName]
+	if !ok {
+		return nil, fmt.Errorf("createDNSStandin: container is not connected to network %s", networkName)
+	}
+	ip := net.ParseIP(endpoint.IPAddress)
+	if ip == nil {
+		return nil, fmt.Errorf("createDNSStandin: container has invalid IP address %q", endpoint.IPAddress)
+	}
+	dns.FrontendIP = ip
+	d.log("DNS stand-in at %s -> %s:%d (dns) %s:%d (https)\n", ip, host, dnsPort, host, httpsPort)
+	return ip, nil
+}
+
+// stopDNSStandin removes the DNS stand-in container and stops the DNS server, if they exist.
+func (d *Deployment) stopDNSStandin() {
+	if d.dnsStandinContainerID != "" {
+		err := d.Deployer.Docker.ContainerRemove(context.Background(), d.dnsStandinContainerID, container.RemoveOptions{
+			Force: true,
+		})
+		if err != nil {
+			log.Printf("stopDNSStandin: failed to remove container %s: %s", d.dnsStandinContainerID, err)
+		}
+		d.dnsStandinContainerID = ""
+	}
+	if d.dnsServer != nil {
+		d.dnsServer.Close()
+		d.dnsServer = nil
+	}
+}
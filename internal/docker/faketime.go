@@ -0,0 +1,107 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/complement/config"
+)
+
+const (
+	MountFaketimeLibPath = "/complement/faketime/libfaketime.so.1"
+	MountFaketimeRCPath  = "/complement/faketime/faketimerc"
+	// libfaketime re-reads the offset file at most this often
+	faketimeCacheDuration = time.Second
+)
+
+// clockOffset returns the offset to start a homeserver with, or nil if clocks cannot be changed.
+func clockOffset(cfg *config.Complement, offset time.Duration) *time.Duration {
+	if cfg.FaketimeLibPath == "" {
+		return nil
+	}
+	return &offset
+}
+
+// faketimeEnv returns the environment variables which preload libfaketime into every process in a container
+// of the image, reading the clock offset from MountFaketimeRCPath. Libraries already preloaded by the image
+// are kept.
+func faketimeEnv(ctx context.Context, docker ContainerRuntime, imageID string) ([]string, error) {
+	inspect, err := docker.ImageInspect(ctx, imageID)
+	if err != nil {
+		return nil, fmt.Errorf("faketimeEnv: failed to inspect image %s: %w", imageID, err)
+	}
+	var imageEnv []string
+	if inspect.Config != nil {
+		imageEnv = inspect.Config.Env
+	}
+	return []string{
+		"LD_PRELOAD=" + faketimePreload(imageEnv),
+		"FAKETIME_TIMESTAMP_FILE=" + MountFaketimeRCPath,
+		fmt.Sprintf("FAKETIME_CACHE_DURATION=%d", int(faketimeCacheDuration.Seconds())),
+		// timeouts and sleeps should not be affected by the offset
+		"FAKETIME_DONT_FAKE_MONOTONIC=1",
+	}, nil
+}
+
+// faketimePreload returns LD_PRELOAD for a container with the environment `imageEnv`, appending libfaketime
+// to any libraries the image already preloads.
+func faketimePreload(imageEnv []string) string {
+	preload := MountFaketimeLibPath
+	for _, ev := range imageEnv {
+		if existing, ok := strings.CutPrefix(ev, "LD_PRELOAD="); ok && existing != "" {
+			preload = existing + ":" + preload
+		}
+	}
+	return preload
+}
+
+// copyFaketime copies libfaketime and the initial clock offset into the container.
+func copyFaketime(docker ContainerRuntime, containerID string, cfg *config.Complement, offset time.Duration) error {
+	lib, err := os.ReadFile(cfg.FaketimeLibPath)
+	if err != nil {
+		return fmt.Errorf("copyFaketime: failed to read COMPLEMENT_FAKETIME_LIB: %w", err)
+	}
+	if err = copyToContainer(docker, containerID, MountFaketimeLibPath, lib); err != nil {
+		return fmt.Errorf("copyFaketime: %w", err)
+	}
+	return writeClockOffset(docker, containerID, offset)
+}
+
+// checkClockOffset returns an error if the offset can't be represented by libfaketime, which only
+// supports offsets in whole seconds.
+func checkClockOffset(offset time.Duration) error {
+	if offset%time.Second != 0 {
+		return fmt.Errorf("clock offset %v is not a whole number of seconds", offset)
+	}
+	return nil
+}
+
+// writeClockOffset writes the clock offset for libfaketime into the container.
+func writeClockOffset(docker ContainerRuntime, containerID string, offset time.Duration) error {
+	// libfaketime understands relative offsets in seconds e.g "+3600" or "-30"
+	rc := fmt.Sprintf("%+d\n", int64(offset/time.Second))
+	if err := copyToContainer(docker, containerID, MountFaketimeRCPath, []byte(rc)); err != nil {
+		return fmt.Errorf("failed to write clock offset: %w", err)
+	}
+	return nil
+}
+
+// SetClockOffset changes the clock of the homeserver to be `offset` from the real time. Blocks until the
+// homeserver will have seen the new offset.
+func (d *Deployer) SetClockOffset(hsDep *HomeserverDeployment, offset time.Duration) error {
+	if d.config.FaketimeLibPath == "" {
+		return fmt.Errorf("SetClockOffset: COMPLEMENT_FAKETIME_LIB must be set to change the clock of homeservers")
+	}
+	if err := checkClockOffset(offset); err != nil {
+		return fmt.Errorf("SetClockOffset: %w", err)
+	}
+	containerID, _ := hsDep.container()
+	if err := writeClockOffset(d.Docker, containerID, offset); err != nil {
+		return fmt.Errorf("SetClockOffset: %w", err)
+	}
+	time.Sleep(faketimeCacheDuration + 100*time.Millisecond)
+	return nil
+}
@@ -0,0 +1,59 @@
+package docker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFaketimePreload(t *testing.T) {
+	testCases := []struct {
+		name     string
+		imageEnv []string
+		want     string
+	}{
+		{
+			name:     "no preload",
+			imageEnv: []string{"PATH=/usr/bin"},
+			want:     MountFaketimeLibPath,
+		},
+		{
+			name:     "empty preload",
+			imageEnv: []string{"LD_PRELOAD="},
+			want:     MountFaketimeLibPath,
+		},
+		{
+			name:     "existing preload is kept",
+			imageEnv: []string{"PATH=/usr/bin", "LD_PRELOAD=/usr/lib/libjemalloc.so.2"},
+			want:     "/usr/lib/libjemalloc.so.2:" + MountFaketimeLibPath,
+		},
+		{
+			name:     "several existing libraries",
+			imageEnv: []string{"LD_PRELOAD=/a.so:/b.so"},
+			want:     "/a.so:/b.so:" + MountFaketimeLibPath,
+		},
+		{
+			name:     "similar variable names are ignored",
+			imageEnv: []string{"XLD_PRELOAD=/x.so", "LD_PRELOAD_PATH=/y.so"},
+			want:     MountFaketimeLibPath,
+		},
+	}
+	for _, tc := range testCases {
+		if got := faketimePreload(tc.imageEnv); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCheckClockOffset(t *testing.T) {
+	for _, offset := range []time.Duration{0, time.Second, -30 * time.Second, 24 * time.Hour} {
+		if err := checkClockOffset(offset); err != nil {
+			t.Errorf("checkClockOffset(%v): got %s, want no error", offset, err)
+		}
+	}
+	// libfaketime would silently round these down
+	for _, offset := range []time.Duration{time.Millisecond, 1500 * time.Millisecond, -time.Nanosecond} {
+		if err := checkClockOffset(offset); err == nil {
+			t.Errorf("checkClockOffset(%v): got no error", offset)
+		}
+	}
+}
@@ -0,0 +1,1068 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	timetypes "github.com/docker/docker/api/types/time"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/matrix-org/complement/config"
+)
+
+var (
+	localRuntimeMu sync.Mutex
+	localRuntime   *processRuntime
+)
+
+// localRuntimeFor returns the process runtime. There is only one per test binary, as images made by the
+// Builder must be visible to every Deployer.
+func localRuntimeFor(cfg *config.Complement) (ContainerRuntime, error) {
+	localRuntimeMu.Lock()
+	defer localRuntimeMu.Unlock()
+	if localRuntime != nil {
+		return localRuntime, nil
+	}
+	root, err := os.MkdirTemp("", "complement-local-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to make directory for local homeservers: %w", err)
+	}
+	localRuntime = newProcessRuntime(cfg, root)
+	return localRuntime, nil
+}
+
+// newProcessRuntime makes a process runtime which keeps its images and containers in `root`.
+func newProcessRuntime(cfg *config.Complement, root string) *processRuntime {
+	return &processRuntime{
+		cfg:        cfg,
+		root:       root,
+		images:     make(map[string]*processImage),
+		containers: make(map[string]*processContainer),
+		networks:   make(map[string]*network.Summary),
+	}
+}
+
+// processRuntime is a ContainerRuntime which runs COMPLEMENT_LOCAL_HS_COMMAND as a local process instead of
+// running containers. Each "container" is a process with its own data directory, and each "image" is a copy
+// of a data directory. Networks are not isolated: every homeserver listens on the host.
+type processRuntime struct {
+	cfg  *config.Complement
+	root string
+
+	mu         sync.Mutex
+	images     map[string]*processImage     // ID -> image
+	containers map[string]*processContainer // ID -> container
+	networks   map[string]*network.Summary  // ID -> network
+}
+
+type processImage struct {
+	id      string
+	refs    []string
+	dir     string
+	labels  map[string]string
+	created time.Time
+}
+
+type processContainer struct {
+	id      string
+	name    string
+	image   string
+	dir     string
+	config  container.Config
+	ports   nat.PortMap
+	created time.Time
+	logs    *processLogs
+
+	// the following fields are guarded by processRuntime.mu
+	cmd      *exec.Cmd
+	exited   chan struct{}
+	exitCode int
+	running  bool
+	paused   bool
+}
+
+var errNotSupportedLocally = errors.New("not supported when COMPLEMENT_CONTAINER_RUNTIME=local")
+
+var labelChangeRegexp = regexp.MustCompile(`^LABEL "(.*)"="(.*)"$`)
+
+func randomID() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// lookupImage finds an image by ID or reference. Must be called with mu held.
+func (r *processRuntime) lookupImage(ref string) *processImage {
+	if img, ok := r.images[strings.TrimPrefix(ref, "sha256:")]; ok {
+		return img
+	}
+	for _, img := range r.images {
+		for _, imgRef := range img.refs {
+			if imgRef == ref {
+				return img
+			}
+		}
+	}
+	return nil
+}
+
+// isBaseImage returns true if the reference is one of the configured homeserver images. There is nothing to
+// build for these, so they are empty data directories.
+func (r *processRuntime) isBaseImage(ref string) bool {
+	if ref == r.cfg.BaseImageURI {
+		return true
+	}
+	for _, uri := range r.cfg.BaseImageURIs {
+		if ref == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupContainer finds a container by ID or name. Must be called with mu held.
+func (r *processRuntime) lookupContainer(idOrName string) (*processContainer, error) {
+	if c, ok := r.containers[idOrName]; ok {
+		return c, nil
+	}
+	for _, c := range r.containers {
+		if c.name == strings.TrimPrefix(idOrName, "/") {
+			return c, nil
+		}
+	}
+	return nil, errdefs.NotFound(fmt.Errorf("no such container: %s", idOrName))
+}
+
+func (r *processRuntime) ImageInspect(ctx context.Context, ref string, _ ...client.ImageInspectOption) (image.InspectResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	img := r.lookupImage(ref)
+	if img == nil {
+		if r.isBaseImage(ref) {
+			return image.InspectResponse{
+				ID:       ref,
+				RepoTags: []string{ref},
+				Config:   &container.Config{},
+			}, nil
+		}
+		return image.InspectResponse{}, errdefs.NotFound(fmt.Errorf("no such image: %s", ref))
+	}
+	return image.InspectResponse{
+		ID:       "sha256:" + img.id,
+		RepoTags: img.refs,
+		Created:  img.created.Format(time.RFC3339Nano),
+		Config: &container.Config{
+			Labels: img.labels,
+		},
+	}, nil
+}
+
+func (r *processRuntime) ImageList(ctx context.Context, options image.ListOptions) ([]image.Summary, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var images []image.Summary
+	for _, img := range r.images {
+		if !options.Filters.MatchKVList("label", img.labels) {
+			continue
+		}
+		images = append(images, image.Summary{
+			ID:       "sha256:" + img.id,
+			RepoTags: img.refs,
+			Labels:   img.labels,
+			Created:  img.created.Unix(),
+		})
+	}
+	return images, nil
+}
+
+func (r *processRuntime) ImagePull(ctx context.Context, ref string, options image.PullOptions) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("ImagePull %s: %w", ref, errNotSupportedLocally)
+}
+
+func (r *processRuntime) ImageRemove(ctx context.Context, ref string, options image.RemoveOptions) ([]image.DeleteResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	img := r.lookupImage(ref)
+	if img == nil {
+		return nil, errdefs.NotFound(fmt.Errorf("no such image: %s", ref))
+	}
+	delete(r.images, img.id)
+	if err := os.RemoveAll(img.dir); err != nil {
+		return nil, fmt.Errorf("failed to remove image directory: %w", err)
+	}
+	return []image.DeleteResponse{{Deleted: "sha256:" + img.id}}, nil
+}
+
+// ContainerCommit copies the data directory of the container. Only LABEL changes are supported.
+func (r *processRuntime) ContainerCommit(ctx context.Context, containerID string, options container.CommitOptions) (container.CommitResponse, error) {
+	r.mu.Lock()
+	c, err := r.lookupContainer(containerID)
+	r.mu.Unlock()
+	if err != nil {
+		return container.CommitResponse{}, err
+	}
+	labels := make(map[string]string)
+	for k, v := range c.config.Labels {
+		labels[k] = v
+	}
+	for _, change := range options.Changes {
+		m := labelChangeRegexp.FindStringSubmatch(change)
+		if m == nil {
+			return container.CommitResponse{}, fmt.Errorf("ContainerCommit: unsupported change %q: %w", change, errNotSupportedLocally)
+		}
+		labels[m[1]] = m[2]
+	}
+	if options.Pause {
+		if err = r.ContainerPause(ctx, c.id); err == nil {
+			defer r.ContainerUnpause(ctx, c.id)
+		}
+	}
+	img := &processImage{
+		id:      randomID(),
+		labels:  labels,
+		created: time.Now(),
+	}
+	img.dir = filepath.Join(r.root, "images", img.id)
+	if err = copyDir(c.dir, img.dir); err != nil {
+		return container.CommitResponse{}, fmt.Errorf("ContainerCommit: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if options.Reference != "" {
+		// the reference moves to the new image
+		if existing := r.lookupImage(options.Reference); existing != nil {
+			existing.refs = removeString(existing.refs, options.Reference)
+		}
+		img.refs = []string{options.Reference}
+	}
+	r.images[img.id] = img
+	return container.CommitResponse{ID: "sha256:" + img.id}, nil
+}
+
+func (r *processRuntime) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.lookupContainer(containerName); containerName != "" && err == nil {
+		return container.CreateResponse{}, errdefs.Conflict(fmt.Errorf("container name %s is already in use", containerName))
+	}
+	if config.Labels[sidecarLabel] != "" {
+		// every container runs COMPLEMENT_LOCAL_HS_COMMAND, so there is no way to run the sidecar's image
+		return container.CreateResponse{}, fmt.Errorf("sidecar %s: %w", config.Labels[sidecarLabel], errNotSupportedLocally)
+	}
+	img := r.lookupImage(config.Image)
+	if img == nil && !r.isBaseImage(config.Image) {
+		return container.CreateResponse{}, errdefs.NotFound(fmt.Errorf("no such image: %s: only COMPLEMENT_BASE_IMAGE and images made by Complement can be used: %w", config.Image, errNotSupportedLocally))
+	}
+	c := &processContainer{
+		id:      randomID(),
+		name:    containerName,
+		image:   config.Image,
+		config:  *config,
+		created: time.Now(),
+		logs:    newProcessLogs(),
+	}
+	c.dir = filepath.Join(r.root, "containers", c.id)
+	// containers inherit the labels of their image
+	labels := make(map[string]string)
+	if img != nil {
+		for k, v := range img.labels {
+			labels[k] = v
+		}
+		if err := copyDir(img.dir, c.dir); err != nil {
+			return container.CreateResponse{}, fmt.Errorf("ContainerCreate: %w", err)
+		}
+	} else if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return container.CreateResponse{}, fmt.Errorf("ContainerCreate: %w", err)
+	}
+	for k, v := range config.Labels {
+		labels[k] = v
+	}
+	c.config.Labels = labels
+	var warnings []string
+	if hostConfig != nil && len(hostConfig.Mounts) > 0 {
+		warnings = append(warnings, "host mounts are ignored when COMPLEMENT_CONTAINER_RUNTIME=local")
+	}
+	r.containers[c.id] = c
+	return container.CreateResponse{ID: c.id, Warnings: warnings}, nil
+}
+
+// allocatePorts picks a free port for the client-server API and the federation API, skipping ports allocated
+// to other containers which may not have been bound yet. The ports are reserved by the returned listeners,
+// which must be closed just before the process starts so it can bind them. Must be called with mu held.
+func (r *processRuntime) allocatePorts() (nat.PortMap, []net.Listener, error) {
+	ports := make(nat.PortMap)
+	var listeners, skipped []net.Listener
+	defer func() {
+		for _, ln := range skipped {
+			ln.Close()
+		}
+	}()
+	for _, port := range []nat.Port{"8008/tcp", "8448/tcp"} {
+		for {
+			ln, err := net.Listen("tcp", r.cfg.HSPortBindingIP+":0")
+			if err != nil {
+				for _, ln := range listeners {
+					ln.Close()
+				}
+				return nil, nil, fmt.Errorf("failed to allocate port: %w", err)
+			}
+			hostPort := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+			if r.portAllocated(hostPort) {
+				// keep it open so the next listener gets a different port
+				skipped = append(skipped, ln)
+				continue
+			}
+			listeners = append(listeners, ln)
+			ports[port] = []nat.PortBinding{{HostIP: r.cfg.HSPortBindingIP, HostPort: hostPort}}
+			break
+		}
+	}
+	return ports, listeners, nil
+}
+
+// portAllocated returns true if the port is allocated to a running container. Must be called with mu held.
+func (r *processRuntime) portAllocated(hostPort string) bool {
+	for _, c := range r.containers {
+		if !c.running {
+			continue
+		}
+		for _, bindings := range c.ports {
+			for _, binding := range bindings {
+				if binding.HostPort == hostPort {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (r *processRuntime) ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, err := r.lookupContainer(containerID)
+	if err != nil {
+		return err
+	}
+	if c.running {
+		return nil
+	}
+	// ports are allocated on each start, as they may have been taken while the process was stopped
+	ports, listeners, err := r.allocatePorts()
+	if err != nil {
+		return fmt.Errorf("ContainerStart: %w", err)
+	}
+	c.ports = ports
+	cmd := exec.Command("sh", "-c", r.cfg.LocalHomeserverCommand)
+	cmd.Dir = c.dir
+	cmd.Env = append(os.Environ(), c.config.Env...)
+	cmd.Env = append(cmd.Env,
+		"COMPLEMENT_DATA_DIR="+c.dir,
+		"COMPLEMENT_CS_PORT="+c.ports["8008/tcp"][0].HostPort,
+		"COMPLEMENT_FED_PORT="+c.ports["8448/tcp"][0].HostPort,
+	)
+	cmd.Stdout = c.logs.writer(stdcopy.Stdout)
+	cmd.Stderr = c.logs.writer(stdcopy.Stderr)
+	setProcessGroup(cmd)
+	// release the ports as late as possible, so nothing else can take them before the process binds them
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("ContainerStart: failed to run COMPLEMENT_LOCAL_HS_COMMAND: %w", err)
+	}
+	c.cmd = cmd
+	c.running = true
+	c.paused = false
+	c.exited = make(chan struct{})
+	go func(exited chan struct{}) {
+		err := cmd.Wait()
+		c.logs.Flush()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		c.exitCode = 0
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			c.exitCode = exitErr.ExitCode()
+		}
+		c.running = false
+		c.paused = false
+		close(exited)
+	}(c.exited)
+	return nil
+}
+
+func (r *processRuntime) ContainerStop(ctx context.Context, containerID string, options container.StopOptions) error {
+	r.mu.Lock()
+	c, err := r.lookupContainer(containerID)
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	if !c.running {
+		r.mu.Unlock()
+		return nil
+	}
+	cmd, exited := c.cmd, c.exited
+	r.mu.Unlock()
+	timeout := 10 * time.Second
+	if options.Timeout != nil {
+		timeout = time.Duration(*options.Timeout) * time.Second
+	}
+	signalProcessGroup(cmd, "CONT")
+	signalProcessGroup(cmd, "TERM")
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(timeout):
+	}
+	signalProcessGroup(cmd, "KILL")
+	<-exited
+	return nil
+}
+
+func (r *processRuntime) ContainerKill(ctx context.Context, containerID, signal string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, err := r.lookupContainer(containerID)
+	if err != nil {
+		return err
+	}
+	if !c.running {
+		return errdefs.Conflict(fmt.Errorf("container %s is not running", containerID))
+	}
+	if signal == "" {
+		signal = "KILL"
+	}
+	return signalProcessGroup(c.cmd, strings.TrimPrefix(signal, "SIG"))
+}
+
+func (r *processRuntime) ContainerPause(ctx context.Context, containerID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, err := r.lookupContainer(containerID)
+	if err != nil {
+		return err
+	}
+	if !c.running {
+		return errdefs.Conflict(fmt.Errorf("container %s is not running", containerID))
+	}
+	if err = signalProcessGroup(c.cmd, "STOP"); err != nil {
+		return err
+	}
+	c.paused = true
+	return nil
+}
+
+func (r *processRuntime) ContainerUnpause(ctx context.Context, containerID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, err := r.lookupContainer(containerID)
+	if err != nil {
+		return err
+	}
+	if !c.paused {
+		return errdefs.Conflict(fmt.Errorf("container %s is not paused", containerID))
+	}
+	if err = signalProcessGroup(c.cmd, "CONT"); err != nil {
+		return err
+	}
+	c.paused = false
+	return nil
+}
+
+func (r *processRuntime) ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error {
+	r.mu.Lock()
+	c, err := r.lookupContainer(containerID)
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	if c.running {
+		if !options.Force {
+			r.mu.Unlock()
+			return errdefs.Conflict(fmt.Errorf("cannot remove running container %s", containerID))
+		}
+		signalProcessGroup(c.cmd, "KILL")
+		exited := c.exited
+		r.mu.Unlock()
+		<-exited
+		r.mu.Lock()
+	}
+	delete(r.containers, c.id)
+	r.mu.Unlock()
+	c.logs.Close()
+	return os.RemoveAll(c.dir)
+}
+
+func (r *processRuntime) ContainerRename(ctx context.Context, containerID, newContainerName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, err := r.lookupContainer(containerID)
+	if err != nil {
+		return err
+	}
+	if other, err := r.lookupContainer(newContainerName); err == nil && other != c {
+		return errdefs.Conflict(fmt.Errorf("container name %s is already in use", newContainerName))
+	}
+	c.name = strings.TrimPrefix(newContainerName, "/")
+	return nil
+}
+
+func (r *processRuntime) ContainerWait(ctx context.Context, containerID string, condition container.WaitCondition) (<-chan container.WaitResponse, <-chan error) {
+	resCh := make(chan container.WaitResponse, 1)
+	errCh := make(chan error, 1)
+	r.mu.Lock()
+	c, err := r.lookupContainer(containerID)
+	if err != nil {
+		r.mu.Unlock()
+		errCh <- err
+		return resCh, errCh
+	}
+	exited := c.exited
+	r.mu.Unlock()
+	go func() {
+		if exited != nil {
+			select {
+			case <-exited:
+			case <-ctx.Done():
+				errCh <- ctx.Err()
+				return
+			}
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		resCh <- container.WaitResponse{StatusCode: int64(c.exitCode)}
+	}()
+	return resCh, errCh
+}
+
+func (r *processRuntime) ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, err := r.lookupContainer(containerID)
+	if err != nil {
+		return container.InspectResponse{}, err
+	}
+	state := &container.State{
+		Status:   c.status(),
+		Running:  c.running,
+		Paused:   c.paused,
+		ExitCode: c.exitCode,
+	}
+	if c.running {
+		state.Pid = c.cmd.Process.Pid
+	}
+	config := c.config
+	networks := make(map[string]*network.EndpointSettings)
+	for _, nw := range r.networks {
+		networks[nw.Name] = &network.EndpointSettings{
+			NetworkID: nw.ID,
+			IPAddress: r.cfg.HSPortBindingIP,
+		}
+	}
+	return container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{
+			ID:      c.id,
+			Name:    "/" + c.name,
+			Image:   c.image,
+			Created: c.created.Format(time.RFC3339Nano),
+			State:   state,
+		},
+		Config: &config,
+		NetworkSettings: &container.NetworkSettings{
+			NetworkSettingsBase: container.NetworkSettingsBase{
+				Ports: c.ports,
+			},
+			Networks: networks,
+		},
+	}, nil
+}
+
+func (c *processContainer) status() string {
+	switch {
+	case c.paused:
+		return "paused"
+	case c.running:
+		return "running"
+	case c.cmd != nil:
+		return "exited"
+	}
+	return "created"
+}
+
+func (r *processRuntime) ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var containers []container.Summary
+	for _, c := range r.containers {
+		if !options.All && !c.running {
+			continue
+		}
+		if !options.Filters.MatchKVList("label", c.config.Labels) {
+			continue
+		}
+		var ports []container.Port
+		for port, bindings := range c.ports {
+			for _, binding := range bindings {
+				hostPort, _ := strconv.Atoi(binding.HostPort)
+				ports = append(ports, container.Port{
+					IP:          binding.HostIP,
+					PrivatePort: uint16(port.Int()),
+					PublicPort:  uint16(hostPort),
+					Type:        port.Proto(),
+				})
+			}
+		}
+		containers = append(containers, container.Summary{
+			ID:      c.id,
+			Names:   []string{"/" + c.name},
+			Image:   c.image,
+			Labels:  c.config.Labels,
+			State:   c.status(),
+			Created: c.created.Unix(),
+			Ports:   ports,
+		})
+	}
+	return containers, nil
+}
+
+// ContainerLogs returns the output of the process multiplexed in the same way as the Docker API, so it can be
+// read with stdcopy.StdCopy.
+func (r *processRuntime) ContainerLogs(ctx context.Context, containerID string, options container.LogsOptions) (io.ReadCloser, error) {
+	r.mu.Lock()
+	c, err := r.lookupContainer(containerID)
+	var exited chan struct{}
+	if err == nil && c.running {
+		exited = c.exited
+	}
+	r.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	reader := &processLogsReader{
+		logs:       c.logs,
+		stdout:     options.ShowStdout,
+		stderr:     options.ShowStderr,
+		timestamps: options.Timestamps,
+	}
+	if options.Since != "" {
+		sec, nsec, err := timetypes.ParseTimestamps(options.Since, 0)
+		if err != nil {
+			return nil, errdefs.InvalidParameter(fmt.Errorf("invalid since: %w", err))
+		}
+		reader.since = time.Unix(sec, nsec)
+	}
+	reader.ctx, reader.cancel = context.WithCancel(ctx)
+	if !options.Follow || exited == nil {
+		// stop at the end of the logs written so far
+		reader.cancel()
+		return reader, nil
+	}
+	go func() {
+		select {
+		case <-exited:
+		case <-reader.ctx.Done():
+		}
+		reader.cancel()
+		c.logs.Broadcast()
+	}()
+	return reader, nil
+}
+
+func (r *processRuntime) ContainerStatsOneShot(ctx context.Context, containerID string) (container.StatsResponseReader, error) {
+	return container.StatsResponseReader{}, fmt.Errorf("ContainerStatsOneShot: %w", errNotSupportedLocally)
+}
+
+// CopyToContainer extracts the tar archive into the data directory of the container.
+func (r *processRuntime) CopyToContainer(ctx context.Context, containerID, dstPath string, content io.Reader, options container.CopyToContainerOptions) error {
+	r.mu.Lock()
+	c, err := r.lookupContainer(containerID)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	root := filepath.Join(c.dir, filepath.FromSlash(dstPath))
+	tr := tar.NewReader(content)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("CopyToContainer: failed to read archive: %w", err)
+		}
+		target := filepath.Join(root, filepath.FromSlash(hdr.Name))
+		if target != filepath.Clean(c.dir) && !strings.HasPrefix(target, filepath.Clean(c.dir)+string(filepath.Separator)) {
+			return fmt.Errorf("CopyToContainer: %s is outside the container", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, fs.FileMode(hdr.Mode).Perm()|0o700)
+		case tar.TypeReg:
+			err = writeFileFrom(target, fs.FileMode(hdr.Mode).Perm(), tr)
+		case tar.TypeSymlink:
+			os.Remove(target)
+			err = os.Symlink(hdr.Linkname, target)
+		default:
+			err = fmt.Errorf("unsupported entry %s: %w", hdr.Name, errNotSupportedLocally)
+		}
+		if err != nil {
+			return fmt.Errorf("CopyToContainer: %w", err)
+		}
+	}
+}
+
+// CopyFromContainer returns a tar archive of the path in the data directory of the container.
+func (r *processRuntime) CopyFromContainer(ctx context.Context, containerID, srcPath string) (io.ReadCloser, container.PathStat, error) {
+	r.mu.Lock()
+	c, err := r.lookupContainer(containerID)
+	r.mu.Unlock()
+	if err != nil {
+		return nil, container.PathStat{}, err
+	}
+	root := filepath.Join(c.dir, filepath.FromSlash(srcPath))
+	info, err := os.Lstat(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, container.PathStat{}, errdefs.NotFound(fmt.Errorf("no such path %s in container %s", srcPath, containerID))
+	}
+	if err != nil {
+		return nil, container.PathStat{}, err
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.Dir(root), path)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if !fi.IsDir() && !fi.Mode().IsRegular() {
+			// sockets, pipes etc are made again by the homeserver
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		return nil, container.PathStat{}, fmt.Errorf("CopyFromContainer: %w", err)
+	}
+	return io.NopCloser(&buf), container.PathStat{
+		Name:  info.Name(),
+		Size:  info.Size(),
+		Mode:  info.Mode(),
+		Mtime: info.ModTime(),
+	}, nil
+}
+
+// NetworkCreate records the network. Networks have no effect on the processes, which all listen on the host.
+func (r *processRuntime) NetworkCreate(ctx context.Context, name string, options network.CreateOptions) (network.CreateResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, nw := range r.networks {
+		if nw.Name == name {
+			return network.CreateResponse{}, errdefs.Conflict(fmt.Errorf("network with name %s already exists", name))
+		}
+	}
+	nw := &network.Summary{
+		ID:      randomID(),
+		Name:    name,
+		Labels:  options.Labels,
+		Created: time.Now(),
+	}
+	r.networks[nw.ID] = nw
+	return network.CreateResponse{ID: nw.ID}, nil
+}
+
+func (r *processRuntime) NetworkList(ctx context.Context, options network.ListOptions) ([]network.Summary, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var networks []network.Summary
+	for _, nw := range r.networks {
+		if !options.Filters.MatchKVList("label", nw.Labels) {
+			continue
+		}
+		if options.Filters.Contains("name") && !options.Filters.Match("name", nw.Name) {
+			continue
+		}
+		networks = append(networks, *nw)
+	}
+	return networks, nil
+}
+
+func (r *processRuntime) NetworkRemove(ctx context.Context, networkID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, nw := range r.networks {
+		if id == networkID || nw.Name == networkID {
+			delete(r.networks, id)
+			return nil
+		}
+	}
+	return errdefs.NotFound(fmt.Errorf("network %s not found", networkID))
+}
+
+func (r *processRuntime) NetworkConnect(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+	return fmt.Errorf("NetworkConnect: %w", errNotSupportedLocally)
+}
+
+func (r *processRuntime) NetworkDisconnect(ctx context.Context, networkID, containerID string, force bool) error {
+	return fmt.Errorf("NetworkDisconnect: %w", errNotSupportedLocally)
+}
+
+// processLogs is the output of a process, split into lines, which can be read while it is being written.
+type processLogs struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	lines   []processLogLine
+	partial map[stdcopy.StdType][]byte
+	closed  bool
+}
+
+type processLogLine struct {
+	time   time.Time
+	stream stdcopy.StdType
+	data   []byte // including the newline, if any
+}
+
+func newProcessLogs() *processLogs {
+	l := &processLogs{
+		partial: make(map[stdcopy.StdType][]byte),
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// writer returns a writer for the stdout or stderr of the process.
+func (l *processLogs) writer(stream stdcopy.StdType) io.Writer {
+	return processLogsWriter{logs: l, stream: stream}
+}
+
+type processLogsWriter struct {
+	logs   *processLogs
+	stream stdcopy.StdType
+}
+
+func (w processLogsWriter) Write(p []byte) (int, error) {
+	l := w.logs
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer l.cond.Broadcast()
+	partial := append(l.partial[w.stream], p...)
+	for {
+		i := bytes.IndexByte(partial, '\n')
+		if i < 0 {
+			break
+		}
+		l.lines = append(l.lines, processLogLine{
+			time:   time.Now(),
+			stream: w.stream,
+			data:   bytes.Clone(partial[:i+1]),
+		})
+		partial = partial[i+1:]
+	}
+	l.partial[w.stream] = partial
+	return len(p), nil
+}
+
+// Broadcast wakes up readers so they can check if they should stop following the logs.
+func (l *processLogs) Broadcast() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// Flush records incomplete lines, which is done when the process exits.
+func (l *processLogs) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer l.cond.Broadcast()
+	for _, stream := range []stdcopy.StdType{stdcopy.Stdout, stdcopy.Stderr} {
+		if len(l.partial[stream]) > 0 {
+			l.lines = append(l.lines, processLogLine{
+				time:   time.Now(),
+				stream: stream,
+				data:   l.partial[stream],
+			})
+			delete(l.partial, stream)
+		}
+	}
+}
+
+// Close stops readers following the logs.
+func (l *processLogs) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.cond.Broadcast()
+}
+
+// processLogsReader reads processLogs in the format of the Docker API, until the end of the logs once the context
+// is cancelled.
+type processLogsReader struct {
+	logs       *processLogs
+	since      time.Time
+	stdout     bool
+	stderr     bool
+	timestamps bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	next    int
+	pending bytes.Buffer
+}
+
+func (r *processLogsReader) Read(p []byte) (int, error) {
+	for r.pending.Len() == 0 {
+		line, ok := r.nextLine()
+		if !ok {
+			return 0, io.EOF
+		}
+		if (line.stream == stdcopy.Stdout && !r.stdout) || (line.stream == stdcopy.Stderr && !r.stderr) {
+			continue
+		}
+		if line.time.Before(r.since) {
+			continue
+		}
+		data := line.data
+		if r.timestamps {
+			data = append([]byte(line.time.UTC().Format(time.RFC3339Nano)+" "), data...)
+		}
+		stdcopy.NewStdWriter(&r.pending, line.stream).Write(data)
+	}
+	return r.pending.Read(p)
+}
+
+// nextLine returns the next line, waiting for one to be written if the logs are being followed.
+func (r *processLogsReader) nextLine() (processLogLine, bool) {
+	r.logs.mu.Lock()
+	defer r.logs.mu.Unlock()
+	for r.next >= len(r.logs.lines) {
+		if r.logs.closed || r.ctx.Err() != nil {
+			return processLogLine{}, false
+		}
+		r.logs.cond.Wait()
+	}
+	r.next++
+	return r.logs.lines[r.next-1], true
+}
+
+func (r *processLogsReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// copyDir copies the directory `src` to `dst`, which must not exist.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0o700)
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return writeFileFrom(target, info.Mode().Perm(), f)
+		}
+		// sockets, pipes etc are made again by the homeserver
+		return nil
+	})
+}
+
+func writeFileFrom(path string, perm fs.FileMode, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func removeString(in []string, s string) []string {
+	var out []string
+	for _, v := range in {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
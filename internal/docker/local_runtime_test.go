@@ -0,0 +1,350 @@
+//go:build !windows
+
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	"github.com/matrix-org/complement/config"
+)
+
+// testProcessRuntime returns a process runtime which runs `command` for each container.
+func testProcessRuntime(t *testing.T, command string) *processRuntime {
+	t.Helper()
+	return newProcessRuntime(&config.Complement{
+		BaseImageURI:           "complement-base",
+		HSPortBindingIP:        "127.0.0.1",
+		LocalHomeserverCommand: command,
+	}, t.TempDir())
+}
+
+func mustCreate(t *testing.T, r *processRuntime, imageRef, name string) string {
+	t.Helper()
+	res, err := r.ContainerCreate(context.Background(), &container.Config{
+		Image:  imageRef,
+		Env:    []string{"SERVER_NAME=" + name},
+		Labels: map[string]string{"complement_hs_name": name},
+	}, nil, nil, nil, name)
+	if err != nil {
+		t.Fatalf("ContainerCreate: %s", err)
+	}
+	return res.ID
+}
+
+// readContainerLogs returns the stdout and stderr the container has written so far.
+func readContainerLogs(t *testing.T, r *processRuntime, containerID string, opts container.LogsOptions) (string, string) {
+	t.Helper()
+	rc, err := r.ContainerLogs(context.Background(), containerID, opts)
+	if err != nil {
+		t.Fatalf("ContainerLogs: %s", err)
+	}
+	defer rc.Close()
+	var stdout, stderr bytes.Buffer
+	if _, err = stdcopy.StdCopy(&stdout, &stderr, rc); err != nil {
+		t.Fatalf("failed to read logs: %s", err)
+	}
+	return stdout.String(), stderr.String()
+}
+
+func waitForStatus(t *testing.T, r *processRuntime, containerID, status string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		inspect, err := r.ContainerInspect(context.Background(), containerID)
+		if err != nil {
+			t.Fatalf("ContainerInspect: %s", err)
+		}
+		if inspect.State.Status == status {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("container status: got %s want %s", inspect.State.Status, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProcessRuntimeContainerLifecycle(t *testing.T) {
+	r := testProcessRuntime(t, `echo "$SERVER_NAME $COMPLEMENT_CS_PORT $COMPLEMENT_FED_PORT" > ports; echo started; echo warning >&2; exec sleep 30`)
+	ctx := context.Background()
+	containerID := mustCreate(t, r, "complement-base", "hs1")
+	if _, err := r.ContainerCreate(ctx, &container.Config{Image: "complement-base"}, nil, nil, nil, "hs1"); !errdefs.IsConflict(err) {
+		t.Errorf("ContainerCreate with a name in use: got %v, want a conflict", err)
+	}
+	if _, err := r.ContainerCreate(ctx, &container.Config{Image: "not-an-image"}, nil, nil, nil, "hs2"); !errdefs.IsNotFound(err) {
+		t.Errorf("ContainerCreate with an unknown image: got %v, want not found", err)
+	}
+	waitForStatus(t, r, containerID, "created")
+
+	if err := r.ContainerStart(ctx, containerID, container.StartOptions{}); err != nil {
+		t.Fatalf("ContainerStart: %s", err)
+	}
+	waitForStatus(t, r, containerID, "running")
+	inspect, err := r.ContainerInspect(ctx, "hs1")
+	if err != nil {
+		t.Fatalf("ContainerInspect by name: %s", err)
+	}
+	csPort := inspect.NetworkSettings.Ports["8008/tcp"][0].HostPort
+	fedPort := inspect.NetworkSettings.Ports["8448/tcp"][0].HostPort
+	if csPort == fedPort {
+		t.Errorf("client and federation ports are both %s", csPort)
+	}
+	// the command runs in the data directory with the environment of the container
+	deadline := time.Now().Add(5 * time.Second)
+	var ports []byte
+	for len(ports) == 0 && time.Now().Before(deadline) {
+		ports, _ = os.ReadFile(filepath.Join(r.containers[containerID].dir, "ports"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if want := "hs1 " + csPort + " " + fedPort + "\n"; string(ports) != want {
+		t.Errorf("command environment: got %q want %q", ports, want)
+	}
+
+	secs := 5
+	if err = r.ContainerStop(ctx, containerID, container.StopOptions{Timeout: &secs}); err != nil {
+		t.Fatalf("ContainerStop: %s", err)
+	}
+	waitForStatus(t, r, containerID, "exited")
+	stdout, stderr := readContainerLogs(t, r, containerID, container.LogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if stdout != "started\n" || stderr != "warning\n" {
+		t.Errorf("logs: got stdout %q stderr %q", stdout, stderr)
+	}
+
+	// committing copies the data directory into an image, which new containers start with
+	res, err := r.ContainerCommit(ctx, containerID, container.CommitOptions{
+		Reference: "localhost/complement:test",
+		Changes:   []string{`LABEL "complement_blueprint"="test"`},
+	})
+	if err != nil {
+		t.Fatalf("ContainerCommit: %s", err)
+	}
+	if _, err = r.ContainerCommit(ctx, containerID, container.CommitOptions{Changes: []string{"ENV FOO=bar"}}); err == nil {
+		t.Errorf("ContainerCommit with an ENV change succeeded, want error")
+	}
+	img, err := r.ImageInspect(ctx, "localhost/complement:test")
+	if err != nil {
+		t.Fatalf("ImageInspect: %s", err)
+	}
+	if img.ID != res.ID || img.Config.Labels["complement_blueprint"] != "test" || img.Config.Labels["complement_hs_name"] != "hs1" {
+		t.Errorf("committed image: got ID %s labels %v", img.ID, img.Config.Labels)
+	}
+	fromImage := mustCreate(t, r, "localhost/complement:test", "hs1_copy")
+	if _, err = os.Stat(filepath.Join(r.containers[fromImage].dir, "ports")); err != nil {
+		t.Errorf("container made from the committed image is missing files: %s", err)
+	}
+
+	dir := r.containers[containerID].dir
+	if err = r.ContainerRemove(ctx, containerID, container.RemoveOptions{}); err != nil {
+		t.Fatalf("ContainerRemove: %s", err)
+	}
+	if _, err = os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("ContainerRemove did not remove the data directory: %v", err)
+	}
+	if _, err = r.ContainerInspect(ctx, containerID); !errdefs.IsNotFound(err) {
+		t.Errorf("ContainerInspect after remove: got %v, want not found", err)
+	}
+}
+
+func TestProcessRuntimeRemoveRunningContainer(t *testing.T) {
+	r := testProcessRuntime(t, `exec sleep 30`)
+	ctx := context.Background()
+	containerID := mustCreate(t, r, "complement-base", "hs1")
+	if err := r.ContainerStart(ctx, containerID, container.StartOptions{}); err != nil {
+		t.Fatalf("ContainerStart: %s", err)
+	}
+	if err := r.ContainerRemove(ctx, containerID, container.RemoveOptions{}); !errdefs.IsConflict(err) {
+		t.Errorf("ContainerRemove of a running container: got %v, want a conflict", err)
+	}
+	if err := r.ContainerRemove(ctx, containerID, container.RemoveOptions{Force: true}); err != nil {
+		t.Fatalf("ContainerRemove with Force: %s", err)
+	}
+}
+
+func TestProcessRuntimeAllocatesDistinctPorts(t *testing.T) {
+	r := testProcessRuntime(t, `exec sleep 30`)
+	ctx := context.Background()
+	seen := make(map[string]bool)
+	for _, name := range []string{"hs1", "hs2", "hs3"} {
+		containerID := mustCreate(t, r, "complement-base", name)
+		if err := r.ContainerStart(ctx, containerID, container.StartOptions{}); err != nil {
+			t.Fatalf("ContainerStart: %s", err)
+		}
+		defer r.ContainerRemove(ctx, containerID, container.RemoveOptions{Force: true})
+		r.mu.Lock()
+		for _, bindings := range r.containers[containerID].ports {
+			if seen[bindings[0].HostPort] {
+				t.Errorf("port %s was allocated twice", bindings[0].HostPort)
+			}
+			seen[bindings[0].HostPort] = true
+			if !r.portAllocated(bindings[0].HostPort) {
+				t.Errorf("port %s is not reported as allocated", bindings[0].HostPort)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+func TestProcessRuntimeLogs(t *testing.T) {
+	r := testProcessRuntime(t, `echo one; sleep 0.2; echo two; printf partial >&2`)
+	ctx := context.Background()
+	containerID := mustCreate(t, r, "complement-base", "hs1")
+	if err := r.ContainerStart(ctx, containerID, container.StartOptions{}); err != nil {
+		t.Fatalf("ContainerStart: %s", err)
+	}
+	// following the logs returns every line until the process exits, including incomplete lines
+	stdout, stderr := readContainerLogs(t, r, containerID, container.LogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if stdout != "one\ntwo\n" || stderr != "partial" {
+		t.Errorf("followed logs: got stdout %q stderr %q", stdout, stderr)
+	}
+	stdout, stderr = readContainerLogs(t, r, containerID, container.LogsOptions{ShowStderr: true})
+	if stdout != "" || stderr != "partial" {
+		t.Errorf("stderr only: got stdout %q stderr %q", stdout, stderr)
+	}
+	// timestamps can be used to continue from the last line read
+	stdout, _ = readContainerLogs(t, r, containerID, container.LogsOptions{ShowStdout: true, Timestamps: true})
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("timestamped logs: got %q", stdout)
+	}
+	ts, text, _ := strings.Cut(lines[0], " ")
+	first, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil || text != "one" {
+		t.Fatalf("timestamped line: got %q", lines[0])
+	}
+	since := first.Add(time.Nanosecond)
+	stdout, _ = readContainerLogs(t, r, containerID, container.LogsOptions{ShowStdout: true, Since: fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond())})
+	if stdout != "two\n" {
+		t.Errorf("logs since the first line: got %q", stdout)
+	}
+}
+
+// makeArchive returns a tar archive of the entries, which are files unless the name ends with / or the
+// content starts with -> for a symlink.
+func makeArchive(t *testing.T, entries ...string) io.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < len(entries); i += 2 {
+		name, content := entries[i], entries[i+1]
+		hdr := &tar.Header{Name: name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(content))}
+		switch {
+		case strings.HasSuffix(name, "/"):
+			hdr.Typeflag, hdr.Mode, hdr.Size = tar.TypeDir, 0o755, 0
+		case strings.HasPrefix(content, "->"):
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, strings.TrimPrefix(content, "->"), 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader: %s", err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(content))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	return &buf
+}
+
+func TestProcessRuntimeCopy(t *testing.T) {
+	r := testProcessRuntime(t, `exec sleep 30`)
+	ctx := context.Background()
+	src := mustCreate(t, r, "complement-base", "hs1")
+	err := r.CopyToContainer(ctx, src, "/", makeArchive(t,
+		"data/", "",
+		"data/media/a.txt", "hello",
+		"data/link", "->media/a.txt",
+	), container.CopyToContainerOptions{})
+	if err != nil {
+		t.Fatalf("CopyToContainer: %s", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(r.containers[src].dir, "data", "link")); err != nil || string(got) != "hello" {
+		t.Errorf("copied symlink: got %q %v", got, err)
+	}
+
+	rc, stat, err := r.CopyFromContainer(ctx, src, "/data")
+	if err != nil {
+		t.Fatalf("CopyFromContainer: %s", err)
+	}
+	if stat.Name != "data" || !stat.Mode.IsDir() {
+		t.Errorf("CopyFromContainer stat: got %+v", stat)
+	}
+	// the archive contains the last element of the path, so it can be extracted into the parent directory
+	dst := mustCreate(t, r, "complement-base", "hs2")
+	err = r.CopyToContainer(ctx, dst, "/restored", rc, container.CopyToContainerOptions{})
+	rc.Close()
+	if err != nil {
+		t.Fatalf("CopyToContainer of the copied archive: %s", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(r.containers[dst].dir, "restored", "data", "media", "a.txt")); err != nil || string(got) != "hello" {
+		t.Errorf("round trip: got %q %v", got, err)
+	}
+	if target, err := os.Readlink(filepath.Join(r.containers[dst].dir, "restored", "data", "link")); err != nil || target != "media/a.txt" {
+		t.Errorf("round trip symlink: got %q %v", target, err)
+	}
+
+	if _, _, err = r.CopyFromContainer(ctx, src, "/missing"); !errdefs.IsNotFound(err) {
+		t.Errorf("CopyFromContainer of a missing path: got %v, want not found", err)
+	}
+}
+
+func TestProcessRuntimeCopyToContainerRejectsPathsOutsideContainer(t *testing.T) {
+	r := testProcessRuntime(t, `exec sleep 30`)
+	ctx := context.Background()
+	containerID := mustCreate(t, r, "complement-base", "hs1")
+	outside := filepath.Dir(r.containers[containerID].dir)
+	testCases := []struct {
+		name    string
+		dstPath string
+		archive io.Reader
+	}{
+		{"entry with ..", "/", makeArchive(t, "../escaped", "x")},
+		{"destination with ..", "/../..", makeArchive(t, "escaped", "x")},
+		{"nested ..", "/data", makeArchive(t, "a/../../../escaped", "x")},
+	}
+	for _, tc := range testCases {
+		if err := r.CopyToContainer(ctx, containerID, tc.dstPath, tc.archive, container.CopyToContainerOptions{}); err == nil {
+			t.Errorf("%s: CopyToContainer succeeded, want error", tc.name)
+		}
+	}
+	matches, _ := filepath.Glob(filepath.Join(outside, "..", "escaped"))
+	matches2, _ := filepath.Glob(filepath.Join(outside, "escaped"))
+	if len(matches)+len(matches2) > 0 {
+		t.Errorf("files were written outside the container: %v %v", matches, matches2)
+	}
+}
+
+func TestProcessRuntimeRename(t *testing.T) {
+	r := testProcessRuntime(t, `exec sleep 30`)
+	ctx := context.Background()
+	hs1 := mustCreate(t, r, "complement-base", "hs1")
+	mustCreate(t, r, "complement-base", "hs2")
+	if err := r.ContainerRename(ctx, hs1, "hs2"); !errdefs.IsConflict(err) {
+		t.Errorf("ContainerRename to a name in use: got %v, want conflict", err)
+	}
+	if err := r.ContainerRename(ctx, hs1, "hs1_pre_upgrade"); err != nil {
+		t.Fatalf("ContainerRename: %s", err)
+	}
+	inspect, err := r.ContainerInspect(ctx, "hs1_pre_upgrade")
+	if err != nil {
+		t.Fatalf("ContainerInspect: %s", err)
+	}
+	if inspect.ID != hs1 || inspect.Name != "/hs1_pre_upgrade" {
+		t.Errorf("ContainerInspect: got %s %s, want %s /hs1_pre_upgrade", inspect.ID, inspect.Name, hs1)
+	}
+	// the old name can be reused
+	mustCreate(t, r, "complement-base", "hs1")
+}
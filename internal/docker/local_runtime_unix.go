@@ -0,0 +1,32 @@
+//go:build !windows
+
+package docker
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+var processSignals = map[string]syscall.Signal{
+	"CONT": syscall.SIGCONT,
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"KILL": syscall.SIGKILL,
+	"STOP": syscall.SIGSTOP,
+	"TERM": syscall.SIGTERM,
+}
+
+// setProcessGroup runs the command in a new process group, so signals reach the homeserver and not just
+// the shell which started it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func signalProcessGroup(cmd *exec.Cmd, signal string) error {
+	sig, ok := processSignals[signal]
+	if !ok {
+		return fmt.Errorf("unknown signal %s", signal)
+	}
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
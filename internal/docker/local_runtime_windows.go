@@ -0,0 +1,17 @@
+package docker
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcessGroup can only kill the process on Windows.
+func signalProcessGroup(cmd *exec.Cmd, signal string) error {
+	switch signal {
+	case "KILL", "TERM", "INT":
+		return cmd.Process.Kill()
+	}
+	return fmt.Errorf("signal %s: %w", signal, errNotSupportedLocally)
+}
@@ -0,0 +1,112 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+	complementRuntime "github.com/matrix-org/complement/runtime"
+)
+
+// the number of matches of each rule to include when reporting them
+const maxReportedLogMatches = 3
+
+// logMatch is part of the logs of a homeserver which matched a LogRule.
+type logMatch struct {
+	rule complementRuntime.LogRule
+	text string
+}
+
+// matchLogRules returns the parts of the logs which match runtime.LogRules and are not allowlisted.
+func matchLogRules(cfg *config.Complement, lines []string) []logMatch {
+	var matches []logMatch
+	for i, line := range lines {
+		for _, rule := range complementRuntime.LogRules {
+			if !rule.Pattern.MatchString(line) {
+				continue
+			}
+			text := line
+			if rule.MultiLine {
+				end := i + 1
+				for end < len(lines) && (strings.HasPrefix(lines[end], " ") || strings.HasPrefix(lines[end], "\t")) {
+					end++
+				}
+				if end < len(lines) {
+					end++ // include the first line which isn't indented
+				}
+				text = strings.Join(lines[i:end], "\n")
+			}
+			if isAllowlisted(cfg, text) {
+				continue
+			}
+			matches = append(matches, logMatch{rule: rule, text: text})
+		}
+	}
+	return matches
+}
+
+func isAllowlisted(cfg *config.Complement, text string) bool {
+	if cfg.LogAllowlist != nil && cfg.LogAllowlist.MatchString(text) {
+		return true
+	}
+	for _, pattern := range complementRuntime.LogAllowlist {
+		if pattern.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLogRules reports lines in the logs of the homeserver which match runtime.LogRules to the test, failing
+// it if COMPLEMENT_LOG_RULES is `fail` and a fatal rule matched.
+func checkLogRules(t ct.TestLike, cfg *config.Complement, hsName string, lines []string) {
+	t.Helper()
+	if cfg.LogRulesMode == "off" {
+		return
+	}
+	matches := matchLogRules(cfg, lines)
+	// rule name -> matches, in the order the rules first matched
+	var ruleNames []string
+	byRule := make(map[string][]logMatch)
+	for _, m := range matches {
+		if _, ok := byRule[m.rule.Name]; !ok {
+			ruleNames = append(ruleNames, m.rule.Name)
+		}
+		byRule[m.rule.Name] = append(byRule[m.rule.Name], m)
+	}
+	for _, name := range ruleNames {
+		ruleMatches := byRule[name]
+		var examples []string
+		for i := 0; i < len(ruleMatches) && i < maxReportedLogMatches; i++ {
+			examples = append(examples, ruleMatches[i].text)
+		}
+		msg := fmt.Sprintf(
+			"%s logs matched rule '%s' %d time(s) during the test. Add to runtime.LogAllowlist or "+
+				"COMPLEMENT_LOG_ALLOWLIST if this is expected. First matches:\n%s",
+			hsName, name, len(ruleMatches), strings.Join(examples, "\n---\n"),
+		)
+		if cfg.LogRulesMode == "fail" && ruleMatches[0].rule.Fatal {
+			ct.Errorf(t, "%s", msg)
+		} else {
+			t.Logf("WARNING: %s", msg)
+		}
+	}
+}
+
+// checkLogs checks the full logs of each homeserver against runtime.LogRules. Used for deployments which are
+// not shared between tests.
+func (d *Deployment) checkLogs(t ct.TestLike) {
+	t.Helper()
+	if d.Config.LogRulesMode == "off" {
+		return
+	}
+	for hsName, hsDep := range d.HS {
+		lines, err := readLogs(d.Deployer.Docker, hsDep.ContainerID)
+		if err != nil {
+			t.Logf("WARNING: failed to read %s logs to check log rules: %s", hsName, err)
+			continue
+		}
+		checkLogRules(t, d.Config, hsName, lines)
+	}
+}
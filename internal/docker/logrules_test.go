@@ -0,0 +1,175 @@
+package docker
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+	complementRuntime "github.com/matrix-org/complement/runtime"
+)
+
+// recordingT records the messages logged and errors reported by the code under test.
+type recordingT struct {
+	ct.TestLike
+	logs   []string
+	errors []string
+	fatals []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Logf(msg string, args ...interface{}) {
+	t.logs = append(t.logs, fmt.Sprintf(msg, args...))
+}
+
+func (t *recordingT) Errorf(msg string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(msg, args...))
+}
+
+// Fatalf records the error and stops the goroutine, like testing.T does.
+func (t *recordingT) Fatalf(msg string, args ...interface{}) {
+	t.fatals = append(t.fatals, fmt.Sprintf(msg, args...))
+	runtime.Goexit()
+}
+
+// runRecording calls fn with a recordingT in a new goroutine, so Fatalf doesn't stop the test.
+func runRecording(fn func(rt *recordingT)) *recordingT {
+	rt := &recordingT{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn(rt)
+	}()
+	<-done
+	return rt
+}
+
+// withLogRules replaces runtime.LogRules and runtime.LogAllowlist for the duration of the test.
+func withLogRules(t *testing.T, rules []complementRuntime.LogRule, allowlist ...*regexp.Regexp) {
+	prevRules, prevAllowlist := complementRuntime.LogRules, complementRuntime.LogAllowlist
+	complementRuntime.LogRules, complementRuntime.LogAllowlist = rules, allowlist
+	t.Cleanup(func() {
+		complementRuntime.LogRules, complementRuntime.LogAllowlist = prevRules, prevAllowlist
+	})
+}
+
+var testLogRules = []complementRuntime.LogRule{
+	{Name: "panic", Pattern: regexp.MustCompile(`^panic: `), Fatal: true},
+	{Name: "traceback", Pattern: regexp.MustCompile(`^Traceback`), MultiLine: true},
+	{Name: "warning", Pattern: regexp.MustCompile(`WARNING`)},
+}
+
+func TestMatchLogRules(t *testing.T) {
+	withLogRules(t, testLogRules, regexp.MustCompile(`expected panic`))
+	testCases := []struct {
+		name      string
+		allowlist string
+		lines     []string
+		want      []string // rule name: text
+	}{
+		{
+			name:  "no matches",
+			lines: []string{"started", "GET /_matrix/client/versions 200"},
+		},
+		{
+			name:  "single line",
+			lines: []string{"started", "panic: oh no", "goroutine 1 [running]:"},
+			want:  []string{"panic: panic: oh no"},
+		},
+		{
+			name: "multi-line captures indented lines and the line after",
+			lines: []string{
+				"Traceback (most recent call last):",
+				`  File "synapse/handlers.py", line 1, in f`,
+				"    raise ValueError()",
+				"ValueError: bad",
+				"next line",
+			},
+			want: []string{"traceback: Traceback (most recent call last):\n  File \"synapse/handlers.py\", line 1, in f\n    raise ValueError()\nValueError: bad"},
+		},
+		{
+			name:  "multi-line at the end of the logs",
+			lines: []string{"Traceback (most recent call last):", "\tframe"},
+			want:  []string{"traceback: Traceback (most recent call last):\n\tframe"},
+		},
+		{
+			name:  "a line can match many rules",
+			lines: []string{"panic: WARNING"},
+			want:  []string{"panic: panic: WARNING", "warning: panic: WARNING"},
+		},
+		{
+			name:  "runtime allowlist",
+			lines: []string{"panic: expected panic"},
+		},
+		{
+			name:      "COMPLEMENT_LOG_ALLOWLIST is matched against every captured line",
+			allowlist: `ValueError: fine`,
+			lines:     []string{"Traceback (most recent call last):", "  frame", "ValueError: fine", "Traceback (most recent call last):", "  frame", "ValueError: bad"},
+			want:      []string{"traceback: Traceback (most recent call last):\n  frame\nValueError: bad"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Complement{}
+			if tc.allowlist != "" {
+				cfg.LogAllowlist = regexp.MustCompile(tc.allowlist)
+			}
+			var got []string
+			for _, m := range matchLogRules(cfg, tc.lines) {
+				got = append(got, m.rule.Name+": "+m.text)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckLogRules(t *testing.T) {
+	withLogRules(t, testLogRules)
+	testCases := []struct {
+		mode       string
+		lines      []string
+		wantErrors int
+		wantLogs   int
+	}{
+		{mode: "off", lines: []string{"panic: oh no"}},
+		{mode: "warn", lines: []string{"panic: oh no"}, wantLogs: 1},
+		{mode: "fail", lines: []string{"panic: oh no"}, wantErrors: 1},
+		// rules which are not fatal only warn, even in fail mode
+		{mode: "fail", lines: []string{"WARNING: slow"}, wantLogs: 1},
+		{mode: "fail", lines: []string{"panic: oh no", "WARNING: slow"}, wantErrors: 1, wantLogs: 1},
+		// matches of the same rule are reported together
+		{mode: "warn", lines: []string{"WARNING: 1", "WARNING: 2"}, wantLogs: 1},
+		{mode: "fail", lines: []string{"all fine"}},
+	}
+	for _, tc := range testCases {
+		rt := &recordingT{}
+		checkLogRules(rt, &config.Complement{LogRulesMode: tc.mode}, "hs1", tc.lines)
+		if len(rt.errors) != tc.wantErrors || len(rt.logs) != tc.wantLogs {
+			t.Errorf("mode %s with %q: got errors %q logs %q, want %d errors %d logs", tc.mode, tc.lines, rt.errors, rt.logs, tc.wantErrors, tc.wantLogs)
+		}
+	}
+}
+
+func TestCheckLogRulesReportsFirstMatches(t *testing.T) {
+	withLogRules(t, testLogRules)
+	var lines []string
+	for i := 1; i <= 5; i++ {
+		lines = append(lines, fmt.Sprintf("WARNING: %d", i))
+	}
+	rt := &recordingT{}
+	checkLogRules(rt, &config.Complement{LogRulesMode: "warn"}, "hs1", lines)
+	if len(rt.logs) != 1 {
+		t.Fatalf("got %d logs, want 1: %q", len(rt.logs), rt.logs)
+	}
+	msg := rt.logs[0]
+	if !strings.Contains(msg, "'warning' 5 time(s)") || !strings.Contains(msg, "WARNING: 3") || strings.Contains(msg, "WARNING: 4") {
+		t.Errorf("got %q, want the count and the first %d matches", msg, maxReportedLogMatches)
+	}
+}
@@ -0,0 +1,372 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	"github.com/matrix-org/complement/ct"
+	complementRuntime "github.com/matrix-org/complement/runtime"
+)
+
+// logStream follows the logs of every homeserver in a dirty deployment, tagging each line with the tests which
+// were running when it was logged. This lets the logs of a single test be printed when the deployment is shared
+// between many tests.
+type logStream struct {
+	mu sync.Mutex
+	// tests currently using the deployment
+	active map[string]bool
+	// HS name -> lines which may still need printing
+	lines map[string][]logLine
+	// HS name -> stops following the logs
+	followed map[string]context.CancelFunc
+	// HS name -> true if the homeserver didn't log the end marker request, so it doesn't log request URLs
+	noRequestLogs map[string]bool
+	wg            sync.WaitGroup
+}
+
+type logLine struct {
+	text  string
+	tests []string
+}
+
+func newLogStream() *logStream {
+	return &logStream{
+		active:        make(map[string]bool),
+		lines:         make(map[string][]logLine),
+		followed:      make(map[string]context.CancelFunc),
+		noRequestLogs: make(map[string]bool),
+	}
+}
+
+// add records a line logged by the homeserver, tagged with the running tests.
+func (s *logStream) add(hsName, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tests := make([]string, 0, len(s.active))
+	for testName := range s.active {
+		tests = append(tests, testName)
+	}
+	sort.Strings(tests)
+	s.lines[hsName] = append(s.lines[hsName], logLine{
+		text:  text,
+		tests: tests,
+	})
+}
+
+// linesFor returns the lines each homeserver logged while the test was running.
+func (s *logStream) linesFor(testName string) map[string][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make(map[string][]string)
+	for hsName, lines := range s.lines {
+		for _, line := range lines {
+			for _, tag := range line.tests {
+				if tag == testName {
+					result[hsName] = append(result[hsName], line.text)
+					break
+				}
+			}
+		}
+	}
+	return result
+}
+
+// prune forgets lines which are not tagged with a running test, as they will never be printed.
+func (s *logStream) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hsName, lines := range s.lines {
+		kept := lines[:0]
+		for _, line := range lines {
+			for _, tag := range line.tests {
+				if s.active[tag] {
+					kept = append(kept, line)
+					break
+				}
+			}
+		}
+		s.lines[hsName] = kept
+	}
+}
+
+// waitForLine waits until the homeserver logs a line containing `substr`, returning false if it doesn't
+// within the timeout.
+func (s *logStream) waitForLine(hsName, substr string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		s.mu.Lock()
+		found := slices.ContainsFunc(s.lines[hsName], func(line logLine) bool {
+			return strings.Contains(line.text, substr)
+		})
+		s.mu.Unlock()
+		if found {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// follow reads the logs of the homeserver until `ctx` is cancelled. When the log stream ends, because the container
+// was stopped or replaced, the logs are followed again from where they left off.
+func (s *logStream) follow(ctx context.Context, docker ContainerRuntime, hsName string, hsDep *HomeserverDeployment) {
+	defer s.wg.Done()
+	var since time.Time
+	for ctx.Err() == nil {
+		opts := container.LogsOptions{
+			ShowStdout: true,
+			ShowStderr: true,
+			Follow:     true,
+			Timestamps: true,
+		}
+		if !since.IsZero() {
+			next := since.Add(time.Nanosecond)
+			opts.Since = fmt.Sprintf("%d.%09d", next.Unix(), next.Nanosecond())
+		}
+		containerID, _ := hsDep.container()
+		rc, err := docker.ContainerLogs(ctx, containerID, opts)
+		if err == nil {
+			stdout := &logLineWriter{stream: s, hsName: hsName, since: &since}
+			stderr := &logLineWriter{stream: s, hsName: hsName, since: &since}
+			stdcopy.StdCopy(stdout, stderr, rc)
+			rc.Close()
+			stdout.flush()
+			stderr.flush()
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// logLineWriter splits the output of a container into lines, removing the timestamp added by the runtime.
+type logLineWriter struct {
+	stream  *logStream
+	hsName  string
+	partial []byte
+	// the time of the last line, shared between stdout and stderr
+	since *time.Time
+}
+
+func (w *logLineWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.line(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+}
+
+func (w *logLineWriter) flush() {
+	if len(w.partial) > 0 {
+		w.line(string(w.partial))
+		w.partial = nil
+	}
+}
+
+func (w *logLineWriter) line(text string) {
+	if ts, rest, ok := strings.Cut(text, " "); ok {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			*w.since = t
+			text = rest
+		}
+	}
+	w.stream.add(w.hsName, text)
+}
+
+// StreamLogs follows the logs of every homeserver in the deployment, so BeginTest can attribute log lines to
+// tests. Homeservers added to the deployment afterwards are followed when StreamLogs is called again.
+func (d *Deployment) StreamLogs() {
+	d.logsMu.Lock()
+	if d.logs == nil {
+		d.logs = newLogStream()
+	}
+	logs := d.logs
+	d.logsMu.Unlock()
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	for hsName, hsDep := range d.servers() {
+		if _, ok := logs.followed[hsName]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		logs.followed[hsName] = cancel
+		logs.wg.Add(1)
+		go logs.follow(ctx, d.Deployer.Docker, hsName, hsDep)
+	}
+}
+
+// logStream returns the stream started by StreamLogs, or nil if the logs are not being followed.
+func (d *Deployment) logStream() *logStream {
+	d.logsMu.Lock()
+	defer d.logsMu.Unlock()
+	return d.logs
+}
+
+// BeginTest marks the start of a test which uses this deployment. Lines logged by homeservers are tagged with
+// the test until it destroys the deployment, and only those lines are printed if the test fails. Requires
+// StreamLogs.
+func (d *Deployment) BeginTest(t ct.TestLike) {
+	logs := d.logStream()
+	if logs == nil {
+		return
+	}
+	logs.mu.Lock()
+	logs.active[t.Name()] = true
+	logs.mu.Unlock()
+	for hsName := range d.servers() {
+		logs.add(hsName, logMarker("BEGIN "+t.Name()))
+	}
+}
+
+// endTest marks the end of a test started with BeginTest, checking its logs against runtime.LogRules and
+// printing or saving them if it failed.
+func (d *Deployment) endTest(t ct.TestLike) {
+	logs := d.logStream()
+	if logs == nil {
+		if t.Failed() {
+			d.Deployer.PrintLogs(d)
+		}
+		return
+	}
+	// the logs are only needed if there are rules to check them against, or to print them
+	checkRules := d.Config.LogRulesMode != "off" && len(complementRuntime.LogRules) > 0
+	if checkRules || t.Failed() {
+		d.awaitEndMarker(logs, "END "+t.Name())
+		lines := logs.linesFor(t.Name())
+		for hsName, hsLines := range lines {
+			checkLogRules(t, d.Config, hsName, hsLines)
+		}
+		if t.Failed() {
+			d.writeTestLogs(t.Name(), lines)
+		}
+	}
+	logs.mu.Lock()
+	delete(logs.active, t.Name())
+	logs.mu.Unlock()
+	logs.prune()
+}
+
+// logMarker returns the line added to the logs of homeservers to mark the start or end of a test.
+func logMarker(annotation string) string {
+	return "=== COMPLEMENT " + annotation + " ==="
+}
+
+// awaitEndMarker sends each homeserver a request containing the annotation, then waits for it to appear in
+// the request logs of the homeserver, so every line logged before it has been read from the log stream. If
+// the homeserver doesn't log the request in time, the annotation is added to the stream instead, and later
+// tests don't wait for that homeserver.
+func (d *Deployment) awaitEndMarker(logs *logStream, annotation string) {
+	query := "complement_test=" + url.QueryEscape(annotation)
+	httpClient := &http.Client{Timeout: time.Second}
+	var wg sync.WaitGroup
+	for hsName, hsDep := range d.servers() {
+		logs.mu.Lock()
+		noRequestLogs := logs.noRequestLogs[hsName]
+		logs.mu.Unlock()
+		if noRequestLogs {
+			logs.add(hsName, logMarker(annotation))
+			continue
+		}
+		_, baseURL := hsDep.container()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := httpClient.Get(baseURL + "/_matrix/client/versions?" + query)
+			if err == nil {
+				res.Body.Close()
+			}
+			if err != nil || !logs.waitForLine(hsName, query, 2*time.Second) {
+				if err == nil {
+					logs.mu.Lock()
+					logs.noRequestLogs[hsName] = true
+					logs.mu.Unlock()
+				}
+				logs.add(hsName, logMarker(annotation))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// writeTestLogs prints the logs of each homeserver, or writes them to COMPLEMENT_SERVER_LOG_DIR if it is set.
+func (d *Deployment) writeTestLogs(testName string, lines map[string][]string) {
+	hsNames := make([]string, 0, len(lines))
+	for hsName := range lines {
+		hsNames = append(hsNames, hsName)
+	}
+	sort.Strings(hsNames)
+	for _, hsName := range hsNames {
+		if d.Config.ServerLogDir != "" {
+			path := filepath.Join(d.Config.ServerLogDir, logFileName(testName, hsName))
+			err := os.MkdirAll(filepath.Dir(path), 0o755)
+			if err == nil {
+				err = os.WriteFile(path, []byte(strings.Join(lines[hsName], "\n")+"\n"), 0o644)
+			}
+			if err != nil {
+				log.Printf("%s : Failed to write %s server logs: %s\n", testName, hsName, err)
+			} else {
+				log.Printf("%s : Wrote %s server logs to %s\n", testName, hsName, path)
+			}
+			continue
+		}
+		log.Printf("============================================\n\n\n")
+		log.Printf("%s : %s server logs:\n", testName, hsName)
+		for _, line := range lines[hsName] {
+			log.Writer().Write([]byte(line + "\n"))
+		}
+		log.Printf("============== %s : %s END LOGS ==============\n\n\n", testName, hsName)
+	}
+}
+
+// logFileName returns a file name for the logs of the homeserver in the test. Subtests are placed in
+// subdirectories.
+func logFileName(testName, hsName string) string {
+	parts := strings.Split(testName, "/")
+	for i := range parts {
+		parts[i] = strings.Map(func(r rune) rune {
+			if r == '_' || r == '-' || r == '.' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+				return r
+			}
+			return '_'
+		}, parts[i])
+	}
+	return filepath.Join(append(parts, hsName+".log")...)
+}
+
+// stopLogStream stops following the logs of the homeservers.
+func (d *Deployment) stopLogStream() {
+	d.logsMu.Lock()
+	logs := d.logs
+	d.logs = nil
+	d.logsMu.Unlock()
+	if logs == nil {
+		return
+	}
+	logs.mu.Lock()
+	for _, cancel := range logs.followed {
+		cancel()
+	}
+	logs.mu.Unlock()
+	logs.wg.Wait()
+}
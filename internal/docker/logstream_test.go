@@ -0,0 +1,59 @@
+package docker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAwaitEndMarker(t *testing.T) {
+	logs := newLogStream()
+	// hs1 logs request URLs, hs2 doesn't
+	hs1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		logs.add("hs1", "GET "+req.URL.String())
+	}))
+	defer hs1.Close()
+	hs2Requests := 0
+	hs2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hs2Requests++
+	}))
+	defer hs2.Close()
+	dep := &Deployment{
+		HS: map[string]*HomeserverDeployment{
+			"hs1": {BaseURL: hs1.URL},
+			"hs2": {BaseURL: hs2.URL},
+		},
+	}
+
+	dep.awaitEndMarker(logs, "END TestOne")
+	if !slices.ContainsFunc(logs.lines["hs1"], func(line logLine) bool {
+		return line.text == "GET /_matrix/client/versions?complement_test=END+TestOne"
+	}) {
+		t.Errorf("hs1 did not log the end marker request: %+v", logs.lines["hs1"])
+	}
+	if !slices.ContainsFunc(logs.lines["hs2"], func(line logLine) bool {
+		return line.text == logMarker("END TestOne")
+	}) {
+		t.Errorf("end marker was not added for hs2: %+v", logs.lines["hs2"])
+	}
+
+	// hs2 doesn't log requests, so later tests don't wait for it
+	start := time.Now()
+	dep.awaitEndMarker(logs, "END TestTwo")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("awaitEndMarker waited %v for a homeserver which doesn't log requests", elapsed)
+	}
+	if hs2Requests != 1 {
+		t.Errorf("hs2 got %d end marker requests, want 1", hs2Requests)
+	}
+	if !slices.ContainsFunc(logs.lines["hs2"], func(line logLine) bool {
+		return line.text == logMarker("END TestTwo")
+	}) {
+		t.Errorf("end marker was not added for hs2: %+v", logs.lines["hs2"])
+	}
+	if logs.noRequestLogs["hs1"] {
+		t.Errorf("hs1 logs requests, but was marked as not logging them")
+	}
+}
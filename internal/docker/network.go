@@ -0,0 +1,231 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	"github.com/matrix-org/complement/helpers"
+)
+
+// iptables chains which hold the partition rules for a homeserver. They are jumped to from the start of
+// INPUT and OUTPUT so they can be removed without affecting any rules the homeserver image has.
+const (
+	partitionChainIn  = "COMPLEMENT_PARTITION_IN"
+	partitionChainOut = "COMPLEMENT_PARTITION_OUT"
+)
+
+// runNetworkTool runs the shell script in a short-lived container which shares the network namespace of
+// the homeserver, so the script can change its network without the homeserver image needing any tools.
+// Returns the combined output of the script.
+func (d *Deployer) runNetworkTool(hsDep *HomeserverDeployment, script string) (string, error) {
+	ctx := context.Background()
+	if err := d.pullImageIfNotExists(ctx, d.config.NetworkToolsImage); err != nil {
+		return "", err
+	}
+	body, err := d.Docker.ContainerCreate(ctx, &container.Config{
+		Image:      d.config.NetworkToolsImage,
+		Entrypoint: []string{"/bin/sh", "-c"},
+		Cmd:        []string{"set -e\n" + script},
+		Labels: map[string]string{
+			complementLabel:  "network_tool",
+			"complement_pkg": d.config.PackageNamespace,
+		},
+	}, &container.HostConfig{
+		NetworkMode: container.NetworkMode("container:" + hsDep.ContainerID),
+		CapAdd:      []string{"NET_ADMIN"},
+	}, nil, nil, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to create network tool container: %w", err)
+	}
+	defer d.Docker.ContainerRemove(ctx, body.ID, container.RemoveOptions{Force: true})
+	if err = d.Docker.ContainerStart(ctx, body.ID, container.StartOptions{}); err != nil {
+		return "", fmt.Errorf("failed to start network tool container: %w", err)
+	}
+	var exitCode int64
+	waitCh, errCh := d.Docker.ContainerWait(ctx, body.ID, container.WaitConditionNotRunning)
+	select {
+	case res := <-waitCh:
+		exitCode = res.StatusCode
+	case err = <-errCh:
+		return "", fmt.Errorf("failed to wait for network tool container: %w", err)
+	}
+	reader, err := d.Docker.ContainerLogs(ctx, body.ID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get network tool logs: %w", err)
+	}
+	defer reader.Close()
+	var output bytes.Buffer
+	stdcopy.StdCopy(&output, &output, reader)
+	if exitCode != 0 {
+		return output.String(), fmt.Errorf("network tool exited with code %d: %s", exitCode, output.String())
+	}
+	return output.String(), nil
+}
+
+// containerIP returns the IP address of the homeserver on its network.
+func (d *Deployer) containerIP(hsDep *HomeserverDeployment) (string, error) {
+	return d.containerIPOnNetwork(hsDep.ContainerID, hsDep.Network)
+}
+
+// sidecarIPs returns the IP addresses of the sidecars of the homeserver on its network.
+func (d *Deployer) sidecarIPs(hsDep *HomeserverDeployment) ([]string, error) {
+	var ips []string
+	err := forEachSidecar(hsDep, func(name, containerID string) error {
+		ip, err := d.containerIPOnNetwork(containerID, hsDep.Network)
+		ips = append(ips, ip)
+		return err
+	})
+	return ips, err
+}
+
+func (d *Deployer) containerIPOnNetwork(containerID, networkName string) (string, error) {
+	inspect, err := d.Docker.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect container %s: %w", containerID, err)
+	}
+	endpoint, ok := inspect.NetworkSettings.Networks[networkName]
+	if !ok || endpoint.IPAddress == "" {
+		return "", fmt.Errorf("container %s has no IP address on network %s", containerID, networkName)
+	}
+	return endpoint.IPAddress, nil
+}
+
+// partitionServer only allows the homeserver to talk to the homeservers at `peerIPs`, and drops traffic
+// to and from the homeservers at `blockedIPs`. Connections made by the homeserver to anything else, such
+// as servers hosted by Complement, are dropped, as are new connections to its federation port. Clients can
+// still connect to the homeserver, and it can always talk to its own sidecars.
+func (d *Deployer) partitionServer(hsDep *HomeserverDeployment, peerIPs, blockedIPs []string) error {
+	sidecarIPs, err := d.sidecarIPs(hsDep)
+	if err != nil {
+		return fmt.Errorf("failed to partition container %s: %w", hsDep.ContainerID, err)
+	}
+	if _, err = d.runNetworkTool(hsDep, partitionScript(sidecarIPs, peerIPs, blockedIPs)); err != nil {
+		return fmt.Errorf("failed to partition container %s: %w", hsDep.ContainerID, err)
+	}
+	return nil
+}
+
+// partitionScript returns the iptables commands used by partitionServer, replacing any existing partition.
+// Traffic to and from `sidecarIPs` is always allowed.
+func partitionScript(sidecarIPs, peerIPs, blockedIPs []string) string {
+	var sb strings.Builder
+	sb.WriteString(healScript())
+	for _, chain := range []string{partitionChainIn, partitionChainOut} {
+		fmt.Fprintf(&sb, "iptables -N %s\n", chain)
+	}
+	fmt.Fprintf(&sb, "iptables -I INPUT -j %s\n", partitionChainIn)
+	fmt.Fprintf(&sb, "iptables -I OUTPUT -j %s\n", partitionChainOut)
+
+	fmt.Fprintf(&sb, "iptables -A %s -i lo -j ACCEPT\n", partitionChainIn)
+	for _, ip := range sidecarIPs {
+		fmt.Fprintf(&sb, "iptables -A %s -s %s -j ACCEPT\n", partitionChainIn, ip)
+	}
+	for _, ip := range blockedIPs {
+		fmt.Fprintf(&sb, "iptables -A %s -s %s -j DROP\n", partitionChainIn, ip)
+	}
+	for _, ip := range peerIPs {
+		fmt.Fprintf(&sb, "iptables -A %s -s %s -j ACCEPT\n", partitionChainIn, ip)
+	}
+	// federation requests from anything else e.g Complement
+	fmt.Fprintf(&sb, "iptables -A %s -p tcp --dport 8448 -m conntrack --ctdir ORIGINAL -j DROP\n", partitionChainIn)
+
+	fmt.Fprintf(&sb, "iptables -A %s -o lo -j ACCEPT\n", partitionChainOut)
+	for _, ip := range sidecarIPs {
+		fmt.Fprintf(&sb, "iptables -A %s -d %s -j ACCEPT\n", partitionChainOut, ip)
+	}
+	for _, ip := range blockedIPs {
+		fmt.Fprintf(&sb, "iptables -A %s -d %s -j DROP\n", partitionChainOut, ip)
+	}
+	for _, ip := range peerIPs {
+		fmt.Fprintf(&sb, "iptables -A %s -d %s -j ACCEPT\n", partitionChainOut, ip)
+	}
+	fmt.Fprintf(&sb, "iptables -A %s -p udp --dport 53 -j ACCEPT\n", partitionChainOut)
+	fmt.Fprintf(&sb, "iptables -A %s -p tcp --dport 53 -j ACCEPT\n", partitionChainOut)
+	// replies to clients, but not connections the homeserver made before the partition
+	fmt.Fprintf(&sb, "iptables -A %s -m conntrack --ctdir REPLY -j ACCEPT\n", partitionChainOut)
+	fmt.Fprintf(&sb, "iptables -A %s -j DROP\n", partitionChainOut)
+	return sb.String()
+}
+
+// healServer removes the rules added by partitionServer.
+func (d *Deployer) healServer(hsDep *HomeserverDeployment) error {
+	if _, err := d.runNetworkTool(hsDep, healScript()); err != nil {
+		return fmt.Errorf("failed to heal container %s: %w", hsDep.ContainerID, err)
+	}
+	return nil
+}
+
+// healScript removes the partition chains, if they exist.
+func healScript() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "iptables -D INPUT -j %s 2>/dev/null || true\n", partitionChainIn)
+	fmt.Fprintf(&sb, "iptables -D OUTPUT -j %s 2>/dev/null || true\n", partitionChainOut)
+	for _, chain := range []string{partitionChainIn, partitionChainOut} {
+		fmt.Fprintf(&sb, "iptables -F %s 2>/dev/null || true\n", chain)
+		fmt.Fprintf(&sb, "iptables -X %s 2>/dev/null || true\n", chain)
+	}
+	return sb.String()
+}
+
+// impairServer applies netem to traffic sent by the homeserver on every interface, except responses to
+// clients. Replaces any existing impairment.
+func (d *Deployer) impairServer(hsDep *HomeserverDeployment, opts helpers.NetworkImpairmentOpts) error {
+	script := impairScript(opts)
+	if script == "" {
+		return d.clearServerImpairment(hsDep)
+	}
+	if _, err := d.runNetworkTool(hsDep, script); err != nil {
+		return fmt.Errorf("failed to impair network of container %s: %w", hsDep.ContainerID, err)
+	}
+	return nil
+}
+
+// impairScript returns the tc commands used by impairServer, or an empty string if `opts` doesn't impair
+// the network.
+func impairScript(opts helpers.NetworkImpairmentOpts) string {
+	var netem []string
+	if opts.Latency > 0 {
+		netem = append(netem, fmt.Sprintf("delay %dus", opts.Latency.Microseconds()))
+		if opts.Jitter > 0 {
+			netem = append(netem, fmt.Sprintf("%dus distribution normal", opts.Jitter.Microseconds()))
+		}
+	}
+	if opts.LossPercent > 0 {
+		netem = append(netem, fmt.Sprintf("loss %g%%", opts.LossPercent))
+	}
+	if opts.BandwidthKbit > 0 {
+		netem = append(netem, fmt.Sprintf("rate %dkbit", opts.BandwidthKbit))
+	}
+	if len(netem) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(`for dev in %s; do
+  tc qdisc del dev $dev root 2>/dev/null || true
+  tc qdisc add dev $dev root handle 1: prio
+  tc qdisc add dev $dev parent 1:3 handle 30: netem %s
+  # responses to clients go to the unimpaired band, everything else is impaired
+  tc filter add dev $dev parent 1: protocol ip prio 1 u32 match ip sport 8008 0xffff flowid 1:1
+  tc filter add dev $dev parent 1: protocol all prio 2 u32 match u32 0 0 flowid 1:3
+done
+`, interfacesScript, strings.Join(netem, " "))
+}
+
+// clearServerImpairment removes the impairment added by impairServer.
+func (d *Deployer) clearServerImpairment(hsDep *HomeserverDeployment) error {
+	script := fmt.Sprintf("for dev in %s; do tc qdisc del dev $dev root 2>/dev/null || true; done\n", interfacesScript)
+	if _, err := d.runNetworkTool(hsDep, script); err != nil {
+		return fmt.Errorf("failed to clear network impairment of container %s: %w", hsDep.ContainerID, err)
+	}
+	return nil
+}
+
+// interfacesScript lists the network interfaces of the container, except loopback.
+const interfacesScript = "$(ip -o link show | awk -F': ' '{print $2}' | cut -d@ -f1 | grep -v '^lo$')"
@@ -0,0 +1,126 @@
+package docker
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/helpers"
+)
+
+// mustBeValidShell fails the test if the script has a syntax error.
+func mustBeValidShell(t *testing.T, script string) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skipf("sh is not available: %s", err)
+	}
+	if out, err := exec.Command("sh", "-n", "-c", "set -e\n"+script).CombinedOutput(); err != nil {
+		t.Errorf("script is not valid: %s: %s\n%s", err, out, script)
+	}
+}
+
+func TestPartitionScript(t *testing.T) {
+	script := partitionScript([]string{"10.0.0.9"}, []string{"10.0.0.2"}, []string{"10.0.0.3", "10.0.0.4"})
+	mustBeValidShell(t, script)
+	lines := strings.Split(strings.TrimSpace(script), "\n")
+	indexOf := func(line string) int {
+		for i, l := range lines {
+			if l == line {
+				return i
+			}
+		}
+		t.Fatalf("script has no line %q:\n%s", line, script)
+		return -1
+	}
+
+	// any existing partition is removed first, so partitions can be replaced
+	if !strings.HasPrefix(script, healScript()) {
+		t.Errorf("script does not start by removing the existing partition:\n%s", script)
+	}
+	// blocked homeservers are dropped before peers and anything else are considered
+	for _, chain := range []struct {
+		name, flag string
+	}{{partitionChainIn, "-s"}, {partitionChainOut, "-d"}} {
+		drop3 := indexOf("iptables -A " + chain.name + " " + chain.flag + " 10.0.0.3 -j DROP")
+		drop4 := indexOf("iptables -A " + chain.name + " " + chain.flag + " 10.0.0.4 -j DROP")
+		accept := indexOf("iptables -A " + chain.name + " " + chain.flag + " 10.0.0.2 -j ACCEPT")
+		if drop3 > accept || drop4 > accept {
+			t.Errorf("%s: peers are accepted before blocked homeservers are dropped:\n%s", chain.name, script)
+		}
+		// the homeserver can always talk to its own sidecars e.g its database
+		sidecar := indexOf("iptables -A " + chain.name + " " + chain.flag + " 10.0.0.9 -j ACCEPT")
+		if sidecar > drop3 || sidecar > drop4 {
+			t.Errorf("%s: sidecars are not accepted before anything is dropped:\n%s", chain.name, script)
+		}
+	}
+	// replies to clients are allowed, then everything else is dropped
+	reply := indexOf("iptables -A " + partitionChainOut + " -m conntrack --ctdir REPLY -j ACCEPT")
+	dropAll := indexOf("iptables -A " + partitionChainOut + " -j DROP")
+	if reply > dropAll || dropAll != len(lines)-1 {
+		t.Errorf("outgoing traffic is not dropped last:\n%s", script)
+	}
+	// the chains are jumped to from the built-in chains
+	indexOf("iptables -I INPUT -j " + partitionChainIn)
+	indexOf("iptables -I OUTPUT -j " + partitionChainOut)
+}
+
+func TestHealScript(t *testing.T) {
+	script := healScript()
+	mustBeValidShell(t, script)
+	// healing must succeed when there is no partition, as the script runs with `set -e`
+	for _, line := range strings.Split(strings.TrimSpace(script), "\n") {
+		if !strings.HasSuffix(line, "|| true") {
+			t.Errorf("line fails if there is no partition: %s", line)
+		}
+	}
+}
+
+func TestImpairScript(t *testing.T) {
+	testCases := []struct {
+		name  string
+		opts  helpers.NetworkImpairmentOpts
+		netem string
+	}{
+		{
+			name: "no impairment",
+		},
+		{
+			name:  "latency",
+			opts:  helpers.NetworkImpairmentOpts{Latency: 50 * time.Millisecond},
+			netem: "netem delay 50000us\n",
+		},
+		{
+			name:  "latency with jitter",
+			opts:  helpers.NetworkImpairmentOpts{Latency: time.Second, Jitter: 10 * time.Millisecond},
+			netem: "netem delay 1000000us 10000us distribution normal\n",
+		},
+		{
+			name:  "jitter without latency is ignored",
+			opts:  helpers.NetworkImpairmentOpts{Jitter: 10 * time.Millisecond, LossPercent: 1},
+			netem: "netem loss 1%\n",
+		},
+		{
+			name:  "everything",
+			opts:  helpers.NetworkImpairmentOpts{Latency: time.Millisecond, Jitter: time.Millisecond, LossPercent: 2.5, BandwidthKbit: 256},
+			netem: "netem delay 1000us 1000us distribution normal loss 2.5% rate 256kbit\n",
+		},
+	}
+	for _, tc := range testCases {
+		script := impairScript(tc.opts)
+		if tc.netem == "" {
+			if script != "" {
+				t.Errorf("%s: got script, want none:\n%s", tc.name, script)
+			}
+			continue
+		}
+		mustBeValidShell(t, script)
+		if !strings.Contains(script, tc.netem) {
+			t.Errorf("%s: script does not contain %q:\n%s", tc.name, tc.netem, script)
+		}
+		// responses to clients are not impaired
+		if !strings.Contains(script, "match ip sport 8008 0xffff flowid 1:1") {
+			t.Errorf("%s: script impairs responses to clients:\n%s", tc.name, script)
+		}
+	}
+}
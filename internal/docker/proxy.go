@@ -0,0 +1,117 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+)
+
+// routeFederationViaProxy makes federation traffic between homeservers in the deployment go to the
+// host running Complement, on the port in `ports` for the destination homeserver. Each homeserver is
+// reconnected to the network without its alias, and a forwarder container takes over the alias.
+// Returns the IDs of the forwarder containers.
+func (d *Deployer) routeFederationViaProxy(dep *Deployment, ports map[string]int) ([]string, error) {
+	ctx := context.Background()
+	if err := d.pullImageIfNotExists(ctx, d.config.FederationProxyImage); err != nil {
+		return nil, err
+	}
+	var extraHosts []string
+	if runtime.GOOS == "linux" {
+		extraHosts = []string{fmt.Sprintf("%s:host-gateway", d.config.HostnameRunningComplement)}
+	}
+	var containerIDs []string
+	for hsName, hsDep := range dep.HS {
+		port, ok := ports[hsName]
+		if !ok {
+			continue
+		}
+		// Drop the alias from the homeserver so the forwarder can use it.
+		if err := d.Docker.NetworkDisconnect(ctx, hsDep.Network, hsDep.ContainerID, true); err != nil {
+			return containerIDs, fmt.Errorf("routeFederationViaProxy: failed to disconnect %s from network: %w", hsName, err)
+		}
+		if err := d.Docker.NetworkConnect(ctx, hsDep.Network, hsDep.ContainerID, &network.EndpointSettings{}); err != nil {
+			return containerIDs, fmt.Errorf("routeFederationViaProxy: failed to reconnect %s to network: %w", hsName, err)
+		}
+		body, err := d.Docker.ContainerCreate(ctx, &container.Config{
+			Image: d.config.FederationProxyImage,
+			Cmd: []string{
+				"TCP-LISTEN:8448,fork,reuseaddr",
+				fmt.Sprintf("TCP:%s:%d", d.config.HostnameRunningComplement, port),
+			},
+			Labels: map[string]string{
+				complementLabel:      "federation_proxy_" + hsName,
+				"complement_pkg":     d.config.PackageNamespace,
+				"complement_hs_name": hsName,
+			},
+		}, &container.HostConfig{
+			ExtraHosts: extraHosts,
+		}, &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				hsDep.Network: {
+					Aliases: []string{hsName},
+				},
+			},
+		}, nil, fmt.Sprintf("complement_%s_%s_federation_proxy_%s", d.config.PackageNamespace, d.DeployNamespace, hsName))
+		if err != nil {
+			return containerIDs, fmt.Errorf("routeFederationViaProxy: failed to create forwarder for %s: %w", hsName, err)
+		}
+		containerIDs = append(containerIDs, body.ID)
+		if err = d.Docker.ContainerStart(ctx, body.ID, container.StartOptions{}); err != nil {
+			return containerIDs, fmt.Errorf("routeFederationViaProxy: failed to start forwarder for %s: %w", hsName, err)
+		}
+		d.log("federation traffic to %s -> %s:%d (%s)\n", hsName, d.config.HostnameRunningComplement, port, body.ID)
+	}
+	return containerIDs, nil
+}
+
+// removeFederationProxy removes the forwarder containers created by routeFederationViaProxy and gives
+// each homeserver its alias back.
+func (d *Deployer) removeFederationProxy(dep *Deployment, containerIDs []string) {
+	ctx := context.Background()
+	for _, containerID := range containerIDs {
+		err := d.Docker.ContainerRemove(ctx, containerID, container.RemoveOptions{
+			Force: true,
+		})
+		if err != nil {
+			log.Printf("removeFederationProxy: failed to remove container %s: %s", containerID, err)
+		}
+	}
+	for hsName, hsDep := range dep.HS {
+		if err := d.Docker.NetworkDisconnect(ctx, hsDep.Network, hsDep.ContainerID, true); err != nil {
+			log.Printf("removeFederationProxy: failed to disconnect %s from network: %s", hsName, err)
+			continue
+		}
+		err := d.Docker.NetworkConnect(ctx, hsDep.Network, hsDep.ContainerID, &network.EndpointSettings{
+			Aliases: []string{hsName},
+		})
+		if err != nil {
+			log.Printf("removeFederationProxy: failed to reconnect %s to network: %s", hsName, err)
+		}
+	}
+}
+
+func (d *Deployer) pullImageIfNotExists(ctx context.Context, imageRef string) error {
+	_, err := d.Docker.ImageInspect(ctx, imageRef)
+	if err == nil {
+		return nil
+	}
+	if !errdefs.IsNotFound(err) {
+		return fmt.Errorf("failed to inspect image %s: %w", imageRef, err)
+	}
+	d.log("Pulling image %s\n", imageRef)
+	rc, err := d.Docker.ImagePull(ctx, imageRef, image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", imageRef, err)
+	}
+	defer rc.Close()
+	// the pull is only complete once the progress stream has been consumed
+	_, err = io.Copy(io.Discard, rc)
+	return err
+}
@@ -0,0 +1,220 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// ResourceUsage is the resources used by a homeserver during a test.
+type ResourceUsage struct {
+	PeakMemoryBytes uint64  `json:"peak_memory_bytes"`
+	CPUSeconds      float64 `json:"cpu_seconds"`
+	TxBytes         uint64  `json:"tx_bytes"`
+	DiskWriteBytes  uint64  `json:"disk_write_bytes"`
+}
+
+// resourceSample is a reading of the stats of a container. Everything except memory is cumulative since the
+// container started.
+type resourceSample struct {
+	memoryBytes    uint64
+	cpuNanos       uint64
+	txBytes        uint64
+	diskWriteBytes uint64
+}
+
+// resetSince returns true if any of the cumulative counters went backwards since `prev`, which happens when
+// the container is restarted.
+func (s resourceSample) resetSince(prev resourceSample) bool {
+	return s.cpuNanos < prev.cpuNanos || s.txBytes < prev.txBytes || s.diskWriteBytes < prev.diskWriteBytes
+}
+
+func sampleResources(ctx context.Context, docker ContainerRuntime, containerID string) (resourceSample, error) {
+	stats, err := docker.ContainerStatsOneShot(ctx, containerID)
+	if err != nil {
+		return resourceSample{}, err
+	}
+	defer stats.Body.Close()
+	var sj container.StatsResponse
+	if err = json.NewDecoder(stats.Body).Decode(&sj); err != nil {
+		return resourceSample{}, fmt.Errorf("failed to decode stats: %w", err)
+	}
+	s := resourceSample{
+		memoryBytes: sj.MemoryStats.Usage,
+		cpuNanos:    sj.CPUStats.CPUUsage.TotalUsage,
+	}
+	// match `docker stats`, which doesn't count the page cache as used memory
+	for _, key := range []string{"inactive_file", "total_inactive_file"} {
+		if inactive, ok := sj.MemoryStats.Stats[key]; ok && inactive < s.memoryBytes {
+			s.memoryBytes -= inactive
+			break
+		}
+	}
+	for _, nw := range sj.Networks {
+		s.txBytes += nw.TxBytes
+	}
+	for _, block := range sj.BlkioStats.IoServiceBytesRecursive {
+		if strings.EqualFold(block.Op, "write") {
+			s.diskWriteBytes += block.Value
+		}
+	}
+	return s, nil
+}
+
+// resourceMonitor samples the stats of every homeserver in a deployment until it is stopped.
+type resourceMonitor struct {
+	dep     *Deployment
+	report  func(testName string, usage map[string]ResourceUsage)
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+	started bool
+
+	// HS name -> usage of containers which have since been replaced or restarted
+	previous map[string]ResourceUsage
+	// HS name -> the container being sampled
+	current map[string]*containerSamples
+}
+
+type containerSamples struct {
+	containerID string
+	first       resourceSample
+	last        resourceSample
+	peakMemory  uint64
+}
+
+func (c *containerSamples) usage() ResourceUsage {
+	return ResourceUsage{
+		PeakMemoryBytes: c.peakMemory,
+		CPUSeconds:      float64(c.last.cpuNanos-c.first.cpuNanos) / float64(time.Second),
+		TxBytes:         c.last.txBytes - c.first.txBytes,
+		DiskWriteBytes:  c.last.diskWriteBytes - c.first.diskWriteBytes,
+	}
+}
+
+func (u ResourceUsage) add(other ResourceUsage) ResourceUsage {
+	return ResourceUsage{
+		PeakMemoryBytes: max(u.PeakMemoryBytes, other.PeakMemoryBytes),
+		CPUSeconds:      u.CPUSeconds + other.CPUSeconds,
+		TxBytes:         u.TxBytes + other.TxBytes,
+		DiskWriteBytes:  u.DiskWriteBytes + other.DiskWriteBytes,
+	}
+}
+
+func newResourceMonitor(dep *Deployment, interval time.Duration) *resourceMonitor {
+	m := &resourceMonitor{
+		dep:      dep,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+		previous: make(map[string]ResourceUsage),
+		current:  make(map[string]*containerSamples),
+	}
+	// take the first sample synchronously so usage before the test starts isn't counted
+	m.sample()
+	go func() {
+		defer close(m.doneCh)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stopCh:
+				return
+			case <-ticker.C:
+				m.sample()
+			}
+		}
+	}()
+	return m
+}
+
+func (m *resourceMonitor) sample() {
+	ctx := context.Background()
+	for hsName, hsDep := range m.dep.servers() {
+		containerID, _ := hsDep.container()
+		s, err := sampleResources(ctx, m.dep.Deployer.Docker, containerID)
+		if err != nil {
+			// the container may be stopped or paused by the test
+			continue
+		}
+		cur := m.current[hsName]
+		if cur == nil || cur.containerID != containerID || s.resetSince(cur.last) {
+			if cur != nil {
+				m.previous[hsName] = m.previous[hsName].add(cur.usage())
+			}
+			cur = &containerSamples{
+				containerID: containerID,
+			}
+			// containers which exist when monitoring starts have used resources before the test. Containers
+			// which appear later, e.g from Restore, only contain usage from this test.
+			if !m.started {
+				cur.first = s
+			}
+			m.current[hsName] = cur
+		}
+		cur.last = s
+		cur.peakMemory = max(cur.peakMemory, s.memoryBytes)
+	}
+	m.started = true
+}
+
+// stop stops sampling and returns the usage of each homeserver since the monitor was created.
+func (m *resourceMonitor) stop() map[string]ResourceUsage {
+	close(m.stopCh)
+	<-m.doneCh
+	m.sample()
+	usage := make(map[string]ResourceUsage)
+	for hsName, prev := range m.previous {
+		usage[hsName] = prev
+	}
+	for hsName, cur := range m.current {
+		usage[hsName] = usage[hsName].add(cur.usage())
+	}
+	return usage
+}
+
+// MonitorResources samples the resource usage of every homeserver in the deployment until the test destroys
+// it, then calls `report` with the usage of each homeserver during the test. Dirty deployments may be shared by
+// parallel tests, so each test has its own monitor, and usage includes that of other tests running at the same
+// time. Replaces any existing monitor for the test, which is not reported.
+func (d *Deployment) MonitorResources(testName string, report func(testName string, usage map[string]ResourceUsage)) {
+	d.resourceMonitorsMu.Lock()
+	defer d.resourceMonitorsMu.Unlock()
+	if m := d.resourceMonitors[testName]; m != nil {
+		m.stop()
+	}
+	if d.resourceMonitors == nil {
+		d.resourceMonitors = make(map[string]*resourceMonitor)
+	}
+	m := newResourceMonitor(d, d.Config.ResourceSampleInterval)
+	m.report = report
+	d.resourceMonitors[testName] = m
+}
+
+// stopResourceMonitor stops the monitor started by MonitorResources for the test and reports the usage, if
+// there is one.
+func (d *Deployment) stopResourceMonitor(testName string) {
+	d.resourceMonitorsMu.Lock()
+	m := d.resourceMonitors[testName]
+	delete(d.resourceMonitors, testName)
+	d.resourceMonitorsMu.Unlock()
+	if m == nil {
+		return
+	}
+	usage := m.stop()
+	if m.report != nil {
+		m.report(testName, usage)
+	}
+}
+
+// stopResourceMonitors stops the monitors of every test without reporting them.
+func (d *Deployment) stopResourceMonitors() {
+	d.resourceMonitorsMu.Lock()
+	defer d.resourceMonitorsMu.Unlock()
+	for _, m := range d.resourceMonitors {
+		m.stop()
+	}
+	d.resourceMonitors = nil
+}
@@ -0,0 +1,185 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/config"
+)
+
+// the label on sidecar containers and images with the name of the sidecar
+const sidecarLabel = "complement_sidecar"
+
+// sidecarHostname returns the hostname of the sidecar on the homeserver network.
+func sidecarHostname(hsName, sidecarName string) string {
+	return hsName + "-" + sidecarName
+}
+
+// sidecarEnv returns environment variables which tell the homeserver the hostnames of its sidecars.
+func sidecarEnv(hsName string, sidecarNames []string) []string {
+	var env []string
+	for _, name := range sidecarNames {
+		key := "COMPLEMENT_SIDECAR_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		env = append(env, key+"="+sidecarHostname(hsName, name))
+	}
+	return env
+}
+
+// sortedSidecarNames returns the names of the sidecars of a homeserver, so they are always started in the
+// same order.
+func sortedSidecarNames(sidecars map[string]string) []string {
+	names := make([]string, 0, len(sidecars))
+	for name := range sidecars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sidecarSpec describes a sidecar container to create.
+type sidecarSpec struct {
+	name          string
+	hsName        string
+	imageID       string
+	containerName string
+	networkName   string
+	blueprintName string
+	contextStr    string
+	// these are only set when the container is created from the blueprint. Images of sidecars made by the
+	// Builder already have them.
+	env         []string
+	cmd         []string
+	healthCheck *container.HealthConfig
+}
+
+// sidecarSpecFromBlueprint converts the sidecar in the blueprint to a sidecarSpec.
+func sidecarSpecFromBlueprint(sc b.Sidecar, hsImage string) sidecarSpec {
+	spec := sidecarSpec{
+		name:    sc.Name,
+		imageID: sc.Image,
+		env:     sc.Env,
+		cmd:     sc.Cmd,
+	}
+	if spec.imageID == "" {
+		spec.imageID = hsImage
+	}
+	if sc.HealthCheck != nil {
+		spec.healthCheck = &container.HealthConfig{
+			Test:     sc.HealthCheck.Test,
+			Interval: sc.HealthCheck.Interval,
+			Timeout:  sc.HealthCheck.Timeout,
+			Retries:  sc.HealthCheck.Retries,
+		}
+		if spec.healthCheck.Interval == 0 {
+			spec.healthCheck.Interval = time.Second
+		}
+		if spec.healthCheck.Timeout == 0 {
+			spec.healthCheck.Timeout = 5 * time.Second
+		}
+		if spec.healthCheck.Retries == 0 {
+			spec.healthCheck.Retries = 30
+		}
+	}
+	return spec
+}
+
+// deploySidecar creates and starts the sidecar, waiting until it is healthy. Returns the container ID, which
+// is set even on failure if the container was created.
+func deploySidecar(docker ContainerRuntime, cfg *config.Complement, spec sidecarSpec) (string, error) {
+	ctx := context.Background()
+	body, err := docker.ContainerCreate(ctx, &container.Config{
+		Image:       spec.imageID,
+		Env:         spec.env,
+		Cmd:         spec.cmd,
+		Healthcheck: spec.healthCheck,
+		Labels: map[string]string{
+			complementLabel:        spec.contextStr,
+			"complement_blueprint": spec.blueprintName,
+			"complement_pkg":       cfg.PackageNamespace,
+			"complement_hs_name":   spec.hsName,
+			sidecarLabel:           spec.name,
+		},
+	}, &container.HostConfig{}, &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			spec.networkName: {
+				Aliases: []string{sidecarHostname(spec.hsName, spec.name)},
+			},
+		},
+	}, nil, spec.containerName)
+	if err != nil {
+		return "", fmt.Errorf("failed to create sidecar %s: %w", spec.name, err)
+	}
+	if err = docker.ContainerStart(ctx, body.ID, container.StartOptions{}); err != nil {
+		return body.ID, fmt.Errorf("failed to start sidecar %s: %w", spec.name, err)
+	}
+	inspect, err := docker.ContainerInspect(ctx, body.ID)
+	if err == nil {
+		for vol := range inspect.Config.Volumes {
+			log.Printf(
+				"WARNING: sidecar %s of %s has a VOLUME %s - data in volumes is not saved in blueprints or checkpoints.",
+				spec.name, spec.hsName, vol,
+			)
+		}
+	}
+	if err = waitForSidecar(ctx, docker, body.ID, time.Now().Add(cfg.SpawnHSTimeout)); err != nil {
+		return body.ID, fmt.Errorf("sidecar %s: %w", spec.name, err)
+	}
+	return body.ID, nil
+}
+
+// waitForSidecar waits until the sidecar is running and, if it has a health check, healthy.
+func waitForSidecar(ctx context.Context, docker ContainerRuntime, containerID string, stopTime time.Time) error {
+	for {
+		inspect, err := docker.ContainerInspect(ctx, containerID)
+		if err != nil {
+			return fmt.Errorf("failed to inspect container %s: %w", containerID, err)
+		}
+		if !inspect.State.Running {
+			return fmt.Errorf("container %s is not running, state=%v", containerID, inspect.State.Status)
+		}
+		health := inspect.State.Health
+		if health == nil || health.Status == container.Healthy {
+			return nil
+		}
+		if health.Status == container.Unhealthy {
+			return fmt.Errorf("container %s is unhealthy", containerID)
+		}
+		if time.Now().After(stopTime) {
+			return fmt.Errorf("timed out waiting for container %s to be healthy, status=%s", containerID, health.Status)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// startSidecars starts the stopped sidecars of the homeserver, waiting until they are ready.
+func (d *Deployer) startSidecars(hsDep *HomeserverDeployment) error {
+	ctx := context.Background()
+	for _, name := range sortedSidecarNames(hsDep.Sidecars) {
+		containerID := hsDep.Sidecars[name]
+		if err := d.Docker.ContainerStart(ctx, containerID, container.StartOptions{}); err != nil {
+			return fmt.Errorf("failed to start sidecar %s: %s", name, err)
+		}
+		if err := waitForSidecar(ctx, d.Docker, containerID, time.Now().Add(d.config.SpawnHSTimeout)); err != nil {
+			return fmt.Errorf("sidecar %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// forEachSidecar calls fn for each sidecar of the homeserver, returning the first error.
+func forEachSidecar(hsDep *HomeserverDeployment, fn func(name, containerID string) error) error {
+	for _, name := range sortedSidecarNames(hsDep.Sidecars) {
+		if err := fn(name, hsDep.Sidecars[name]); err != nil {
+			return fmt.Errorf("sidecar %s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/errdefs"
+
+	complementRuntime "github.com/matrix-org/complement/runtime"
+)
+
+// the label on blueprint images built from Homeserver.UpgradeFromImageURI with the image to upgrade to
+const upgradeToLabel = "complement_upgrade_to"
+
+// dataArchive is a path in a container which was saved to a temporary file.
+type dataArchive struct {
+	path string
+	file *os.File
+}
+
+// UpgradeServer replaces the homeserver container with a container of `imageURI`, copying the data of the
+// homeserver to the new container. If `imageURI` is empty, the image the blueprint would have been built from
+// without Homeserver.UpgradeFromImageURI is used. Sidecars are left running. The HomeserverDeployment is
+// updated in place so existing clients talk to the new container. The old container is kept until the new
+// container is running, and is started again if the upgrade fails.
+func (d *Deployer) UpgradeServer(dep *Deployment, hsName, imageURI string) error {
+	ctx := context.Background()
+	hsDep := dep.HS[hsName]
+	inspect, err := d.Docker.ContainerInspect(ctx, hsDep.ContainerID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect container %s: %w", hsDep.ContainerID, err)
+	}
+	if imageURI == "" {
+		imageURI = inspect.Config.Labels[upgradeToLabel]
+		if imageURI == "" {
+			return fmt.Errorf("no image to upgrade to: %s was not built from a blueprint with UpgradeFromImageURI", hsName)
+		}
+	}
+	paths := dataPaths(inspect)
+	if len(paths) == 0 {
+		return fmt.Errorf(
+			"don't know where %s keeps its data: set runtime.DataPaths for %s", hsName, complementRuntime.Homeserver,
+		)
+	}
+
+	// stop the homeserver gracefully so all of its data is written
+	secs := int(d.config.SpawnHSTimeout.Seconds())
+	err = d.Docker.ContainerStop(ctx, hsDep.ContainerID, container.StopOptions{
+		Timeout: &secs,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to stop container %s: %w", hsDep.ContainerID, err)
+	}
+	archives, err := d.saveDataPaths(hsDep.ContainerID, paths)
+	defer func() {
+		for _, a := range archives {
+			a.file.Close()
+			os.Remove(a.file.Name())
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	// keep the old container until the new one is running, so the homeserver can be restored if the upgrade fails
+	containerName := strings.TrimPrefix(inspect.Name, "/")
+	contextStr := inspect.Config.Labels[complementLabel]
+	oldContainerName := containerName + "_pre_upgrade"
+	if err = d.Docker.ContainerRename(ctx, hsDep.ContainerID, oldContainerName); err != nil {
+		return fmt.Errorf("failed to rename container %s: %w", hsDep.ContainerID, err)
+	}
+	upgraded, err := deployImage(
+		d.Docker, imageURI, containerName,
+		d.config.PackageNamespace, dep.BlueprintName, hsName, hsDep.ApplicationServices, contextStr,
+		hsDep.Network, d.config, deployImageOpts{
+			dnsServers:  dep.dnsServers,
+			clockOffset: clockOffset(d.config, dep.clockOffsets[hsName]),
+			sidecars:    hsDep.Sidecars,
+			beforeStart: func(containerID string) error {
+				return d.restoreDataPaths(containerID, archives)
+			},
+		},
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to deploy image %s: %w", imageURI, err)
+		if upgraded != nil && upgraded.ContainerID != "" {
+			printLogs(d.Docker, upgraded.ContainerID, contextStr)
+		}
+		if rollbackErr := d.rollbackUpgrade(hsDep, upgraded, containerName); rollbackErr != nil {
+			return fmt.Errorf("%w, and failed to restore the old container: %s", err, rollbackErr)
+		}
+		return err
+	}
+	err = d.Docker.ContainerRemove(ctx, hsDep.ContainerID, container.RemoveOptions{
+		Force: true,
+	})
+	if err != nil {
+		d.log("%s: failed to remove old container %s: %s\n", hsName, hsDep.ContainerID, err)
+	}
+	hsDep.setContainerID(upgraded.ContainerID)
+	hsDep.SetEndpoints(upgraded.BaseURL, upgraded.FedBaseURL)
+	d.log("%s: upgraded to %s %s (%s)\n", hsName, imageURI, hsDep.BaseURL, hsDep.ContainerID)
+	return nil
+}
+
+// rollbackUpgrade removes the container of a failed upgrade, if it was created, then gives the old container
+// back its name and starts it again.
+func (d *Deployer) rollbackUpgrade(hsDep, upgraded *HomeserverDeployment, containerName string) error {
+	ctx := context.Background()
+	if upgraded != nil && upgraded.ContainerID != "" {
+		err := d.Docker.ContainerRemove(ctx, upgraded.ContainerID, container.RemoveOptions{
+			Force: true,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to remove container %s: %w", upgraded.ContainerID, err)
+		}
+	}
+	if err := d.Docker.ContainerRename(ctx, hsDep.ContainerID, containerName); err != nil {
+		return fmt.Errorf("failed to rename container %s: %w", hsDep.ContainerID, err)
+	}
+	return d.StartServer(hsDep)
+}
+
+// dataPaths returns the paths to copy when upgrading the container: runtime.DataPaths and its volumes.
+func dataPaths(inspect container.InspectResponse) []string {
+	paths := slices.Clone(complementRuntime.DataPaths)
+	for _, m := range inspect.Mounts {
+		if m.Type == mount.TypeVolume && !slices.Contains(paths, m.Destination) {
+			paths = append(paths, m.Destination)
+		}
+	}
+	return paths
+}
+
+// saveDataPaths saves the paths in the container to temporary files. Paths which don't exist are skipped.
+// The files are returned even on failure so they can be removed.
+func (d *Deployer) saveDataPaths(containerID string, paths []string) ([]dataArchive, error) {
+	var archives []dataArchive
+	for _, p := range paths {
+		rc, _, err := d.Docker.CopyFromContainer(context.Background(), containerID, p)
+		if errdefs.IsNotFound(err) {
+			d.log("%s: not copying %s as it doesn't exist", containerID, p)
+			continue
+		}
+		if err != nil {
+			return archives, fmt.Errorf("failed to copy %s from container %s: %w", p, containerID, err)
+		}
+		f, err := os.CreateTemp("", "complement-upgrade-")
+		if err != nil {
+			rc.Close()
+			return archives, err
+		}
+		archives = append(archives, dataArchive{path: p, file: f})
+		_, err = io.Copy(f, rc)
+		rc.Close()
+		if err != nil {
+			return archives, fmt.Errorf("failed to copy %s from container %s: %w", p, containerID, err)
+		}
+	}
+	return archives, nil
+}
+
+// restoreDataPaths copies the saved paths into the container.
+func (d *Deployer) restoreDataPaths(containerID string, archives []dataArchive) error {
+	for _, a := range archives {
+		if _, err := a.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		// the archive contains the last element of the path, so extract it into the parent directory
+		err := d.Docker.CopyToContainer(context.Background(), containerID, path.Dir(a.path), a.file, container.CopyToContainerOptions{
+			AllowOverwriteDirWithFile: false,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to copy %s to container %s: %w", a.path, containerID, err)
+		}
+	}
+	return nil
+}
+
+// signingKeyIDs returns the IDs of the signing keys the homeserver currently uses.
+func (d *Deployment) signingKeyIDs(hsName string) ([]string, error) {
+	httpClient := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: d.RoundTripper(),
+	}
+	res, err := httpClient.Get("https://" + hsName + "/_matrix/key/v2/server")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /_matrix/key/v2/server returned HTTP %d", res.StatusCode)
+	}
+	var body struct {
+		VerifyKeys map[string]json.RawMessage `json:"verify_keys"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode /_matrix/key/v2/server response: %w", err)
+	}
+	keyIDs := make([]string, 0, len(body.VerifyKeys))
+	for keyID := range body.VerifyKeys {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+	return keyIDs, nil
+}
@@ -331,7 +331,7 @@ func AnyOf(checkers ...JSON) JSON {
 			builder.WriteString("\n    ")
 			builder.WriteString(err.Error())
 		}
-		return fmt.Errorf(builder.String())
+		return fmt.Errorf("%s", builder.String())
 	}
 }
 
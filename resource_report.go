@@ -0,0 +1,102 @@
+package complement
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// resourceReport collects the resource usage of homeservers in each test. See COMPLEMENT_RESOURCE_REPORT_DIR.
+type resourceReport struct {
+	mu    sync.Mutex
+	tests []resourceReportTest
+}
+
+type resourceReportTest struct {
+	Test        string                          `json:"test"`
+	Homeservers map[string]docker.ResourceUsage `json:"homeservers"`
+}
+
+// record is called by a deployment when a test destroys it.
+func (r *resourceReport) record(testName string, usage map[string]docker.ResourceUsage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tests = append(r.tests, resourceReportTest{
+		Test:        testName,
+		Homeservers: usage,
+	})
+}
+
+// write writes the JSON report to `dir` and prints the summary table to `summary`.
+func (r *resourceReport) write(dir, pkgNamespace string, summary io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sort.SliceStable(r.tests, func(i, j int) bool {
+		return r.tests[i].Test < r.tests[j].Test
+	})
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to make report directory: %w", err)
+	}
+	data, err := json.MarshalIndent(struct {
+		Package string               `json:"package"`
+		Tests   []resourceReportTest `json:"tests"`
+	}{
+		Package: pkgNamespace,
+		Tests:   r.tests,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("resources_%s.json", pkgNamespace))
+	if err = os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+
+	fmt.Fprintf(summary, "Resource usage for %s (full report at %s):\n", pkgNamespace, path)
+	tw := tabwriter.NewWriter(summary, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "TEST\tHS\tPEAK MEMORY\tCPU SECONDS\tBYTES SENT\tDISK WRITES\t")
+	var total docker.ResourceUsage
+	for _, test := range r.tests {
+		hsNames := make([]string, 0, len(test.Homeservers))
+		for hsName := range test.Homeservers {
+			hsNames = append(hsNames, hsName)
+		}
+		sort.Strings(hsNames)
+		for _, hsName := range hsNames {
+			usage := test.Homeservers[hsName]
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%.2f\t%s\t%s\t\n",
+				test.Test, hsName, formatBytes(usage.PeakMemoryBytes), usage.CPUSeconds,
+				formatBytes(usage.TxBytes), formatBytes(usage.DiskWriteBytes),
+			)
+			total.PeakMemoryBytes = max(total.PeakMemoryBytes, usage.PeakMemoryBytes)
+			total.CPUSeconds += usage.CPUSeconds
+			total.TxBytes += usage.TxBytes
+			total.DiskWriteBytes += usage.DiskWriteBytes
+		}
+	}
+	fmt.Fprintf(tw, "TOTAL\t\t%s\t%.2f\t%s\t%s\t\n",
+		formatBytes(total.PeakMemoryBytes), total.CPUSeconds, formatBytes(total.TxBytes), formatBytes(total.DiskWriteBytes),
+	)
+	return tw.Flush()
+}
+
+// formatBytes formats a number of bytes using binary units e.g 1.5MiB
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -3,7 +3,7 @@ package runtime
 import (
 	"context"
 
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/api/types/container"
 	"github.com/matrix-org/complement/ct"
 )
 
@@ -16,9 +16,21 @@ const (
 
 var Homeserver string
 
+// ContainerClient is the part of the container runtime which ContainerKillFunc can use.
+type ContainerClient interface {
+	ContainerKill(ctx context.Context, container, signal string) error
+	ContainerStop(ctx context.Context, container string, options container.StopOptions) error
+}
+
+// DataPaths are the paths in the homeserver container which hold its data, including its signing key. When a
+// homeserver is upgraded to a new image with UpgradeServer, these paths and any volumes are copied from the old
+// container to the new one. Homeserver implementations should set this in their `hs_$name.go`. Only Synapse sets
+// it so far, so UpgradeServer fails for other homeservers, unless the homeserver keeps all of its data in volumes.
+var DataPaths []string
+
 // ContainerKillFunc is used to destroy a container, it can be overwritten by Homeserver implementations
 // to e.g. gracefully stop a container.
-var ContainerKillFunc = func(client *client.Client, containerID string) error {
+var ContainerKillFunc = func(client ContainerClient, containerID string) error {
 	return client.ContainerKill(context.Background(), containerID, "KILL")
 }
 
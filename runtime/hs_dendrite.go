@@ -5,16 +5,21 @@ package runtime
 
 import (
 	"context"
+	"regexp"
 
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
 )
 
 func init() {
 	Homeserver = Dendrite
+	LogRules = append(LogRules, LogRule{
+		Name:    "logrus panic",
+		Pattern: regexp.MustCompile(`level=(panic|fatal)`),
+		Fatal:   true,
+	})
 	// For Dendrite, we want to always stop the container gracefully, as this is needed to
 	// extract e.g. coverage reports.
-	ContainerKillFunc = func(client *client.Client, containerID string) error {
+	ContainerKillFunc = func(client ContainerClient, containerID string) error {
 		oneSecond := 1
 		return client.ContainerStop(context.Background(), containerID, container.StopOptions{
 			Timeout: &oneSecond,
@@ -2,6 +2,27 @@
 
 package runtime
 
+import "regexp"
+
 func init() {
 	Homeserver = Synapse
+	// the signing key, media and SQLite database are in /data, and Postgres is in its default location
+	DataPaths = []string{"/data", "/var/lib/postgresql/data"}
+	LogRules = append(LogRules,
+		LogRule{
+			Name:      "Python traceback",
+			Pattern:   regexp.MustCompile(`Traceback \(most recent call last\):`),
+			MultiLine: true,
+		},
+		LogRule{
+			Name:    "database error",
+			Pattern: regexp.MustCompile(`psycopg2\.errors\.|sqlite3\.(OperationalError|DatabaseError|IntegrityError)`),
+			Fatal:   true,
+		},
+	)
+	LogAllowlist = append(LogAllowlist,
+		// tests routinely make servers federate with servers which are unreachable
+		regexp.MustCompile(`twisted\.internet\.error\.(ConnectionRefusedError|DNSLookupError|TimeoutError)`),
+		regexp.MustCompile(`synapse\.api\.errors\.(RequestSendFailed|HttpResponseException)`),
+	)
 }
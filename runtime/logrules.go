@@ -0,0 +1,37 @@
+package runtime
+
+import "regexp"
+
+// LogRule matches lines in homeserver logs which indicate a bug in the homeserver, even if the test passed.
+type LogRule struct {
+	// Name is used when reporting matches e.g "Go panic".
+	Name string
+	// Pattern is matched against each line of the logs.
+	Pattern *regexp.Regexp
+	// Fatal rules fail the test which caused the match when COMPLEMENT_LOG_RULES is `fail`. Other rules only
+	// log a warning.
+	Fatal bool
+	// MultiLine rules also match the indented lines which follow the matching line, and the first line which
+	// isn't indented, e.g a Python traceback and the exception which caused it. The allowlist is checked against
+	// all of these lines.
+	MultiLine bool
+}
+
+// LogRules are checked against the logs of each homeserver when a test destroys its deployment. Homeserver
+// implementations can add rules in their `hs_$name.go`.
+var LogRules = []LogRule{
+	{
+		Name:    "Go panic",
+		Pattern: regexp.MustCompile(`^panic: |^fatal error: `),
+		Fatal:   true,
+	},
+	{
+		Name:    "Rust panic",
+		Pattern: regexp.MustCompile(`panicked at `),
+		Fatal:   true,
+	},
+}
+
+// LogAllowlist contains patterns for matches which are expected and should not be reported. Homeserver
+// implementations can add patterns in their `hs_$name.go`.
+var LogAllowlist []*regexp.Regexp
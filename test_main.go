@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/complement/b"
 	"github.com/matrix-org/complement/config"
@@ -96,13 +97,52 @@ func OldDeploy(t ct.TestLike, blueprint b.Blueprint) Deployment {
 	return testPackage.OldDeploy(t, blueprint)
 }
 
+type deployOpts struct {
+	dnsStandin   bool
+	clockOffsets map[string]time.Duration
+}
+
+// needsCleanDeployment returns true if the options cannot be applied to a dirty deployment.
+func (o *deployOpts) needsCleanDeployment() bool {
+	return o.dnsStandin || len(o.clockOffsets) > 0
+}
+
+// DeployOpt is an option for Deploy.
+type DeployOpt func(*deployOpts)
+
+// EXPERIMENTAL
+// WithDNSStandin deploys a DNS stand-in alongside the homeservers, which they use to resolve names which
+// are not known to the deployment network. Use Deployment.DNS to control it. The deployment is never a
+// dirty deployment, even when COMPLEMENT_ENABLE_DIRTY_RUNS is set.
+func WithDNSStandin() DeployOpt {
+	return func(o *deployOpts) {
+		o.dnsStandin = true
+	}
+}
+
+// EXPERIMENTAL
+// WithClockOffset starts the homeserver `hsName` with its clock `offset` from the real time, e.g to check how
+// other homeservers handle events from a server whose clock is wrong. Use Deployment.SetClockOffset to change
+// it during the test. The offset must be a whole number of seconds. Requires COMPLEMENT_FAKETIME_LIB. The
+// deployment is never a dirty deployment.
+func WithClockOffset(hsName string, offset time.Duration) DeployOpt {
+	return func(o *deployOpts) {
+		if o.clockOffsets == nil {
+			o.clockOffsets = make(map[string]time.Duration)
+		}
+		o.clockOffsets[hsName] = offset
+	}
+}
+
 // Deploy will deploy the given number of servers or terminate the test.
 // This function is the main setup function for all tests as it provides a deployment with
 // which tests can interact with.
 //
 // For test consistency and compatibility, deployers should be creating servers that can
 // be referred to as `hs1`, `hs2`, etc as the `hsName` in the `Deployment` interface.
-func Deploy(t ct.TestLike, numServers int) Deployment {
+//
+// Options are ignored by custom deployments set via WithDeployment.
+func Deploy(t ct.TestLike, numServers int, opts ...DeployOpt) Deployment {
 	t.Helper()
 	if testPackage == nil {
 		ct.Fatalf(t, "Deploy: testPackage not set, did you forget to call complement.TestMain?")
@@ -110,5 +150,5 @@ func Deploy(t ct.TestLike, numServers int) Deployment {
 	if customDeployer != nil {
 		return customDeployer(t, numServers, testPackage.Config)
 	}
-	return testPackage.Deploy(t, numServers)
+	return testPackage.Deploy(t, numServers, opts...)
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,6 +14,7 @@ import (
 	"github.com/matrix-org/complement/client"
 	"github.com/matrix-org/complement/config"
 	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/federation"
 	"github.com/matrix-org/complement/helpers"
 	"github.com/matrix-org/complement/internal/docker"
 	"github.com/matrix-org/gomatrixserverlib/spec"
@@ -76,6 +78,110 @@ type Deployment interface {
 	Network() string
 }
 
+// The interfaces below are optional features of a Deployment. The Docker deployment supports all of them,
+// but custom deployments set via WithDeployment may not. Use RequireCapability to access them from a test.
+
+// EXPERIMENTAL
+// FederationProxyDeployment is a Deployment which can route federation traffic through a proxy.
+type FederationProxyDeployment interface {
+	// FederationProxy routes all federation traffic between homeservers in this deployment through a proxy
+	// running in Complement, which re-terminates TLS using the Complement CA. The proxy records every request
+	// and can delay, drop or modify requests by direction and path. The first call creates the proxy;
+	// subsequent calls return the same proxy with its rules and recorded requests cleared. Fails the test if
+	// the homeservers are partitioned.
+	FederationProxy(t ct.TestLike) *federation.Proxy
+}
+
+// EXPERIMENTAL
+// DNSDeployment is a Deployment whose homeservers resolve names using a DNS server in Complement.
+type DNSDeployment interface {
+	// DNS returns the DNS server which homeservers in this deployment use to resolve names which are not
+	// known to the deployment network, along with an HTTPS frontend for routing those names to federation
+	// servers in Complement. Useful for testing .well-known and SRV server discovery. The deployment must
+	// have been created using WithDNSStandin. Each call clears the records, routes and recorded queries.
+	DNS(t ct.TestLike) *federation.DNSServer
+}
+
+// EXPERIMENTAL
+// NetworkFaultDeployment is a Deployment which can partition and impair the network of its homeservers.
+type NetworkFaultDeployment interface {
+	// Partition splits the homeservers into groups which cannot talk to each other, e.g
+	// `Partition(t, []string{"hs1"}, []string{"hs2", "hs3"})`. Homeservers not in any group are placed in a group
+	// together. Homeservers cannot make or receive federation connections to or from servers hosted by Complement,
+	// but clients can still connect to every homeserver, and homeservers can still talk to their own sidecars.
+	// Replaces any existing partition. Cannot be used together with FederationProxy: fails the test if federation
+	// traffic is being proxied, or if there is a problem changing the network of a homeserver.
+	Partition(t ct.TestLike, groups ...[]string)
+	// Heal removes the partition created by Partition. Does nothing if there is no partition.
+	Heal(t ct.TestLike)
+	// ImpairNetwork applies netem-style latency, jitter, packet loss and a bandwidth cap to traffic sent by the
+	// homeserver, except responses to clients. Replaces any existing impairment on the homeserver.
+	// Fails the test if there is a problem changing the network of the homeserver.
+	ImpairNetwork(t ct.TestLike, hsName string, opts helpers.NetworkImpairmentOpts)
+	// ClearNetworkImpairment removes the impairment applied by ImpairNetwork. Does nothing if the homeserver
+	// has no impairment.
+	ClearNetworkImpairment(t ct.TestLike, hsName string)
+}
+
+// EXPERIMENTAL
+// ClockDeployment is a Deployment which can change the clocks of its homeservers.
+type ClockDeployment interface {
+	// SetClockOffset changes the clock of the homeserver to be `offset` from the real time, e.g 24 hours in the
+	// future, so tests don't need to sleep until tokens or delayed events expire. Offsets are not cumulative:
+	// use 0 to reset the clock. Monotonic clocks are not changed. Fails the test if the offset is not a whole
+	// number of seconds. Requires COMPLEMENT_FAKETIME_LIB.
+	SetClockOffset(t ct.TestLike, hsName string, offset time.Duration)
+}
+
+// EXPERIMENTAL
+// CheckpointDeployment is a Deployment which can save the state of its homeservers and roll back to it.
+type CheckpointDeployment interface {
+	// Checkpoint saves the state of every homeserver in the deployment, returning an ID which can be passed to
+	// Restore. This allows a heavy fixture to be set up once, with each test rolled back to it. Data in volumes
+	// is not saved.
+	Checkpoint(t ct.TestLike) string
+	// Restore restarts every homeserver saved by Checkpoint from the saved state. Homeservers get new ports,
+	// but existing clients are updated to use them. Access tokens created after the checkpoint are no longer valid.
+	// Partitions and network impairments of the restored homeservers are removed, not restored.
+	Restore(t ct.TestLike, checkpointID string)
+}
+
+// EXPERIMENTAL
+// UpgradeDeployment is a Deployment which can upgrade its homeservers to a new version.
+type UpgradeDeployment interface {
+	// UpgradeServer stops the homeserver and starts `imageURI` with the same data, server name and signing key,
+	// so tests can check that data is migrated from one version to the next. Existing clients keep working. If
+	// `imageURI` is empty, the homeserver must be in a blueprint with UpgradeFromImageURI, and it is upgraded to
+	// the image it would have been built from otherwise. Fails the test if the signing key changes. Requires
+	// runtime.DataPaths to be set for the homeserver, which is currently only the case for Synapse.
+	UpgradeServer(t ct.TestLike, hsName, imageURI string)
+}
+
+// the Docker deployment supports every optional feature
+var (
+	_ FederationProxyDeployment = (*docker.Deployment)(nil)
+	_ DNSDeployment             = (*docker.Deployment)(nil)
+	_ NetworkFaultDeployment    = (*docker.Deployment)(nil)
+	_ ClockDeployment           = (*docker.Deployment)(nil)
+	_ CheckpointDeployment      = (*docker.Deployment)(nil)
+	_ UpgradeDeployment         = (*docker.Deployment)(nil)
+)
+
+// EXPERIMENTAL
+// RequireCapability returns the deployment as one of the optional deployment interfaces, skipping the test if
+// the deployment doesn't implement it. For example:
+//
+//	checkpoints := complement.RequireCapability[complement.CheckpointDeployment](t, deployment)
+//	id := checkpoints.Checkpoint(t)
+func RequireCapability[T any](t ct.TestLike, deployment Deployment) T {
+	t.Helper()
+	capability, ok := deployment.(T)
+	if !ok {
+		t.Skipf("RequireCapability: deployment %T does not implement %T", deployment, (*T)(nil))
+	}
+	return capability
+}
+
 // TestPackage represents the configuration for a package of tests. A package of tests
 // are all tests in the same Go package (directory).
 type TestPackage struct {
@@ -90,6 +196,10 @@ type TestPackage struct {
 	// in dirty mode.
 	existingDeployment   *docker.Deployment
 	existingDeploymentMu *sync.Mutex
+	// used instead of existingDeployment if COMPLEMENT_DIRTY_RUNS_POOL_SIZE is set
+	dirtyPool *dirtyPool
+	// set if COMPLEMENT_RESOURCE_REPORT_DIR is set
+	resourceReport *resourceReport
 }
 
 // NewTestPackage creates a new test package which can be used to deploy containers for all tests
@@ -109,12 +219,17 @@ func NewTestPackage(pkgNamespace string) (*TestPackage, error) {
 	// we use GMSL which uses logrus by default. We don't want those logs in our test output unless they are Serious.
 	logrus.SetLevel(logrus.ErrorLevel)
 
-	return &TestPackage{
+	tp := &TestPackage{
 		complementBuilder:    builder,
 		namespaceCounter:     0,
 		Config:               cfg,
 		existingDeploymentMu: &sync.Mutex{},
-	}, nil
+		dirtyPool:            newDirtyPool(cfg),
+	}
+	if cfg.ResourceReportDir != "" {
+		tp.resourceReport = &resourceReport{}
+	}
+	return tp, nil
 }
 
 func (tp *TestPackage) Cleanup() {
@@ -124,7 +239,13 @@ func (tp *TestPackage) Cleanup() {
 		tp.existingDeployment.DestroyAtCleanup()
 	}
 	tp.existingDeploymentMu.Unlock()
+	tp.dirtyPool.destroyAll()
 	tp.complementBuilder.Cleanup()
+	if tp.resourceReport != nil {
+		if err := tp.resourceReport.write(tp.Config.ResourceReportDir, tp.Config.PackageNamespace, os.Stdout); err != nil {
+			log.Printf("Failed to write resource report: %s", err)
+		}
+	}
 }
 
 // Deploy will deploy the given blueprint or terminate the test.
@@ -151,10 +272,19 @@ func (tp *TestPackage) OldDeploy(t ct.TestLike, blueprint b.Blueprint) Deploymen
 	return dep
 }
 
-func (tp *TestPackage) Deploy(t ct.TestLike, numServers int) Deployment {
+func (tp *TestPackage) Deploy(t ct.TestLike, numServers int, opts ...DeployOpt) Deployment {
 	t.Helper()
-	if tp.Config.EnableDirtyRuns {
-		return tp.dirtyDeploy(t, numServers)
+	var o deployOpts
+	for _, opt := range opts {
+		opt(&o)
+	}
+	// dirty deployments are shared between tests so cannot have per-test options
+	if tp.Config.EnableDirtyRuns && !o.needsCleanDeployment() {
+		dep := tp.dirtyDeploy(t, numServers)
+		// the deployment is shared, so tag its logs with this test
+		dep.StreamLogs()
+		dep.BeginTest(t)
+		return tp.monitorResources(t, dep)
 	}
 	// non-dirty deployments below
 	blueprint := mapServersToBlueprint(numServers)
@@ -168,15 +298,32 @@ func (tp *TestPackage) Deploy(t ct.TestLike, numServers int) Deployment {
 		ct.Fatalf(t, "Deploy: NewDeployer returned error %s", err)
 	}
 	timeStartDeploy := time.Now()
-	dep, err := d.Deploy(context.Background(), blueprint.Name)
+	dockerOpts := docker.DeployOptions{
+		ClockOffsets: o.clockOffsets,
+	}
+	if o.dnsStandin {
+		dockerOpts.DNSStandin = t
+	}
+	dep, err := d.DeployWithOptions(context.Background(), blueprint.Name, dockerOpts)
 	if err != nil {
 		ct.Fatalf(t, "Deploy: Deploy returned error %s", err)
 	}
 	t.Logf("Deploy times: %v blueprints, %v containers", timeStartDeploy.Sub(timeStartBlueprint), time.Since(timeStartDeploy))
+	return tp.monitorResources(t, dep)
+}
+
+// monitorResources samples the resource usage of the deployment for the report, if enabled.
+func (tp *TestPackage) monitorResources(t ct.TestLike, dep *docker.Deployment) Deployment {
+	if tp.resourceReport != nil {
+		dep.MonitorResources(t.Name(), tp.resourceReport.record)
+	}
 	return dep
 }
 
-func (tp *TestPackage) dirtyDeploy(t ct.TestLike, numServers int) Deployment {
+func (tp *TestPackage) dirtyDeploy(t ct.TestLike, numServers int) *docker.Deployment {
+	if tp.Config.DirtyRunsPoolSize > 0 {
+		return tp.dirtyPool.lease(t, numServers)
+	}
 	tp.existingDeploymentMu.Lock()
 	defer tp.existingDeploymentMu.Unlock()
 	// do we even have a deployment?
@@ -213,7 +360,7 @@ func (tp *TestPackage) dirtyDeploy(t ct.TestLike, numServers int) Deployment {
 		if err != nil {
 			ct.Fatalf(t, "dirtyDeploy: failed to add %s: %s", hsName, err)
 		}
-		tp.existingDeployment.HS[hsName] = hsDep
+		tp.existingDeployment.AddServer(hsName, hsDep)
 	}
 
 	return tp.existingDeployment